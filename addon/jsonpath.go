@@ -0,0 +1,177 @@
+package addon
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// 简化版 JSONPath，仅支持 $.a.b[0].c 这类逐级访问
+
+var errJsonPath = errors.New("invalid json path")
+
+type jsonPathSegment struct {
+	key   string
+	index int
+	isIdx bool
+}
+
+func parseJsonPath(path string) ([]jsonPathSegment, error) {
+	path = strings.TrimSpace(path)
+	path = strings.TrimPrefix(path, "$")
+	if path == "" {
+		return nil, errJsonPath
+	}
+
+	segments := make([]jsonPathSegment, 0)
+	for len(path) > 0 {
+		switch path[0] {
+		case '.':
+			path = path[1:]
+			end := strings.IndexAny(path, ".[")
+			if end == -1 {
+				end = len(path)
+			}
+			if end == 0 {
+				return nil, errJsonPath
+			}
+			segments = append(segments, jsonPathSegment{key: path[:end]})
+			path = path[end:]
+
+		case '[':
+			end := strings.IndexByte(path, ']')
+			if end == -1 {
+				return nil, errJsonPath
+			}
+			inner := path[1:end]
+			path = path[end+1:]
+
+			if len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0] {
+				segments = append(segments, jsonPathSegment{key: inner[1 : len(inner)-1]})
+				continue
+			}
+
+			idx, err := strconv.Atoi(inner)
+			if err != nil || idx < 0 {
+				return nil, errJsonPath
+			}
+			segments = append(segments, jsonPathSegment{index: idx, isIdx: true})
+
+		default:
+			// 兼容省略 $. 的写法
+			if len(segments) != 0 {
+				return nil, errJsonPath
+			}
+			path = "." + path
+		}
+	}
+
+	return segments, nil
+}
+
+// 返回是否命中路径
+func jsonPathSet(doc interface{}, segments []jsonPathSegment, value interface{}) (interface{}, bool) {
+	if len(segments) == 0 {
+		return value, true
+	}
+
+	seg := segments[0]
+	switch v := doc.(type) {
+	case map[string]interface{}:
+		if seg.isIdx {
+			return doc, false
+		}
+		child, ok := v[seg.key]
+		if !ok && len(segments) > 1 {
+			return doc, false
+		}
+		child, ok = jsonPathSet(child, segments[1:], value)
+		if ok {
+			v[seg.key] = child
+		}
+		return v, ok
+
+	case []interface{}:
+		if !seg.isIdx || seg.index >= len(v) {
+			return doc, false
+		}
+		child, ok := jsonPathSet(v[seg.index], segments[1:], value)
+		if ok {
+			v[seg.index] = child
+		}
+		return v, ok
+	}
+
+	return doc, false
+}
+
+func jsonPathRemove(doc interface{}, segments []jsonPathSegment) (interface{}, bool) {
+	if len(segments) == 0 {
+		return doc, false
+	}
+
+	seg := segments[0]
+	last := len(segments) == 1
+
+	switch v := doc.(type) {
+	case map[string]interface{}:
+		if seg.isIdx {
+			return doc, false
+		}
+		child, ok := v[seg.key]
+		if !ok {
+			return doc, false
+		}
+		if last {
+			delete(v, seg.key)
+			return v, true
+		}
+		child, ok = jsonPathRemove(child, segments[1:])
+		if ok {
+			v[seg.key] = child
+		}
+		return v, ok
+
+	case []interface{}:
+		if !seg.isIdx || seg.index >= len(v) {
+			return doc, false
+		}
+		if last {
+			return append(v[:seg.index], v[seg.index+1:]...), true
+		}
+		child, ok := jsonPathRemove(v[seg.index], segments[1:])
+		if ok {
+			v[seg.index] = child
+		}
+		return v, ok
+	}
+
+	return doc, false
+}
+
+func jsonPathGet(doc interface{}, segments []jsonPathSegment) (interface{}, bool) {
+	for _, seg := range segments {
+		switch v := doc.(type) {
+		case map[string]interface{}:
+			if seg.isIdx {
+				return nil, false
+			}
+			child, ok := v[seg.key]
+			if !ok {
+				return nil, false
+			}
+			doc = child
+
+		case []interface{}:
+			if !seg.isIdx || seg.index >= len(v) {
+				return nil, false
+			}
+			doc = v[seg.index]
+
+		default:
+			return nil, false
+		}
+	}
+
+	return doc, true
+}
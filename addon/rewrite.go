@@ -0,0 +1,487 @@
+package addon
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vela-ssoc/vela-mitm/proxy"
+)
+
+// 声明式改写规则, 按顺序匹配 host/path/method/content-type 后执行动作
+
+type RewriteAction struct {
+	Target  string `json:"target" yaml:"target"`   // header query cookie status body json
+	Op      string `json:"op" yaml:"op"`           // set add remove replace
+	Key     string `json:"key" yaml:"key"`         // header/query/cookie 名称, json 为 JSONPath
+	Value   string `json:"value" yaml:"value"`     // 新值, replace 时为替换内容
+	Pattern string `json:"pattern" yaml:"pattern"` // replace 使用的正则
+
+	pattern *regexp.Regexp
+}
+
+type RewriteRule struct {
+	Name        string          `json:"name" yaml:"name"`
+	Enable      bool            `json:"enable" yaml:"enable"`
+	Host        string          `json:"host" yaml:"host"` // 正则
+	Path        string          `json:"path" yaml:"path"` // 正则
+	Method      []string        `json:"method" yaml:"method"`
+	ContentType string          `json:"content_type" yaml:"content_type"` // 包含即命中
+	Request     []RewriteAction `json:"request" yaml:"request"`
+	Response    []RewriteAction `json:"response" yaml:"response"`
+	Hits        int64           `json:"hits" yaml:"-"`
+
+	host *regexp.Regexp
+	path *regexp.Regexp
+	hits *int64
+}
+
+type Rewrite struct {
+	proxy.BaseAddon
+
+	mu    sync.RWMutex
+	rules []*RewriteRule
+
+	// 请求阶段已计数的规则, 同一 flow 的响应阶段不再计数
+	counted sync.Map // *proxy.Flow -> map[*RewriteRule]bool
+}
+
+func NewRewrite(rules []RewriteRule) (*Rewrite, error) {
+	rw := new(Rewrite)
+	if err := rw.SetRules(rules); err != nil {
+		return nil, err
+	}
+	return rw, nil
+}
+
+func (action *RewriteAction) compile() error {
+	switch action.Target {
+	case "header", "query", "cookie", "body":
+	case "status":
+		if _, err := strconv.Atoi(action.Value); err != nil {
+			return fmt.Errorf("invalid status code %s", action.Value)
+		}
+		return nil
+	case "json":
+		if _, err := parseJsonPath(action.Key); err != nil {
+			return fmt.Errorf("%v %s", err, action.Key)
+		}
+	default:
+		return fmt.Errorf("invalid rewrite target %s", action.Target)
+	}
+
+	switch action.Op {
+	case "set", "add", "remove":
+	case "replace":
+		re, err := regexp.Compile(action.Pattern)
+		if err != nil {
+			return err
+		}
+		action.pattern = re
+	default:
+		return fmt.Errorf("invalid rewrite op %s", action.Op)
+	}
+
+	return nil
+}
+
+func (rule *RewriteRule) compile() error {
+	var err error
+	if rule.Host != "" {
+		if rule.host, err = regexp.Compile(rule.Host); err != nil {
+			return err
+		}
+	}
+
+	if rule.Path != "" {
+		if rule.path, err = regexp.Compile(rule.Path); err != nil {
+			return err
+		}
+	}
+
+	for i := range rule.Request {
+		if rule.Request[i].Target == "status" {
+			return fmt.Errorf("status rewrite only in response")
+		}
+		if err = rule.Request[i].compile(); err != nil {
+			return err
+		}
+	}
+
+	for i := range rule.Response {
+		if rule.Response[i].Target == "query" {
+			return fmt.Errorf("query rewrite only in request")
+		}
+		if err = rule.Response[i].compile(); err != nil {
+			return err
+		}
+	}
+
+	rule.hits = new(int64)
+	return nil
+}
+
+// 规则内容相同时认为未修改, 用于保留命中次数
+func (rule *RewriteRule) key() string {
+	r := *rule
+	r.Hits = 0
+	chunk, _ := json.Marshal(&r)
+	return string(chunk)
+}
+
+// 整体替换规则列表, 规则顺序即执行顺序; 未修改的规则保留命中次数
+func (rw *Rewrite) SetRules(rules []RewriteRule) error {
+	compiled := make([]*RewriteRule, len(rules))
+	for i := range rules {
+		rule := rules[i]
+		rule.Request = append([]RewriteAction(nil), rules[i].Request...)
+		rule.Response = append([]RewriteAction(nil), rules[i].Response...)
+		if err := rule.compile(); err != nil {
+			return fmt.Errorf("rewrite rule %d %s: %v", i, rule.Name, err)
+		}
+		compiled[i] = &rule
+	}
+
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	old := make(map[string][]*int64, len(rw.rules))
+	for _, rule := range rw.rules {
+		k := rule.key()
+		old[k] = append(old[k], rule.hits)
+	}
+	for _, rule := range compiled {
+		k := rule.key()
+		if hits := old[k]; len(hits) > 0 {
+			rule.hits = hits[0]
+			old[k] = hits[1:]
+		}
+	}
+
+	rw.rules = compiled
+	return nil
+}
+
+// 返回规则副本, 附带命中次数
+func (rw *Rewrite) Rules() []RewriteRule {
+	rw.mu.RLock()
+	defer rw.mu.RUnlock()
+
+	rules := make([]RewriteRule, len(rw.rules))
+	for i, rule := range rw.rules {
+		rules[i] = *rule
+		rules[i].Hits = atomic.LoadInt64(rule.hits)
+	}
+	return rules
+}
+
+func (rw *Rewrite) snapshot() []*RewriteRule {
+	rw.mu.RLock()
+	defer rw.mu.RUnlock()
+	return rw.rules
+}
+
+func (rule *RewriteRule) match(req *proxy.Request, contentType string) bool {
+	if !rule.Enable {
+		return false
+	}
+
+	if len(rule.Method) > 0 {
+		hit := false
+		for _, m := range rule.Method {
+			if strings.EqualFold(m, req.Method) || m == "ANY" || m == "any" {
+				hit = true
+				break
+			}
+		}
+		if !hit {
+			return false
+		}
+	}
+
+	if rule.host != nil && !rule.host.MatchString(req.URL.Host) {
+		return false
+	}
+
+	if rule.path != nil && !rule.path.MatchString(req.URL.Path) {
+		return false
+	}
+
+	if rule.ContentType != "" && !strings.Contains(contentType, rule.ContentType) {
+		return false
+	}
+
+	return true
+}
+
+// 同时有请求和响应动作的规则每个 flow 只计一次命中
+func (rw *Rewrite) Request(f *proxy.Flow) {
+	var counted map[*RewriteRule]bool
+	for _, rule := range rw.snapshot() {
+		if len(rule.Request) == 0 || !rule.match(f.Request, f.Request.Header.Get("Content-Type")) {
+			continue
+		}
+
+		atomic.AddInt64(rule.hits, 1)
+		if len(rule.Response) > 0 {
+			if counted == nil {
+				counted = make(map[*RewriteRule]bool)
+			}
+			counted[rule] = true
+		}
+		for i := range rule.Request {
+			rewriteRequest(f.Request, &rule.Request[i])
+		}
+	}
+
+	if counted == nil {
+		return
+	}
+	rw.counted.Store(f, counted)
+	// 没有响应 (上游出错) 时在 flow 结束后清理
+	if done := f.Done(); done != nil {
+		go func() {
+			<-done
+			rw.counted.Delete(f)
+		}()
+	}
+}
+
+func (rw *Rewrite) Response(f *proxy.Flow) {
+	if f.Response == nil {
+		return
+	}
+
+	var counted map[*RewriteRule]bool
+	if v, ok := rw.counted.LoadAndDelete(f); ok {
+		counted = v.(map[*RewriteRule]bool)
+	}
+
+	for _, rule := range rw.snapshot() {
+		if len(rule.Response) == 0 || !rule.match(f.Request, f.Response.Header.Get("Content-Type")) {
+			continue
+		}
+
+		if !counted[rule] {
+			atomic.AddInt64(rule.hits, 1)
+		}
+		for i := range rule.Response {
+			rewriteResponse(f.Response, &rule.Response[i])
+		}
+	}
+}
+
+func rewriteRequest(req *proxy.Request, action *RewriteAction) {
+	switch action.Target {
+	case "header":
+		rewriteHeader(req.Header, action)
+
+	case "query":
+		query := req.URL.Query()
+		switch action.Op {
+		case "set":
+			query.Set(action.Key, action.Value)
+		case "add":
+			query.Add(action.Key, action.Value)
+		case "remove":
+			query.Del(action.Key)
+		case "replace":
+			for i, v := range query[action.Key] {
+				query[action.Key][i] = action.pattern.ReplaceAllString(v, action.Value)
+			}
+		}
+		req.URL.RawQuery = query.Encode()
+
+	case "cookie":
+		rewriteRequestCookie(req.Header, action)
+
+	case "body", "json":
+		body, err := req.DecodedBody()
+		if err != nil {
+			log.Errorf("rewrite decode request body fail %v", err)
+			return
+		}
+
+		body, ok := rewriteBody(body, action)
+		if !ok {
+			return
+		}
+		req.SetBody(body)
+	}
+}
+
+func rewriteResponse(res *proxy.Response, action *RewriteAction) {
+	if res.Header == nil {
+		res.Header = make(http.Header)
+	}
+
+	switch action.Target {
+	case "header":
+		rewriteHeader(res.Header, action)
+
+	case "status":
+		code, _ := strconv.Atoi(action.Value)
+		res.StatusCode = code
+
+	case "cookie":
+		rewriteResponseCookie(res.Header, action)
+
+	case "body", "json":
+		body, err := res.DecodedBody()
+		if err != nil {
+			log.Errorf("rewrite decode response body fail %v", err)
+			return
+		}
+
+		body, ok := rewriteBody(body, action)
+		if !ok {
+			return
+		}
+		res.SetBody(body)
+	}
+}
+
+func rewriteHeader(header http.Header, action *RewriteAction) {
+	switch action.Op {
+	case "set":
+		header.Set(action.Key, action.Value)
+	case "add":
+		header.Add(action.Key, action.Value)
+	case "remove":
+		header.Del(action.Key)
+	case "replace":
+		values := header.Values(action.Key)
+		for i, v := range values {
+			values[i] = action.pattern.ReplaceAllString(v, action.Value)
+		}
+	}
+}
+
+func rewriteRequestCookie(header http.Header, action *RewriteAction) {
+	cookies := (&http.Request{Header: header}).Cookies()
+	parts := make([]string, 0, len(cookies)+1)
+	found := false
+
+	for _, c := range cookies {
+		if c.Name != action.Key {
+			parts = append(parts, c.Name+"="+c.Value)
+			continue
+		}
+
+		found = true
+		switch action.Op {
+		case "remove":
+		case "replace":
+			parts = append(parts, c.Name+"="+action.pattern.ReplaceAllString(c.Value, action.Value))
+		default:
+			parts = append(parts, c.Name+"="+action.Value)
+		}
+	}
+
+	if !found && (action.Op == "set" || action.Op == "add") {
+		parts = append(parts, action.Key+"="+action.Value)
+	}
+
+	if len(parts) == 0 {
+		header.Del("Cookie")
+		return
+	}
+	header.Set("Cookie", strings.Join(parts, "; "))
+}
+
+func rewriteResponseCookie(header http.Header, action *RewriteAction) {
+	lines := header.Values("Set-Cookie")
+	kept := make([]string, 0, len(lines)+1)
+
+	for _, line := range lines {
+		name := line
+		if i := strings.IndexByte(line, '='); i != -1 {
+			name = strings.TrimSpace(line[:i])
+		}
+
+		if name != action.Key {
+			kept = append(kept, line)
+			continue
+		}
+
+		switch action.Op {
+		case "replace":
+			kept = append(kept, action.pattern.ReplaceAllString(line, action.Value))
+		case "add":
+			kept = append(kept, line)
+		}
+	}
+
+	if action.Op == "set" || action.Op == "add" {
+		kept = append(kept, action.Key+"="+action.Value)
+	}
+
+	header.Del("Set-Cookie")
+	for _, line := range kept {
+		header.Add("Set-Cookie", line)
+	}
+}
+
+// 返回新 body, 以及是否发生改写
+func rewriteBody(body []byte, action *RewriteAction) ([]byte, bool) {
+	if action.Target == "body" {
+		switch action.Op {
+		case "set":
+			return []byte(action.Value), true
+		case "remove":
+			return []byte{}, true
+		case "replace":
+			return action.pattern.ReplaceAll(body, []byte(action.Value)), true
+		}
+		return body, false
+	}
+
+	var doc interface{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		log.Debugf("rewrite json body fail %v", err)
+		return body, false
+	}
+
+	segments, _ := parseJsonPath(action.Key)
+
+	var ok bool
+	switch action.Op {
+	case "set", "add":
+		var value interface{}
+		if err := json.Unmarshal([]byte(action.Value), &value); err != nil {
+			value = action.Value
+		}
+		doc, ok = jsonPathSet(doc, segments, value)
+	case "remove":
+		doc, ok = jsonPathRemove(doc, segments)
+	case "replace":
+		var current interface{}
+		current, ok = jsonPathGet(doc, segments)
+		if !ok {
+			break
+		}
+		str, isStr := current.(string)
+		if !isStr {
+			ok = false
+			break
+		}
+		doc, ok = jsonPathSet(doc, segments, action.pattern.ReplaceAllString(str, action.Value))
+	}
+
+	if !ok {
+		return body, false
+	}
+
+	chunk, err := json.Marshal(doc)
+	if err != nil {
+		log.Errorf("rewrite json marshal fail %v", err)
+		return body, false
+	}
+	return chunk, true
+}
@@ -0,0 +1,212 @@
+package addon
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/vela-ssoc/vela-mitm/proxy"
+)
+
+func newRewriteFlow(t *testing.T, rawURL string) *proxy.Flow {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &proxy.Flow{
+		Request: &proxy.Request{
+			Method: "POST",
+			URL:    u,
+			Header: http.Header{
+				"Content-Type": {"application/json"},
+				"Cookie":       {"sid=abc; lang=en"},
+			},
+			Body: []byte(`{"user":{"name":"bob","roles":["a","b"]}}`),
+		},
+	}
+}
+
+func TestRewriteRequest(t *testing.T) {
+	rw, err := NewRewrite([]RewriteRule{
+		{
+			Name:   "disabled",
+			Enable: false,
+			Request: []RewriteAction{
+				{Target: "header", Op: "set", Key: "X-Disabled", Value: "1"},
+			},
+		},
+		{
+			Name:   "api",
+			Enable: true,
+			Host:   `^api\.`,
+			Path:   `^/v1/`,
+			Method: []string{"POST"},
+			Request: []RewriteAction{
+				{Target: "header", Op: "set", Key: "X-Test", Value: "1"},
+				{Target: "query", Op: "set", Key: "debug", Value: "true"},
+				{Target: "query", Op: "remove", Key: "token"},
+				{Target: "cookie", Op: "set", Key: "sid", Value: "xyz"},
+				{Target: "cookie", Op: "remove", Key: "lang"},
+				{Target: "json", Op: "set", Key: "$.user.name", Value: `"alice"`},
+				{Target: "json", Op: "remove", Key: "$.user.roles[0]"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := newRewriteFlow(t, "http://api.example.com/v1/user?token=1")
+	rw.Request(f)
+
+	if f.Request.Header.Get("X-Disabled") != "" {
+		t.Fatal("disabled rule should not apply")
+	}
+	if f.Request.Header.Get("X-Test") != "1" {
+		t.Fatal("header set fail")
+	}
+	if f.Request.URL.RawQuery != "debug=true" {
+		t.Fatalf("query rewrite fail %s", f.Request.URL.RawQuery)
+	}
+	if f.Request.Header.Get("Cookie") != "sid=xyz" {
+		t.Fatalf("cookie rewrite fail %s", f.Request.Header.Get("Cookie"))
+	}
+	if string(f.Request.Body) != `{"user":{"name":"alice","roles":["b"]}}` {
+		t.Fatalf("json rewrite fail %s", f.Request.Body)
+	}
+
+	rules := rw.Rules()
+	if rules[0].Hits != 0 || rules[1].Hits != 1 {
+		t.Fatalf("hits counter fail %d %d", rules[0].Hits, rules[1].Hits)
+	}
+
+	f = newRewriteFlow(t, "http://www.example.com/v1/user")
+	rw.Request(f)
+	if f.Request.Header.Get("X-Test") != "" {
+		t.Fatal("host mismatch should not apply")
+	}
+}
+
+func TestRewriteResponse(t *testing.T) {
+	rw, err := NewRewrite([]RewriteRule{
+		{
+			Enable:      true,
+			ContentType: "text/html",
+			Response: []RewriteAction{
+				{Target: "status", Value: "201"},
+				{Target: "body", Op: "replace", Pattern: `secret-\d+`, Value: "***"},
+				{Target: "cookie", Op: "set", Key: "debug", Value: "1"},
+				{Target: "header", Op: "remove", Key: "Server"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte("token secret-123 end"))
+	gz.Close()
+
+	f := newRewriteFlow(t, "http://www.example.com/")
+	f.Response = &proxy.Response{
+		StatusCode: 200,
+		Header: http.Header{
+			"Content-Type":     {"text/html; charset=utf-8"},
+			"Content-Encoding": {"gzip"},
+			"Server":           {"nginx"},
+		},
+		Body: buf.Bytes(),
+	}
+	rw.Response(f)
+
+	if f.Response.StatusCode != 201 {
+		t.Fatal("status rewrite fail")
+	}
+	if string(f.Response.Body) != "token *** end" {
+		t.Fatalf("body rewrite fail %s", f.Response.Body)
+	}
+	if f.Response.Header.Get("Content-Encoding") != "" || f.Response.Header.Get("Content-Length") != "13" {
+		t.Fatal("content header not fixed")
+	}
+	if f.Response.Header.Get("Set-Cookie") != "debug=1" || f.Response.Header.Get("Server") != "" {
+		t.Fatal("header rewrite fail")
+	}
+}
+
+func TestRewriteInvalidRule(t *testing.T) {
+	if _, err := NewRewrite([]RewriteRule{{Host: "("}}); err == nil {
+		t.Fatal("invalid regex should fail")
+	}
+	if _, err := NewRewrite([]RewriteRule{{Request: []RewriteAction{{Target: "status", Value: "200"}}}}); err == nil {
+		t.Fatal("status in request should fail")
+	}
+}
+
+func TestRewriteHits(t *testing.T) {
+	both := RewriteRule{
+		Name:     "both",
+		Enable:   true,
+		Request:  []RewriteAction{{Target: "header", Op: "set", Key: "X-Req", Value: "1"}},
+		Response: []RewriteAction{{Target: "header", Op: "set", Key: "X-Res", Value: "1"}},
+	}
+	other := RewriteRule{Name: "other", Enable: true, Response: []RewriteAction{{Target: "status", Value: "204"}}}
+	rw, err := NewRewrite([]RewriteRule{both, other})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		f := newRewriteFlow(t, "http://www.example.com/")
+		rw.Request(f)
+		f.Response = &proxy.Response{StatusCode: 200, Header: http.Header{}}
+		rw.Response(f)
+	}
+
+	// 请求和响应都有动作的规则每个 flow 计一次
+	rules := rw.Rules()
+	if rules[0].Hits != 2 || rules[1].Hits != 2 {
+		t.Fatalf("hits %d %d", rules[0].Hits, rules[1].Hits)
+	}
+
+	// 未修改的规则保留命中次数, 修改过的重新计数
+	other.Response[0].Value = "202"
+	if err = rw.SetRules([]RewriteRule{other, both}); err != nil {
+		t.Fatal(err)
+	}
+	rules = rw.Rules()
+	if rules[0].Hits != 0 || rules[1].Name != "both" || rules[1].Hits != 2 {
+		t.Fatalf("hits after update %+v", rules)
+	}
+}
+
+func TestRewriteEncodedRequest(t *testing.T) {
+	rw, err := NewRewrite([]RewriteRule{{
+		Enable:  true,
+		Request: []RewriteAction{{Target: "json", Op: "set", Key: "$.user.name", Value: `"alice"`}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := newRewriteFlow(t, "http://www.example.com/")
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(f.Request.Body)
+	gz.Close()
+	f.Request.Body = buf.Bytes()
+	f.Request.Header.Set("Content-Encoding", "gzip")
+
+	rw.Request(f)
+	want := `{"user":{"name":"alice","roles":["a","b"]}}`
+	if string(f.Request.Body) != want {
+		t.Fatalf("encoded json rewrite fail %q", f.Request.Body)
+	}
+	if f.Request.Header.Get("Content-Encoding") != "" || f.Request.Header.Get("Content-Length") != "43" {
+		t.Fatal("content header not fixed")
+	}
+}
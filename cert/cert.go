@@ -325,13 +325,21 @@ func (ca *CA) GetCert(commonName string) (*tls.Certificate, error) {
 	return val.(*tls.Certificate), nil
 }
 
-// TODO: 是否应该支持多个 SubjectAltName
 func (ca *CA) DummyCert(commonName string) (*tls.Certificate, error) {
 	log.Debugf("ca DummyCert: %v", commonName)
+	return ca.IssueCert(commonName)
+}
+
+// 签发包含多个 SubjectAltName 的证书, 第一个作为 CommonName
+func (ca *CA) IssueCert(hosts ...string) (*tls.Certificate, error) {
+	if len(hosts) == 0 {
+		return nil, errors.New("no host to issue")
+	}
+
 	template := &x509.Certificate{
 		SerialNumber: big.NewInt(time.Now().UnixNano() / 100000),
 		Subject: pkix.Name{
-			CommonName:   commonName,
+			CommonName:   hosts[0],
 			Organization: []string{"mitmproxy"},
 		},
 		NotBefore:          time.Now().Add(-time.Hour * 48),
@@ -340,11 +348,12 @@ func (ca *CA) DummyCert(commonName string) (*tls.Certificate, error) {
 		ExtKeyUsage:        []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
 	}
 
-	ip := net.ParseIP(commonName)
-	if ip != nil {
-		template.IPAddresses = []net.IP{ip}
-	} else {
-		template.DNSNames = []string{commonName}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
 	}
 
 	certBytes, err := x509.CreateCertificate(rand.Reader, template, &ca.RootCert, &ca.PrivateKey.PublicKey, &ca.PrivateKey)
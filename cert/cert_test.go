@@ -2,6 +2,7 @@ package cert
 
 import (
 	"bytes"
+	"crypto/x509"
 	"io/ioutil"
 	"reflect"
 	"testing"
@@ -40,3 +41,28 @@ func TestNewCA(t *testing.T) {
 		t.Fatal("pem content should equal")
 	}
 }
+
+func TestIssueCert(t *testing.T) {
+	ca, err := NewCAMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := ca.IssueCert("mitm.local", "127.0.0.1", "::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(&ca.RootCert)
+	for _, host := range []string{"mitm.local", "127.0.0.1", "::1"} {
+		if _, err := leaf.Verify(x509.VerifyOptions{DNSName: host, Roots: pool}); err != nil {
+			t.Errorf("verify %s: %v", host, err)
+		}
+	}
+}
@@ -1,26 +1,83 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
 	uuid "github.com/satori/go.uuid"
 	log "github.com/sirupsen/logrus"
+	"github.com/vela-ssoc/vela-mitm/addon"
 	"github.com/vela-ssoc/vela-mitm/proxy"
 	"github.com/vela-ssoc/vela-mitm/web"
 	"gopkg.in/yaml.v2"
 	"io"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 )
 
 type config struct {
 	Addr   string   `yaml:"addr"`
 	Port   int      `yaml:"port"`
 	Large  int      `yaml:"large"`
+	Spool  int64    `yaml:"spool"`
 	Name   string   `yaml:"name"`
 	Pass   string   `yaml:"pass"`
 	Origin []string `yaml:"origin"`
 	Mode   string   `default:"proxy" yaml:"mode"`
+
+	// 多用户, pass 使用 -hash 生成
+	Users []web.User `yaml:"users"`
+	// web 后台 https, unix socket, 只监听 loopback
+	Console web.Listen `yaml:"console"`
+	// 审计日志文件, 默认 audit.{name}.log
+	Audit string `yaml:"audit"`
+	// token 签名密钥, 为空时每次启动随机生成
+	Secret       string        `yaml:"secret"`
+	TokenTTL     time.Duration `yaml:"token_ttl"`
+	MaxLoginFail int           `yaml:"max_login_fail"`
+	Lockout      time.Duration `yaml:"lockout"`
+
+	// intruder 文件 payload 目录, 默认 payloads
+	PayloadDir string `yaml:"payload_dir"`
+
+	FullText  bool          `yaml:"fulltext"`
+	Retention web.Retention `yaml:"retention"`
+
+	Rewrite []addon.RewriteRule `yaml:"rewrite"`
+	Script  []web.ScriptRule    `yaml:"script"`
+	Passive web.PassiveConfig   `yaml:"passive"`
+	Scope   web.Scope           `yaml:"scope"`
+
+	// 代理 repeater intruder 连接目标服务器的配置
+	Outbound outbound `yaml:"outbound"`
+}
+
+type outbound struct {
+	Hosts      map[string]string `yaml:"hosts"`
+	ClientCert string            `yaml:"client_cert"`
+	ClientKey  string            `yaml:"client_key"`
+}
+
+func (o outbound) hosts() map[string]string {
+	hosts := make(map[string]string, len(o.Hosts))
+	for host, to := range o.Hosts {
+		hosts[strings.ToLower(host)] = to
+	}
+	return hosts
+}
+
+func (o outbound) certificates() ([]tls.Certificate, error) {
+	if o.ClientCert == "" {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(o.ClientCert, o.ClientKey)
+	if err != nil {
+		return nil, fmt.Errorf("load client cert fail %v", err)
+	}
+	return []tls.Certificate{cert}, nil
 }
 
 var f = fmt.Sprintf
@@ -51,6 +108,7 @@ var defaultMitm = &config{
 	Addr:   "0.0.0.0",
 	Port:   9080,
 	Large:  1024 * 1024 * 5,
+	Spool:  1024 * 1024 * 100,
 	Name:   "mitm",
 	Pass:   uuid.NewV4().String()[:8],
 	Origin: []string{"http://127.0.0.1", "https://127.0.0.1"},
@@ -98,9 +156,63 @@ func LoadConfig(path string) (*config, error) {
 	return &conf, nil
 }
 
+// 替换配置文件中的一项, 其他配置保持原有的顺序和取值; 写入临时文件后替换, 不会留下写了一半的配置
+func SaveConfig(path, key string, value interface{}) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	chunk, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var doc yaml.MapSlice
+	if err = yaml.Unmarshal(chunk, &doc); err != nil {
+		return err
+	}
+
+	found := false
+	for i := range doc {
+		if k, ok := doc[i].Key.(string); ok && k == key {
+			doc[i].Value = value
+			found = true
+		}
+	}
+	if !found {
+		doc = append(doc, yaml.MapItem{Key: key, Value: value})
+	}
+
+	if chunk, err = yaml.Marshal(doc); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, chunk, info.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
 func main() {
 
 	path := flag.String("c", "mitm.yaml", "默认配置信息")
+	hash := flag.String("hash", "", "生成 users 中使用的密码摘要")
+	totp := flag.String("totp", "", "为指定用户生成 totp 密钥")
+	flag.Parse()
+
+	if *hash != "" {
+		fmt.Println(web.HashPassword(*hash))
+		return
+	}
+
+	if *totp != "" {
+		secret := web.GenerateTOTPSecret()
+		fmt.Println(secret)
+		fmt.Println(web.TOTPURI("vela-mitm", *totp, secret))
+		return
+	}
 
 	cfg, err := LoadConfig(*path)
 	if err != nil {
@@ -108,12 +220,20 @@ func main() {
 		return
 	}
 
+	certs, err := cfg.Outbound.certificates()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	opts := &proxy.Options{
 		Mode:              cfg.Mode,
 		SslInsecure:       true,
 		Addr:              cfg.ProxyListen(),
 		StreamLargeBodies: int64(cfg.Large),
+		SpoolLargeBodies:  cfg.Spool,
 		CaRootPath:        cfg.Cert(),
+		Hosts:             cfg.Outbound.hosts(),
+		ClientCerts:       certs,
 		Upstream: func(r *http.Request, p *proxy.Proxy) string {
 			peer := r.Header.Get("X-Mitmproxy-Peer")
 			if len(peer) == 0 {
@@ -124,7 +244,7 @@ func main() {
 		},
 	}
 
-	if cfg.Name == "" || cfg.Pass == "" {
+	if cfg.Name == "" || (cfg.Pass == "" && len(cfg.Users) == 0) {
 		log.Fatal("not found user or pass")
 		return
 	}
@@ -134,11 +254,51 @@ func main() {
 		log.Fatal(err)
 	}
 
+	rewrite, err := addon.NewRewrite(cfg.Rewrite)
+	if err != nil {
+		log.Fatal(err)
+	}
+	p.AddAddon(rewrite)
+
+	script, err := web.NewScriptAddon(cfg.Script)
+	if err != nil {
+		log.Fatal(err)
+	}
+	p.AddAddon(script)
+
+	passive, err := web.NewPassiveAddon(cfg.Passive)
+	if err != nil {
+		log.Fatal(err)
+	}
+	p.AddAddon(passive)
+
+	scope, err := web.NewProjectScope(cfg.Scope)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	p.AddAddon(web.NewWebAddon(web.Config{
-		Addr:   cfg.WebListen(),
-		Name:   cfg.Name,
-		Pass:   cfg.Pass,
-		Origin: cfg.Origin,
+		Addr:         cfg.WebListen(),
+		Listen:       cfg.Console,
+		Name:         cfg.Name,
+		Pass:         cfg.Pass,
+		Users:        cfg.Users,
+		Origin:       cfg.Origin,
+		CertDir:      cfg.Cert(),
+		PayloadDir:   cfg.PayloadDir,
+		Audit:        cfg.Audit,
+		Secret:       cfg.Secret,
+		TokenTTL:     cfg.TokenTTL,
+		Lockout:      cfg.Lockout,
+		MaxLoginFail: cfg.MaxLoginFail,
+		FullText:     cfg.FullText,
+		Retention:    cfg.Retention,
+		Rewrite:      rewrite,
+		Script:       script,
+		Passive:      passive,
+		Scope:        scope,
+		SaveScope:    func(s web.Scope) error { return SaveConfig(*path, "scope", s) },
+		Proxy:        p,
 	}))
 	log.Fatal(p.Start())
 }
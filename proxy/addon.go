@@ -40,6 +40,9 @@ type Addon interface {
 
 	// Stream response body modifier
 	StreamResponseModifier(*Flow, io.Reader) io.Reader
+
+	// A streamed flow has been fully forwarded, spooled bodies are in Request.Spool and Response.Spool.
+	StreamComplete(*Flow)
 }
 
 // BaseAddon do nothing
@@ -62,6 +65,7 @@ func (addon *BaseAddon) StreamRequestModifier(f *Flow, in io.Reader) io.Reader {
 func (addon *BaseAddon) StreamResponseModifier(f *Flow, in io.Reader) io.Reader {
 	return in
 }
+func (addon *BaseAddon) StreamComplete(*Flow) {}
 
 // LogAddon log connection and flow
 type LogAddon struct {
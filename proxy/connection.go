@@ -11,6 +11,7 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	uuid "github.com/satori/go.uuid"
@@ -19,16 +20,21 @@ import (
 
 // client connection
 type ClientConn struct {
-	Id   uuid.UUID
-	Conn net.Conn
-	Tls  bool
+	Id        uuid.UUID
+	Conn      net.Conn
+	Tls       bool
+	Connected time.Time
+	Closed    time.Time
+
+	connBytes
 }
 
 func newClientConn(c net.Conn) *ClientConn {
 	return &ClientConn{
-		Id:   uuid.NewV4(),
-		Conn: c,
-		Tls:  false,
+		Id:        uuid.NewV4(),
+		Conn:      c,
+		Tls:       false,
+		Connected: time.Now(),
 	}
 }
 
@@ -42,15 +48,26 @@ func (c *ClientConn) MarshalJSON() ([]byte, error) {
 
 // server connection
 type ServerConn struct {
-	Id      uuid.UUID
-	Address string
-	Conn    net.Conn
+	Id        uuid.UUID
+	Address   string
+	Conn      net.Conn
+	Connected time.Time
+	Closed    time.Time
+
+	connBytes
 
 	tlsHandshaked   chan struct{}
 	tlsHandshakeErr error
 	tlsConn         *tls.Conn
 	tlsState        *tls.ConnectionState
 	client          *http.Client
+
+	// https 拦截时连接和握手的时间, 记入该连接的第一个 flow
+	connectStart time.Time
+	connectDone  time.Time
+	tlsStart     time.Time
+	tlsDone      time.Time
+	timingUsed   bool
 }
 
 func newServerConn() *ServerConn {
@@ -73,6 +90,16 @@ func (c *ServerConn) TlsState() *tls.ConnectionState {
 	return c.tlsState
 }
 
+// 不等待握手, 未握手或非 tls 连接返回 nil
+func (c *ServerConn) TlsStateNow() *tls.ConnectionState {
+	select {
+	case <-c.tlsHandshaked:
+		return c.tlsState
+	default:
+		return nil
+	}
+}
+
 // connection context ctx key
 var connContextKey = new(struct{})
 
@@ -83,7 +110,8 @@ type ConnContext struct {
 
 	proxy              *Proxy
 	pipeConn           *pipeConn
-	closeAfterResponse bool // after http response, http server will close the connection
+	closeAfterResponse bool  // after http response, http server will close the connection
+	requests           int64 // 连接上处理的请求数, keep-alive 时大于 1
 }
 
 func newConnContext(c net.Conn, proxy *Proxy) *ConnContext {
@@ -98,6 +126,10 @@ func (connCtx *ConnContext) Id() uuid.UUID {
 	return connCtx.ClientConn.Id
 }
 
+func (connCtx *ConnContext) Requests() int64 {
+	return atomic.LoadInt64(&connCtx.requests)
+}
+
 func (connCtx *ConnContext) initHttpServerConn(r *http.Request) {
 	if connCtx.ServerConn != nil {
 		return
@@ -106,21 +138,12 @@ func (connCtx *ConnContext) initHttpServerConn(r *http.Request) {
 		return
 	}
 
-	var useProxy func(*http.Request) (*url.URL, error)
-	upstream := connCtx.proxy.Opts.Upstream(r, connCtx.proxy)
-	if len(upstream) > 0 {
-		upstreamUrl, _ := url.Parse(upstream)
-		useProxy = http.ProxyURL(upstreamUrl)
-	} else {
-		useProxy = http.ProxyFromEnvironment
-	}
-
 	serverConn := newServerConn()
 	serverConn.client = &http.Client{
 		Transport: &http.Transport{
-			Proxy: useProxy,
+			Proxy: connCtx.proxy.upstreamProxy(r),
 			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-				c, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+				c, err := connCtx.proxy.dialContext(ctx, network, addr)
 				if err != nil {
 					return nil, err
 				}
@@ -131,6 +154,7 @@ func (connCtx *ConnContext) initHttpServerConn(r *http.Request) {
 				}
 				serverConn.Conn = cw
 				serverConn.Address = addr
+				serverConn.Connected = time.Now()
 				defer func() {
 					for _, addon := range connCtx.proxy.Addons {
 						addon.ServerConnected(connCtx)
@@ -140,10 +164,7 @@ func (connCtx *ConnContext) initHttpServerConn(r *http.Request) {
 			},
 			ForceAttemptHTTP2:  false, // disable http2
 			DisableCompression: true,  // To get the original response from the server, set Transport.DisableCompression to true.
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: connCtx.proxy.Opts.SslInsecure,
-				KeyLogWriter:       getTlsKeyLogWriter(),
-			},
+			TLSClientConfig:    connCtx.proxy.tlsClientConfig(),
 		},
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
 			// 禁止自动重定向
@@ -160,10 +181,13 @@ func (connCtx *ConnContext) initServerTcpConn(req *http.Request) error {
 	ServerConn.Address = connCtx.pipeConn.host
 
 	upstream := connCtx.proxy.Opts.Upstream(req, connCtx.proxy)
-	plainConn, err := getConnFrom(req.Host, upstream)
+	ServerConn.connectStart = time.Now()
+	plainConn, err := connCtx.proxy.getConnFrom(req.Host, upstream)
 	if err != nil {
 		return err
 	}
+	ServerConn.connectDone = time.Now()
+	ServerConn.Connected = ServerConn.connectDone
 	ServerConn.Conn = &wrapServerConn{
 		Conn:    plainConn,
 		proxy:   connCtx.proxy,
@@ -201,6 +225,7 @@ func (connCtx *ConnContext) tlsHandshake(clientHello *tls.ClientHelloInfo) error
 	cfg := &tls.Config{
 		InsecureSkipVerify: connCtx.proxy.Opts.SslInsecure,
 		KeyLogWriter:       getTlsKeyLogWriter(),
+		Certificates:       connCtx.proxy.Opts.ClientCerts,
 		ServerName:         clientHello.ServerName,
 		NextProtos:         []string{"http/1.1"}, // todo: h2
 		// CurvePreferences:   clientHello.SupportedCurves, // todo: 如果打开会出错
@@ -222,7 +247,9 @@ func (connCtx *ConnContext) tlsHandshake(clientHello *tls.ClientHelloInfo) error
 	}
 
 	tlsConn := tls.Client(connCtx.ServerConn.Conn, cfg)
+	connCtx.ServerConn.tlsStart = time.Now()
 	err := tlsConn.HandshakeContext(context.Background())
+	connCtx.ServerConn.tlsDone = time.Now()
 	if err != nil {
 		connCtx.ServerConn.tlsHandshakeErr = err
 		close(connCtx.ServerConn.tlsHandshaked)
@@ -254,6 +281,7 @@ func (c *wrapClientConn) Close() error {
 
 	c.closed = true
 	c.closeErr = c.Conn.Close()
+	c.connCtx.ClientConn.Closed = time.Now()
 
 	for _, addon := range c.proxy.Addons {
 		addon.ClientDisconnected(c.connCtx.ClientConn)
@@ -301,6 +329,9 @@ func (c *wrapServerConn) Close() error {
 
 	c.closed = true
 	c.closeErr = c.Conn.Close()
+	if c.connCtx.ServerConn != nil {
+		c.connCtx.ServerConn.Closed = time.Now()
+	}
 
 	for _, addon := range c.proxy.Addons {
 		addon.ServerDisconnected(c.connCtx)
@@ -373,7 +404,7 @@ func getProxyConn(proxyUrl *url.URL, address string) (net.Conn, error) {
 	return conn, nil
 }
 
-func getConnFrom(address string, upstream string) (net.Conn, error) {
+func (proxy *Proxy) getConnFrom(address string, upstream string) (net.Conn, error) {
 	clientReq := &http.Request{URL: &url.URL{Scheme: "https", Host: address}}
 
 	var proxyUrl *url.URL
@@ -396,7 +427,55 @@ func getConnFrom(address string, upstream string) (net.Conn, error) {
 	if proxyUrl != nil {
 		conn, err = getProxyConn(proxyUrl, address)
 	} else {
-		conn, err = (&net.Dialer{}).DialContext(context.Background(), "tcp", address)
+		conn, err = proxy.dialContext(context.Background(), "tcp", address)
 	}
 	return conn, err
 }
+
+// 连接收发的字节数, 包含 tls 开销
+type connBytes struct {
+	bytesIn  int64
+	bytesOut int64
+}
+
+// 从对端读取的字节数
+func (b *connBytes) BytesIn() int64 {
+	return atomic.LoadInt64(&b.bytesIn)
+}
+
+// 写往对端的字节数
+func (b *connBytes) BytesOut() int64 {
+	return atomic.LoadInt64(&b.bytesOut)
+}
+
+func (c *wrapClientConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if c.connCtx != nil {
+		atomic.AddInt64(&c.connCtx.ClientConn.bytesIn, int64(n))
+	}
+	return n, err
+}
+
+func (c *wrapClientConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if c.connCtx != nil {
+		atomic.AddInt64(&c.connCtx.ClientConn.bytesOut, int64(n))
+	}
+	return n, err
+}
+
+func (c *wrapServerConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if sc := c.connCtx.ServerConn; sc != nil {
+		atomic.AddInt64(&sc.bytesIn, int64(n))
+	}
+	return n, err
+}
+
+func (c *wrapServerConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if sc := c.connCtx.ServerConn; sc != nil {
+		atomic.AddInt64(&sc.bytesOut, int64(n))
+	}
+	return n, err
+}
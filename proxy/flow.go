@@ -17,6 +17,7 @@ type Request struct {
 	Proto  string
 	Header http.Header
 	Body   []byte
+	Spool  *Spool // stream 模式下落盘的 body
 	raw    *http.Request
 }
 
@@ -111,6 +112,7 @@ type Response struct {
 	Header     http.Header `json:"header"`
 	Body       []byte      `json:"-"`
 	BodyReader io.Reader
+	Spool      *Spool `json:"-"` // stream 模式下落盘的 body
 
 	close bool // connection close
 
@@ -130,6 +132,12 @@ type Flow struct {
 	// 如果为 true，则不缓冲 Request.Body 和 Response.Body，且不进入之后的 Addon.Request 和 Addon.Response
 	Stream bool
 
+	// 由 addon 打上的标签, 随 flow 一同记录
+	Tags []string
+
+	// 各阶段时间点
+	Timing Timing
+
 	done chan struct{}
 }
 
@@ -146,6 +154,38 @@ func (f *Flow) Done() <-chan struct{} {
 
 func (f *Flow) finish() {
 	close(f.done)
+
+	if f.Request != nil && f.Request.Spool != nil {
+		f.Request.Spool.remove()
+	}
+	if f.Response != nil && f.Response.Spool != nil {
+		f.Response.Spool.remove()
+	}
+}
+
+func (f *Flow) closeSpool() {
+	if f.Request.Spool != nil {
+		f.Request.Spool.Close()
+	}
+	if f.Response != nil && f.Response.Spool != nil {
+		f.Response.Spool.Close()
+	}
+}
+
+func (f *Flow) Tag(tags ...string) {
+	for _, tag := range tags {
+		exist := false
+		for _, item := range f.Tags {
+			if item == tag {
+				exist = true
+				break
+			}
+		}
+
+		if !exist {
+			f.Tags = append(f.Tags, tag)
+		}
+	}
 }
 
 func (f *Flow) MarshalJSON() ([]byte, error) {
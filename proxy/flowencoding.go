@@ -6,6 +6,7 @@ import (
 	"compress/gzip"
 	"errors"
 	"io"
+	"net/http"
 	"strconv"
 	"strings"
 
@@ -82,6 +83,42 @@ func (r *Response) ReplaceToDecodedBody() {
 	r.Header.Del("Transfer-Encoding")
 }
 
+// 替换为明文 body，同时清理 Content-Encoding 并修正 Content-Length
+func (r *Response) SetBody(body []byte) {
+	r.Body = body
+	r.decodedBody = nil
+	r.decoded = false
+	r.decodedErr = nil
+
+	if r.Header == nil {
+		r.Header = make(http.Header)
+	}
+	r.Header.Del("Content-Encoding")
+	r.Header.Del("Transfer-Encoding")
+	r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+}
+
+// 请求 body 按 Content-Encoding 解码, 不缓存结果
+func (r *Request) DecodedBody() ([]byte, error) {
+	enc := r.Header.Get("Content-Encoding")
+	if len(r.Body) == 0 || enc == "" || enc == "identity" {
+		return r.Body, nil
+	}
+	return decode(enc, r.Body)
+}
+
+// 替换为明文 body，同时清理 Content-Encoding 并修正 Content-Length
+func (r *Request) SetBody(body []byte) {
+	r.Body = body
+
+	if r.Header == nil {
+		r.Header = make(http.Header)
+	}
+	r.Header.Del("Content-Encoding")
+	r.Header.Del("Transfer-Encoding")
+	r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+}
+
 func decode(enc string, body []byte) ([]byte, error) {
 	if enc == "gzip" {
 		dreader, err := gzip.NewReader(bytes.NewReader(body))
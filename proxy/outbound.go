@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// 以此开头的 header 只用于控制代理 (如 X-Mitmproxy-Peer 指定上游), 不发往目标服务器
+const ControlHeaderPrefix = "X-Mitmproxy-"
+
+func StripControlHeaders(header http.Header) {
+	for key := range header {
+		if strings.HasPrefix(http.CanonicalHeaderKey(key), ControlHeaderPrefix) {
+			delete(header, key)
+		}
+	}
+}
+
+func controlHeaders(header http.Header) http.Header {
+	ctrl := make(http.Header)
+	for key, values := range header {
+		if strings.HasPrefix(http.CanonicalHeaderKey(key), ControlHeaderPrefix) {
+			ctrl[key] = values
+		}
+	}
+	return ctrl
+}
+
+// Opts.Hosts 中有对应的主机名时替换, 值不带端口时保留原端口
+func (proxy *Proxy) resolve(addr string) string {
+	if len(proxy.Opts.Hosts) == 0 {
+		return addr
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+
+	to, ok := proxy.Opts.Hosts[strings.ToLower(host)]
+	if !ok {
+		return addr
+	}
+	if _, _, err = net.SplitHostPort(to); err == nil {
+		return to
+	}
+	return net.JoinHostPort(to, port)
+}
+
+func (proxy *Proxy) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return (&net.Dialer{}).DialContext(ctx, network, proxy.resolve(addr))
+}
+
+// 连接目标服务器的 tls 配置
+func (proxy *Proxy) tlsClientConfig() *tls.Config {
+	return &tls.Config{
+		InsecureSkipVerify: proxy.Opts.SslInsecure,
+		KeyLogWriter:       getTlsKeyLogWriter(),
+		Certificates:       proxy.Opts.ClientCerts,
+	}
+}
+
+// 按 Opts.Upstream 选择上游代理, 没有时使用环境变量
+func (proxy *Proxy) upstreamProxy(r *http.Request) func(*http.Request) (*url.URL, error) {
+	if proxy.Opts.Upstream == nil {
+		return http.ProxyFromEnvironment
+	}
+
+	upstream := proxy.Opts.Upstream(r, proxy)
+	if len(upstream) == 0 {
+		return http.ProxyFromEnvironment
+	}
+
+	upstreamUrl, _ := url.Parse(upstream)
+	return http.ProxyURL(upstreamUrl)
+}
+
+func noRedirect(req *http.Request, via []*http.Request) error {
+	return http.ErrUseLastResponse
+}
+
+// 与代理连接目标服务器相同的配置: 上游代理 tls hosts, 不使用 http2, 不解压, 不跟随重定向
+// r 只用于选择上游代理, 发送前需要调用 StripControlHeaders
+func (proxy *Proxy) OutboundClient(r *http.Request, timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy:              proxy.upstreamProxy(r),
+			DialContext:        proxy.dialContext,
+			ForceAttemptHTTP2:  false,
+			DisableCompression: true,
+			DisableKeepAlives:  true,
+			TLSClientConfig:    proxy.tlsClientConfig(),
+		},
+		CheckRedirect: noRedirect,
+	}
+}
+
+// 代理自身的监听地址, 监听所有地址时使用 127.0.0.1
+func (proxy *Proxy) localAddr() (string, error) {
+	host, port, err := net.SplitHostPort(proxy.Opts.Addr)
+	if err != nil {
+		return "", fmt.Errorf("invalid proxy addr %s", proxy.Opts.Addr)
+	}
+
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// 通过代理自身的监听地址发送, 请求和响应经过全部 addon, 与浏览器经过代理的请求相同
+// https 通过 CONNECT 建立隧道, r 中的控制 header 同时放在 CONNECT 请求中, 由代理删除
+func (proxy *Proxy) ChainClient(r *http.Request, timeout time.Duration) (*http.Client, error) {
+	addr, err := proxy.localAddr()
+	if err != nil {
+		return nil, err
+	}
+
+	roots := x509.NewCertPool()
+	ca := proxy.GetCertificate()
+	roots.AddCert(&ca)
+
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy:              http.ProxyURL(&url.URL{Scheme: "http", Host: addr}),
+			ProxyConnectHeader: controlHeaders(r.Header),
+			ForceAttemptHTTP2:  false,
+			DisableCompression: true,
+			DisableKeepAlives:  true,
+			TLSClientConfig:    &tls.Config{RootCAs: roots},
+		},
+		CheckRedirect: noRedirect,
+	}, nil
+}
+
+// 原样发送使用的连接, 与 hosts tls 配置相同, 不经过上游代理; tls 时 sni 为空使用 addr 中的主机名
+// protos 为 alpn 协议, 默认 http/1.1
+func (proxy *Proxy) DialRaw(ctx context.Context, addr string, useTLS bool, sni string, protos ...string) (net.Conn, error) {
+	conn, err := proxy.dialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if !useTLS {
+		return conn, nil
+	}
+
+	cfg := proxy.tlsClientConfig()
+	cfg.ServerName = sni
+	if cfg.ServerName == "" {
+		cfg.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	cfg.NextProtos = protos
+	if len(protos) == 0 {
+		cfg.NextProtos = []string{"http/1.1"}
+	}
+
+	tc := tls.Client(conn, cfg)
+	if err = tc.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("tls handshake fail %v", err)
+	}
+	return tc, nil
+}
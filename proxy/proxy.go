@@ -3,23 +3,33 @@ package proxy
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"crypto/x509"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"runtime"
+	"sync/atomic"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
+const Version = "1.3.4"
+
 type Options struct {
 	Debug             int
 	Addr              string
 	StreamLargeBodies int64 // 当请求或响应体大于此字节时，转为 stream 模式
+	SpoolLargeBodies  int64 // stream 模式下 body 写入临时文件的上限, 0 不写入
+	SpoolDir          string
 	SslInsecure       bool
 	CaRootPath        string
 	Mode              string
 	Upstream          func(r *http.Request, p *Proxy) string
+	Hosts             map[string]string // 连接目标服务器时替换主机名 (小写), 类似 /etc/hosts, 值可以带端口
+	ClientCerts       []tls.Certificate // 目标服务器要求客户端证书时使用
 }
 
 type Proxy struct {
@@ -39,7 +49,7 @@ func NewProxy(opts *Options) (*Proxy, error) {
 
 	proxy := &Proxy{
 		Opts:    opts,
-		Version: "1.3.4",
+		Version: Version,
 		Addons:  make([]Addon, 0),
 	}
 
@@ -182,6 +192,9 @@ func (proxy *Proxy) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 	f := newFlow()
 	f.Request = newRequest(req)
 	f.ConnContext = req.Context().Value(connContextKey).(*ConnContext)
+	f.Timing.ClientConnect = f.ConnContext.ClientConn.Connected
+	atomic.AddInt64(&f.ConnContext.requests, 1)
+	f.Timing.RequestHeaders = time.Now()
 	defer f.finish()
 
 	// trigger addon event Requestheaders
@@ -209,6 +222,7 @@ func (proxy *Proxy) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 			f.Stream = true
 		} else {
 			f.Request.Body = reqBuf
+			f.Timing.RequestComplete = time.Now()
 
 			// trigger addon event Request
 			for _, addon := range proxy.Addons {
@@ -222,6 +236,10 @@ func (proxy *Proxy) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 		}
 	}
 
+	if f.Stream {
+		reqBody = proxy.spool(&f.Request.Spool, reqBody)
+	}
+
 	for _, addon := range proxy.Addons {
 		reqBody = addon.StreamRequestModifier(f, reqBody)
 	}
@@ -237,8 +255,12 @@ func (proxy *Proxy) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 			proxyReq.Header.Add(key, v)
 		}
 	}
+	StripControlHeaders(proxyReq.Header)
+
+	proxyReq = proxyReq.WithContext(httptrace.WithClientTrace(proxyReq.Context(), f.Timing.trace()))
 
 	f.ConnContext.initHttpServerConn(req)
+	f.Timing.UpstreamStart = time.Now()
 	proxyRes, err := f.ConnContext.ServerConn.client.Do(proxyReq)
 	if err != nil {
 		logErr(log, err)
@@ -246,6 +268,11 @@ func (proxy *Proxy) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	f.Timing.withServerConn(f.ConnContext.ServerConn)
+	if f.Timing.RequestComplete.IsZero() {
+		f.Timing.RequestComplete = f.Timing.RequestSent
+	}
+
 	if proxyRes.Close {
 		f.ConnContext.closeAfterResponse = true
 	}
@@ -282,6 +309,7 @@ func (proxy *Proxy) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 			f.Stream = true
 		} else {
 			f.Response.Body = resBuf
+			f.Timing.ResponseComplete = time.Now()
 
 			// trigger addon event Response
 			for _, addon := range proxy.Addons {
@@ -289,11 +317,29 @@ func (proxy *Proxy) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 			}
 		}
 	}
+	if f.Stream {
+		resBody = proxy.spool(&f.Response.Spool, resBody)
+	}
+
 	for _, addon := range proxy.Addons {
 		resBody = addon.StreamResponseModifier(f, resBody)
 	}
 
 	reply(f.Response, resBody)
+
+	f.Timing.ClientComplete = time.Now()
+	if f.Timing.ResponseComplete.IsZero() {
+		f.Timing.ResponseComplete = f.Timing.ClientComplete
+	}
+
+	if f.Stream {
+		f.closeSpool()
+
+		// trigger addon event StreamComplete
+		for _, addon := range proxy.Addons {
+			addon.StreamComplete(f)
+		}
+	}
 }
 
 func (proxy *Proxy) handleConnect(res http.ResponseWriter, req *http.Request) {
@@ -321,7 +367,7 @@ func (proxy *Proxy) handleConnect(res http.ResponseWriter, req *http.Request) {
 	} else {
 		log.Debugf("begin transpond %v", req.Host)
 		upstream := proxy.Opts.Upstream(req, proxy)
-		conn, err = getConnFrom(req.Host, upstream)
+		conn, err = proxy.getConnFrom(req.Host, upstream)
 	}
 	if err != nil {
 		log.Error(err)
@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// stream 模式下 body 不进入内存, 边转发边写入临时文件
+// 超过 Options.SpoolLargeBodies 后停止写入并标记 Truncated
+// 临时文件在 flow 结束时删除, 需要保留的 addon 在 StreamComplete 中自行复制
+type Spool struct {
+	Path      string // 为空表示没有数据
+	Size      int64  // 实际转发的字节数
+	Written   int64  // 写入文件的字节数
+	Truncated bool
+
+	mu     sync.Mutex
+	file   *os.File
+	dir    string
+	limit  int64
+	closed bool
+}
+
+func newSpool(dir string, limit int64) *Spool {
+	return &Spool{dir: dir, limit: limit}
+}
+
+func (s *Spool) write(p []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Size += int64(len(p))
+	if s.closed || s.Truncated {
+		return
+	}
+
+	if s.file == nil {
+		file, err := os.CreateTemp(s.dir, "mitm-spool-*")
+		if err != nil {
+			log.Errorf("create spool file fail %v", err)
+			s.closed = true
+			return
+		}
+		s.file = file
+		s.Path = file.Name()
+	}
+
+	if remain := s.limit - s.Written; int64(len(p)) > remain {
+		p = p[:remain]
+		s.Truncated = true
+	}
+
+	n, err := s.file.Write(p)
+	s.Written += int64(n)
+	if err != nil {
+		log.Errorf("write spool file %s fail %v", s.Path, err)
+		s.Truncated = true
+	}
+}
+
+// 关闭文件, 之后可以读取 Path
+func (s *Spool) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+	s.closed = true
+
+	if s.file != nil {
+		s.file.Close()
+	}
+}
+
+func (s *Spool) remove() {
+	s.Close()
+	if s.Path != "" {
+		os.Remove(s.Path)
+	}
+}
+
+type spoolReader struct {
+	r     io.Reader
+	spool *Spool
+}
+
+func (sr *spoolReader) Read(p []byte) (int, error) {
+	n, err := sr.r.Read(p)
+	if n > 0 {
+		sr.spool.write(p[:n])
+	}
+	if err == io.EOF {
+		sr.spool.Close()
+	}
+	return n, err
+}
+
+// 未开启 SpoolLargeBodies 时原样返回
+func (proxy *Proxy) spool(dst **Spool, r io.Reader) io.Reader {
+	if proxy.Opts.SpoolLargeBodies <= 0 || r == nil || r == http.NoBody {
+		return r
+	}
+
+	s := newSpool(proxy.Opts.SpoolDir, proxy.Opts.SpoolLargeBodies)
+	*dst = s
+	return &spoolReader{r: r, spool: s}
+}
@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSpoolReader(t *testing.T) {
+	p := &Proxy{Opts: &Options{SpoolLargeBodies: 4, SpoolDir: t.TempDir()}}
+
+	var s *Spool
+	r := p.spool(&s, strings.NewReader("hello world"))
+	body, err := io.ReadAll(r)
+	if err != nil || string(body) != "hello world" {
+		t.Fatalf("forward %q %v", body, err)
+	}
+
+	// 转发完整 body, 文件只写入 limit 字节
+	if s.Size != 11 || s.Written != 4 || !s.Truncated {
+		t.Fatalf("spool %+v", s)
+	}
+	if data, _ := os.ReadFile(s.Path); string(data) != "hell" {
+		t.Fatalf("spool file %q", data)
+	}
+
+	s.remove()
+	if _, err = os.Stat(s.Path); !os.IsNotExist(err) {
+		t.Fatalf("spool file not removed %v", err)
+	}
+
+	// 没有开启时不落盘
+	p.Opts.SpoolLargeBodies = 0
+	s = nil
+	if p.spool(&s, strings.NewReader("x")); s != nil {
+		t.Fatal("spool without SpoolLargeBodies")
+	}
+}
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net/http/httptrace"
+	"time"
+)
+
+// flow 各阶段的时间点, 未发生的阶段为零值
+// 上游 DNS/TCP/TLS 来自 httptrace, https 拦截时连接在握手阶段建立, 取自 ServerConn
+type Timing struct {
+	ClientConnect    time.Time `json:"client_connect"`    // 客户端连接建立
+	RequestHeaders   time.Time `json:"request_headers"`   // 请求头读取完成
+	RequestComplete  time.Time `json:"request_complete"`  // 请求 body 读取完成
+	UpstreamStart    time.Time `json:"upstream_start"`    // 开始请求上游
+	DNSStart         time.Time `json:"dns_start"`         //
+	DNSDone          time.Time `json:"dns_done"`          //
+	ConnectStart     time.Time `json:"connect_start"`     // 上游 tcp 连接
+	ConnectDone      time.Time `json:"connect_done"`      //
+	TLSStart         time.Time `json:"tls_start"`         // 上游 tls 握手
+	TLSDone          time.Time `json:"tls_done"`          //
+	GotConn          time.Time `json:"got_conn"`          // 拿到上游连接
+	RequestSent      time.Time `json:"request_sent"`      // 请求写入上游完成
+	FirstByte        time.Time `json:"first_byte"`        // 上游响应首字节
+	ResponseComplete time.Time `json:"response_complete"` // 响应 body 读取完成
+	ClientComplete   time.Time `json:"client_complete"`   // 响应写回客户端完成
+	ConnReused       bool      `json:"conn_reused"`
+}
+
+// httptrace 的回调在 Client.Do 返回前完成
+func (t *Timing) trace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.DNSStart = time.Now()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.DNSDone = time.Now()
+		},
+		ConnectStart: func(network, addr string) {
+			if t.ConnectStart.IsZero() {
+				t.ConnectStart = time.Now()
+			}
+		},
+		ConnectDone: func(network, addr string, err error) {
+			t.ConnectDone = time.Now()
+		},
+		TLSHandshakeStart: func() {
+			t.TLSStart = time.Now()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.TLSDone = time.Now()
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.GotConn = time.Now()
+			t.ConnReused = info.Reused
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			t.RequestSent = time.Now()
+		},
+		GotFirstResponseByte: func() {
+			t.FirstByte = time.Now()
+		},
+	}
+}
+
+// https 拦截时上游连接在 tls 握手前建立, 只记在该连接的第一个 flow 上
+func (t *Timing) withServerConn(sc *ServerConn) {
+	if sc == nil || sc.timingUsed {
+		return
+	}
+	sc.timingUsed = true
+
+	if t.ConnectStart.IsZero() && !sc.connectStart.IsZero() {
+		t.ConnectStart = sc.connectStart
+		t.ConnectDone = sc.connectDone
+	}
+
+	if t.TLSStart.IsZero() && !sc.tlsStart.IsZero() {
+		t.TLSStart = sc.tlsStart
+		t.TLSDone = sc.tlsDone
+	}
+}
@@ -0,0 +1,664 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bytedance/sonic"
+	uuid "github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/vela-ssoc/vela-mitm/proxy"
+)
+
+/*
+	主动扫描: 对 history 中的请求逐个修改参数 (query urlencoded 表单 json 顶层字段) 发送检测请求
+	发现保存到 FlowDB 的 finding, 触发发现的请求作为证据保存到 history (带 active-scan 标签)
+	请求只发往扫描的 scope 和项目 scope 内的目标, 同一 host 的请求在所有扫描任务之间共用速率限制
+*/
+
+const (
+	ActiveSQLi            = "sqli"
+	ActiveXSS             = "xss"
+	ActiveTraversal       = "path-traversal"
+	ActiveSSRF            = "ssrf"
+	ActiveRedirect        = "open-redirect"
+	ActiveHeaderInjection = "header-injection"
+)
+
+var activeChecks = []string{
+	ActiveSQLi,
+	ActiveXSS,
+	ActiveTraversal,
+	ActiveSSRF,
+	ActiveRedirect,
+	ActiveHeaderInjection,
+}
+
+const (
+	activeDefaultRate     = 5
+	activeDefaultTimeout  = 10 * time.Second
+	activeDefaultDelay    = 5
+	activeMaxDelay        = 30
+	activeDefaultRequests = 100
+	activeCallbackGrace   = 2 * time.Second
+	activeEvidenceTag     = "active-scan"
+)
+
+// FlowIDs 为右键选中的 flow, Host 为右键选中的 host (history 中该 host 的请求, 按 method path 和参数名去重)
+// Scope 为允许发送的 host, 支持 * 通配, 为空时为目标请求的 host; 目标同时需要在项目 scope 内
+type ActiveScan struct {
+	FlowIDs      []string `json:"flow_ids,omitempty"`
+	Host         string   `json:"host,omitempty"`
+	Checks       []string `json:"checks,omitempty"` // 默认全部
+	Scope        []string `json:"scope,omitempty"`
+	Rate         float64  `json:"rate,omitempty"`          // 每个 host 每秒的请求数, 默认 5
+	Timeout      int      `json:"timeout,omitempty"`       // 单个请求的超时, 毫秒, 默认 10000
+	Delay        int      `json:"delay,omitempty"`         // 时间盲注的延迟, 秒, 默认 5
+	Callback     string   `json:"callback,omitempty"`      // ssrf 回连的监听地址, 默认 127.0.0.1:0, 只有 admin 可以监听非 loopback 地址
+	CallbackHost string   `json:"callback_host,omitempty"` // payload 中使用的 host:port, 默认为监听地址
+	MaxRequests  int      `json:"max_requests,omitempty"`  // host 模式最多扫描的请求数, 默认 100
+}
+
+type ActiveReport struct {
+	Targets  int       `json:"targets"`
+	Points   int       `json:"points"`   // 参数个数
+	Requests int       `json:"requests"` // 发送的请求数
+	Findings []Finding `json:"findings"`
+	Notes    []string  `json:"notes,omitempty"`
+}
+
+func (r *ActiveReport) clone() *ActiveReport {
+	c := *r
+	c.Findings = append([]Finding(nil), r.Findings...)
+	c.Notes = append([]string(nil), r.Notes...)
+	return &c
+}
+
+// 参数位置
+const (
+	pointQuery = "query"
+	pointForm  = "form"
+	pointJSON  = "json"
+)
+
+type activePoint struct {
+	Location string
+	Name     string
+	Value    string
+}
+
+type activeTarget struct {
+	source  string // history flow_id
+	request *proxy.RequestEditData
+	host    string
+	path    string
+	points  []activePoint
+}
+
+type activeUnit struct {
+	target *activeTarget
+	point  activePoint
+	check  string
+}
+
+type activeScanner struct {
+	web      *WebAddon
+	db       *FlowDB
+	us       *userState
+	scope    []string
+	interval time.Duration
+	timeout  time.Duration
+	delay    int
+	checks   []string
+	targets  []*activeTarget
+	units    []activeUnit
+	report   *ActiveReport
+
+	callback     string
+	callbackHost string
+	cb           *activeCallback
+	pending      map[string]*activeProbe // 等待回连的 ssrf 请求
+}
+
+func (web *WebAddon) newActiveScanner(db *FlowDB, scan *ActiveScan) (*activeScanner, error) {
+	s := &activeScanner{
+		web:          web,
+		db:           db,
+		scope:        scan.Scope,
+		interval:     time.Second / activeDefaultRate,
+		timeout:      activeDefaultTimeout,
+		delay:        activeDefaultDelay,
+		checks:       scan.Checks,
+		callback:     scan.Callback,
+		callbackHost: scan.CallbackHost,
+		report:       &ActiveReport{Findings: make([]Finding, 0)},
+		pending:      make(map[string]*activeProbe),
+	}
+	if scan.Rate > 0 {
+		s.interval = time.Duration(float64(time.Second) / scan.Rate)
+	}
+	if scan.Timeout > 0 {
+		s.timeout = time.Duration(scan.Timeout) * time.Millisecond
+	}
+	if scan.Delay > 0 {
+		s.delay = scan.Delay
+	}
+	if s.delay > activeMaxDelay {
+		s.delay = activeMaxDelay
+	}
+	if s.callback == "" {
+		s.callback = "127.0.0.1:0"
+	}
+
+	if len(s.checks) == 0 {
+		s.checks = activeChecks
+	}
+	for _, name := range s.checks {
+		if activeCheckFuncs[name] == nil {
+			return nil, fmt.Errorf("unknown check %s", name)
+		}
+	}
+
+	flows, err := s.flows(scan)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	for _, flow := range flows {
+		t := newActiveTarget(flow)
+		if t == nil {
+			continue
+		}
+		if len(scan.Scope) == 0 && !hostInScope(s.scope, t.host) {
+			s.scope = append(s.scope, strings.ToLower(strings.Split(t.host, ":")[0]))
+		}
+
+		key := t.request.Method + " " + t.host + t.path
+		for _, p := range t.points {
+			key += " " + p.Location + ":" + p.Name
+		}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		if !hostInScope(s.scope, t.host) || web.config.Scope.Check(t.request.RawURL) != nil {
+			s.report.Notes = append(s.report.Notes, fmt.Sprintf("%s %s%s out of scope", t.request.Method, t.host, t.path))
+			continue
+		}
+		if len(t.points) == 0 {
+			s.report.Notes = append(s.report.Notes, fmt.Sprintf("%s %s%s has no parameter", t.request.Method, t.host, t.path))
+			continue
+		}
+
+		s.targets = append(s.targets, t)
+		s.report.Points += len(t.points)
+		for _, p := range t.points {
+			for _, check := range s.checks {
+				s.units = append(s.units, activeUnit{target: t, point: p, check: check})
+			}
+		}
+	}
+	s.report.Targets = len(s.targets)
+
+	if len(s.units) == 0 {
+		return nil, fmt.Errorf("no parameter to scan")
+	}
+	return s, nil
+}
+
+func (s *activeScanner) flows(scan *ActiveScan) ([]Flow, error) {
+	var flows []Flow
+	for _, id := range scan.FlowIDs {
+		flow, err := s.db.FindFlowId(id)
+		if err != nil {
+			return nil, fmt.Errorf("flow %s not found", id)
+		}
+		if err = s.db.LoadBody(flow); err != nil {
+			return nil, err
+		}
+		flows = append(flows, *flow)
+	}
+
+	if scan.Host != "" {
+		limit := scan.MaxRequests
+		if limit <= 0 {
+			limit = activeDefaultRequests
+		}
+
+		// 新的在前, 跳过扫描自身的证据请求; 只加载保留的 flow 的 body
+		fq, err := ParseQuery(fmt.Sprintf("host=%q AND tag!=%q", scan.Host, activeEvidenceTag))
+		if err != nil {
+			return nil, err
+		}
+		found, _, err := s.db.Page(fq, 0, limit)
+		if err != nil {
+			return nil, err
+		}
+		for _, fs := range found {
+			flow, err := s.db.FindFlowId(fs.FlowID)
+			if err != nil {
+				continue
+			}
+			if err = s.db.LoadBody(flow); err != nil {
+				return nil, err
+			}
+			flows = append(flows, *flow)
+		}
+	}
+
+	if len(flows) == 0 {
+		return nil, fmt.Errorf("flow_ids or host required")
+	}
+	return flows, nil
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func newActiveTarget(flow Flow) *activeTarget {
+	fr := flowRequest(&flow)
+	u, err := url.Parse(fr.RawURL)
+	if err != nil || u.Host == "" {
+		return nil
+	}
+
+	t := &activeTarget{source: flow.FlowID, request: fr, host: u.Host, path: u.Path}
+	for _, name := range sortedKeys(u.Query()) {
+		t.points = append(t.points, activePoint{Location: pointQuery, Name: name, Value: u.Query().Get(name)})
+	}
+
+	contentType := fr.Header.Get("Content-Type")
+	switch {
+	case strings.HasPrefix(contentType, "application/x-www-form-urlencoded"):
+		form, err := url.ParseQuery(fr.Body)
+		if err != nil {
+			break
+		}
+		for _, name := range sortedKeys(form) {
+			t.points = append(t.points, activePoint{Location: pointForm, Name: name, Value: form.Get(name)})
+		}
+
+	case strings.Contains(contentType, "json"):
+		var body map[string]interface{}
+		if err := sonic.UnmarshalString(fr.Body, &body); err != nil {
+			break
+		}
+		keys := make([]string, 0, len(body))
+		for k := range body {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			switch v := body[k].(type) {
+			case string:
+				t.points = append(t.points, activePoint{Location: pointJSON, Name: k, Value: v})
+			case float64, bool:
+				t.points = append(t.points, activePoint{Location: pointJSON, Name: k, Value: fmt.Sprint(v)})
+			}
+		}
+	}
+	return t
+}
+
+func sortedKeys(values url.Values) []string {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// 替换参数的值, 其他部分不变; json 字段总是替换为字符串
+func (p activePoint) apply(fr *proxy.RequestEditData, value string) *proxy.RequestEditData {
+	out := &proxy.RequestEditData{Method: fr.Method, RawURL: fr.RawURL, Header: fr.Header.Clone(), Body: fr.Body}
+	if out.Header == nil {
+		out.Header = make(http.Header)
+	}
+	out.Header.Del("Content-Length")
+
+	switch p.Location {
+	case pointQuery:
+		u, _ := url.Parse(fr.RawURL)
+		query := u.Query()
+		query.Set(p.Name, value)
+		u.RawQuery = query.Encode()
+		out.RawURL = u.String()
+
+	case pointForm:
+		form, _ := url.ParseQuery(fr.Body)
+		form.Set(p.Name, value)
+		out.Body = form.Encode()
+
+	case pointJSON:
+		var body map[string]interface{}
+		if err := sonic.UnmarshalString(fr.Body, &body); err == nil {
+			body[p.Name] = value
+			out.Body, _ = sonic.MarshalString(body)
+		}
+	}
+	return out
+}
+
+// host 不带端口匹配, 模式忽略大小写
+func hostInScope(scope []string, host string) bool {
+	name := strings.ToLower(host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		name = strings.ToLower(h)
+	}
+	for _, pattern := range scope {
+		pattern = strings.ToLower(pattern)
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, strings.ToLower(host)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// 校验之后作为后台任务执行, 报告通过 JobDetail.Report 读取, 可以暂停和恢复
+func (web *WebAddon) startActiveScan(c *concurrentConn, scan *ActiveScan) (JobInfo, error) {
+	if !c.userData.Role.Allow(RoleAdmin) && !loopbackAddr(scan.Callback) {
+		return JobInfo{}, fmt.Errorf("callback %s must listen on loopback, only admin can change", scan.Callback)
+	}
+
+	s, err := web.newActiveScanner(c.db, scan)
+	if err != nil {
+		return JobInfo{}, err
+	}
+
+	return web.submitJob(c, jobSpec{
+		Kind:     JobScan,
+		Total:    len(s.units),
+		Pausable: true,
+		Run: func(ctx context.Context, j *backgroundJob, db *FlowDB) error {
+			s.db = db
+			return s.run(ctx, j)
+		},
+	}), nil
+}
+
+// 为空时使用默认的 127.0.0.1:0
+func loopbackAddr(addr string) bool {
+	if addr == "" {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (s *activeScanner) run(ctx context.Context, j *backgroundJob) error {
+	s.us = j.us
+
+	for _, unit := range s.units {
+		if unit.check == ActiveSSRF && s.cb == nil {
+			cb, err := listenCallback(s.callback)
+			if err != nil {
+				return fmt.Errorf("ssrf callback listen fail %v", err)
+			}
+			defer cb.close()
+			s.cb = cb
+			if s.callbackHost == "" {
+				s.callbackHost = cb.addr
+			}
+		}
+	}
+	j.setOutput(s.report.clone())
+
+	baselines := make(map[*activeTarget]*activeProbe)
+	for i, unit := range s.units {
+		if j.wait(ctx) != nil {
+			break
+		}
+
+		base, ok := baselines[unit.target]
+		if !ok {
+			base = s.baseline(ctx, unit.target)
+			baselines[unit.target] = base
+		}
+
+		if base != nil {
+			for _, fd := range activeCheckFuncs[unit.check](ctx, s, unit.target, unit.point, base) {
+				s.addFinding(unit, fd)
+			}
+		}
+
+		j.setOutput(s.report.clone())
+		j.progress(i+1, len(s.units))
+	}
+
+	// 等待延迟的回连
+	if len(s.pending) > 0 && ctx.Err() == nil {
+		select {
+		case <-time.After(activeCallbackGrace):
+		case <-ctx.Done():
+		}
+		for token, probe := range s.pending {
+			if hit := s.cb.hit(token); hit != "" {
+				s.addFinding(probe.unit, ssrfFinding(probe, s.evidence(probe, ActiveSSRF), hit))
+			}
+		}
+		j.setOutput(s.report.clone())
+	}
+	return nil
+}
+
+// 正常请求发送两次, 响应不一致时 Stable 为 false, 不做布尔盲注检测
+func (s *activeScanner) baseline(ctx context.Context, t *activeTarget) *activeProbe {
+	first := s.send(ctx, t.request)
+	if first.err != nil {
+		s.report.Notes = append(s.report.Notes, fmt.Sprintf("%s %s%s baseline fail %v", t.request.Method, t.host, t.path, first.err))
+		return nil
+	}
+
+	second := s.send(ctx, t.request)
+	first.stable = second.err == nil && similarFlow(first.flow, second.flow, 0)
+	if second.elapsed > first.elapsed {
+		first.elapsed = second.elapsed
+	}
+	return first
+}
+
+// 一次检测请求及其响应
+type activeProbe struct {
+	unit    activeUnit
+	request *proxy.RequestEditData
+	payload string
+	flow    *Flow
+	elapsed time.Duration
+	err     error
+	stable  bool
+}
+
+// 按 host 限速, 不在 scope 内的请求不发送
+func (s *activeScanner) send(ctx context.Context, fr *proxy.RequestEditData) *activeProbe {
+	probe := &activeProbe{request: fr}
+	u, err := url.Parse(fr.RawURL)
+	if err != nil {
+		probe.err = err
+		return probe
+	}
+	if !hostInScope(s.scope, u.Host) {
+		probe.err = fmt.Errorf("%s out of scope", u.Host)
+		return probe
+	}
+	if probe.err = s.web.scanLimit.wait(ctx, u.Host, s.interval); probe.err != nil {
+		return probe
+	}
+
+	s.report.Requests++
+	start := time.Now()
+	probe.flow, probe.err = s.web.doRequest(ctx, fr, sendOptions{Timeout: s.timeout, NoRedirect: true})
+	probe.elapsed = time.Since(start)
+	return probe
+}
+
+func (s *activeScanner) probe(ctx context.Context, t *activeTarget, p activePoint, payload string) *activeProbe {
+	probe := s.send(ctx, p.apply(t.request, payload))
+	probe.payload = payload
+	return probe
+}
+
+// 证据请求保存到 history, 新的发现推送给用户
+func (s *activeScanner) addFinding(unit activeUnit, fd *Finding) {
+	fd.Type, fd.Name = unit.check, unit.point.Name
+	fd.Host, fd.Path = unit.target.host, unit.target.path
+	fd.ID = findingID(fd.Type, fd.Name, fd.Host, fd.Path)
+	flowIDs := []string{unit.target.source}
+	for _, id := range fd.FlowIDs {
+		if id != "" {
+			flowIDs = append(flowIDs, id)
+		}
+	}
+	fd.FlowIDs = flowIDs
+	fd.Last = time.Now()
+
+	created, err := s.db.AddFinding(fd)
+	if err != nil {
+		log.Errorf("save finding fail %v", err)
+		return
+	}
+	log.Warnf("active scan %s %s%s %s: %s", fd.Type, fd.Host, fd.Path, fd.Name, fd.Detail)
+
+	s.report.Findings = append(s.report.Findings, *fd)
+	if created && s.us != nil {
+		chunk, _ := sonic.Marshal(fd)
+		sendToUser(s.us, messageTypeFinding, fd.ID, chunk)
+	}
+}
+
+// 保存证据请求, 返回 flow_id
+func (s *activeScanner) evidence(probe *activeProbe, check string) string {
+	if probe == nil || probe.flow == nil {
+		return ""
+	}
+
+	flow := *probe.flow
+	flow.FlowID = ""
+	flow.MType = messageTypeResponseBody
+	flow.Tags = []string{activeEvidenceTag, check}
+	if err := s.db.AddFlow(&flow); err != nil {
+		log.Errorf("save evidence flow fail %v", err)
+		return ""
+	}
+	return flow.FlowID
+}
+
+// 状态码相同, body 长度差异不超过 tolerance 加 2%
+func similarFlow(a, b *Flow, tolerance int) bool {
+	if a == nil || b == nil || a.StatusCode != b.StatusCode {
+		return false
+	}
+	diff := len(a.ResponseBody) - len(b.ResponseBody)
+	if diff < 0 {
+		diff = -diff
+	}
+	max := len(a.ResponseBody)
+	if len(b.ResponseBody) > max {
+		max = len(b.ResponseBody)
+	}
+	return diff <= tolerance+max/50
+}
+
+// 所有扫描任务共用, 同一 host 的请求间隔不小于任务的 interval
+type hostLimiter struct {
+	mu   sync.Mutex
+	next map[string]time.Time
+}
+
+func (hl *hostLimiter) wait(ctx context.Context, host string, interval time.Duration) error {
+	hl.mu.Lock()
+	if hl.next == nil {
+		hl.next = make(map[string]time.Time)
+	}
+	now := time.Now()
+	at := hl.next[host]
+	if at.Before(now) {
+		at = now
+	}
+	hl.next[host] = at.Add(interval)
+
+	// 清理过期的 host
+	for h, t := range hl.next {
+		if t.Before(now) {
+			delete(hl.next, h)
+		}
+	}
+	hl.mu.Unlock()
+
+	timer := time.NewTimer(time.Until(at))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ssrf 回连监听, 请求路径的第一段为 token
+type activeCallback struct {
+	addr   string
+	server *http.Server
+	mu     sync.Mutex
+	hits   map[string]string
+}
+
+func listenCallback(addr string) (*activeCallback, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	cb := &activeCallback{addr: ln.Addr().String(), hits: make(map[string]string)}
+	cb.server = &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)[0]
+		cb.mu.Lock()
+		if _, ok := cb.hits[token]; !ok {
+			cb.hits[token] = fmt.Sprintf("%s %s from %s", r.Method, r.URL.RequestURI(), r.RemoteAddr)
+		}
+		cb.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	})}
+	go cb.server.Serve(ln)
+	return cb, nil
+}
+
+func (cb *activeCallback) hit(token string) string {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.hits[token]
+}
+
+func (cb *activeCallback) close() {
+	cb.server.Close()
+}
+
+func activeToken() string {
+	return "vm" + strings.ReplaceAll(uuid.NewV4().String(), "-", "")[:10]
+}
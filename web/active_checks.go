@@ -0,0 +1,227 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+type activeCheckFunc func(ctx context.Context, s *activeScanner, t *activeTarget, p activePoint, base *activeProbe) []*Finding
+
+var activeCheckFuncs = map[string]activeCheckFunc{
+	ActiveSQLi:            checkSQLi,
+	ActiveXSS:             checkXSS,
+	ActiveTraversal:       checkTraversal,
+	ActiveSSRF:            checkSSRF,
+	ActiveRedirect:        checkRedirect,
+	ActiveHeaderInjection: checkHeaderInjection,
+}
+
+var sqlErrorRe = regexp.MustCompile(`(?i)you have an error in your sql syntax|warning: mysql_|mysqli?_fetch|unclosed quotation mark|quoted string not properly terminated|ORA-\d{5}|PostgreSQL.{0,40}ERROR|pg_query\(\)|syntax error at or near|SQLSTATE\[|sqlite3?\.OperationalError|SQLite3::|unrecognized token:|Microsoft OLE DB Provider|ODBC SQL Server Driver|JDBC.{0,40}SQLException`)
+
+// 布尔盲注的 payload: 条件为真和为假时的后缀
+var sqlBooleanPayloads = []struct {
+	True  string
+	False string
+}{
+	{"' AND '1'='1", "' AND '1'='2"},
+	{" AND 1=1", " AND 1=2"},
+	{"\" AND \"1\"=\"1", "\" AND \"1\"=\"2"},
+}
+
+// %d 为延迟秒数
+var sqlTimePayloads = []string{
+	"' AND SLEEP(%d)-- -",
+	" AND SLEEP(%d)",
+	"'; WAITFOR DELAY '0:0:%d'--",
+	"'||pg_sleep(%d)--",
+}
+
+// 报错注入 -> 布尔盲注 -> 时间盲注, 找到一种即返回
+func checkSQLi(ctx context.Context, s *activeScanner, t *activeTarget, p activePoint, base *activeProbe) []*Finding {
+	baseErr := sqlErrorRe.MatchString(base.flow.ResponseBody)
+	for _, suffix := range []string{"'", "\"", "')"} {
+		probe := s.probe(ctx, t, p, p.Value+suffix)
+		if probe.err != nil || baseErr {
+			continue
+		}
+		if m := sqlErrorRe.FindStringIndex(probe.flow.ResponseBody); m != nil {
+			return []*Finding{{
+				Severity: SeverityHigh,
+				Detail:   fmt.Sprintf("sql error with payload %q", probe.payload),
+				Evidence: snippet(probe.flow.ResponseBody, m[0], m[1]-m[0]),
+				FlowIDs:  []string{s.evidence(probe, ActiveSQLi)},
+			}}
+		}
+	}
+
+	if base.stable {
+		for _, bp := range sqlBooleanPayloads {
+			confirmed := true
+			var evidence *activeProbe
+			for i := 0; i < 2 && confirmed; i++ {
+				yes := s.probe(ctx, t, p, p.Value+bp.True)
+				no := s.probe(ctx, t, p, p.Value+bp.False)
+				confirmed = yes.err == nil && no.err == nil &&
+					similarFlow(yes.flow, base.flow, len(bp.True)) && !similarFlow(yes.flow, no.flow, 0)
+				evidence = no
+			}
+			if confirmed {
+				return []*Finding{{
+					Severity: SeverityHigh,
+					Detail:   fmt.Sprintf("boolean based, %q and %q return different responses", bp.True, bp.False),
+					Evidence: fmt.Sprintf("true: %d %d bytes, false: %d %d bytes", base.flow.StatusCode, len(base.flow.ResponseBody), evidence.flow.StatusCode, len(evidence.flow.ResponseBody)),
+					FlowIDs:  []string{s.evidence(evidence, ActiveSQLi)},
+				}}
+			}
+		}
+	}
+
+	delay := time.Duration(s.delay) * time.Second
+	if s.timeout <= delay {
+		return nil
+	}
+	for _, format := range sqlTimePayloads {
+		payload := p.Value + fmt.Sprintf(format, s.delay)
+		var probe *activeProbe
+		confirmed := true
+		for i := 0; i < 2 && confirmed; i++ {
+			probe = s.probe(ctx, t, p, payload)
+			confirmed = probe.err == nil && probe.elapsed >= base.elapsed+delay*4/5
+		}
+		if confirmed {
+			return []*Finding{{
+				Severity: SeverityHigh,
+				Detail:   fmt.Sprintf("time based, payload %q", payload),
+				Evidence: fmt.Sprintf("response took %dms, baseline %dms", probe.elapsed.Milliseconds(), base.elapsed.Milliseconds()),
+				FlowIDs:  []string{s.evidence(probe, ActiveSQLi)},
+			}}
+		}
+	}
+	return nil
+}
+
+// payload 原样出现在 html 响应中
+func checkXSS(ctx context.Context, s *activeScanner, t *activeTarget, p activePoint, base *activeProbe) []*Finding {
+	token := activeToken()
+	payload := token + `"'<vmx>`
+
+	probe := s.probe(ctx, t, p, payload)
+	if probe.err != nil || !strings.Contains(probe.flow.ResponseHeader.Get("Content-Type"), "html") {
+		return nil
+	}
+
+	i := strings.Index(probe.flow.ResponseBody, payload)
+	if i < 0 {
+		return nil
+	}
+	return []*Finding{{
+		Severity: SeverityHigh,
+		Detail:   "payload reflected without html encoding",
+		Evidence: snippet(probe.flow.ResponseBody, i, len(payload)),
+		FlowIDs:  []string{s.evidence(probe, ActiveXSS)},
+	}}
+}
+
+var traversalPayloads = []string{
+	"../../../../../../../../../../etc/passwd",
+	"....//....//....//....//....//....//....//etc/passwd",
+	"/etc/passwd",
+	`..\..\..\..\..\..\..\..\windows\win.ini`,
+	"file:///etc/passwd",
+}
+
+var traversalRe = regexp.MustCompile(`root:[^:\r\n]*:0:0:|\[(?:fonts|extensions)\]\s+`)
+
+func checkTraversal(ctx context.Context, s *activeScanner, t *activeTarget, p activePoint, base *activeProbe) []*Finding {
+	if traversalRe.MatchString(base.flow.ResponseBody) {
+		return nil
+	}
+
+	for _, payload := range traversalPayloads {
+		probe := s.probe(ctx, t, p, payload)
+		if probe.err != nil {
+			continue
+		}
+		if m := traversalRe.FindStringIndex(probe.flow.ResponseBody); m != nil {
+			return []*Finding{{
+				Severity: SeverityHigh,
+				Detail:   fmt.Sprintf("file content with payload %q", payload),
+				Evidence: snippet(probe.flow.ResponseBody, m[0], m[1]-m[0]),
+				FlowIDs:  []string{s.evidence(probe, ActiveTraversal)},
+			}}
+		}
+	}
+	return nil
+}
+
+// 回连在响应之后才到达时在扫描结束前再检查一次
+func checkSSRF(ctx context.Context, s *activeScanner, t *activeTarget, p activePoint, base *activeProbe) []*Finding {
+	token := activeToken()
+	payload := "http://" + s.callbackHost + "/" + token
+
+	probe := s.probe(ctx, t, p, payload)
+	if probe.err != nil {
+		return nil
+	}
+	probe.unit = activeUnit{target: t, point: p, check: ActiveSSRF}
+
+	if hit := s.cb.hit(token); hit != "" {
+		return []*Finding{ssrfFinding(probe, s.evidence(probe, ActiveSSRF), hit)}
+	}
+	s.pending[token] = probe
+	return nil
+}
+
+func ssrfFinding(probe *activeProbe, flowID, hit string) *Finding {
+	return &Finding{
+		Severity: SeverityHigh,
+		Detail:   fmt.Sprintf("callback received for payload %q", probe.payload),
+		Evidence: hit,
+		FlowIDs:  []string{flowID},
+	}
+}
+
+// 3xx 的 Location 指向 payload 中的域名
+func checkRedirect(ctx context.Context, s *activeScanner, t *activeTarget, p activePoint, base *activeProbe) []*Finding {
+	domain := activeToken() + ".example.com"
+	for _, payload := range []string{"https://" + domain + "/", "//" + domain + "/"} {
+		probe := s.probe(ctx, t, p, payload)
+		if probe.err != nil || probe.flow.StatusCode < 300 || probe.flow.StatusCode >= 400 {
+			continue
+		}
+
+		location := probe.flow.ResponseHeader.Get("Location")
+		if u, err := url.Parse(location); err == nil && strings.EqualFold(u.Hostname(), domain) {
+			return []*Finding{{
+				Severity: SeverityMedium,
+				Detail:   fmt.Sprintf("redirect to payload %q", payload),
+				Evidence: "Location: " + location,
+				FlowIDs:  []string{s.evidence(probe, ActiveRedirect)},
+			}}
+		}
+	}
+	return nil
+}
+
+// 参数中的换行写入响应头
+func checkHeaderInjection(ctx context.Context, s *activeScanner, t *activeTarget, p activePoint, base *activeProbe) []*Finding {
+	token := activeToken()
+	for _, sep := range []string{"\r\n", "\n"} {
+		payload := p.Value + sep + "X-Vm-Inject: " + token
+		probe := s.probe(ctx, t, p, payload)
+		if probe.err != nil || probe.flow.ResponseHeader.Get("X-Vm-Inject") != token {
+			continue
+		}
+		return []*Finding{{
+			Severity: SeverityHigh,
+			Detail:   fmt.Sprintf("crlf in parameter injects response header, payload %q", payload),
+			Evidence: "X-Vm-Inject: " + token,
+			FlowIDs:  []string{s.evidence(probe, ActiveHeaderInjection)},
+		}}
+	}
+	return nil
+}
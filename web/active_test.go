@@ -0,0 +1,178 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 每个路径有一种漏洞, 参数只有一个
+func vulnerableServer(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sql", func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Query().Get("id"), "'") {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, "You have an error in your SQL syntax near ''1''")
+			return
+		}
+		fmt.Fprint(w, "item 1")
+	})
+	mux.HandleFunc("/bool", func(w http.ResponseWriter, r *http.Request) {
+		id := r.URL.Query().Get("id")
+		if strings.HasSuffix(id, "'1'='2") || strings.HasSuffix(id, "1=2") {
+			fmt.Fprint(w, "no result")
+			return
+		}
+		fmt.Fprint(w, strings.Repeat("item 1 detail ", 20))
+	})
+	mux.HandleFunc("/sleep", func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Query().Get("id"), "SLEEP(1)") {
+			time.Sleep(time.Second)
+		}
+		fmt.Fprint(w, "item 1")
+	})
+	mux.HandleFunc("/xss", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(w, "<p>%s</p>", r.URL.Query().Get("q"))
+	})
+	mux.HandleFunc("/file", func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Query().Get("name"), "etc/passwd") {
+			fmt.Fprint(w, "root:x:0:0:root:/root:/bin/bash\n")
+			return
+		}
+		fmt.Fprint(w, "file")
+	})
+	mux.HandleFunc("/fetch", func(w http.ResponseWriter, r *http.Request) {
+		resp, err := http.Get(r.URL.Query().Get("url"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		io.Copy(w, resp.Body)
+		resp.Body.Close()
+	})
+	mux.HandleFunc("/go", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, r.URL.Query().Get("next"), http.StatusFound)
+	})
+	// net/http 会替换 header 中的换行, 直接写原始响应
+	mux.HandleFunc("/hdr", func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintf(buf, "HTTP/1.1 200 OK\r\nX-Lang: %s\r\nContent-Length: 2\r\nConnection: close\r\n\r\nok", r.URL.Query().Get("lang"))
+		buf.Flush()
+	})
+	mux.HandleFunc("/safe", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	})
+
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestActiveScan(t *testing.T) {
+	db := newTestFlowDB(t)
+
+	ts := vulnerableServer(t)
+	for _, path := range []string{"/sql?id=1", "/bool?id=1", "/sleep?id=1", "/xss?q=hello", "/file?name=a.txt",
+		"/fetch?url=http://example.com/", "/go?next=/home", "/hdr?lang=en", "/safe?q=abc", "/safe?q=def", "/safe"} {
+		if err := db.AddFlow(&Flow{Method: "GET", RawURL: ts.URL + path, RequestHeader: http.Header{}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	host := ts.Listener.Addr().String()
+	s, err := (&WebAddon{}).newActiveScanner(db, &ActiveScan{Host: host, Rate: 1000, Delay: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.report.Targets != 9 || len(s.report.Notes) != 1 {
+		t.Fatalf("targets %d notes %v", s.report.Targets, s.report.Notes)
+	}
+
+	j := &backgroundJob{us: &userState{}}
+	if err = s.run(context.Background(), j); err != nil {
+		t.Fatal(err)
+	}
+	report := j.snapshot().Report.(*ActiveReport)
+
+	want := map[string]string{
+		ActiveSQLi + " /sql":            "sql error",
+		ActiveSQLi + " /bool":           "boolean based",
+		ActiveSQLi + " /sleep":          "time based",
+		ActiveXSS + " /xss":             "reflected",
+		ActiveTraversal + " /file":      "file content",
+		ActiveSSRF + " /fetch":          "callback received",
+		ActiveRedirect + " /go":         "redirect to",
+		ActiveHeaderInjection + " /hdr": "injects response header",
+	}
+	got := make(map[string]Finding)
+	for _, fd := range report.Findings {
+		got[fd.Type+" "+fd.Path] = fd
+	}
+	for key, detail := range want {
+		fd, ok := got[key]
+		if !ok || !strings.Contains(fd.Detail, detail) || fd.Host != host || len(fd.FlowIDs) != 2 {
+			t.Fatalf("%s: %+v", key, fd)
+		}
+		evidence, err := db.FindFlowId(fd.FlowIDs[1])
+		if err != nil || !hasTag(evidence.Tags, activeEvidenceTag) || !hasTag(evidence.Tags, fd.Type) {
+			t.Fatalf("%s evidence %v %+v", key, err, evidence)
+		}
+	}
+	if len(got) != len(want) {
+		t.Fatalf("findings %+v", report.Findings)
+	}
+
+	findings, _ := db.Findings(FindingFilter{Host: host}, 0, 0)
+	if len(findings) != len(want) {
+		t.Fatalf("stored findings %d", len(findings))
+	}
+
+	// scope 外的 host 不扫描
+	if _, err = (&WebAddon{}).newActiveScanner(db, &ActiveScan{Host: host, Scope: []string{"*.example.com"}}); err == nil {
+		t.Fatal("out of scope should fail")
+	}
+	if !hostInScope([]string{"*.example.com"}, "a.example.com:8443") || hostInScope([]string{"*.example.com"}, "example.com") {
+		t.Fatal("scope match")
+	}
+
+	// host 模式只取最新的 max_requests 个请求, 跳过证据请求
+	s, err = (&WebAddon{}).newActiveScanner(db, &ActiveScan{Host: host, MaxRequests: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.report.Targets != 1 || s.targets[0].path != "/safe" || len(s.report.Notes) != 1 {
+		t.Fatalf("targets %d notes %v", s.report.Targets, s.report.Notes)
+	}
+}
+
+func TestActiveCallback(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"":             true,
+		"127.0.0.1:0":  true,
+		"[::1]:8080":   true,
+		"localhost:80": true,
+		"0.0.0.0:8080": false,
+		":8080":        false,
+		"10.0.0.1:80":  false,
+		"127.0.0.1":    false,
+	} {
+		if loopbackAddr(addr) != want {
+			t.Fatalf("loopback %q", addr)
+		}
+	}
+
+	c := &concurrentConn{userData: &UserData{Name: "alice", Role: RoleTester}, user: &userState{}}
+	if _, err := (&WebAddon{}).startActiveScan(c, &ActiveScan{Host: "a.com", Callback: "0.0.0.0:8080"}); err == nil {
+		t.Fatal("tester should not listen on all interfaces")
+	}
+}
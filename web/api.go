@@ -0,0 +1,272 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/bytedance/sonic"
+	"github.com/vela-ssoc/vela-mitm/proxy"
+)
+
+// 版本化的 rest api, 与 websocket 共用会话 token, 也可以通过 /login 直接获取
+const apiPrefix = "/api/v1"
+
+// rest api 统一的错误格式: {"error": {"code": 404, "message": "..."}}
+type APIError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Detail  interface{} `json:"detail,omitempty"`
+}
+
+type apiErrorBody struct {
+	Error APIError `json:"error"`
+}
+
+func apiError(w http.ResponseWriter, code int, format string, v ...interface{}) {
+	BadJSON(w, code, apiErrorBody{Error: APIError{Code: code, Message: fmt.Sprintf(format, v...)}})
+}
+
+func apiJSON(w http.ResponseWriter, v interface{}) {
+	chunk, err := sonic.Marshal(v)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, "marshal fail %v", err)
+		return
+	}
+	JSON(w, chunk)
+}
+
+type apiParam struct {
+	Name string
+	Type string // string integer boolean
+	Desc string
+}
+
+// 路由表同时用于分发请求和生成 openapi 描述
+// Body Resp 为请求和响应的示例值, 只取类型
+type apiRoute struct {
+	Method  string
+	Path    string // 相对 apiPrefix, {name} 为路径参数
+	Summary string
+	Query   []apiParam
+	Body    interface{}
+	Resp    interface{}
+	Public  bool // 不需要登录
+	Role    Role // 需要的角色, 为空时为 viewer
+	handle  func(w http.ResponseWriter, r *http.Request, c *concurrentConn)
+}
+
+func (route *apiRoute) need() Role {
+	if route.Role == 0 {
+		return RoleViewer
+	}
+	return route.Role
+}
+
+type apiRouter struct {
+	web    *WebAddon
+	routes []apiRoute
+}
+
+func (web *WebAddon) API() http.Handler {
+	return &apiRouter{web: web, routes: web.apiRoutes()}
+}
+
+func (web *WebAddon) apiRoutes() []apiRoute {
+	limit := apiParam{Name: "limit", Type: "integer", Desc: "每页条数, 默认 50, 最大 1000"}
+	offset := apiParam{Name: "offset", Type: "integer", Desc: "跳过的条数"}
+
+	return []apiRoute{
+		{Method: http.MethodPost, Path: "/login", Summary: "登录获取 token", Public: true,
+			Body: loginForm{}, Resp: apiToken{}, handle: web.apiLogin},
+		{Method: http.MethodPost, Path: "/refresh", Summary: "作废当前 token 并签发新的 token",
+			Resp: apiToken{}, handle: web.apiRefresh},
+		{Method: http.MethodPost, Path: "/logout", Summary: "作废当前 token 并断开同一次登录的 websocket",
+			Resp: map[string]bool{}, handle: web.apiLogout},
+		{Method: http.MethodGet, Path: "/flows", Summary: "按 id 倒序分页列出 flow",
+			Query: []apiParam{
+				{Name: "q", Type: "string", Desc: "过滤表达式, 与 history/search 相同"},
+				limit,
+				{Name: "cursor", Type: "string", Desc: "上一页返回的 next_cursor"},
+			},
+			Resp: apiFlowPage{}, handle: web.apiFlows},
+		{Method: http.MethodGet, Path: "/flows/{id}", Summary: "读取 flow 及解压后的 body",
+			Query: []apiParam{{Name: "body", Type: "boolean", Desc: "false 时不读取 body"}},
+			Resp:  Flow{}, handle: web.apiFlow},
+		{Method: http.MethodGet, Path: "/rules/breakpoint", Summary: "读取断点规则",
+			Resp: &breakPointRule{}, handle: web.apiRule(messageTypeChangeBreakPointRules)},
+		{Method: http.MethodPut, Path: "/rules/breakpoint", Summary: "替换断点规则",
+			Role: RoleTester,
+			Body: &breakPointRule{}, Resp: &breakPointRule{}, handle: web.apiRule(messageTypeChangeBreakPointRules)},
+		{Method: http.MethodGet, Path: "/rules/history", Summary: "读取 history 记录规则",
+			Resp: &breakPointRule{}, handle: web.apiRule(MessageTypeChangeHistoryRules)},
+		{Method: http.MethodPut, Path: "/rules/history", Summary: "替换 history 记录规则",
+			Role: RoleTester,
+			Body: &breakPointRule{}, Resp: &breakPointRule{}, handle: web.apiRule(MessageTypeChangeHistoryRules)},
+		{Method: http.MethodPost, Path: "/repeater", Summary: "重放请求, async 为 true 时作为后台任务执行并返回任务", Role: RoleTester,
+			Query: []apiParam{
+				{Name: "async", Type: "boolean", Desc: "true 时立即返回任务, 结果通过 /jobs/{id} 读取"},
+				{Name: "timeout", Type: "integer", Desc: "超时毫秒, 默认 60000"},
+				{Name: "chain", Type: "boolean", Desc: "true 时经过代理自身发送, 请求和响应经过改写规则 脚本并记录到 history"},
+			},
+			Body: proxy.RequestEditData{}, Resp: Flow{}, handle: web.apiRepeater},
+		{Method: http.MethodPost, Path: "/repeater/raw", Summary: "原样发送请求字节, 不做任何规范化, 返回原始响应", Role: RoleTester,
+			Query: []apiParam{{Name: "timeout", Type: "integer", Desc: "超时毫秒, 默认 60000"}},
+			Body:  RawRequest{}, Resp: RawResult{}, handle: web.apiRepeaterRaw},
+		{Method: http.MethodGet, Path: "/repeater/tabs", Summary: "按创建时间倒序列出 repeater 标签",
+			Resp: []RepeaterTab{}, handle: web.apiRepeaterTabs},
+		{Method: http.MethodPost, Path: "/repeater/tabs", Summary: "创建 repeater 标签, flow_id 不为空时从 history 复制请求", Role: RoleTester,
+			Body: RepeaterTabForm{}, Resp: RepeaterTab{}, handle: web.apiRepeaterCreate},
+		{Method: http.MethodGet, Path: "/repeater/tabs/{id}", Summary: "repeater 标签及按顺序排列的发送记录",
+			Query: []apiParam{limit, offset, {Name: "flow", Type: "boolean", Desc: "true 时返回请求和响应"}},
+			Resp:  RepeaterDetail{}, handle: web.apiRepeaterTab},
+		{Method: http.MethodPut, Path: "/repeater/tabs/{id}", Summary: "修改 repeater 标签的名称或请求", Role: RoleTester,
+			Body: RepeaterTabForm{}, Resp: RepeaterTab{}, handle: web.apiRepeaterUpdate},
+		{Method: http.MethodDelete, Path: "/repeater/tabs/{id}", Summary: "删除 repeater 标签及发送记录", Role: RoleTester,
+			Resp: map[string]bool{}, handle: web.apiRepeaterDelete},
+		{Method: http.MethodPost, Path: "/repeater/tabs/{id}/send", Summary: "发送标签的请求并记录, body 为空时使用标签的请求, 原始请求标签的 body 为 RawRequest", Role: RoleTester,
+			Query: []apiParam{
+				{Name: "async", Type: "boolean", Desc: "true 时作为后台任务执行并返回任务"},
+				{Name: "timeout", Type: "integer", Desc: "超时毫秒, 默认 60000"},
+				{Name: "chain", Type: "boolean", Desc: "true 时经过代理自身发送, 请求和响应经过改写规则 脚本并记录到 history"},
+			},
+			Body: proxy.RequestEditData{}, Resp: RepeaterEntry{}, handle: web.apiRepeaterSend},
+		{Method: http.MethodGet, Path: "/repeater/diff", Summary: "比较两个响应的状态码 header 和 body, json body 按字段比较",
+			Query: []apiParam{
+				{Name: "a", Type: "string", Desc: "flow:{flow_id} tab:{id}:{seq} 或 intruder:{job}:{index}"},
+				{Name: "b", Type: "string", Desc: "格式同 a"},
+			},
+			Resp: FlowDiff{}, handle: web.apiRepeaterDiff},
+		{Method: http.MethodGet, Path: "/jobs", Summary: "按创建时间倒序列出后台任务, admin 列出所有用户的任务",
+			Resp: []JobInfo{}, handle: web.apiJobs},
+		{Method: http.MethodGet, Path: "/jobs/{id}", Summary: "后台任务状态, repeat 任务包含结果, 扫描任务包含报告",
+			Resp: JobDetail{}, handle: web.apiJob},
+		{Method: http.MethodPost, Path: "/jobs/{id}/{action}", Summary: "stop pause resume 后台任务, repeat 不能暂停", Role: RoleTester,
+			Resp: JobInfo{}, handle: web.apiJobControl},
+		{Method: http.MethodPost, Path: "/intruder", Summary: "启动 intruder 任务, 结果通过 websocket 推送", Role: RoleTester,
+			Body: IntruderAttack{}, Resp: IntruderJob{}, handle: web.apiIntruderStart},
+		{Method: http.MethodGet, Path: "/intruder", Summary: "按创建时间倒序列出 intruder 任务",
+			Query: []apiParam{limit, offset},
+			Resp:  []IntruderJob{}, handle: web.apiIntruderJobs},
+		{Method: http.MethodGet, Path: "/intruder/{id}", Summary: "intruder 任务及按序号排列的结果",
+			Query: []apiParam{limit, offset, {Name: "flow", Type: "boolean", Desc: "true 时返回请求和响应"},
+				{Name: "analysis", Type: "boolean", Desc: "true 时返回聚类和异常, 并在结果中标记异常原因"}},
+			Resp: IntruderDetail{}, handle: web.apiIntruderJob},
+		{Method: http.MethodGet, Path: "/intruder/{id}/diff/{index}", Summary: "intruder 结果与基准请求的响应差异",
+			Resp: FlowDiff{}, handle: web.apiIntruderDiff},
+		{Method: http.MethodDelete, Path: "/intruder/{id}", Summary: "停止 intruder 任务", Role: RoleTester,
+			Resp: map[string]bool{}, handle: web.apiIntruderStop},
+		{Method: http.MethodPost, Path: "/smuggle", Summary: "启动请求走私扫描, 报告通过 /jobs/{id} 读取", Role: RoleTester,
+			Body: SmuggleScan{}, Resp: JobInfo{}, handle: web.apiSmuggle},
+		{Method: http.MethodPost, Path: "/scan", Summary: "对 flow 或 host 启动主动扫描, 报告通过 /jobs/{id} 读取, 发现保存在 /findings", Role: RoleTester,
+			Body: ActiveScan{}, Resp: JobInfo{}, handle: web.apiScan},
+		{Method: http.MethodGet, Path: "/findings", Summary: "按最后出现时间倒序列出扫描发现",
+			Query: []apiParam{limit, offset,
+				{Name: "type", Type: "string", Desc: "发现类型, 如 insecure-cookie cors"},
+				{Name: "severity", Type: "string", Desc: "info low medium high"},
+				{Name: "host", Type: "string", Desc: "host:port"}},
+			Resp: []Finding{}, handle: web.apiFindings},
+		{Method: http.MethodGet, Path: "/findings/{id}", Summary: "读取扫描发现",
+			Resp: Finding{}, handle: web.apiFinding},
+		{Method: http.MethodDelete, Path: "/findings/{id}", Summary: "删除扫描发现", Role: RoleTester,
+			Resp: map[string]bool{}, handle: web.apiFindingDelete},
+		{Method: http.MethodGet, Path: "/certs", Summary: "ca 证书",
+			Resp: []apiCert{}, handle: web.apiCerts},
+		{Method: http.MethodGet, Path: "/scope", Summary: "项目 scope",
+			Resp: Scope{}, handle: web.apiScope},
+		{Method: http.MethodPut, Path: "/scope", Summary: "替换项目 scope", Role: RoleAdmin,
+			Body: Scope{}, Resp: Scope{}, handle: web.apiScope},
+		{Method: http.MethodGet, Path: "/config", Summary: "当前配置",
+			Resp: apiConfig{}, handle: web.apiConfig},
+		{Method: http.MethodGet, Path: "/audit", Summary: "审计日志, 新的在前", Role: RoleAdmin,
+			Query: []apiParam{{Name: "limit", Type: "integer", Desc: "条数, 默认 100"}},
+			Resp:  []AuditEntry{}, handle: web.apiAudit},
+		{Method: http.MethodGet, Path: "/openapi.json", Summary: "openapi 描述", Public: true,
+			Resp: map[string]interface{}{}, handle: web.apiOpenAPI},
+	}
+}
+
+type apiVarsKey struct{}
+
+// 路径参数
+func apiVar(r *http.Request, name string) string {
+	vars, _ := r.Context().Value(apiVarsKey{}).(map[string]string)
+	return vars[name]
+}
+
+func matchPath(pattern, path string) (map[string]string, bool) {
+	ps := strings.Split(strings.Trim(pattern, "/"), "/")
+	ss := strings.Split(strings.Trim(path, "/"), "/")
+	if len(ps) != len(ss) {
+		return nil, false
+	}
+
+	var vars map[string]string
+	for i, p := range ps {
+		if strings.HasPrefix(p, "{") && strings.HasSuffix(p, "}") {
+			if ss[i] == "" {
+				return nil, false
+			}
+			if vars == nil {
+				vars = make(map[string]string)
+			}
+			vars[p[1:len(p)-1]] = ss[i]
+			continue
+		}
+
+		if p != ss[i] {
+			return nil, false
+		}
+	}
+	return vars, true
+}
+
+func (api *apiRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if api.web.preflight(w, r) {
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, apiPrefix)
+	found := false
+	for i := range api.routes {
+		route := &api.routes[i]
+		vars, ok := matchPath(route.Path, path)
+		if !ok {
+			continue
+		}
+
+		found = true
+		if route.Method != r.Method {
+			continue
+		}
+
+		var c *concurrentConn
+		if !route.Public {
+			if c = api.web.session(r); c == nil {
+				apiError(w, http.StatusUnauthorized, "invalid token")
+				return
+			}
+
+			need := route.need()
+			allowed := c.userData.Role.Allow(need)
+			api.web.audit(c, r.Method+" "+r.URL.Path, r.URL.RawQuery, r.RemoteAddr, need, allowed)
+			if !allowed {
+				apiError(w, http.StatusForbidden, "role %s not allow, need %s", c.userData.Role, need)
+				return
+			}
+		}
+
+		if vars != nil {
+			r = r.WithContext(context.WithValue(r.Context(), apiVarsKey{}, vars))
+		}
+		route.handle(w, r, c)
+		return
+	}
+
+	if found {
+		apiError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	apiError(w, http.StatusNotFound, "%s not found", r.URL.Path)
+}
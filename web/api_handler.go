@@ -0,0 +1,623 @@
+package web
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/bytedance/sonic/decoder"
+	"github.com/vela-ssoc/vela-mitm/addon"
+	"github.com/vela-ssoc/vela-mitm/proxy"
+)
+
+const (
+	apiDefaultLimit = 50
+	apiMaxLimit     = 1000
+)
+
+type apiToken struct {
+	Name      string    `json:"name"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type apiFlowPage struct {
+	Items      []FlowSimple `json:"items"`
+	NextCursor string       `json:"next_cursor,omitempty"` // 为空表示没有更多数据
+}
+
+type apiCert struct {
+	Name      string    `json:"name"`
+	Subject   string    `json:"subject"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	SHA256    string    `json:"sha256"`
+	PEM       string    `json:"pem"`
+}
+
+type apiConfig struct {
+	Name      string              `json:"name"`
+	Origin    []string            `json:"origin"`
+	Users     []User              `json:"users"`
+	FullText  bool                `json:"fulltext"`
+	Retention Retention           `json:"retention"`
+	Rewrite   []addon.RewriteRule `json:"rewrite"`
+	Script    []ScriptRule        `json:"script"`
+	Scope     Scope               `json:"scope"`
+}
+
+// 每次登录签发新的 token, 同一用户的 api 请求共用一个会话
+func (web *WebAddon) apiLogin(w http.ResponseWriter, r *http.Request, _ *concurrentConn) {
+	var form loginForm
+	if err := decoder.NewStreamDecoder(r.Body).Decode(&form); err != nil {
+		apiError(w, http.StatusBadRequest, "decode fail %v", err)
+		return
+	}
+
+	u, err := web.login(r, &form)
+	if err != nil {
+		le := err.(*loginError)
+		le.header(w)
+		apiError(w, le.status, "%s", le.msg)
+		return
+	}
+
+	apiJSON(w, web.issueToken(u.Name, ""))
+}
+
+func (web *WebAddon) apiRefresh(w http.ResponseWriter, r *http.Request, _ *concurrentConn) {
+	tk, err := web.refresh(r)
+	if err != nil {
+		apiError(w, http.StatusUnauthorized, "%v", err)
+		return
+	}
+	apiJSON(w, tk)
+}
+
+func (web *WebAddon) apiLogout(w http.ResponseWriter, r *http.Request, _ *concurrentConn) {
+	if err := web.logout(r); err != nil {
+		apiError(w, http.StatusUnauthorized, "%v", err)
+		return
+	}
+	apiJSON(w, map[string]bool{"ok": true})
+}
+
+func (web *WebAddon) apiFlows(w http.ResponseWriter, r *http.Request, c *concurrentConn) {
+	query := r.URL.Query()
+
+	limit := apiDefaultLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			apiError(w, http.StatusBadRequest, "invalid limit %s", v)
+			return
+		}
+		if n > apiMaxLimit {
+			n = apiMaxLimit
+		}
+		limit = n
+	}
+
+	var cursor int
+	if v := query.Get("cursor"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			apiError(w, http.StatusBadRequest, "invalid cursor %s", v)
+			return
+		}
+		cursor = n
+	}
+
+	var fq *FlowQuery
+	if expr := query.Get("q"); expr != "" {
+		var err error
+		if fq, err = ParseQuery(expr); err != nil {
+			body := apiErrorBody{Error: APIError{Code: http.StatusBadRequest, Message: err.Error()}}
+			if qe, ok := err.(*QueryError); ok {
+				body.Error.Detail = qe
+			}
+			BadJSON(w, http.StatusBadRequest, body)
+			return
+		}
+	}
+
+	flows, next, err := c.db.Page(fq, cursor, limit)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, "query fail %v", err)
+		return
+	}
+
+	page := apiFlowPage{Items: flows}
+	if next > 0 {
+		page.NextCursor = strconv.Itoa(next)
+	}
+	apiJSON(w, page)
+}
+
+func (web *WebAddon) apiFlow(w http.ResponseWriter, r *http.Request, c *concurrentConn) {
+	flow, err := c.db.FindFlowId(apiVar(r, "id"))
+	if err != nil {
+		apiError(w, http.StatusNotFound, "flow %s not found", apiVar(r, "id"))
+		return
+	}
+
+	if r.URL.Query().Get("body") != "false" {
+		if err = c.db.LoadBody(flow); err != nil {
+			apiError(w, http.StatusInternalServerError, "load body fail %v", err)
+			return
+		}
+		flow.Uncompress()
+	}
+
+	apiJSON(w, flow)
+}
+
+// 规则与 websocket 下发的规则相同, 作用于当前用户的所有会话
+func (web *WebAddon) apiRule(mType messageType) func(w http.ResponseWriter, r *http.Request, c *concurrentConn) {
+	return func(w http.ResponseWriter, r *http.Request, c *concurrentConn) {
+		if r.Method == http.MethodPut {
+			rule := &breakPointRule{}
+			if err := json.NewDecoder(r.Body).Decode(rule); err != nil {
+				apiError(w, http.StatusBadRequest, "decode fail %v", err)
+				return
+			}
+
+			msg := &messageMeta{mType: mType, rule: rule}
+			msg.parseRule()
+			c.SetRule(msg)
+		}
+
+		rule, history := c.user.rules()
+		if mType == MessageTypeChangeHistoryRules {
+			rule = history
+		}
+
+		if rule == nil {
+			rule = &breakPointRule{}
+		}
+		apiJSON(w, rule)
+	}
+}
+
+func (web *WebAddon) apiRepeater(w http.ResponseWriter, r *http.Request, c *concurrentConn) {
+	var fr proxy.RequestEditData
+	if err := decoder.NewStreamDecoder(r.Body).Decode(&fr); err != nil {
+		apiError(w, http.StatusBadRequest, "decode fail %v", err)
+		return
+	}
+
+	if r.URL.Query().Get("async") == "true" {
+		apiJSON(w, web.submitRepeat(c, &fr, repeatOptions(r)))
+		return
+	}
+
+	flow, err := web.doRequest(r.Context(), &fr, repeatOptions(r))
+	if err != nil {
+		apiError(w, http.StatusBadGateway, "%v", err)
+		return
+	}
+
+	apiJSON(w, flow)
+}
+
+func (web *WebAddon) apiRepeaterRaw(w http.ResponseWriter, r *http.Request, c *concurrentConn) {
+	var rr RawRequest
+	if err := decoder.NewStreamDecoder(r.Body).Decode(&rr); err != nil {
+		apiError(w, http.StatusBadRequest, "decode fail %v", err)
+		return
+	}
+
+	res, err := web.sendRaw(r.Context(), &rr, repeatOptions(r).Timeout)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	apiJSON(w, res)
+}
+
+func (web *WebAddon) apiCerts(w http.ResponseWriter, r *http.Request, _ *concurrentConn) {
+	chunk, err := os.ReadFile(filepath.Join(web.certDir(), "mitmproxy-ca-cert.pem"))
+	if err != nil {
+		apiError(w, http.StatusNotFound, "ca cert not found")
+		return
+	}
+
+	block, _ := pem.Decode(chunk)
+	if block == nil {
+		apiError(w, http.StatusInternalServerError, "invalid ca cert")
+		return
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, "parse ca cert fail %v", err)
+		return
+	}
+
+	sum := sha256.Sum256(cert.Raw)
+	apiJSON(w, []apiCert{{
+		Name:      "ca",
+		Subject:   cert.Subject.String(),
+		NotBefore: cert.NotBefore,
+		NotAfter:  cert.NotAfter,
+		SHA256:    hex.EncodeToString(sum[:]),
+		PEM:       string(chunk),
+	}})
+}
+
+func (web *WebAddon) apiConfig(w http.ResponseWriter, r *http.Request, _ *concurrentConn) {
+	cfg := apiConfig{
+		Name:      web.config.Name,
+		Origin:    web.config.Origin,
+		Users:     web.accounts(),
+		FullText:  web.config.FullText,
+		Retention: web.config.Retention,
+		Rewrite:   []addon.RewriteRule{},
+		Script:    []ScriptRule{},
+		Scope:     web.config.Scope.Get(),
+	}
+
+	if web.config.Rewrite != nil {
+		cfg.Rewrite = web.config.Rewrite.Rules()
+	}
+
+	if web.config.Script != nil {
+		cfg.Script = web.config.Script.Scripts()
+	}
+
+	apiJSON(w, cfg)
+}
+
+func (web *WebAddon) apiAudit(w http.ResponseWriter, r *http.Request, _ *concurrentConn) {
+	limit := auditDefaultLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			apiError(w, http.StatusBadRequest, "invalid limit %s", v)
+			return
+		}
+		limit = n
+	}
+
+	entries, err := web.auditLog.tail(limit)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, "read audit fail %v", err)
+		return
+	}
+	apiJSON(w, entries)
+}
+
+// limit offset 参数, 出错时已写入响应
+func apiLimitOffset(w http.ResponseWriter, r *http.Request) (limit, offset int, ok bool) {
+	query := r.URL.Query()
+
+	limit = apiDefaultLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			apiError(w, http.StatusBadRequest, "invalid limit %s", v)
+			return 0, 0, false
+		}
+		if n > apiMaxLimit {
+			n = apiMaxLimit
+		}
+		limit = n
+	}
+
+	if v := query.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			apiError(w, http.StatusBadRequest, "invalid offset %s", v)
+			return 0, 0, false
+		}
+		offset = n
+	}
+	return limit, offset, true
+}
+
+func (web *WebAddon) apiIntruderStart(w http.ResponseWriter, r *http.Request, c *concurrentConn) {
+	var atk IntruderAttack
+	if err := decoder.NewStreamDecoder(r.Body).Decode(&atk); err != nil {
+		apiError(w, http.StatusBadRequest, "decode fail %v", err)
+		return
+	}
+
+	job, err := web.startIntruder(c, &atk)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	apiJSON(w, job)
+}
+
+func (web *WebAddon) apiSmuggle(w http.ResponseWriter, r *http.Request, c *concurrentConn) {
+	var scan SmuggleScan
+	if err := decoder.NewStreamDecoder(r.Body).Decode(&scan); err != nil {
+		apiError(w, http.StatusBadRequest, "decode fail %v", err)
+		return
+	}
+
+	info, err := web.startSmuggle(c, &scan)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	apiJSON(w, info)
+}
+
+func (web *WebAddon) apiScan(w http.ResponseWriter, r *http.Request, c *concurrentConn) {
+	var scan ActiveScan
+	if err := decoder.NewStreamDecoder(r.Body).Decode(&scan); err != nil {
+		apiError(w, http.StatusBadRequest, "decode fail %v", err)
+		return
+	}
+
+	info, err := web.startActiveScan(c, &scan)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	apiJSON(w, info)
+}
+
+func (web *WebAddon) apiIntruderJobs(w http.ResponseWriter, r *http.Request, c *concurrentConn) {
+	limit, offset, ok := apiLimitOffset(w, r)
+	if !ok {
+		return
+	}
+
+	jobs, err := c.db.IntruderJobs(offset, limit)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, "query fail %v", err)
+		return
+	}
+	apiJSON(w, jobs)
+}
+
+func (web *WebAddon) apiIntruderJob(w http.ResponseWriter, r *http.Request, c *concurrentConn) {
+	limit, offset, ok := apiLimitOffset(w, r)
+	if !ok {
+		return
+	}
+
+	id := apiVar(r, "id")
+	job, err := c.db.IntruderJob(id)
+	if err != nil {
+		apiError(w, http.StatusNotFound, "job %s not found", id)
+		return
+	}
+
+	query := r.URL.Query()
+	results, err := c.db.IntruderResults(id, offset, limit, query.Get("flow") == "true")
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, "query fail %v", err)
+		return
+	}
+
+	detail := IntruderDetail{IntruderJob: *job, Results: results}
+	if query.Get("analysis") == "true" {
+		if detail.Analysis, err = c.db.IntruderAnalysis(job); err != nil {
+			apiError(w, http.StatusInternalServerError, "analysis fail %v", err)
+			return
+		}
+		detail.Analysis.mark(results)
+	}
+	apiJSON(w, detail)
+}
+
+func (web *WebAddon) apiIntruderDiff(w http.ResponseWriter, r *http.Request, c *concurrentConn) {
+	index, err := strconv.Atoi(apiVar(r, "index"))
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "invalid index %s", apiVar(r, "index"))
+		return
+	}
+
+	diff, err := c.db.IntruderDiff(apiVar(r, "id"), index)
+	if err != nil {
+		apiError(w, http.StatusNotFound, "%v", err)
+		return
+	}
+	apiJSON(w, diff)
+}
+
+func (web *WebAddon) apiIntruderStop(w http.ResponseWriter, r *http.Request, c *concurrentConn) {
+	if err := web.stopJob(c, apiVar(r, "id")); err != nil {
+		apiError(w, http.StatusNotFound, "%s: %v", apiVar(r, "id"), err)
+		return
+	}
+	apiJSON(w, map[string]bool{"ok": true})
+}
+
+func (web *WebAddon) apiJobs(w http.ResponseWriter, r *http.Request, c *concurrentConn) {
+	apiJSON(w, web.listJobs(c))
+}
+
+func (web *WebAddon) apiJob(w http.ResponseWriter, r *http.Request, c *concurrentConn) {
+	j, err := web.job(c, apiVar(r, "id"))
+	if err != nil {
+		apiError(w, http.StatusNotFound, "%s: %v", apiVar(r, "id"), err)
+		return
+	}
+	apiJSON(w, j.snapshot())
+}
+
+func (web *WebAddon) apiJobControl(w http.ResponseWriter, r *http.Request, c *concurrentConn) {
+	id := apiVar(r, "id")
+	if err := web.controlJob(c, id, apiVar(r, "action")); err != nil {
+		code := http.StatusConflict
+		if err == JobNotFoundE {
+			code = http.StatusNotFound
+		}
+		apiError(w, code, "%s: %v", id, err)
+		return
+	}
+
+	j, _ := web.job(c, id)
+	apiJSON(w, j.snapshot().JobInfo)
+}
+
+func (web *WebAddon) apiRepeaterTabs(w http.ResponseWriter, r *http.Request, c *concurrentConn) {
+	tabs, err := c.db.RepeaterTabs()
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, "query fail %v", err)
+		return
+	}
+	apiJSON(w, tabs)
+}
+
+func (web *WebAddon) apiRepeaterCreate(w http.ResponseWriter, r *http.Request, c *concurrentConn) {
+	var form RepeaterTabForm
+	if err := decoder.NewStreamDecoder(r.Body).Decode(&form); err != nil {
+		apiError(w, http.StatusBadRequest, "decode fail %v", err)
+		return
+	}
+
+	tab, err := createRepeaterTab(c.db, &form)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	apiJSON(w, tab)
+}
+
+func (web *WebAddon) apiRepeaterTab(w http.ResponseWriter, r *http.Request, c *concurrentConn) {
+	limit, offset, ok := apiLimitOffset(w, r)
+	if !ok {
+		return
+	}
+
+	id := apiVar(r, "id")
+	tab, err := c.db.RepeaterTab(id)
+	if err != nil {
+		apiError(w, http.StatusNotFound, "tab %s not found", id)
+		return
+	}
+
+	entries, err := c.db.RepeaterEntries(id, offset, limit, r.URL.Query().Get("flow") == "true")
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, "query fail %v", err)
+		return
+	}
+	apiJSON(w, RepeaterDetail{RepeaterTab: *tab, Entries: entries})
+}
+
+func (web *WebAddon) apiRepeaterUpdate(w http.ResponseWriter, r *http.Request, c *concurrentConn) {
+	var form RepeaterTabForm
+	if err := decoder.NewStreamDecoder(r.Body).Decode(&form); err != nil {
+		apiError(w, http.StatusBadRequest, "decode fail %v", err)
+		return
+	}
+
+	tab, err := updateRepeaterTab(c.db, apiVar(r, "id"), &form)
+	if err != nil {
+		apiError(w, http.StatusNotFound, "%v", err)
+		return
+	}
+	apiJSON(w, tab)
+}
+
+func (web *WebAddon) apiRepeaterDelete(w http.ResponseWriter, r *http.Request, c *concurrentConn) {
+	if err := c.db.DeleteRepeaterTab(apiVar(r, "id")); err != nil {
+		apiError(w, http.StatusNotFound, "tab %s not found", apiVar(r, "id"))
+		return
+	}
+	apiJSON(w, map[string]bool{"ok": true})
+}
+
+func (web *WebAddon) apiRepeaterSend(w http.ResponseWriter, r *http.Request, c *concurrentConn) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "read body fail %v", err)
+		return
+	}
+
+	id := apiVar(r, "id")
+	if r.URL.Query().Get("async") == "true" {
+		apiJSON(w, web.submitRepeaterSend(c, id, body, repeatOptions(r)))
+		return
+	}
+
+	entry, err := web.sendRepeaterBody(r.Context(), c.db, id, body, repeatOptions(r))
+	if err != nil {
+		apiError(w, http.StatusNotFound, "%v", err)
+		return
+	}
+	apiJSON(w, entry)
+}
+
+func (web *WebAddon) apiRepeaterDiff(w http.ResponseWriter, r *http.Request, c *concurrentConn) {
+	query := r.URL.Query()
+	diff, err := diffResponses(c.db, query.Get("a"), query.Get("b"))
+	if err != nil {
+		apiError(w, http.StatusNotFound, "%v", err)
+		return
+	}
+	apiJSON(w, diff)
+}
+
+func (web *WebAddon) apiFindings(w http.ResponseWriter, r *http.Request, c *concurrentConn) {
+	limit, offset, ok := apiLimitOffset(w, r)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	filter := FindingFilter{Type: query.Get("type"), Severity: query.Get("severity"), Host: query.Get("host")}
+	findings, err := c.db.Findings(filter, offset, limit)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, "query fail %v", err)
+		return
+	}
+	apiJSON(w, findings)
+}
+
+func (web *WebAddon) apiFinding(w http.ResponseWriter, r *http.Request, c *concurrentConn) {
+	fd, err := c.db.Finding(apiVar(r, "id"))
+	if err != nil {
+		apiError(w, http.StatusNotFound, "finding %s not found", apiVar(r, "id"))
+		return
+	}
+	apiJSON(w, fd)
+}
+
+func (web *WebAddon) apiFindingDelete(w http.ResponseWriter, r *http.Request, c *concurrentConn) {
+	id := apiVar(r, "id")
+	if _, err := c.db.Finding(id); err != nil {
+		apiError(w, http.StatusNotFound, "finding %s not found", id)
+		return
+	}
+	if err := c.db.DeleteFindings(id); err != nil {
+		apiError(w, http.StatusInternalServerError, "delete fail %v", err)
+		return
+	}
+	apiJSON(w, map[string]bool{"ok": true})
+}
+
+// GET 读取, PUT 整体替换
+func (web *WebAddon) apiScope(w http.ResponseWriter, r *http.Request, c *concurrentConn) {
+	if web.config.Scope == nil {
+		apiError(w, http.StatusNotFound, "scope not enable")
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		var scope Scope
+		if err := decoder.NewStreamDecoder(r.Body).Decode(&scope); err != nil {
+			apiError(w, http.StatusBadRequest, "decode fail %v", err)
+			return
+		}
+		if code, err := web.updateScope(scope); err != nil {
+			apiError(w, code, "%v", err)
+			return
+		}
+	}
+	apiJSON(w, web.config.Scope.Get())
+}
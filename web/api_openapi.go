@@ -0,0 +1,191 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// 根据路由表和 go 类型生成 openapi 3 描述, 字段名取 json tag
+
+type openapiSchema map[string]interface{}
+
+type schemaGen struct {
+	defs map[string]openapiSchema
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// apiCert => Cert, breakPointRule => BreakPointRule
+func schemaName(t reflect.Type) string {
+	name := []rune(strings.TrimPrefix(t.Name(), "api"))
+	name[0] = unicode.ToUpper(name[0])
+	return string(name)
+}
+
+func (g *schemaGen) schema(t reflect.Type) openapiSchema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if t == timeType {
+		return openapiSchema{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return openapiSchema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return openapiSchema{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return openapiSchema{"type": "number"}
+	case reflect.String:
+		return openapiSchema{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return openapiSchema{"type": "string", "format": "byte"}
+		}
+		return openapiSchema{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return openapiSchema{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.object(t)
+		}
+
+		name := schemaName(t)
+		if _, ok := g.defs[name]; !ok {
+			// 先占位, 防止类型自引用时死循环
+			g.defs[name] = openapiSchema{}
+			g.defs[name] = g.object(t)
+		}
+		return openapiSchema{"$ref": "#/components/schemas/" + name}
+	}
+
+	return openapiSchema{}
+}
+
+func (g *schemaGen) object(t reflect.Type) openapiSchema {
+	props := openapiSchema{}
+	g.fields(t, props)
+	return openapiSchema{"type": "object", "properties": props}
+}
+
+func (g *schemaGen) fields(t reflect.Type, props openapiSchema) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+
+		name := strings.Split(tag, ",")[0]
+		ft := field.Type
+		for ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+
+		// 匿名嵌入的结构体字段展开
+		if field.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+			g.fields(ft, props)
+			continue
+		}
+
+		if !field.IsExported() {
+			continue
+		}
+
+		if name == "" {
+			name = field.Name
+		}
+		props[name] = g.schema(field.Type)
+	}
+}
+
+func jsonContent(s openapiSchema) openapiSchema {
+	return openapiSchema{"application/json": openapiSchema{"schema": s}}
+}
+
+func (api *apiRouter) openapi() openapiSchema {
+	g := &schemaGen{defs: make(map[string]openapiSchema)}
+	errResp := openapiSchema{"description": "错误", "content": jsonContent(g.schema(reflect.TypeOf(apiErrorBody{})))}
+
+	paths := openapiSchema{}
+	for _, route := range api.routes {
+		params := make([]openapiSchema, 0)
+		for _, seg := range strings.Split(route.Path, "/") {
+			if strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}") {
+				params = append(params, openapiSchema{
+					"name": seg[1 : len(seg)-1], "in": "path", "required": true,
+					"schema": openapiSchema{"type": "string"},
+				})
+			}
+		}
+
+		for _, p := range route.Query {
+			params = append(params, openapiSchema{
+				"name": p.Name, "in": "query", "description": p.Desc,
+				"schema": openapiSchema{"type": p.Type},
+			})
+		}
+
+		op := openapiSchema{
+			"summary":    route.Summary,
+			"parameters": params,
+			"responses": openapiSchema{
+				"200":     openapiSchema{"description": "成功", "content": jsonContent(g.schema(reflect.TypeOf(route.Resp)))},
+				"default": errResp,
+			},
+		}
+
+		if route.Body != nil {
+			op["requestBody"] = openapiSchema{"required": true, "content": jsonContent(g.schema(reflect.TypeOf(route.Body)))}
+		}
+
+		if route.Public {
+			op["security"] = []openapiSchema{}
+		} else {
+			op["x-role"] = route.need().String()
+		}
+
+		item, ok := paths[route.Path].(openapiSchema)
+		if !ok {
+			item = openapiSchema{}
+			paths[route.Path] = item
+		}
+		item[strings.ToLower(route.Method)] = op
+	}
+
+	return openapiSchema{
+		"openapi": "3.0.3",
+		"info": openapiSchema{
+			"title":   "vela-mitm",
+			"version": "v1",
+		},
+		"servers": []openapiSchema{{"url": apiPrefix}},
+		"paths":   paths,
+		"components": openapiSchema{
+			"schemas": g.defs,
+			"securitySchemes": openapiSchema{
+				"token": openapiSchema{"type": "apiKey", "in": "header", "name": "Authorization"},
+			},
+		},
+		"security": []openapiSchema{{"token": []string{}}},
+	}
+}
+
+func (web *WebAddon) apiOpenAPI(w http.ResponseWriter, r *http.Request, _ *concurrentConn) {
+	api := &apiRouter{web: web, routes: web.apiRoutes()}
+
+	// encoding/json 按 key 排序, 输出稳定
+	chunk, err := json.MarshalIndent(api.openapi(), "", "  ")
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, "marshal fail %v", err)
+		return
+	}
+	JSON(w, chunk)
+}
@@ -0,0 +1,59 @@
+package web
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestMatchPath(t *testing.T) {
+	cases := []struct {
+		pattern, path string
+		ok            bool
+		id            string
+	}{
+		{"/flows", "/flows", true, ""},
+		{"/flows", "/flows/", true, ""},
+		{"/flows/{id}", "/flows/abc", true, "abc"},
+		{"/flows/{id}", "/flows", false, ""},
+		{"/flows/{id}", "/flows/abc/body", false, ""},
+		{"/rules/history", "/rules/breakpoint", false, ""},
+	}
+
+	for _, c := range cases {
+		vars, ok := matchPath(c.pattern, c.path)
+		if ok != c.ok || vars["id"] != c.id {
+			t.Errorf("match %s %s = %v %v", c.pattern, c.path, vars, ok)
+		}
+	}
+}
+
+func TestOpenAPIRefs(t *testing.T) {
+	web := &WebAddon{}
+	api := &apiRouter{web: web, routes: web.apiRoutes()}
+	chunk, err := json.Marshal(api.openapi())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var spec struct {
+		Paths      map[string]map[string]json.RawMessage `json:"paths"`
+		Components struct {
+			Schemas map[string]json.RawMessage `json:"schemas"`
+		} `json:"components"`
+	}
+	if err = json.Unmarshal(chunk, &spec); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := spec.Paths["/flows/{id}"]["get"]; !ok {
+		t.Errorf("missing GET /flows/{id}")
+	}
+
+	for _, part := range strings.Split(string(chunk), `"$ref":"#/components/schemas/`)[1:] {
+		name := part[:strings.Index(part, `"`)]
+		if _, ok := spec.Components.Schemas[name]; !ok {
+			t.Errorf("unresolved schema %s", name)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package web
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bytedance/sonic"
+	log "github.com/sirupsen/logrus"
+)
+
+// 审计日志, 记录需要 tester 以上权限的操作和被拒绝的请求, 每行一个 json
+type AuditEntry struct {
+	Time    time.Time `json:"time"`
+	User    string    `json:"user"`
+	Role    string    `json:"role"`
+	Action  string    `json:"action"`           // 如 POST history/clear, ws change_request
+	Target  string    `json:"target,omitempty"` // flow id 或查询参数
+	Remote  string    `json:"remote,omitempty"`
+	Allowed bool      `json:"allowed"`
+}
+
+const auditDefaultLimit = 100
+
+// 读取时最多从文件末尾读取的字节数
+const auditTailSize = 4 << 20
+
+type auditLog struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+func newAuditLog(path string) *auditLog {
+	return &auditLog{path: path}
+}
+
+func (a *auditLog) write(e AuditEntry) {
+	if a == nil {
+		return
+	}
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	chunk, err := json.Marshal(e)
+	if err != nil {
+		log.Errorf("audit marshal fail %v", err)
+		return
+	}
+	chunk = append(chunk, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.file == nil {
+		a.file, err = os.OpenFile(a.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			log.Errorf("audit open %s fail %v", a.path, err)
+			return
+		}
+	}
+
+	if _, err = a.file.Write(chunk); err != nil {
+		log.Errorf("audit write fail %v", err)
+	}
+}
+
+// 最近的 limit 条记录, 新的在前
+func (a *auditLog) tail(limit int) ([]AuditEntry, error) {
+	entries := make([]AuditEntry, 0)
+	if a == nil {
+		return entries, nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	f, err := os.Open(a.path)
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	offset := stat.Size() - auditTailSize
+	if offset < 0 {
+		offset = 0
+	}
+
+	chunk, err := io.ReadAll(io.NewSectionReader(f, offset, stat.Size()-offset))
+	if err != nil {
+		return nil, err
+	}
+
+	// 从中间截断时丢弃第一行不完整的记录
+	if offset > 0 {
+		if i := bytes.IndexByte(chunk, '\n'); i >= 0 {
+			chunk = chunk[i+1:]
+		}
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(chunk))
+	scanner.Buffer(make([]byte, 0, 64*1024), auditTailSize)
+	for scanner.Scan() {
+		var e AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		entries = append(entries, e)
+	}
+
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+
+	if limit > 0 && len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries, nil
+}
+
+// 只记录特权操作, viewer 级别的请求被拒绝时也会记录
+func (web *WebAddon) audit(c *concurrentConn, action, target, remote string, need Role, allowed bool) {
+	if allowed && need <= RoleViewer {
+		return
+	}
+
+	web.auditLog.write(AuditEntry{
+		User:    c.userData.Name,
+		Role:    c.userData.Role.String(),
+		Action:  action,
+		Target:  target,
+		Remote:  remote,
+		Allowed: allowed,
+	})
+}
+
+// ?limit=100
+func (web *WebAddon) MitmAudit(w http.ResponseWriter, r *http.Request, _ *FlowDB) {
+	limit := auditDefaultLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			Bad(w, http.StatusBadRequest, "invalid limit %s", v)
+			return
+		}
+		limit = n
+	}
+
+	entries, err := web.auditLog.tail(limit)
+	if err != nil {
+		Bad(w, http.StatusInternalServerError, "read audit fail %v", err)
+		return
+	}
+
+	chunk, _ := sonic.Marshal(entries)
+	JSON(w, chunk)
+}
@@ -0,0 +1,44 @@
+package web
+
+import (
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func TestRolePerm(t *testing.T) {
+	cases := []struct {
+		role   Role
+		p      perm
+		method string
+		want   bool
+	}{
+		{ParseRole(""), permView, http.MethodGet, true},
+		{ParseRole("viewer"), permTest, http.MethodPost, false},
+		{ParseRole("Tester"), permTest, http.MethodPost, true},
+		{ParseRole("tester"), permConfig, http.MethodGet, true},
+		{ParseRole("tester"), permConfig, http.MethodPost, false},
+		{ParseRole("admin"), permAdmin, http.MethodPost, true},
+	}
+
+	for i, c := range cases {
+		if got := c.role.Allow(c.p.need(c.method)); got != c.want {
+			t.Errorf("case %d: %s %s got %v", i, c.role, c.method, got)
+		}
+	}
+}
+
+func TestAuditTail(t *testing.T) {
+	a := newAuditLog(filepath.Join(t.TempDir(), "audit.log"))
+	for _, action := range []string{"a", "b", "c"} {
+		a.write(AuditEntry{User: "u", Action: action, Allowed: true})
+	}
+
+	entries, err := a.tail(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Action != "c" || entries[1].Action != "b" {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+}
@@ -0,0 +1,345 @@
+package web
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bytedance/sonic"
+	"github.com/bytedance/sonic/decoder"
+)
+
+const (
+	loginDefaultMaxFail = 5
+	loginDefaultLockout = 15 * time.Minute
+)
+
+// 登录失败计数, 同一 ip 或同一用户在 window 内失败 max 次后锁定 lockout
+type loginLimiter struct {
+	max     int
+	window  time.Duration
+	lockout time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*loginAttempt
+}
+
+type loginAttempt struct {
+	fails int
+	first time.Time
+	until time.Time
+}
+
+func newLoginLimiter(max int, lockout time.Duration) *loginLimiter {
+	if max <= 0 {
+		max = loginDefaultMaxFail
+	}
+	if lockout <= 0 {
+		lockout = loginDefaultLockout
+	}
+	return &loginLimiter{max: max, window: lockout, lockout: lockout, entries: make(map[string]*loginAttempt)}
+}
+
+// 返回剩余的锁定时间, 0 表示未锁定
+func (l *loginLimiter) locked(now time.Time, keys ...string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var remain time.Duration
+	for _, key := range keys {
+		if a, ok := l.entries[key]; ok && a.until.After(now) && a.until.Sub(now) > remain {
+			remain = a.until.Sub(now)
+		}
+	}
+	return remain
+}
+
+func (l *loginLimiter) fail(now time.Time, keys ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key, a := range l.entries {
+		if now.Sub(a.first) > l.window && !a.until.After(now) {
+			delete(l.entries, key)
+		}
+	}
+
+	for _, key := range keys {
+		a, ok := l.entries[key]
+		if !ok {
+			a = &loginAttempt{first: now}
+			l.entries[key] = a
+		}
+
+		a.fails++
+		if a.fails >= l.max {
+			a.until = now.Add(l.lockout)
+			a.fails = 0
+			a.first = now
+		}
+	}
+}
+
+func (l *loginLimiter) reset(keys ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, key := range keys {
+		delete(l.entries, key)
+	}
+}
+
+type loginError struct {
+	status int
+	retry  time.Duration
+	msg    string
+}
+
+func (e *loginError) Error() string {
+	return e.msg
+}
+
+func (e *loginError) header(w http.ResponseWriter) {
+	if e.retry > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(e.retry/time.Second)+1))
+	}
+}
+
+type loginForm struct {
+	Name string `json:"name"`
+	Pass string `json:"pass"`
+	Code string `json:"code,omitempty"` // 配置了 totp 的用户需要
+}
+
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (web *WebAddon) account(name string) (*User, bool) {
+	for _, u := range web.accounts() {
+		if u.Name == name {
+			return &u, true
+		}
+	}
+	return nil, false
+}
+
+// 校验密码和 totp, 失败计入限流并写审计日志
+func (web *WebAddon) login(r *http.Request, form *loginForm) (*User, error) {
+	name := form.Name
+	if name == "" {
+		name = web.config.Name
+	}
+
+	now := time.Now()
+	keys := []string{"ip:" + remoteHost(r), "user:" + name}
+	entry := AuditEntry{User: name, Action: "login", Remote: r.RemoteAddr}
+
+	if remain := web.limiter.locked(now, keys...); remain > 0 {
+		web.auditLog.write(entry)
+		return nil, &loginError{status: http.StatusTooManyRequests, retry: remain, msg: "too many failed logins, try later"}
+	}
+
+	u, ok := web.authenticate(name, form.Pass)
+	if ok && u.TOTP != "" {
+		var step int64
+		step, ok = verifyTOTP(u.TOTP, form.Code, now)
+		ok = ok && web.userState(u.Name).useTOTP(step)
+	}
+
+	if !ok {
+		web.limiter.fail(now, keys...)
+		web.auditLog.write(entry)
+		return nil, &loginError{status: http.StatusUnauthorized, msg: "invalid name, pass or code"}
+	}
+
+	// 只清除该用户的计数; ip 的计数不清除, 等 lockout 时间后过期,
+	// 否则持有一个账户的人可以在每次猜测其他账户后登录自己的账户清零 ip 的计数
+	web.limiter.reset(keys[1])
+	entry.Role, entry.Allowed = ParseRole(u.Role).String(), true
+	web.auditLog.write(entry)
+	return u, nil
+}
+
+func bearer(r *http.Request) string {
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+// Authorization: {token} 或 Bearer {token}
+func (web *WebAddon) session(r *http.Request) *concurrentConn {
+	claims, err := web.tokens.verify(bearer(r))
+	if err != nil {
+		return nil
+	}
+	return web.sessionOf(claims)
+}
+
+// 优先使用同一次登录的 websocket 会话, 否则使用该用户的 api 会话
+func (web *WebAddon) sessionOf(claims *tokenClaims) *concurrentConn {
+	web.connsMu.RLock()
+	for _, c := range web.conns {
+		if !c.headless() && c.userData.SID == claims.SID {
+			web.connsMu.RUnlock()
+			return c
+		}
+	}
+	web.connsMu.RUnlock()
+
+	u, ok := web.account(claims.User)
+	if !ok {
+		return nil
+	}
+	return web.headlessConn(u)
+}
+
+// 同一用户的 api 会话只有一个
+func (web *WebAddon) headlessConn(u *User) *concurrentConn {
+	web.headlessMu.Lock()
+	defer web.headlessMu.Unlock()
+
+	web.connsMu.RLock()
+	for _, c := range web.conns {
+		if c.headless() && c.userData.Name == u.Name {
+			web.connsMu.RUnlock()
+			return c
+		}
+	}
+	web.connsMu.RUnlock()
+
+	c := newConn(nil, newUserData(u))
+	web.addConn(c)
+	return c
+}
+
+func (web *WebAddon) issueToken(name, sid string) *apiToken {
+	token, claims := web.tokens.issue(name, sid)
+	return &apiToken{Name: name, Token: token, ExpiresAt: claims.ExpireAt()}
+}
+
+// 旧 token 作废, 签发同一 sid 的新 token
+func (web *WebAddon) refresh(r *http.Request) (*apiToken, error) {
+	claims, err := web.tokens.verify(bearer(r))
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := web.account(claims.User); !ok {
+		return nil, TokenInvalidE
+	}
+
+	web.tokens.revoke(claims)
+	return web.issueToken(claims.User, claims.SID), nil
+}
+
+// token 作废并断开同一次登录的 websocket 会话
+func (web *WebAddon) logout(r *http.Request) error {
+	claims, err := web.tokens.verify(bearer(r))
+	if err != nil {
+		return err
+	}
+	web.tokens.revoke(claims)
+
+	var closing []*concurrentConn
+	web.connsMu.RLock()
+	for _, c := range web.conns {
+		if !c.headless() && c.userData.SID == claims.SID {
+			closing = append(closing, c)
+		}
+	}
+	web.connsMu.RUnlock()
+
+	for _, c := range closing {
+		c.conn.Close()
+	}
+	return nil
+}
+
+// 没有 Origin 的非浏览器客户端和同源请求放行, 其他来源需要在 Config.Origin 中
+func (web *WebAddon) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	return web.HaveOrigin(origin)
+}
+
+func writeToken(w http.ResponseWriter, tk *apiToken) {
+	chunk, _ := sonic.Marshal(tk)
+	JSON(w, chunk)
+}
+
+// POST {"name": "", "pass": "", "code": ""}
+func (web *WebAddon) MitmLogin(w http.ResponseWriter, r *http.Request) {
+	if web.preflight(w, r) {
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		Bad(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var form loginForm
+	if err := decoder.NewStreamDecoder(r.Body).Decode(&form); err != nil {
+		Bad(w, http.StatusBadRequest, "decode fail %v", err)
+		return
+	}
+
+	u, err := web.login(r, &form)
+	if err != nil {
+		le := err.(*loginError)
+		le.header(w)
+		Bad(w, le.status, "%s", le.msg)
+		return
+	}
+
+	writeToken(w, web.issueToken(u.Name, ""))
+}
+
+func (web *WebAddon) MitmRefresh(w http.ResponseWriter, r *http.Request) {
+	if web.preflight(w, r) {
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		Bad(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	tk, err := web.refresh(r)
+	if err != nil {
+		Bad(w, http.StatusUnauthorized, "%v", err)
+		return
+	}
+	writeToken(w, tk)
+}
+
+func (web *WebAddon) MitmLogout(w http.ResponseWriter, r *http.Request) {
+	if web.preflight(w, r) {
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		Bad(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if err := web.logout(r); err != nil {
+		Bad(w, http.StatusUnauthorized, "%v", err)
+		return
+	}
+	w.Write([]byte("ok"))
+}
@@ -0,0 +1,114 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTOTP(t *testing.T) {
+	// RFC 6238 Appendix B, SHA1, 取后 6 位
+	key := []byte("12345678901234567890")
+	cases := map[int64]string{59: "287082", 1111111109: "081804", 1234567890: "005924", 2000000000: "279037"}
+	for ts, want := range cases {
+		if got := totpCode(key, ts/totpPeriod); got != want {
+			t.Errorf("%d: want %s got %s", ts, want, got)
+		}
+	}
+
+	secret := totpEncoding.EncodeToString(key)
+	if _, ok := verifyTOTP(secret, "287082", time.Unix(59+totpPeriod, 0)); !ok {
+		t.Error("previous period should be accepted")
+	}
+	if _, ok := verifyTOTP(secret, "287082", time.Unix(59+3*totpPeriod, 0)); ok {
+		t.Error("stale code should be rejected")
+	}
+}
+
+func TestToken(t *testing.T) {
+	s := newTokenSigner("secret", time.Hour)
+	token, claims := s.issue("alice", "")
+	if c, err := s.verify(token); err != nil || c.User != "alice" || c.SID != claims.SID {
+		t.Fatalf("verify fail %v %+v", err, c)
+	}
+
+	parts := strings.Split(token, ".")
+	if _, err := newTokenSigner("other", time.Hour).verify(token); err != TokenInvalidE {
+		t.Errorf("other key: %v", err)
+	}
+	if _, err := s.verify(parts[0] + "." + parts[1] + "x." + parts[2]); err != TokenInvalidE {
+		t.Errorf("tampered: %v", err)
+	}
+
+	s.revoke(claims)
+	if _, err := s.verify(token); err != TokenRevokedE {
+		t.Errorf("revoked: %v", err)
+	}
+
+	s.ttl = -time.Second
+	expired, _ := s.issue("alice", "")
+	if _, err := s.verify(expired); err != TokenExpiredE {
+		t.Errorf("expired: %v", err)
+	}
+}
+
+func TestLoginLimiter(t *testing.T) {
+	l := newLoginLimiter(3, time.Minute)
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		l.fail(now, "ip:a", "user:u")
+	}
+	if l.locked(now, "ip:a") > 0 {
+		t.Fatal("locked too early")
+	}
+
+	l.fail(now, "ip:a", "user:u")
+	if l.locked(now, "ip:b", "user:u") != time.Minute {
+		t.Fatal("user should be locked")
+	}
+	if l.locked(now.Add(time.Minute), "ip:a", "user:u") > 0 {
+		t.Fatal("lock should expire")
+	}
+}
+
+func TestLoginReset(t *testing.T) {
+	web := &WebAddon{
+		config:  Config{Users: []User{{Name: "alice", Pass: HashPassword("a")}, {Name: "bob", Pass: HashPassword("b")}}},
+		limiter: newLoginLimiter(3, time.Minute),
+	}
+	login := func(ip, name, pass string) error {
+		r := httptest.NewRequest(http.MethodPost, "/login", nil)
+		r.RemoteAddr = ip + ":1234"
+		_, err := web.login(r, &loginForm{Name: name, Pass: pass})
+		return err
+	}
+
+	// 登录成功清除用户的计数
+	for i := 0; i < 2; i++ {
+		login("10.0.0.1", "alice", "x")
+	}
+	if err := login("10.0.0.1", "alice", "a"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		login("10.0.0.2", "alice", "x")
+	}
+	if err := login("10.0.0.3", "alice", "a"); err != nil {
+		t.Fatalf("user count not reset %v", err)
+	}
+
+	// ip 的计数不因登录成功清除
+	for i := 0; i < 2; i++ {
+		login("10.0.0.4", "bob", "x")
+	}
+	if err := login("10.0.0.4", "alice", "a"); err != nil {
+		t.Fatal(err)
+	}
+	login("10.0.0.4", "bob", "x")
+	err := login("10.0.0.4", "alice", "a")
+	if le, ok := err.(*loginError); !ok || le.status != http.StatusTooManyRequests {
+		t.Fatalf("ip should be locked %v", err)
+	}
+}
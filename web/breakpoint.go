@@ -3,6 +3,7 @@ package web
 import (
 	log "github.com/sirupsen/logrus"
 	"github.com/vela-ssoc/vela-kit/lua"
+	"regexp"
 	"strings"
 	"sync"
 )
@@ -29,13 +30,25 @@ type breakPointRule struct {
 	Cnd       []Condition    `json:"Condition"`
 	Script    string         `json:"Script"`
 	Phase     []string       `json:"Phase"` // 1 - change request 2 - change response 3 - both
+	Logic     string         `json:"Logic"` // and - 全部条件满足 or - 任一条件满足(默认)
 	script    *lua.LFunction `json:"-"`
+	regex     sync.Map       `json:"-"` // 条件正则缓存 pattern => *regexp.Regexp
 }
 
 func (rule *breakPointRule) parse() {
 	//cnd := strings.Split(rule.Condition, "\n")
 	//rule.cond = cond.New(cnd...)
 
+	for _, cnd := range rule.Cnd {
+		if !strings.HasSuffix(cnd.Method, "regex") {
+			continue
+		}
+
+		for _, item := range strings.Split(cnd.Data, "\n") {
+			rule.compile(cnd.Method, item)
+		}
+	}
+
 	co := ruleLuaCoroutinePool.Get().(*lua.LState)
 	fn, err := co.LoadString(rule.Script)
 	if err != nil {
@@ -122,16 +135,55 @@ func (rule *breakPointRule) HaveMethod(method string) bool {
 	return false
 }
 
+func (rule *breakPointRule) compile(method, pattern string) *regexp.Regexp {
+	if strings.TrimPrefix(method, "!") == "iregex" {
+		pattern = "(?i)" + pattern
+	}
+
+	if re, ok := rule.regex.Load(pattern); ok {
+		return re.(*regexp.Regexp)
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		log.Errorf("condition regex %s compile fail %v", pattern, err)
+		return nil
+	}
+
+	rule.regex.Store(pattern, re)
+	return re
+}
+
+func (rule *breakPointRule) cndMethod(method string) (func(a, b string) bool, bool) {
+	fn, isNot := ParseCndMethod(method)
+	if !strings.HasSuffix(method, "regex") {
+		return fn, isNot
+	}
+
+	return func(a, b string) bool {
+		re := rule.compile(method, b)
+		if re == nil {
+			return false
+		}
+		return re.MatchString(a)
+	}, isNot
+}
+
 func (rule *breakPointRule) CallCnd(cnd Condition, fl *flowL) bool {
 
 	ret := false
 
-	fn, isNot := ParseCndMethod(cnd.Method)
+	fn, isNot := rule.cndMethod(cnd.Method)
 
-	data := strings.Split(cnd.Data, "\n")
+	var value string
 	lv := fl.Index(nil, cnd.Key)
+	if lv != nil && lv.Type() != lua.LTNil {
+		value = lv.String()
+	}
+
+	data := strings.Split(cnd.Data, "\n")
 	for _, item := range data {
-		if fn(lv.String(), item) {
+		if fn(value, item) {
 			ret = true
 			goto done
 		}
@@ -150,6 +202,15 @@ func (rule *breakPointRule) MatchCnd(fl *flowL) bool {
 		return true
 	}
 
+	if strings.EqualFold(rule.Logic, "and") {
+		for _, cnd := range rule.Cnd {
+			if !rule.CallCnd(cnd, fl) {
+				return false
+			}
+		}
+		return true
+	}
+
 	for _, cnd := range rule.Cnd {
 		if rule.CallCnd(cnd, fl) {
 			return true
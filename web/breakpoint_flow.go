@@ -17,6 +17,12 @@ type flowL struct {
 	flow *proxy.Flow
 	ctx  context.Context
 	wait bool
+
+	// 脚本 addon 使用, 断点规则只读
+	phase   string
+	script  string
+	mutable bool
+	done    bool
 }
 
 func (fl *flowL) String() string                         { return "" }
@@ -128,6 +134,23 @@ func (fl *flowL) Index(L *lua.LState, key string) lua.LValue {
 		return lua.B2L(fl.flow.Request.Body)
 	case "ext":
 		return lua.S2L(fl.Ext())
+	case "method":
+		return lua.S2L(fl.flow.Request.Method)
+	case "status":
+		if fl.flow.Response == nil {
+			return lua.LNil
+		}
+		return lua.LInt(fl.flow.Response.StatusCode)
+	case "client_ip":
+		if fl.flow.ConnContext == nil {
+			return lua.LNil
+		}
+		return lua.S2L(fl.flow.ConnContext.ClientConn.Conn.RemoteAddr().String())
+	case "server_ip":
+		if fl.flow.ConnContext == nil || fl.flow.ConnContext.ServerConn == nil || fl.flow.ConnContext.ServerConn.Conn == nil {
+			return lua.LNil
+		}
+		return lua.S2L(fl.flow.ConnContext.ServerConn.Conn.RemoteAddr().String())
 	}
 
 	if strings.HasPrefix(key, "h_") {
@@ -139,6 +162,9 @@ func (fl *flowL) Index(L *lua.LState, key string) lua.LValue {
 	}
 
 	if strings.HasPrefix(key, "r_") {
+		if fl.flow.Response == nil {
+			return lua.LNil
+		}
 		return fl.ResponseL(key[2:])
 	}
 
@@ -20,6 +20,10 @@ func flowContextIndexL(L *lua.LState, key string) lua.LValue {
 	case "have":
 		return lua.NewFunction(fl.containL)
 	default:
+		if fn := fl.mutableIndex(key); fn != nil {
+			return fn
+		}
+
 		v := fl.Index(L, key)
 		if v == nil {
 			return &elementL{null: true}
@@ -0,0 +1,137 @@
+package web
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/vela-ssoc/vela-mitm/proxy"
+)
+
+func TestParseCndMethod(t *testing.T) {
+	cases := []struct {
+		method string
+		value  string
+		data   string
+		want   bool
+	}{
+		{"equal", "www.a.com", "www.a.com", true},
+		{"equal", "www.a.com", "WWW.A.COM", false},
+		{"!equal", "www.a.com", "www.b.com", true},
+		{"iequal", "www.a.com", "WWW.A.COM", true},
+		{"!iequal", "www.a.com", "WWW.A.COM", false},
+
+		{"regex", "/api/v1/user", `^/api/v\d+/`, true},
+		{"regex", "/static/a.js", `^/api/`, false},
+		{"regex", "/api", `(`, false},
+		{"!regex", "/static/a.js", `^/api/`, true},
+		{"!regex", "/api/v1", `^/api/`, false},
+		{"iregex", "/API/v1", `^/api/`, true},
+		{"!iregex", "/API/v1", `^/api/`, false},
+
+		{"prefix", "/api/v1", "/api", true},
+		{"!prefix", "/api/v1", "/api", false},
+		{"iprefix", "/API/v1", "/api", true},
+		{"suffix", "a.js", ".js", true},
+		{"!suffix", "a.js", ".css", true},
+		{"isuffix", "a.JS", ".js", true},
+		{"contain", "token=abc", "abc", true},
+		{"!contain", "token=abc", "abc", false},
+		{"icontain", "token=ABC", "abc", true},
+
+		{"ip", "10.1.2.3:5432", "10.0.0.0/8", true},
+		{"ip", "192.168.1.10", "192.168.1.1-192.168.1.20", true},
+		{"ip", "192.168.1.30", "192.168.1.1-192.168.1.20", false},
+		{"ip", "::1", "::1", true},
+		{"ip", "not-ip", "10.0.0.0/8", false},
+		{"!ip", "172.16.0.1", "10.0.0.0/8", true},
+		{"!ip", "10.0.0.1", "10.0.0.0/8", false},
+
+		{">", "404", "400", true},
+		{">", "200", "400", false},
+		{">", "abc", "400", false},
+		{">=", "400", "400", true},
+		{"<", "1024", "2048", true},
+		{"<=", "2049", "2048", false},
+		{"!>", "200", "400", true},
+		{"range", "204", "200-299", true},
+		{"range", "300", "200-299", false},
+		{"range", "-5", "-10-0", true},
+		{"!range", "500", "200-299", true},
+
+		{"exists", "a", "", true},
+		{"exists", "", "", false},
+		{"!exists", "", "", true},
+
+		{"unknown", "a", "a", false},
+		{"!unknown", "a", "a", false},
+	}
+
+	for _, c := range cases {
+		fn, isNot := ParseCndMethod(c.method)
+		got := fn(c.value, c.data)
+		if isNot {
+			got = !got
+		}
+
+		if got != c.want {
+			t.Errorf("%s(%q, %q) = %v, want %v", c.method, c.value, c.data, got, c.want)
+		}
+	}
+}
+
+func newTestFlowL(t *testing.T, rawURL string, status int) *flowL {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &proxy.Flow{
+		Request: &proxy.Request{
+			Method: "GET",
+			URL:    u,
+			Header: http.Header{"User-Agent": {"curl/7.0"}},
+		},
+		Response: &proxy.Response{
+			StatusCode: status,
+			Header:     make(http.Header),
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return &flowL{ctx: ctx, stop: cancel, flow: f}
+}
+
+func TestMatchCndLogic(t *testing.T) {
+	cnd := []Condition{
+		{Key: "host", Method: "equal", Data: "api.example.com\nwww.example.com"},
+		{Key: "uri", Method: "regex", Data: `^/v\d+/`},
+		{Key: "status", Method: ">=", Data: "400"},
+		{Key: "a_debug", Method: "!exists"},
+	}
+
+	cases := []struct {
+		logic string
+		url   string
+		code  int
+		want  bool
+	}{
+		{"", "http://api.example.com/static", 200, true},
+		{"or", "http://other.com/static?debug=1", 200, false},
+		{"and", "http://www.example.com/v1/user", 500, true},
+		{"and", "http://www.example.com/v1/user", 200, false},
+		{"and", "http://www.example.com/v1/user?debug=1", 500, false},
+		{"AND", "http://other.com/v1/user", 500, false},
+	}
+
+	for _, c := range cases {
+		rule := &breakPointRule{Cnd: cnd, Logic: c.logic}
+		rule.parse()
+
+		if got := rule.MatchCnd(newTestFlowL(t, c.url, c.code)); got != c.want {
+			t.Errorf("logic %q %s %d = %v, want %v", c.logic, c.url, c.code, got, c.want)
+		}
+	}
+}
@@ -1,8 +1,51 @@
 package web
 
+import (
+	"time"
+
+	"github.com/vela-ssoc/vela-mitm/addon"
+	"github.com/vela-ssoc/vela-mitm/proxy"
+)
+
 type Config struct {
-	Addr   string
+	Addr string
+	// unix socket, 只监听 loopback, https
+	Listen Listen
 	Name   string
 	Pass   string
+	// 多用户, Name/Pass 同时作为一个用户
+	Users  []User
 	Origin []string
+	// ca 证书目录, 默认 cert.d
+	CertDir string
+	// 审计日志文件, 默认 audit.{Name}.log
+	Audit string
+	// token 签名密钥, 为空时随机生成; TokenTTL 默认 12h
+	Secret   string
+	TokenTTL time.Duration
+	// 登录失败 MaxLoginFail 次 (默认 5) 后锁定 Lockout (默认 15m)
+	MaxLoginFail int
+	Lockout      time.Duration
+	// intruder 文件 payload 所在目录, 默认 payloads
+	PayloadDir string
+	// 对 history 建立全文索引
+	FullText bool
+	// history 保留策略
+	Retention Retention
+	Rewrite   *addon.Rewrite
+	Script    *ScriptAddon
+	Passive   *PassiveAddon
+	// 项目 scope, 为空时所有目标都在 scope 内
+	Scope *ProjectScope
+	// web 后台修改 scope 后写回配置文件, 为空时只在内存中生效
+	SaveScope func(Scope) error
+	// repeater intruder 使用代理的上游 tls hosts 配置, 为空时直接连接
+	Proxy *proxy.Proxy
+}
+
+func (cfg Config) auditPath() string {
+	if cfg.Audit == "" {
+		return "audit." + cfg.Name + ".log"
+	}
+	return cfg.Audit
 }
@@ -2,9 +2,11 @@ package web
 
 import (
 	"context"
+	"fmt"
 	"strconv"
 	"sync"
 
+	"github.com/bytedance/sonic"
 	"github.com/gorilla/websocket"
 	log "github.com/sirupsen/logrus"
 	"github.com/vela-ssoc/vela-mitm/proxy"
@@ -12,6 +14,8 @@ import (
 
 type concurrentConn struct {
 	userData *UserData
+	user     *userState
+	web      *WebAddon // addConn 时设置, 用于写审计日志
 	conn     *websocket.Conn
 	mu       sync.Mutex
 
@@ -21,10 +25,9 @@ type concurrentConn struct {
 	waitQueue   map[string]*flowTx
 	waitChansMu sync.Mutex
 
-	ctx        context.Context
-	stop       context.CancelFunc
-	breakPoint *breakPointRule
-	history    *breakPointRule
+	ctx  context.Context
+	stop context.CancelFunc
+	feed *FlowQuery // 实时推送过滤, nil 表示不推送
 }
 
 type flowTx struct {
@@ -48,11 +51,17 @@ func newConn(c *websocket.Conn, ud *UserData) *concurrentConn {
 	return cnn
 }
 
-func (c *concurrentConn) OpenDB(name string) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+// rest api 登录的会话没有 websocket 连接
+func (c *concurrentConn) headless() bool {
+	return c.conn == nil
+}
 
-	c.db = NewFlowDB(name)
+// 调用方持有 c.mu
+func (c *concurrentConn) write(data []byte) error {
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.WriteMessage(websocket.BinaryMessage, data)
 }
 
 func (c *concurrentConn) interceptorClear() {
@@ -76,18 +85,14 @@ func (c *concurrentConn) interceptorClear() {
 
 }
 
-func (c *concurrentConn) whenConnClose(connCtx *proxy.ConnContext) {
-	//c.mu.Lock()
-	//defer c.mu.Unlock()
-
-	//delete(c.sendConnMessageMap, connCtx.Id().String())
+// 连接建立/更新/关闭时推送, 关闭时的记录包含最终的字节数和请求数
+func (c *concurrentConn) sendConn(mType messageType, rc *ConnRecord) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	//msg := newMessageConnClose(connCtx)
-	//err := c.conn.WriteMessage(websocket.BinaryMessage, msg.bytes())
-	//if err != nil {
-	//	log.Error(err)
-	//	return
-	//}
+	if err := c.write(NewBinMessage(mType, rc.ID, 0, rc.Bytes())); err != nil {
+		log.Error(err)
+	}
 }
 
 func (c *concurrentConn) SendInterceptor(msg *messageFlow, f *proxy.Flow) {
@@ -95,7 +100,7 @@ func (c *concurrentConn) SendInterceptor(msg *messageFlow, f *proxy.Flow) {
 	defer c.mu.Unlock()
 
 	chunk := ToFlow(msg, f, true).Bytes()
-	err := c.conn.WriteMessage(websocket.BinaryMessage, NewBinMessage(msg.mType, msg.id.String(), 1, chunk))
+	err := c.write(NewBinMessage(msg.mType, msg.id.String(), 1, chunk))
 	if err != nil {
 		log.Error(err)
 		return
@@ -110,11 +115,7 @@ func (c *concurrentConn) writeMessage(msg *messageFlow, f *proxy.Flow) {
 	}
 
 	if msg.mType == messageTypeResponseBody {
-		ctx, cancel := context.WithCancel(c.ctx)
-		fl := &flowL{ctx: ctx, stop: cancel, flow: f, wait: false}
-		if c.history.Match(fl) {
-			c.db.UpsertFlow(msg, f)
-		}
+		c.record(msg, f)
 	}
 
 	if msg.waitIntercept == 1 {
@@ -122,18 +123,100 @@ func (c *concurrentConn) writeMessage(msg *messageFlow, f *proxy.Flow) {
 	}
 }
 
+// 按 history 规则保存 flow 并推送实时过滤, 同一用户只由一个会话保存
+// 普通 flow 等写回客户端后再保存, 以记录完整的耗时; stream 模式在转发完成时调用, 直接保存
+func (c *concurrentConn) record(msg *messageFlow, f *proxy.Flow) {
+	if c.recording(f) {
+		if f.Stream {
+			c.db.UpsertFlow(msg, f)
+		} else {
+			go func() {
+				<-f.Done()
+				c.db.UpsertFlow(msg, f)
+			}()
+		}
+	}
+	c.sendFeed(msg, f)
+}
+
+// 当前会话是否负责保存 flow
+func (c *concurrentConn) recording(f *proxy.Flow) bool {
+	_, history := c.user.rules()
+	if history == nil || c.user.recorder() != c || !c.web.config.Scope.Record(f.Request.URL) {
+		return false
+	}
+
+	ctx, cancel := context.WithCancel(c.ctx)
+	defer cancel()
+	return history.Match(&flowL{ctx: ctx, stop: cancel, flow: f, wait: false})
+}
+
+// 连接上还没有 flow 时无法按 history 规则判断, 开启 history 的用户都保存连接记录
+func (c *concurrentConn) recordingConn() bool {
+	_, history := c.user.rules()
+	return history != nil && c.user.recorder() == c
+}
+
+// 规则属于用户, 关闭断点时放行该用户所有会话上等待的 flow
 func (c *concurrentConn) SetRule(v *messageMeta) {
+	c.user.setRule(c, v.mType, v.rule)
+
+	if v.mType == messageTypeChangeBreakPointRules && !v.rule.Enable {
+		for _, s := range c.user.snapshot() {
+			s.interceptorClear()
+		}
+	}
+}
 
-	if v.mType == messageTypeChangeBreakPointRules {
-		c.breakPoint = v.rule
-		if !c.breakPoint.Enable {
-			c.interceptorClear()
+func (c *concurrentConn) SetFeed(v *messageFeed) {
+	var reply []byte
+	fq, err := ParseQuery(v.query)
+	if err != nil {
+		qe, ok := err.(*QueryError)
+		if !ok {
+			qe = &QueryError{Msg: err.Error()}
 		}
+		reply, _ = sonic.Marshal(qe)
+	} else {
+		reply = []byte(`{"pos":-1,"error":""}`)
+		c.mu.Lock()
+		if len(v.query) == 0 {
+			c.feed = nil
+		} else {
+			c.feed = fq
+		}
+		c.mu.Unlock()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.write(NewBinMessage(messageTypeFeed, EmptyID, 0, reply)); err != nil {
+		log.Error(err)
+	}
+}
+
+// 推送满足过滤条件的 flow 摘要
+func (c *concurrentConn) sendFeed(msg *messageFlow, f *proxy.Flow) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.feed == nil || f.Request.Method == "CONNECT" {
 		return
 	}
 
-	if v.mType == MessageTypeChangeHistoryRules {
-		c.history = v.rule
+	flow := ToFlow(msg, f, false)
+	if !c.feed.MatchFlow(flow) {
+		return
+	}
+
+	chunk, err := sonic.Marshal(flow.ToSimple())
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	if err = c.write(NewBinMessage(messageTypeFlows, flow.FlowID, 0, chunk)); err != nil {
+		log.Error(err)
 	}
 }
 
@@ -152,7 +235,7 @@ func (c *concurrentConn) readloop() {
 
 		if string(data) == "ping" {
 			c.mu.Lock()
-			err := c.conn.WriteMessage(websocket.BinaryMessage, []byte("pong"))
+			err := c.write([]byte("pong"))
 			c.mu.Unlock()
 			if err != nil {
 				log.Error(err)
@@ -171,6 +254,10 @@ func (c *concurrentConn) readloop() {
 			continue
 		}
 
+		if !c.allow(msg) {
+			continue
+		}
+
 		switch v := msg.(type) {
 		case *messageEdit:
 			tx := c.initWaitContext(v.id.String())
@@ -180,12 +267,53 @@ func (c *concurrentConn) readloop() {
 		case *messageMeta:
 			c.SetRule(v)
 
+		case *messageFeed:
+			c.SetFeed(v)
+
 		default:
 			log.Warn("invalid message, skip")
 		}
 	}
 }
 
+// 权限不足的消息不处理, 回复 messageTypeDenied
+func (c *concurrentConn) allow(msg message) bool {
+	need := messageRole(msg)
+	allowed := c.userData.Role.Allow(need)
+
+	var action, target string
+	switch v := msg.(type) {
+	case *messageEdit:
+		action, target = fmt.Sprintf("ws edit %d", v.mType), v.id.String()
+	case *messageMeta:
+		action = fmt.Sprintf("ws rule %d", v.mType)
+	default:
+		action = fmt.Sprintf("ws %T", msg)
+	}
+
+	if c.web != nil {
+		c.web.audit(c, action, target, c.conn.RemoteAddr().String(), need, allowed)
+	}
+
+	if allowed {
+		return true
+	}
+
+	log.Warnf("user %s role %s not allow %s", c.userData.Name, c.userData.Role, action)
+	chunk, _ := sonic.Marshal(map[string]string{"action": action, "need": need.String()})
+	c.mu.Lock()
+	id := target
+	if id == "" {
+		id = EmptyID
+	}
+	err := c.write(NewBinMessage(messageTypeDenied, id, 0, chunk))
+	c.mu.Unlock()
+	if err != nil {
+		log.Error(err)
+	}
+	return false
+}
+
 func (c *concurrentConn) pop(key string) {
 	c.waitChansMu.Lock()
 	defer c.waitChansMu.Unlock()
@@ -225,8 +353,13 @@ func (c *concurrentConn) initWaitChan(key string) chan interface{} {
 
 // 是否拦截
 func (c *concurrentConn) isIntercpt(f *proxy.Flow, after *messageFlow) bool {
+	breakPoint, _ := c.user.rules()
+	if breakPoint == nil || c.headless() || !c.user.isActive(c) {
+		return false
+	}
 
-	if c.breakPoint == nil {
+	// scope 外的 flow 不拦截
+	if !c.web.config.Scope.InScope(f.Request.URL) {
 		return false
 	}
 
@@ -249,7 +382,7 @@ func (c *concurrentConn) isIntercpt(f *proxy.Flow, after *messageFlow) bool {
 
 	}
 
-	if !c.breakPoint.Enable {
+	if !breakPoint.Enable {
 		return false
 	}
 
@@ -257,11 +390,11 @@ func (c *concurrentConn) isIntercpt(f *proxy.Flow, after *messageFlow) bool {
 
 	fl := flowL{ctx: ctx, stop: cancel, flow: f, wait: false}
 
-	if !c.breakPoint.MatchPhase(phase) {
+	if !breakPoint.MatchPhase(phase) {
 		return false
 	}
 
-	if c.breakPoint.Match(&fl) {
+	if breakPoint.Match(&fl) {
 		return true
 	}
 
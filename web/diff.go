@@ -0,0 +1,357 @@
+package web
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 去掉相同的首尾后, 行数或编辑距离超过上限时不再计算最短差异, 直接整体替换
+const (
+	diffMaxLines = 10000
+	diffMaxEdits = 1000
+)
+
+// Op 为 "=" "-" "+", 分别表示相同, 只在旧版本, 只在新版本
+type DiffLine struct {
+	Op   string `json:"op"`
+	Text string `json:"text"`
+}
+
+type HeaderDiff struct {
+	Name string   `json:"name"`
+	Old  []string `json:"old"`
+	New  []string `json:"new"`
+}
+
+// Path 如 $.data.items[0].name, Op 为 add remove change
+type JSONDiff struct {
+	Path string      `json:"path"`
+	Op   string      `json:"op"`
+	Old  interface{} `json:"old,omitempty"`
+	New  interface{} `json:"new,omitempty"`
+}
+
+// 两个 body 都是 json 时 JSON 为按字段的差异, Body 为格式化 (key 排序) 之后按行的差异
+type FlowDiff struct {
+	Status [2]int       `json:"status"`
+	Length [2]int       `json:"length"`
+	Header []HeaderDiff `json:"header"`
+	Body   []DiffLine   `json:"body"` // 相同的行只保留变化前后 diffContext 行
+	JSON   []JSONDiff   `json:"json,omitempty"`
+}
+
+const jsonDiffLimit = 1000
+
+const diffContext = 3
+
+// Myers O(ND) 差异算法, 按行比较
+func diffLines(a, b []string) []DiffLine {
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+
+	lines := make([]DiffLine, 0, pre+suf)
+	for _, s := range a[:pre] {
+		lines = append(lines, DiffLine{Op: "=", Text: s})
+	}
+	lines = append(lines, myersDiff(a[pre:len(a)-suf], b[pre:len(b)-suf])...)
+	for _, s := range a[len(a)-suf:] {
+		lines = append(lines, DiffLine{Op: "=", Text: s})
+	}
+	return lines
+}
+
+func replaceLines(a, b []string) []DiffLine {
+	lines := make([]DiffLine, 0, len(a)+len(b))
+	for _, s := range a {
+		lines = append(lines, DiffLine{Op: "-", Text: s})
+	}
+	for _, s := range b {
+		lines = append(lines, DiffLine{Op: "+", Text: s})
+	}
+	return lines
+}
+
+// 每一步只保存 k 在 [-d, d] 内的终点, 内存为 O(D^2)
+func myersDiff(a, b []string) []DiffLine {
+	n, m := len(a), len(b)
+	if n+m == 0 {
+		return nil
+	}
+	if n > diffMaxLines || m > diffMaxLines {
+		return replaceLines(a, b)
+	}
+
+	max := n + m
+	offset := max + 1
+	v := make([]int, 2*max+2)
+	var trace [][]int
+
+	found := false
+	for d := 0; d <= max && d <= diffMaxEdits; d++ {
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+
+		trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+		if found {
+			break
+		}
+	}
+
+	if !found {
+		return replaceLines(a, b)
+	}
+
+	// 第 d 步之前 k 上的终点, 即第 d-1 步的结果
+	prev := func(d, k int) int {
+		if d == 0 {
+			return 0
+		}
+		w := trace[d-1]
+		if i := k + d - 1; i >= 0 && i < len(w) {
+			return w[i]
+		}
+		return 0
+	}
+
+	// 从终点回溯每一步的来源
+	var rev []DiffLine
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		k := x - y
+
+		var prevK int
+		if k == -d || (k != d && prev(d, k-1) < prev(d, k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+
+		prevX := prev(d, prevK)
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			x--
+			y--
+			rev = append(rev, DiffLine{Op: "=", Text: a[x]})
+		}
+
+		if d > 0 {
+			if x == prevX {
+				y--
+				rev = append(rev, DiffLine{Op: "+", Text: b[y]})
+			} else {
+				x--
+				rev = append(rev, DiffLine{Op: "-", Text: a[x]})
+			}
+		}
+	}
+
+	lines := make([]DiffLine, len(rev))
+	for i := range rev {
+		lines[i] = rev[len(rev)-1-i]
+	}
+	return lines
+}
+
+// 相同的行只保留变化前后 context 行, 省略的部分用 Op "..." 表示, Text 为省略的行数
+func compactDiff(lines []DiffLine, context int) []DiffLine {
+	keep := make([]bool, len(lines))
+	for i, line := range lines {
+		if line.Op == "=" {
+			continue
+		}
+		for j := i - context; j <= i+context; j++ {
+			if j >= 0 && j < len(lines) {
+				keep[j] = true
+			}
+		}
+	}
+
+	out := make([]DiffLine, 0)
+	skipped := 0
+	for i, line := range lines {
+		if keep[i] {
+			if skipped > 0 {
+				out = append(out, DiffLine{Op: "...", Text: strconv.Itoa(skipped)})
+				skipped = 0
+			}
+			out = append(out, line)
+			continue
+		}
+		skipped++
+	}
+
+	if skipped > 0 {
+		out = append(out, DiffLine{Op: "...", Text: strconv.Itoa(skipped)})
+	}
+	return out
+}
+
+func diffHeader(a, b http.Header) []HeaderDiff {
+	names := make(map[string]struct{})
+	for name := range a {
+		names[http.CanonicalHeaderKey(name)] = struct{}{}
+	}
+	for name := range b {
+		names[http.CanonicalHeaderKey(name)] = struct{}{}
+	}
+
+	keys := make([]string, 0, len(names))
+	for name := range names {
+		keys = append(keys, name)
+	}
+	sort.Strings(keys)
+
+	diffs := make([]HeaderDiff, 0)
+	for _, name := range keys {
+		old, cur := a.Values(name), b.Values(name)
+		if strings.Join(old, "\n") == strings.Join(cur, "\n") {
+			continue
+		}
+		diffs = append(diffs, HeaderDiff{Name: name, Old: old, New: cur})
+	}
+	return diffs
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// 按字段比较, 数组按下标比较, 最多 jsonDiffLimit 项
+func diffJSON(path string, a, b interface{}, out *[]JSONDiff) {
+	if len(*out) >= jsonDiffLimit {
+		return
+	}
+
+	switch av := a.(type) {
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+
+		keys := make([]string, 0, len(av)+len(bv))
+		for k := range av {
+			keys = append(keys, k)
+		}
+		for k := range bv {
+			if _, ok := av[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			x, inA := av[k]
+			y, inB := bv[k]
+			switch {
+			case !inB:
+				*out = append(*out, JSONDiff{Path: path + "." + k, Op: "remove", Old: x})
+			case !inA:
+				*out = append(*out, JSONDiff{Path: path + "." + k, Op: "add", New: y})
+			default:
+				diffJSON(path+"."+k, x, y, out)
+			}
+		}
+		return
+
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok {
+			break
+		}
+
+		for i := 0; i < len(av) || i < len(bv); i++ {
+			p := path + "[" + strconv.Itoa(i) + "]"
+			switch {
+			case i >= len(bv):
+				*out = append(*out, JSONDiff{Path: p, Op: "remove", Old: av[i]})
+			case i >= len(av):
+				*out = append(*out, JSONDiff{Path: p, Op: "add", New: bv[i]})
+			default:
+				diffJSON(p, av[i], bv[i], out)
+			}
+		}
+		return
+	}
+
+	if !reflect.DeepEqual(a, b) {
+		*out = append(*out, JSONDiff{Path: path, Op: "change", Old: a, New: b})
+	}
+}
+
+// 不是 json 时返回 false
+func parseJSONBody(body string) (interface{}, bool) {
+	trimmed := strings.TrimSpace(body)
+	if trimmed == "" || (trimmed[0] != '{' && trimmed[0] != '[') {
+		return nil, false
+	}
+
+	var v interface{}
+	if err := json.Unmarshal([]byte(trimmed), &v); err != nil {
+		return nil, false
+	}
+	return v, true
+}
+
+func indentJSON(v interface{}) string {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+	return b.String()
+}
+
+// 比较两个响应, 如 intruder 结果与基准请求, repeater 的两次发送
+func DiffFlows(old, cur *Flow) *FlowDiff {
+	diff := &FlowDiff{
+		Status: [2]int{old.StatusCode, cur.StatusCode},
+		Length: [2]int{old.ResponseSize, cur.ResponseSize},
+		Header: diffHeader(old.ResponseHeader, cur.ResponseHeader),
+	}
+
+	a, b := old.ResponseBody, cur.ResponseBody
+	x, okA := parseJSONBody(a)
+	y, okB := parseJSONBody(b)
+	if okA && okB {
+		diff.JSON = make([]JSONDiff, 0)
+		diffJSON("$", x, y, &diff.JSON)
+		a, b = indentJSON(x), indentJSON(y)
+	}
+
+	diff.Body = compactDiff(diffLines(splitLines(a), splitLines(b)), diffContext)
+	return diff
+}
@@ -5,9 +5,11 @@ import (
 	"github.com/asdine/storm/v3"
 	"github.com/asdine/storm/v3/q"
 	"github.com/bytedance/sonic"
+	uuid "github.com/satori/go.uuid"
 	log "github.com/sirupsen/logrus"
 	"github.com/vela-ssoc/vela-mitm/proxy"
 	"go.etcd.io/bbolt"
+	"net/url"
 	"os"
 	"sync"
 )
@@ -19,32 +21,61 @@ type FlowDB struct {
 	FlowMgrBkt string
 	Path       string
 	db         *storm.DB
+	index      *flowIndex
+	retention  Retention
+	scope      *ProjectScope
+	janitor    chan struct{}
+	stat       janitorStat
 }
 
 func (fdb *FlowDB) close() {
 	fdb.mu.Lock()
 	defer fdb.mu.Unlock()
 
+	fdb.stopIndex()
+	fdb.stopJanitor()
+
+	if fdb.db == nil {
+		return
+	}
 	if err := fdb.db.Close(); err != nil {
 		log.Errorf("close %s fail %v", fdb.Path, err)
 	}
 }
 
+// 只清空流量相关的数据, 重放标签, 爆破任务和漏洞结果保留
 func (fdb *FlowDB) Reset() error {
 	fdb.mu.Lock()
 	defer fdb.mu.Unlock()
 
-	if err := fdb.db.Close(); err != nil {
-		log.Errorf("flow db close fail %v", err)
-		return err
+	if fdb.db == nil {
+		return fmt.Errorf("flow db %s not open", fdb.Path)
+	}
+
+	// 丢弃还未写入的索引, 避免清空后写回
+	if fdb.index != nil {
+		for len(fdb.index.queue) > 0 {
+			<-fdb.index.queue
+		}
 	}
 
-	if err := os.Remove(fdb.Path); err != nil {
-		log.Errorf("flow db close fail %v", err)
+	buckets := [][]byte{[]byte(fdb.FlowBucket), []byte(fdb.FlowMgrBkt), blobBucket, blobRefBucket, ftsBucket, ftsDocBucket, []byte(connBucket)}
+	err := fdb.db.Bolt.Update(func(tx *bbolt.Tx) error {
+		for _, name := range buckets {
+			if err := tx.DeleteBucket(name); err != nil && err != bbolt.ErrBucketNotFound {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf("flow db reset fail %v", err)
 		return err
 	}
 
-	fdb.open()
+	if err := os.RemoveAll(fdb.spoolDir()); err != nil {
+		log.Errorf("flow spool remove fail %v", err)
+	}
 
 	return nil
 }
@@ -81,38 +112,117 @@ type HistoryMgr struct {
 	Flows []FlowSimple `json:"flows"`
 }
 
+// 按状态码计数, n 为 -1 时用于删除 flow
+func (fsm *FlowStatMgr) count(status, n int) {
+	fsm.Total += n
+	switch {
+	case status == 200:
+		fsm.Http200 += n
+	case status > 300 && status < 399:
+		fsm.Http30x += n
+	case status > 400 && status < 499:
+		fsm.Http40x += n
+	case status > 500 && status < 599:
+		fsm.Http50x += n
+	}
+}
+
 func (fdb *FlowDB) IncrFlowStatus(flow *Flow) {
 	bkt := fdb.db.From(fdb.FlowMgrBkt)
 	fsm := &FlowStatMgr{}
 
 	bkt.Get(fdb.FlowMgrBkt, "flow-mgr", fsm)
-	fsm.Total++
-	if flow.StatusCode == 200 {
-		fsm.Http200++
-		goto done
+	fsm.count(flow.StatusCode, 1)
+	if e := bkt.Set(fdb.FlowMgrBkt, "flow-mgr", fsm); e != nil {
+		log.Errorf("bucket set flow stat fail %v", e)
 	}
-	if flow.StatusCode > 300 && flow.StatusCode < 399 {
-		fsm.Http30x++
-		goto done
+}
+
+func (fdb *FlowDB) History(skip, size int) []byte {
+	return fdb.history(nil, skip, size)
+}
+
+// 按过滤表达式分页查询 history
+func (fdb *FlowDB) Search(fq *FlowQuery, skip, size int) []byte {
+	return fdb.history(fq, skip, size)
+}
+
+// 按过滤表达式导出, limit <= 0 表示不限制, 返回的 flow 已加载 body
+func (fdb *FlowDB) Export(fq *FlowQuery, limit int) ([]Flow, error) {
+	fdb.mu.Lock()
+	defer fdb.mu.Unlock()
+
+	var flows []Flow
+	err := fdb.db.Bolt.View(func(tx *bbolt.Tx) error {
+		read := func(hash string) ([]byte, error) {
+			return blobGet(tx, hash)
+		}
+
+		matchers := []q.Matcher{q.Not(q.Eq("Method", "CONNECT"))}
+		if fq != nil {
+			matchers = append(matchers, fq.withBlob(read))
+		}
+
+		query := fdb.db.From(fdb.FlowBucket).WithTransaction(tx).Select(matchers...)
+		if limit > 0 {
+			query = query.Limit(limit)
+		}
+
+		if err := query.Find(&flows); err != nil {
+			return err
+		}
+
+		for i := range flows {
+			if err := flows[i].readBody(read); err != nil {
+				log.Errorf("flow %s load body fail %v", flows[i].FlowID, err)
+			}
+		}
+		return nil
+	})
+
+	if err == storm.ErrNotFound {
+		return []Flow{}, nil
 	}
+	return flows, err
+}
+
+// 按 id 倒序翻页, before 为上一页返回的游标, 0 表示从最新开始; 没有更多数据时 next 为 0
+func (fdb *FlowDB) Page(fq *FlowQuery, before, limit int) (flows []FlowSimple, next int, err error) {
+	fdb.mu.Lock()
+	defer fdb.mu.Unlock()
 
-	if flow.StatusCode > 400 && flow.StatusCode < 499 {
-		fsm.Http40x++
-		goto done
+	var records []Flow
+	err = fdb.db.Bolt.View(func(tx *bbolt.Tx) error {
+		matchers := []q.Matcher{q.Not(q.Eq("Method", "CONNECT"))}
+		if before > 0 {
+			matchers = append(matchers, q.Lt("ID", before))
+		}
+		if fq != nil {
+			matchers = append(matchers, fq.withBlob(func(hash string) ([]byte, error) {
+				return blobGet(tx, hash)
+			}))
+		}
+
+		node := fdb.db.From(fdb.FlowBucket).WithTransaction(tx)
+		return node.Select(matchers...).Reverse().Limit(limit).Find(&records)
+	})
+
+	if err != nil && err != storm.ErrNotFound {
+		return nil, 0, err
 	}
 
-	if flow.StatusCode > 500 && flow.StatusCode < 599 {
-		fsm.Http50x++
-		goto done
+	flows = make([]FlowSimple, len(records))
+	for i := range records {
+		flows[i] = records[i].ToSimple()
 	}
 
-done:
-	if e := bkt.Set(fdb.FlowMgrBkt, "flow-mgr", fsm); e != nil {
-		log.Errorf("bucket set flow stat fail %v", e)
+	if len(records) == limit && limit > 0 {
+		next = records[len(records)-1].ID
 	}
+	return flows, next, nil
 }
 
-func (fdb *FlowDB) History(skip, size int) []byte {
+func (fdb *FlowDB) history(fq *FlowQuery, skip, size int) []byte {
 	fdb.mu.Lock()
 	defer fdb.mu.Unlock()
 
@@ -121,11 +231,24 @@ func (fdb *FlowDB) History(skip, size int) []byte {
 	bkt := fdb.db.From(fdb.FlowMgrBkt)
 	bkt.Get(fdb.FlowMgrBkt, "flow-mgr", &fsm)
 
+	// 列表只读取 flow 记录, 过滤条件涉及 body 时才读取 blob
 	var flows []Flow
-	bkt = fdb.db.From(fdb.FlowBucket)
-	err := bkt.Select(q.Not(q.Eq("Method", "CONNECT"))).Reverse().Skip(skip).Limit(size).Find(&flows)
+	err := fdb.db.Bolt.View(func(tx *bbolt.Tx) error {
+		matchers := []q.Matcher{q.Not(q.Eq("Method", "CONNECT"))}
+		if fq != nil {
+			matchers = append(matchers, fq.withBlob(func(hash string) ([]byte, error) {
+				return blobGet(tx, hash)
+			}))
+		}
+
+		node := fdb.db.From(fdb.FlowBucket).WithTransaction(tx)
+		return node.Select(matchers...).Reverse().Skip(skip).Limit(size).Find(&flows)
+	})
 	if err != nil {
-		log.Errorf("read all fail %v", err)
+		if err != storm.ErrNotFound {
+			log.Errorf("read all fail %v", err)
+		}
+		history.Flows = []FlowSimple{}
 		goto DONE
 	}
 
@@ -155,21 +278,76 @@ func (fdb *FlowDB) UpsertFlow(msg *messageFlow, f *proxy.Flow) {
 	fdb.mu.Lock()
 	defer fdb.mu.Unlock()
 
-	if fdb.db == nil {
+	if fdb.db == nil || !fdb.scope.Record(f.Request.URL) {
 		return
 	}
 
-	bkt := fdb.db.From(fdb.FlowBucket)
 	flow := ToFlow(msg, f, false)
 	flow.ParseURL()
-	if e := bkt.Save(flow); e != nil {
-		log.Errorf("save flow fail %v", e)
-	} else {
-		fdb.IncrFlowStatus(flow)
+
+	// 共用 FlowDB 的多个用户都开启 history 时同一 flow 只保存一次
+	if err := fdb.db.From(fdb.FlowBucket).One("FlowID", flow.FlowID, new(Flow)); err == nil {
+		return
+	}
+	fdb.saveSpool(flow, f)
+
+	if err := fdb.saveFlow(flow); err != nil && err != storm.ErrAlreadyExists {
+		log.Errorf("save flow fail %v", err)
+	}
+}
+
+// 开启 record_only 时 UpsertFlow 只保存 scope 内的 flow
+func (fdb *FlowDB) SetScope(scope *ProjectScope) {
+	fdb.mu.Lock()
+	defer fdb.mu.Unlock()
+	fdb.scope = scope
+}
+
+// 保存不经过代理的 flow, 如扫描发送的请求; FlowID 为空时生成
+func (fdb *FlowDB) AddFlow(flow *Flow) error {
+	fdb.mu.Lock()
+	defer fdb.mu.Unlock()
+
+	if fdb.db == nil {
+		return fmt.Errorf("flow db not open")
+	}
+
+	if flow.FlowID == "" {
+		flow.FlowID = uuid.NewV4().String()
+	}
+	if u, err := url.Parse(flow.RawURL); err == nil {
+		flow.Scheme = u.Scheme
+		flow.URL = u.Scheme + "://" + u.Host + u.Path
+		flow.Query = u.RawQuery
+	}
+	return fdb.saveFlow(flow)
+}
+
+// 大 body 写入 blob, flow 记录只保存引用; 调用方持有锁
+func (fdb *FlowDB) saveFlow(flow *Flow) error {
+	err := fdb.db.Bolt.Update(func(tx *bbolt.Tx) error {
+		stored, err := outlineFlow(tx, flow)
+		if err != nil {
+			return err
+		}
+
+		if err = fdb.db.From(fdb.FlowBucket).WithTransaction(tx).Save(stored); err != nil {
+			return err
+		}
+
+		flow.ID = stored.ID
+		return nil
+	})
+	if err != nil {
+		return err
 	}
+
+	fdb.IncrFlowStatus(flow)
+	fdb.indexFlow(flow)
+	return nil
 }
 
-func (fdb *FlowDB) open() {
+func (fdb *FlowDB) open() error {
 
 	opt := &bbolt.Options{
 		Timeout:      0,
@@ -182,11 +360,12 @@ func (fdb *FlowDB) open() {
 	db, err := storm.Open(fdb.Path, storm.BoltOptions(0600, opt), storm.Codec(SonicCodec))
 	if err != nil {
 		log.Errorf("open flow db fail %v", err)
-		return
+		return err
 	}
 
 	fdb.db = db
 	fdb.options = opt
+	return nil
 }
 
 func NewFlowDB(name string) *FlowDB {
@@ -0,0 +1,202 @@
+package web
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"github.com/vela-ssoc/vela-kit/auxlib"
+	"go.etcd.io/bbolt"
+)
+
+// body 按内容寻址存储, 相同内容只存一份
+// flow-blob     sha256 => 编码标记(1 byte) + 数据
+// flow-blob-ref sha256 => 引用计数, 为 0 时删除
+
+var (
+	blobBucket    = []byte("flow-blob")
+	blobRefBucket = []byte("flow-blob-ref")
+)
+
+const (
+	// 小于该长度的 body 直接存在 flow 记录中
+	blobInlineSize = 512
+
+	blobRaw   byte = 0
+	blobFlate byte = 1
+)
+
+func blobHash(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// 压缩后更小才压缩, 已经 gzip 的响应通常原样保存
+func blobEncode(body []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(blobFlate)
+
+	w, _ := flate.NewWriter(&buf, flate.BestSpeed)
+	w.Write(body)
+	w.Close()
+
+	if buf.Len() < len(body)+1 {
+		return buf.Bytes()
+	}
+
+	raw := make([]byte, len(body)+1)
+	raw[0] = blobRaw
+	copy(raw[1:], body)
+	return raw
+}
+
+func blobDecode(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty blob")
+	}
+
+	switch data[0] {
+	case blobRaw:
+		return append([]byte(nil), data[1:]...), nil
+	case blobFlate:
+		r := flate.NewReader(bytes.NewReader(data[1:]))
+		defer r.Close()
+		return io.ReadAll(r)
+	}
+
+	return nil, fmt.Errorf("unknown blob codec %d", data[0])
+}
+
+func blobPut(tx *bbolt.Tx, body []byte) (string, error) {
+	blobs, err := tx.CreateBucketIfNotExists(blobBucket)
+	if err != nil {
+		return "", err
+	}
+
+	refs, err := tx.CreateBucketIfNotExists(blobRefBucket)
+	if err != nil {
+		return "", err
+	}
+
+	hash := blobHash(body)
+	key := []byte(hash)
+
+	var count uint64
+	if v := refs.Get(key); len(v) == 8 {
+		count = binary.BigEndian.Uint64(v)
+	}
+
+	if count == 0 || blobs.Get(key) == nil {
+		if err = blobs.Put(key, blobEncode(body)); err != nil {
+			return "", err
+		}
+	}
+
+	ref := make([]byte, 8)
+	binary.BigEndian.PutUint64(ref, count+1)
+	return hash, refs.Put(key, ref)
+}
+
+// 减少引用计数, 没有引用时删除 blob
+func blobRelease(tx *bbolt.Tx, hash string) error {
+	if hash == "" {
+		return nil
+	}
+
+	blobs := tx.Bucket(blobBucket)
+	refs := tx.Bucket(blobRefBucket)
+	if blobs == nil || refs == nil {
+		return nil
+	}
+
+	key := []byte(hash)
+	var count uint64
+	if v := refs.Get(key); len(v) == 8 {
+		count = binary.BigEndian.Uint64(v)
+	}
+
+	if count > 1 {
+		ref := make([]byte, 8)
+		binary.BigEndian.PutUint64(ref, count-1)
+		return refs.Put(key, ref)
+	}
+
+	if err := refs.Delete(key); err != nil {
+		return err
+	}
+	return blobs.Delete(key)
+}
+
+func blobGet(tx *bbolt.Tx, hash string) ([]byte, error) {
+	blobs := tx.Bucket(blobBucket)
+	if blobs == nil {
+		return nil, fmt.Errorf("blob %s not found", hash)
+	}
+
+	data := blobs.Get([]byte(hash))
+	if data == nil {
+		return nil, fmt.Errorf("blob %s not found", hash)
+	}
+	return blobDecode(data)
+}
+
+// 超过 blobInlineSize 的 body 移入 blob, 返回用于保存的 flow 副本
+func outlineFlow(tx *bbolt.Tx, flow *Flow) (*Flow, error) {
+	stored := *flow
+
+	if len(flow.RequestBody) >= blobInlineSize {
+		hash, err := blobPut(tx, auxlib.S2B(flow.RequestBody))
+		if err != nil {
+			return nil, err
+		}
+		stored.RequestBlob = hash
+		stored.RequestBody = ""
+	}
+
+	if len(flow.ResponseBody) >= blobInlineSize {
+		hash, err := blobPut(tx, auxlib.S2B(flow.ResponseBody))
+		if err != nil {
+			return nil, err
+		}
+		stored.ResponseBlob = hash
+		stored.ResponseBody = ""
+	}
+
+	return &stored, nil
+}
+
+func (f *Flow) readBody(read func(hash string) ([]byte, error)) error {
+	if f.RequestBlob != "" && f.RequestBody == "" {
+		body, err := read(f.RequestBlob)
+		if err != nil {
+			return err
+		}
+		f.RequestBody = auxlib.B2S(body)
+	}
+
+	if f.ResponseBlob != "" && f.ResponseBody == "" {
+		body, err := read(f.ResponseBlob)
+		if err != nil {
+			return err
+		}
+		f.ResponseBody = auxlib.B2S(body)
+	}
+
+	return nil
+}
+
+// 按需从 blob 中加载 body, FindFlowId 只返回 flow 记录
+func (fdb *FlowDB) LoadBody(flow *Flow) error {
+	fdb.mu.Lock()
+	defer fdb.mu.Unlock()
+
+	return fdb.db.Bolt.View(func(tx *bbolt.Tx) error {
+		return flow.readBody(func(hash string) ([]byte, error) {
+			return blobGet(tx, hash)
+		})
+	})
+}
@@ -0,0 +1,124 @@
+package web
+
+import (
+	"bytes"
+	"crypto/rand"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+func TestBlobRefCount(t *testing.T) {
+	db, err := bbolt.Open(filepath.Join(t.TempDir(), "blob.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	body := bytes.Repeat([]byte("console.log(1);"), 100)
+
+	var hash string
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for i := 0; i < 3; i++ {
+			h, err := blobPut(tx, body)
+			if err != nil {
+				return err
+			}
+			hash = h
+		}
+
+		var n int
+		tx.Bucket(blobBucket).ForEach(func(k, v []byte) error {
+			n++
+			return nil
+		})
+		if n != 1 {
+			t.Fatalf("blob count %d, want 1", n)
+		}
+
+		stored, err := blobGet(tx, hash)
+		if err != nil || !bytes.Equal(stored, body) {
+			t.Fatalf("blob get %v", err)
+		}
+
+		for i := 0; i < 2; i++ {
+			if err = blobRelease(tx, hash); err != nil {
+				return err
+			}
+		}
+		if _, err = blobGet(tx, hash); err != nil {
+			t.Fatalf("blob released too early %v", err)
+		}
+
+		if err = blobRelease(tx, hash); err != nil {
+			return err
+		}
+		if _, err = blobGet(tx, hash); err == nil {
+			t.Fatal("blob not released")
+		}
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBlobEncode(t *testing.T) {
+	for _, body := range [][]byte{{}, []byte("x"), bytes.Repeat([]byte("abc"), 1000)} {
+		out, err := blobDecode(blobEncode(body))
+		if err != nil || !bytes.Equal(out, body) {
+			t.Fatalf("blob roundtrip %d fail %v", len(body), err)
+		}
+	}
+}
+
+// max_size 按 blob 实际存储的字节计算, 共用的 blob 只计一次
+func TestPruneBlobSize(t *testing.T) {
+	const bodySize = 64 << 10
+	bodies := make([]string, 5)
+	for i := range bodies {
+		body := make([]byte, bodySize)
+		rand.Read(body)
+		bodies[i] = string(body)
+	}
+
+	cases := []struct {
+		name   string
+		shared bool
+		remain []int
+	}{
+		{"distinct", false, []int{2, 3, 4}},
+		{"shared", true, []int{0, 1, 2, 3, 4}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			db := newTestFlowDB(t)
+			flows := make([]*Flow, len(bodies))
+			for i := range flows {
+				body := bodies[i]
+				if tc.shared {
+					body = bodies[0]
+				}
+				flows[i] = &Flow{Method: "GET", RawURL: "http://a.com/", ResponseBody: body, Time: time.Now()}
+				if err := addTestFlow(db, flows[i]); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			db.SetRetention(Retention{MaxSize: 3*bodySize + 8<<10, Interval: time.Hour})
+			if _, err := db.Prune(); err != nil {
+				t.Fatal(err)
+			}
+			remain := remainFlows(t, db, flows)
+			if len(remain) != len(tc.remain) || remain[0] != tc.remain[0] {
+				t.Fatalf("remain %v want %v", remain, tc.remain)
+			}
+			if stats, err := db.Stats(); err != nil || stats.FlowBytes+stats.BlobBytes > 3*bodySize+8<<10 {
+				t.Fatalf("stats %v %+v", err, stats)
+			}
+		})
+	}
+}
@@ -0,0 +1,187 @@
+package web
+
+import (
+	"crypto/tls"
+	"net/url"
+	"time"
+
+	"github.com/asdine/storm/v3"
+	"github.com/asdine/storm/v3/q"
+	"github.com/bytedance/sonic"
+	log "github.com/sirupsen/logrus"
+	"github.com/vela-ssoc/vela-mitm/proxy"
+)
+
+const connBucket = "conn"
+
+// 客户端连接记录, ID 与 Flow.ConnId 相同
+// 字节数为连接上的原始流量, tls 连接包含握手和加密开销
+type ConnRecord struct {
+	ID            string    `json:"id" storm:"id"`
+	ClientAddress string    `json:"client_address"`
+	ClientTls     bool      `json:"client_tls"`
+	ServerAddress string    `json:"server_address"`
+	ServerPeer    string    `json:"server_peer"`
+	Open          time.Time `json:"open" storm:"index"`
+	Close         time.Time `json:"close"`
+	Closed        bool      `json:"closed"`
+	Requests      int64     `json:"requests"`
+	ClientIn      int64     `json:"client_in"`  // 从客户端读取
+	ClientOut     int64     `json:"client_out"` // 写往客户端
+	ServerIn      int64     `json:"server_in"`  // 从上游读取
+	ServerOut     int64     `json:"server_out"` // 写往上游
+	TLSVersion    string    `json:"tls_version,omitempty"`
+	TLSCipher     string    `json:"tls_cipher,omitempty"`
+	TLSServerName string    `json:"tls_server_name,omitempty"`
+	TLSProtocol   string    `json:"tls_protocol,omitempty"` // ALPN
+}
+
+type ConnDetail struct {
+	ConnRecord
+	Flows []FlowSimple `json:"flows"`
+}
+
+// connCtx 在客户端刚连接时为 nil
+func NewConnRecord(client *proxy.ClientConn, connCtx *proxy.ConnContext) *ConnRecord {
+	rc := &ConnRecord{
+		ID:        client.Id.String(),
+		ClientTls: client.Tls,
+		Open:      client.Connected,
+		Close:     client.Closed,
+		Closed:    !client.Closed.IsZero(),
+		ClientIn:  client.BytesIn(),
+		ClientOut: client.BytesOut(),
+	}
+
+	if client.Conn != nil {
+		rc.ClientAddress = client.Conn.RemoteAddr().String()
+	}
+
+	if connCtx == nil {
+		return rc
+	}
+
+	rc.Requests = connCtx.Requests()
+
+	sc := connCtx.ServerConn
+	if sc == nil {
+		return rc
+	}
+
+	rc.ServerAddress = sc.Address
+	rc.ServerIn = sc.BytesIn()
+	rc.ServerOut = sc.BytesOut()
+	if sc.Conn != nil {
+		rc.ServerPeer = sc.Conn.RemoteAddr().String()
+	}
+
+	if state := sc.TlsStateNow(); state != nil {
+		rc.TLSVersion = tlsVersionName(state.Version)
+		rc.TLSCipher = tls.CipherSuiteName(state.CipherSuite)
+		rc.TLSServerName = state.ServerName
+		rc.TLSProtocol = state.NegotiatedProtocol
+	}
+
+	return rc
+}
+
+func tlsVersionName(v uint16) string {
+	switch v {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return ""
+}
+
+// 上游地址未知时返回 nil
+func (rc *ConnRecord) url() *url.URL {
+	if rc.ServerAddress == "" {
+		return nil
+	}
+
+	scheme := "http"
+	if rc.ClientTls || rc.TLSVersion != "" {
+		scheme = "https"
+	}
+	return &url.URL{Scheme: scheme, Host: rc.ServerAddress, Path: "/"}
+}
+
+func (rc *ConnRecord) Bytes() []byte {
+	chunk, _ := sonic.Marshal(rc)
+	return chunk
+}
+
+func (fdb *FlowDB) UpsertConn(rc *ConnRecord) {
+	fdb.mu.Lock()
+	defer fdb.mu.Unlock()
+
+	if fdb.db == nil {
+		return
+	}
+
+	if err := fdb.db.From(connBucket).Save(rc); err != nil {
+		log.Errorf("save conn %s fail %v", rc.ID, err)
+	}
+}
+
+func (fdb *FlowDB) DeleteConn(id string) {
+	fdb.mu.Lock()
+	defer fdb.mu.Unlock()
+
+	if fdb.db == nil {
+		return
+	}
+
+	if err := fdb.db.From(connBucket).DeleteStruct(&ConnRecord{ID: id}); err != nil && err != storm.ErrNotFound {
+		log.Errorf("delete conn %s fail %v", id, err)
+	}
+}
+
+// 按建立时间倒序分页
+func (fdb *FlowDB) Conns(skip, size int) ([]ConnRecord, error) {
+	fdb.mu.Lock()
+	defer fdb.mu.Unlock()
+
+	conns := make([]ConnRecord, 0)
+	err := fdb.db.From(connBucket).AllByIndex("Open", &conns, storm.Reverse(), storm.Skip(skip), storm.Limit(size))
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	return conns, nil
+}
+
+// 连接记录及其上的 flow, 按时间顺序
+func (fdb *FlowDB) Conn(id string) (*ConnDetail, error) {
+	fdb.mu.Lock()
+	defer fdb.mu.Unlock()
+
+	detail := &ConnDetail{Flows: make([]FlowSimple, 0)}
+	if err := fdb.db.From(connBucket).One("ID", id, &detail.ConnRecord); err != nil {
+		return nil, err
+	}
+
+	var flows []Flow
+	err := fdb.db.From(fdb.FlowBucket).Select(q.Eq("ConnId", id)).OrderBy("Time").Find(&flows)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+
+	for i := range flows {
+		detail.Flows = append(detail.Flows, flows[i].ToSimple())
+	}
+	return detail, nil
+}
+
+// 调用方持有 fdb.mu, 删除关闭时间早于 before 的连接记录
+func (fdb *FlowDB) pruneConns(before time.Time) {
+	err := fdb.db.From(connBucket).Select(q.Eq("Closed", true), q.Lt("Close", before)).Delete(new(ConnRecord))
+	if err != nil && err != storm.ErrNotFound {
+		log.Errorf("prune conn fail %v", err)
+	}
+}
@@ -0,0 +1,113 @@
+package web
+
+import (
+	"testing"
+	"time"
+
+	"github.com/asdine/storm/v3"
+	uuid "github.com/satori/go.uuid"
+)
+
+func newConnSession(web *WebAddon, db *FlowDB, us *userState, history bool) *concurrentConn {
+	c := &concurrentConn{userData: &UserData{Name: "u"}, user: us, web: web, db: db}
+	us.join(c)
+	if history {
+		us.setRule(c, MessageTypeChangeHistoryRules, &breakPointRule{Enable: true})
+	}
+	web.conns = append(web.conns, c)
+	return c
+}
+
+// bolt 写入的页数, 同一记录每次保存相同
+func connWrites(db *FlowDB) int64 {
+	return db.db.Bolt.Stats().TxStats.Write
+}
+
+func TestSaveConn(t *testing.T) {
+	shared, other := newTestFlowDB(t), newTestFlowDB(t)
+	web := &WebAddon{}
+
+	// alice 的两个会话和 bob 共用一个 FlowDB, carol 没有开启 history
+	alice := &userState{}
+	newConnSession(web, shared, alice, true)
+	newConnSession(web, shared, alice, false)
+	newConnSession(web, shared, &userState{}, true)
+	newConnSession(web, other, &userState{}, false)
+
+	rc := &ConnRecord{ID: uuid.NewV4().String(), Open: time.Now()}
+	shared.UpsertConn(rc)
+	before := connWrites(shared)
+	shared.UpsertConn(rc)
+	once := connWrites(shared) - before
+
+	rc.Requests = 1
+	before = connWrites(shared)
+	web.saveConn(rc)
+	if n := connWrites(shared) - before; n >= 2*once {
+		t.Fatalf("shared db page writes %d, one save writes %d", n, once)
+	}
+
+	detail, err := shared.Conn(rc.ID)
+	if err != nil || detail.Requests != 1 {
+		t.Fatalf("shared conn %v %+v", err, detail)
+	}
+	if _, err = other.Conn(rc.ID); err != storm.ErrNotFound {
+		t.Fatalf("conn saved without history %v", err)
+	}
+
+	// record_only 时上游不在 scope 内的连接不保存
+	scope, err := NewProjectScope(Scope{Include: []ScopeRule{{Host: "a.com"}}, RecordOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	web.config.Scope = scope
+	rc.ServerAddress = "b.com:443"
+	web.saveConn(rc)
+	if _, err = shared.Conn(rc.ID); err != storm.ErrNotFound {
+		t.Fatalf("out of scope conn kept %v", err)
+	}
+	rc.ServerAddress = "a.com:80"
+	web.saveConn(rc)
+	if _, err = shared.Conn(rc.ID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPruneConns(t *testing.T) {
+	now := time.Now()
+	policies := []func(db *FlowDB) Retention{
+		func(*FlowDB) Retention { return Retention{MaxCount: 1} },
+		func(db *FlowDB) Retention {
+			stats, _ := db.Stats()
+			return Retention{MaxSize: stats.FlowBytes / 2}
+		},
+		func(*FlowDB) Retention { return Retention{MaxAge: time.Hour} },
+	}
+
+	// 每种策略都清理早于保留的 flow 关闭的连接, 未关闭的连接保留
+	for _, policy := range policies {
+		db := newTestFlowDB(t)
+		addRetentionFlows(t, db, []string{"http://a.com/1", "http://a.com/2"}, []time.Time{now.Add(-3 * time.Hour), now.Add(-time.Minute)})
+
+		old := &ConnRecord{ID: "old", Open: now.Add(-4 * time.Hour), Close: now.Add(-2 * time.Hour), Closed: true}
+		recent := &ConnRecord{ID: "recent", Open: now.Add(-2 * time.Minute), Close: now, Closed: true}
+		open := &ConnRecord{ID: "open", Open: now.Add(-5 * time.Hour)}
+		for _, rc := range []*ConnRecord{old, recent, open} {
+			db.UpsertConn(rc)
+		}
+
+		r := policy(db)
+		db.SetRetention(r)
+		if n, err := db.Prune(); err != nil || n != 1 {
+			t.Fatalf("%+v prune %d %v", r, n, err)
+		}
+
+		conns, err := db.Conns(0, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(conns) != 2 || conns[0].ID != "recent" || conns[1].ID != "open" {
+			t.Fatalf("%+v conns %+v", r, conns)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package web
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"time"
+
+	"github.com/asdine/storm/v3"
+	"github.com/asdine/storm/v3/q"
+)
+
+const (
+	findingBucket = "finding"
+	// 每个发现最多保留的 flow_id, 超过时丢弃最早的
+	findingMaxFlows = 20
+)
+
+const (
+	SeverityInfo   = "info"
+	SeverityLow    = "low"
+	SeverityMedium = "medium"
+	SeverityHigh   = "high"
+)
+
+// 扫描发现, 同一 host path 上同类型同名称的问题合并为一条, Count 为出现次数
+// Name 为 header cookie 或参数名等, 没有时为空
+type Finding struct {
+	ID       string    `json:"id" storm:"id"`
+	Type     string    `json:"type" storm:"index"`
+	Severity string    `json:"severity" storm:"index"`
+	Name     string    `json:"name,omitempty"`
+	Host     string    `json:"host" storm:"index"`
+	Path     string    `json:"path"`
+	Detail   string    `json:"detail"`
+	Evidence string    `json:"evidence,omitempty"`
+	FlowIDs  []string  `json:"flow_ids"`
+	Count    int       `json:"count"`
+	First    time.Time `json:"first"`
+	Last     time.Time `json:"last" storm:"index"`
+}
+
+type FindingFilter struct {
+	Type     string
+	Severity string
+	Host     string
+}
+
+func findingID(typ, name, host, path string) string {
+	sum := sha1.Sum([]byte(typ + "\x00" + name + "\x00" + host + "\x00" + path))
+	return hex.EncodeToString(sum[:8])
+}
+
+// 保存发现, 已存在时更新次数和 flow_id; 同一 flow 重复添加时不做修改
+// 返回 true 表示新的发现
+func (fdb *FlowDB) AddFinding(fd *Finding) (bool, error) {
+	fdb.mu.Lock()
+	defer fdb.mu.Unlock()
+
+	if fd.ID == "" {
+		fd.ID = findingID(fd.Type, fd.Name, fd.Host, fd.Path)
+	}
+	if fd.Last.IsZero() {
+		fd.Last = time.Now()
+	}
+
+	stored := &Finding{}
+	err := fdb.db.From(findingBucket).One("ID", fd.ID, stored)
+	if err == storm.ErrNotFound {
+		fd.First, fd.Count = fd.Last, 1
+		return true, fdb.db.From(findingBucket).Save(fd)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	for _, id := range fd.FlowIDs {
+		for _, old := range stored.FlowIDs {
+			if id == old {
+				*fd = *stored
+				return false, nil
+			}
+		}
+	}
+
+	stored.Count++
+	stored.Last = fd.Last
+	stored.Severity, stored.Detail, stored.Evidence = fd.Severity, fd.Detail, fd.Evidence
+	stored.FlowIDs = append(stored.FlowIDs, fd.FlowIDs...)
+	if n := len(stored.FlowIDs); n > findingMaxFlows {
+		stored.FlowIDs = stored.FlowIDs[n-findingMaxFlows:]
+	}
+
+	if err = fdb.db.From(findingBucket).Save(stored); err != nil {
+		return false, err
+	}
+	*fd = *stored
+	return false, nil
+}
+
+// 按最后出现时间倒序
+func (fdb *FlowDB) Findings(filter FindingFilter, skip, size int) ([]Finding, error) {
+	fdb.mu.Lock()
+	defer fdb.mu.Unlock()
+
+	var matchers []q.Matcher
+	if filter.Type != "" {
+		matchers = append(matchers, q.Eq("Type", filter.Type))
+	}
+	if filter.Severity != "" {
+		matchers = append(matchers, q.Eq("Severity", filter.Severity))
+	}
+	if filter.Host != "" {
+		matchers = append(matchers, q.Eq("Host", filter.Host))
+	}
+
+	findings := make([]Finding, 0)
+	query := fdb.db.From(findingBucket).Select(matchers...).OrderBy("Last").Reverse().Skip(skip)
+	if size > 0 {
+		query = query.Limit(size)
+	}
+
+	err := query.Find(&findings)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	return findings, nil
+}
+
+func (fdb *FlowDB) Finding(id string) (*Finding, error) {
+	fdb.mu.Lock()
+	defer fdb.mu.Unlock()
+
+	fd := &Finding{}
+	if err := fdb.db.From(findingBucket).One("ID", id, fd); err != nil {
+		return nil, err
+	}
+	return fd, nil
+}
+
+// id 为空时删除全部
+func (fdb *FlowDB) DeleteFindings(id string) error {
+	fdb.mu.Lock()
+	defer fdb.mu.Unlock()
+
+	var matchers []q.Matcher
+	if id != "" {
+		matchers = append(matchers, q.Eq("ID", id))
+	}
+
+	err := fdb.db.From(findingBucket).Select(matchers...).Delete(new(Finding))
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,427 @@
+package web
+
+import (
+	"bytes"
+	"encoding/binary"
+	"html"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vela-ssoc/vela-kit/auxlib"
+	"go.etcd.io/bbolt"
+)
+
+// 全文索引: 与 flow 同库的倒排表, 异步构建
+// flow-fts     term => { id(8 byte) => flow id }
+// flow-fts-doc id(8 byte) => terms, 删除 flow 时清理倒排
+
+var (
+	ftsBucket    = []byte("flow-fts")
+	ftsDocBucket = []byte("flow-fts-doc")
+)
+
+const (
+	ftsQueueSize   = 1024
+	ftsMaxTermLen  = 64
+	ftsMaxBodySize = 1024 * 1024
+)
+
+type flowIndex struct {
+	queue chan *Flow
+	done  chan struct{}
+}
+
+type FullTextSnippet struct {
+	Field string `json:"field"`
+	Text  string `json:"text"`
+}
+
+type FullTextHit struct {
+	ID       int               `json:"id"`
+	FlowID   string            `json:"flow_id"`
+	Method   string            `json:"method"`
+	URL      string            `json:"url"`
+	Snippets []FullTextSnippet `json:"snippets"`
+}
+
+// 开启全文索引, 之后保存的 flow 会进入索引
+func (fdb *FlowDB) EnableFullText() {
+	fdb.mu.Lock()
+	defer fdb.mu.Unlock()
+
+	if fdb.index != nil {
+		return
+	}
+
+	fdb.index = &flowIndex{
+		queue: make(chan *Flow, ftsQueueSize),
+		done:  make(chan struct{}),
+	}
+	go fdb.indexLoop(fdb.index)
+}
+
+func (fdb *FlowDB) FullTextEnabled() bool {
+	fdb.mu.Lock()
+	defer fdb.mu.Unlock()
+	return fdb.index != nil
+}
+
+// 调用方持有 fdb.mu
+func (fdb *FlowDB) indexFlow(flow *Flow) {
+	if fdb.index == nil {
+		return
+	}
+
+	select {
+	case fdb.index.queue <- flow:
+	default:
+		log.Warnf("full text index queue full, skip flow %s", flow.FlowID)
+	}
+}
+
+func (fdb *FlowDB) indexLoop(idx *flowIndex) {
+	for {
+		select {
+		case <-idx.done:
+			return
+		case flow := <-idx.queue:
+			terms := ftsTerms(ftsDocument(flow))
+
+			fdb.mu.Lock()
+			if fdb.db != nil {
+				if err := fdb.db.Bolt.Update(func(tx *bbolt.Tx) error {
+					return ftsPut(tx, flow, terms)
+				}); err != nil {
+					log.Errorf("full text index flow %s fail %v", flow.FlowID, err)
+				}
+			}
+			fdb.mu.Unlock()
+		}
+	}
+}
+
+func (fdb *FlowDB) stopIndex() {
+	if fdb.index == nil {
+		return
+	}
+	close(fdb.index.done)
+	fdb.index = nil
+}
+
+func ftsKey(id int) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(id))
+	return key
+}
+
+func ftsPut(tx *bbolt.Tx, flow *Flow, terms []string) error {
+	root, err := tx.CreateBucketIfNotExists(ftsBucket)
+	if err != nil {
+		return err
+	}
+
+	docs, err := tx.CreateBucketIfNotExists(ftsDocBucket)
+	if err != nil {
+		return err
+	}
+
+	key := ftsKey(flow.ID)
+	for _, term := range terms {
+		bkt, err := root.CreateBucketIfNotExists([]byte(term))
+		if err != nil {
+			return err
+		}
+		if err = bkt.Put(key, []byte(flow.FlowID)); err != nil {
+			return err
+		}
+	}
+
+	return docs.Put(key, []byte(strings.Join(terms, "\n")))
+}
+
+// 从倒排表中删除 flow, 调用方持有写事务
+func ftsDelete(tx *bbolt.Tx, id int) error {
+	docs := tx.Bucket(ftsDocBucket)
+	root := tx.Bucket(ftsBucket)
+	if docs == nil || root == nil {
+		return nil
+	}
+
+	key := ftsKey(id)
+	terms := docs.Get(key)
+	if terms == nil {
+		return nil
+	}
+
+	for _, term := range strings.Split(string(terms), "\n") {
+		bkt := root.Bucket([]byte(term))
+		if bkt == nil {
+			continue
+		}
+		if err := bkt.Delete(key); err != nil {
+			return err
+		}
+		if k, _ := bkt.Cursor().First(); k == nil {
+			if err := root.DeleteBucket([]byte(term)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return docs.Delete(key)
+}
+
+type ftsField struct {
+	name string
+	text string
+}
+
+func ftsHeaderText(flow *Flow, response bool) string {
+	header := flow.RequestHeader
+	if response {
+		header = flow.ResponseHeader
+	}
+
+	var buf strings.Builder
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, v := range header[name] {
+			buf.WriteString(name)
+			buf.WriteString(": ")
+			buf.WriteString(v)
+			buf.WriteString("\n")
+		}
+	}
+	return buf.String()
+}
+
+func ftsBody(text string) string {
+	if len(text) > ftsMaxBodySize {
+		return text[:ftsMaxBodySize]
+	}
+	return text
+}
+
+func ftsDocument(flow *Flow) []ftsField {
+	return []ftsField{
+		{name: "url", text: flow.RawURL},
+		{name: "request_header", text: ftsHeaderText(flow, false)},
+		{name: "request_body", text: ftsBody(UncompressedBody(flow.RequestHeader, auxlib.S2B(flow.RequestBody)))},
+		{name: "response_header", text: ftsHeaderText(flow, true)},
+		{name: "response_body", text: ftsBody(UncompressedBody(flow.ResponseHeader, auxlib.S2B(flow.ResponseBody)))},
+	}
+}
+
+func isFtsRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
+
+func ftsTokenize(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !isFtsRune(r)
+	})
+
+	tokens := make([]string, 0, len(words))
+	for _, w := range words {
+		if len(w) < 2 || len(w) > ftsMaxTermLen {
+			continue
+		}
+		tokens = append(tokens, w)
+	}
+	return tokens
+}
+
+func ftsTerms(fields []ftsField) []string {
+	seen := make(map[string]bool)
+	terms := make([]string, 0)
+	for _, field := range fields {
+		for _, token := range ftsTokenize(field.text) {
+			if seen[token] {
+				continue
+			}
+			seen[token] = true
+			terms = append(terms, token)
+		}
+	}
+	return terms
+}
+
+// 返回 term 下的 id 集合, prefix 为 true 时匹配前缀
+func ftsLookup(root *bbolt.Bucket, term string, prefix bool) map[string]string {
+	ids := make(map[string]string)
+	collect := func(bkt *bbolt.Bucket) {
+		bkt.ForEach(func(k, v []byte) error {
+			ids[string(k)] = string(v)
+			return nil
+		})
+	}
+
+	if !prefix {
+		if bkt := root.Bucket([]byte(term)); bkt != nil {
+			collect(bkt)
+		}
+		return ids
+	}
+
+	c := root.Cursor()
+	p := []byte(term)
+	for k, _ := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, _ = c.Next() {
+		if bkt := root.Bucket(k); bkt != nil {
+			collect(bkt)
+		}
+	}
+	return ids
+}
+
+// 全文搜索, 多个词为 AND, 以 * 结尾表示前缀匹配; 结果按时间倒序
+func (fdb *FlowDB) FullTextSearch(text string, limit int) ([]FullTextHit, error) {
+	type ftsQuery struct {
+		term   string
+		prefix bool
+	}
+
+	terms := make([]ftsQuery, 0)
+	for _, word := range strings.Fields(text) {
+		prefix := strings.HasSuffix(word, "*")
+		for _, token := range ftsTokenize(word) {
+			terms = append(terms, ftsQuery{term: token})
+		}
+		if prefix && len(terms) > 0 {
+			terms[len(terms)-1].prefix = true
+		}
+	}
+
+	hits := make([]FullTextHit, 0)
+	if len(terms) == 0 {
+		return hits, nil
+	}
+
+	fdb.mu.Lock()
+	var matched map[string]string
+	err := fdb.db.Bolt.View(func(tx *bbolt.Tx) error {
+		root := tx.Bucket(ftsBucket)
+		if root == nil {
+			return nil
+		}
+
+		for i, t := range terms {
+			ids := ftsLookup(root, t.term, t.prefix)
+			if i == 0 {
+				matched = ids
+				continue
+			}
+			for k := range matched {
+				if _, ok := ids[k]; !ok {
+					delete(matched, k)
+				}
+			}
+		}
+		return nil
+	})
+	fdb.mu.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(matched))
+	for k := range matched {
+		keys = append(keys, k)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+	}
+
+	words := make([]string, 0, len(terms))
+	for _, t := range terms {
+		if t.prefix {
+			words = append(words, regexp.QuoteMeta(t.term)+`[\p{L}\p{N}_]*`)
+			continue
+		}
+		words = append(words, regexp.QuoteMeta(t.term))
+	}
+	highlight := regexp.MustCompile(`(?i)` + strings.Join(words, "|"))
+
+	for _, k := range keys {
+		flow, err := fdb.FindFlowId(matched[k])
+		if err != nil {
+			continue
+		}
+
+		if err = fdb.LoadBody(flow); err != nil {
+			log.Errorf("flow %s load body fail %v", flow.FlowID, err)
+		}
+
+		hit := FullTextHit{
+			ID:       flow.ID,
+			FlowID:   flow.FlowID,
+			Method:   flow.Method,
+			URL:      flow.RawURL,
+			Snippets: make([]FullTextSnippet, 0),
+		}
+
+		for _, field := range ftsDocument(flow) {
+			if snippet, ok := ftsSnippet(field.text, highlight); ok {
+				hit.Snippets = append(hit.Snippets, FullTextSnippet{Field: field.name, Text: snippet})
+			}
+		}
+		hits = append(hits, hit)
+	}
+
+	return hits, nil
+}
+
+// 截取第一处命中附近的内容, 命中词以 <mark> 标记, 其余内容做 html 转义
+func ftsSnippet(text string, re *regexp.Regexp) (string, bool) {
+	loc := re.FindStringIndex(text)
+	if loc == nil {
+		return "", false
+	}
+
+	start := loc[0] - 40
+	if start < 0 {
+		start = 0
+	}
+	for start > 0 && !utf8.RuneStart(text[start]) {
+		start--
+	}
+
+	end := loc[1] + 80
+	if end > len(text) {
+		end = len(text)
+	}
+	for end < len(text) && !utf8.RuneStart(text[end]) {
+		end++
+	}
+
+	window := text[start:end]
+	var buf strings.Builder
+	if start > 0 {
+		buf.WriteString("...")
+	}
+
+	last := 0
+	for _, m := range re.FindAllStringIndex(window, -1) {
+		buf.WriteString(html.EscapeString(window[last:m[0]]))
+		buf.WriteString("<mark>")
+		buf.WriteString(html.EscapeString(window[m[0]:m[1]]))
+		buf.WriteString("</mark>")
+		last = m[1]
+	}
+	buf.WriteString(html.EscapeString(window[last:]))
+
+	if end < len(text) {
+		buf.WriteString("...")
+	}
+	return buf.String(), true
+}
@@ -0,0 +1,91 @@
+package web
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// 索引异步构建, 等待直到命中 n 条
+func waitFullText(t *testing.T, db *FlowDB, text string, n int) []FullTextHit {
+	t.Helper()
+	for i := 0; i < 200; i++ {
+		hits, err := db.FullTextSearch(text, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(hits) == n {
+			return hits
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("full text %q not %d hits", text, n)
+	return nil
+}
+
+func TestFullTextIndex(t *testing.T) {
+	db := newTestFlowDB(t)
+	db.EnableFullText()
+
+	flows := []*Flow{
+		{Method: "GET", RawURL: "http://a.com/users?id=1", RequestHeader: http.Header{"X-Trace": {"trace_abc"}},
+			ResponseHeader: http.Header{"Content-Type": {"text/html"}}, ResponseBody: "<b>hello</b> alice_12345"},
+		{Method: "POST", RawURL: "http://b.com/login", RequestHeader: http.Header{}, RequestBody: "user=bob&pass=secret",
+			ResponseHeader: http.Header{}, ResponseBody: "hello bob"},
+	}
+	for _, flow := range flows {
+		if err := addTestFlow(db, flow); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hits := waitFullText(t, db, "hello", 2)
+	// 按时间倒序
+	if hits[0].FlowID != flows[1].FlowID || hits[1].FlowID != flows[0].FlowID {
+		t.Fatalf("order %+v", hits)
+	}
+
+	hits = waitFullText(t, db, "hello alice_123*", 1)
+	if hits[0].FlowID != flows[0].FlowID || hits[0].URL != flows[0].RawURL {
+		t.Fatalf("prefix %+v", hits[0])
+	}
+	var body string
+	for _, s := range hits[0].Snippets {
+		if s.Field == "response_body" {
+			body = s.Text
+		}
+	}
+	if !strings.Contains(body, "<mark>alice_12345</mark>") || strings.Contains(body, "<b>") {
+		t.Fatalf("snippet %q", body)
+	}
+
+	waitFullText(t, db, "trace_abc", 1)
+	waitFullText(t, db, "secret bob", 1)
+	waitFullText(t, db, "hello missing", 0)
+
+	// 清理 flow 时同时删除倒排
+	db.SetRetention(Retention{MaxCount: 1, Interval: time.Hour})
+	if n, err := db.Prune(); err != nil || n != 1 {
+		t.Fatalf("prune %d %v", n, err)
+	}
+	if hits = waitFullText(t, db, "hello", 1); hits[0].FlowID != flows[1].FlowID {
+		t.Fatalf("after prune %+v", hits)
+	}
+	waitFullText(t, db, "alice_12345", 0)
+
+	err := db.db.Bolt.View(func(tx *bbolt.Tx) error {
+		if tx.Bucket(ftsBucket).Bucket([]byte("alice_12345")) != nil {
+			t.Fatal("term bucket not removed")
+		}
+		if tx.Bucket(ftsDocBucket).Get(ftsKey(flows[0].ID)) != nil {
+			t.Fatal("doc not removed")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
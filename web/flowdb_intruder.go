@@ -0,0 +1,248 @@
+package web
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/asdine/storm/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+// intruder-result 只保存汇总列, 请求和响应按 jobID/index 保存在 intruder-flow
+const (
+	intruderBucket       = "intruder"
+	intruderResultBucket = "intruder-result"
+	intruderFlowBucket   = "intruder-flow"
+)
+
+const (
+	IntruderRunning = JobRunning
+	IntruderDone    = JobDone
+	IntruderStopped = JobStopped
+)
+
+type IntruderJob struct {
+	ID        string         `json:"id" storm:"id"`
+	User      string         `json:"user"`
+	Mode      string         `json:"mode"`
+	Positions int            `json:"positions"`
+	Total     int            `json:"total"`
+	Done      int            `json:"done"`
+	Errors    int            `json:"errors"`
+	State     string         `json:"state"`
+	Created   time.Time      `json:"created" storm:"index"`
+	Finished  time.Time      `json:"finished"`
+	Attack    IntruderAttack `json:"attack"`
+}
+
+// 一次请求的结果, Flow 包含实际发送的请求和响应, 响应 body 超过 intruderBodyLimit 时截断
+// sniper 时 Position 为替换的位置, 其他模式为 -1
+// 基准请求使用标记内的原值, Index 为 -1, 不计入 Done
+// Matches Extracts 与 IntruderAttack 的 Grep Extract 一一对应, Anomalies 只在分析时填充
+type IntruderResult struct {
+	ID        int      `json:"id" storm:"id,increment"`
+	JobID     string   `json:"job_id" storm:"index"`
+	Index     int      `json:"index"`
+	Baseline  bool     `json:"baseline,omitempty"`
+	Position  int      `json:"position"`
+	Payloads  []string `json:"payloads"`
+	Status    int      `json:"status"`
+	Length    int      `json:"length"`
+	Time      int64    `json:"time"` // 毫秒
+	Error     string   `json:"error,omitempty"`
+	Matches   []bool   `json:"matches,omitempty"`
+	Extracts  []string `json:"extracts,omitempty"`
+	Anomalies []string `json:"anomalies,omitempty"`
+	Flow      *Flow    `json:"flow,omitempty"`
+}
+
+const intruderBaselineIndex = -1
+
+type IntruderDetail struct {
+	IntruderJob
+	Results  []IntruderResult  `json:"results"`
+	Analysis *IntruderAnalysis `json:"analysis,omitempty"`
+}
+
+func (fdb *FlowDB) SaveIntruderJob(job *IntruderJob) {
+	fdb.mu.Lock()
+	defer fdb.mu.Unlock()
+
+	if fdb.db == nil {
+		return
+	}
+
+	if err := fdb.db.From(intruderBucket).Save(job); err != nil {
+		log.Errorf("save intruder job %s fail %v", job.ID, err)
+	}
+}
+
+func (fdb *FlowDB) SaveIntruderResult(res *IntruderResult) {
+	fdb.mu.Lock()
+	defer fdb.mu.Unlock()
+
+	if fdb.db == nil {
+		return
+	}
+
+	row := *res
+	row.Flow = nil
+	if err := fdb.db.From(intruderResultBucket).Save(&row); err != nil {
+		log.Errorf("save intruder result %s/%d fail %v", res.JobID, res.Index, err)
+		return
+	}
+	res.ID = row.ID
+
+	if res.Flow == nil {
+		return
+	}
+	if err := fdb.db.From(intruderFlowBucket).Set(intruderFlowBucket, intruderFlowKey(res.JobID, res.Index), res.Flow); err != nil {
+		log.Errorf("save intruder flow %s/%d fail %v", res.JobID, res.Index, err)
+	}
+}
+
+func intruderFlowKey(id string, index int) string {
+	return fmt.Sprintf("%s/%d", id, index)
+}
+
+// 调用方持有锁; 只按 JobID 索引读取该任务的汇总列, 按序号排序
+func (fdb *FlowDB) intruderRows(id string) ([]IntruderResult, error) {
+	var results []IntruderResult
+	err := fdb.db.From(intruderResultBucket).Find("JobID", id, &results)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+
+	sort.Slice(results, func(i, k int) bool { return results[i].Index < results[k].Index })
+	return results, nil
+}
+
+// 调用方持有锁
+func (fdb *FlowDB) loadIntruderFlow(res *IntruderResult) {
+	if res.Error != "" {
+		return
+	}
+
+	flow := &Flow{}
+	if err := fdb.db.From(intruderFlowBucket).Get(intruderFlowBucket, intruderFlowKey(res.JobID, res.Index), flow); err == nil {
+		res.Flow = flow
+	}
+}
+
+// 按创建时间倒序
+func (fdb *FlowDB) IntruderJobs(skip, size int) ([]IntruderJob, error) {
+	fdb.mu.Lock()
+	defer fdb.mu.Unlock()
+
+	jobs := make([]IntruderJob, 0)
+	err := fdb.db.From(intruderBucket).AllByIndex("Created", &jobs, storm.Reverse(), storm.Skip(skip), storm.Limit(size))
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+func (fdb *FlowDB) IntruderJob(id string) (*IntruderJob, error) {
+	fdb.mu.Lock()
+	defer fdb.mu.Unlock()
+
+	job := &IntruderJob{}
+	if err := fdb.db.From(intruderBucket).One("ID", id, job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// 按请求序号排序, 不包含基准请求, withFlow 为 false 时不返回请求和响应
+func (fdb *FlowDB) IntruderResults(id string, skip, size int, withFlow bool) ([]IntruderResult, error) {
+	fdb.mu.Lock()
+	defer fdb.mu.Unlock()
+
+	rows, err := fdb.intruderRows(id)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]IntruderResult, 0)
+	for _, res := range rows {
+		if res.Index < 0 {
+			continue
+		}
+		if skip > 0 {
+			skip--
+			continue
+		}
+		if size > 0 && len(results) >= size {
+			break
+		}
+
+		if withFlow {
+			fdb.loadIntruderFlow(&res)
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+// index 为 intruderBaselineIndex 时返回基准请求
+func (fdb *FlowDB) IntruderResult(id string, index int) (*IntruderResult, error) {
+	fdb.mu.Lock()
+	defer fdb.mu.Unlock()
+
+	res, err := fdb.intruderResult(id, index)
+	if err != nil {
+		return nil, err
+	}
+	fdb.loadIntruderFlow(res)
+	return res, nil
+}
+
+// 调用方持有锁, 不加载请求和响应
+func (fdb *FlowDB) intruderResult(id string, index int) (*IntruderResult, error) {
+	rows, err := fdb.intruderRows(id)
+	if err != nil {
+		return nil, err
+	}
+
+	i := sort.Search(len(rows), func(i int) bool { return rows[i].Index >= index })
+	if i == len(rows) || rows[i].Index != index {
+		return nil, storm.ErrNotFound
+	}
+	return &rows[i], nil
+}
+
+// 分析任务的全部结果, 基准请求不返回请求和响应
+func (fdb *FlowDB) IntruderAnalysis(job *IntruderJob) (*IntruderAnalysis, error) {
+	results, err := fdb.IntruderResults(job.ID, 0, 0, false)
+	if err != nil {
+		return nil, err
+	}
+
+	an := analyzeIntruder(results, len(job.Attack.Grep))
+
+	fdb.mu.Lock()
+	defer fdb.mu.Unlock()
+	if base, err := fdb.intruderResult(job.ID, intruderBaselineIndex); err == nil {
+		an.Baseline = base
+	}
+	return an, nil
+}
+
+// 第 index 个结果与基准请求的响应差异
+func (fdb *FlowDB) IntruderDiff(id string, index int) (*FlowDiff, error) {
+	base, err := fdb.IntruderResult(id, intruderBaselineIndex)
+	if err != nil {
+		return nil, fmt.Errorf("baseline of job %s not found", id)
+	}
+
+	res, err := fdb.IntruderResult(id, index)
+	if err != nil {
+		return nil, fmt.Errorf("result %d of job %s not found", index, id)
+	}
+
+	if base.Flow == nil || res.Flow == nil {
+		return nil, fmt.Errorf("request fail, baseline: %s result: %s", base.Error, res.Error)
+	}
+	return DiffFlows(base.Flow, res.Flow), nil
+}
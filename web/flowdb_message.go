@@ -95,6 +95,8 @@ type Flow struct {
 	URL           string      `json:"url"`
 	Query         string      `json:"query"`
 	RequestBody   string      `json:"request_body"`
+	RequestSize   int         `json:"request_size"`
+	RequestBlob   string      `json:"request_blob,omitempty"`
 
 	//connect
 	ConnId        string `json:"connId"`
@@ -108,7 +110,17 @@ type Flow struct {
 	ResponseBody   string      `json:"response_body"`
 	StatusCode     int         `json:"status_code"`
 	ResponseSize   int         `json:"response_size"`
+	ResponseBlob   string      `json:"response_blob,omitempty"`
 
+	//stream 模式落盘的 body 文件, 通过 /flow/download 下载
+	Stream       bool   `json:"stream,omitempty"`
+	RequestFile  string `json:"request_file,omitempty"`
+	ResponseFile string `json:"response_file,omitempty"`
+	Truncated    bool   `json:"truncated,omitempty"`
+
+	Timing proxy.Timing `json:"timing"`
+
+	Tags []string  `json:"tags"`
 	Time time.Time `json:"time"`
 }
 
@@ -126,7 +138,7 @@ func (f *Flow) ToSimple() FlowSimple {
 		RawURL:      f.RawURL,
 		URL:         f.URL,
 		Query:       f.Query,
-		RequestBody: f.RequestBody,
+		RequestSize: f.RequestSize,
 
 		//connect,
 		ConnId:        f.ConnId,
@@ -138,6 +150,9 @@ func (f *Flow) ToSimple() FlowSimple {
 		//response,
 		StatusCode:   f.StatusCode,
 		ResponseSize: f.ResponseSize,
+		Stream:       f.Stream,
+		Duration:     f.Duration(),
+		Tags:         f.Tags,
 		Time:         f.Time.Unix(),
 	}
 
@@ -156,7 +171,7 @@ type FlowSimple struct {
 	RawURL      string `json:"rawURL"`
 	URL         string `json:"url"`
 	Query       string `json:"query"`
-	RequestBody string `json:"request_body"`
+	RequestSize int    `json:"request_size"`
 
 	//connect
 	ConnId        string `json:"connId"`
@@ -166,9 +181,12 @@ type FlowSimple struct {
 	ServerPeer    string `json:"server_peer"`
 
 	//response
-	StatusCode   int   `json:"status_code"`
-	ResponseSize int   `json:"response_size"`
-	Time         int64 `json:"time"`
+	StatusCode   int      `json:"status_code"`
+	ResponseSize int      `json:"response_size"`
+	Stream       bool     `json:"stream,omitempty"`
+	Duration     int64    `json:"duration"`
+	Tags         []string `json:"tags"`
+	Time         int64    `json:"time"`
 }
 
 func (f *Flow) Uncompress() *Flow {
@@ -217,6 +235,41 @@ func (f *Flow) WithResponse(pf *proxy.Flow, decompress bool) {
 
 }
 
+// 请求头读取到响应写回客户端的耗时(ms), 响应未完成时到响应读取完成
+func (f *Flow) Duration() int64 {
+	t := f.Timing
+	if t.RequestHeaders.IsZero() {
+		return 0
+	}
+
+	end := t.ClientComplete
+	if end.IsZero() {
+		end = t.ResponseComplete
+	}
+	if end.IsZero() {
+		return 0
+	}
+	return end.Sub(t.RequestHeaders).Milliseconds()
+}
+
+// stream 模式下 body 大小取自 spool
+func (f *Flow) WithSpool(pf *proxy.Flow) {
+	if !pf.Stream {
+		return
+	}
+	f.Stream = true
+
+	if s := pf.Request.Spool; s != nil {
+		f.RequestSize = int(s.Size)
+		f.Truncated = f.Truncated || s.Truncated
+	}
+
+	if pf.Response != nil && pf.Response.Spool != nil {
+		f.ResponseSize = int(pf.Response.Spool.Size)
+		f.Truncated = f.Truncated || pf.Response.Spool.Truncated
+	}
+}
+
 func ToFlow(msg *messageFlow, f *proxy.Flow, decompress bool) *Flow {
 	connId := f.ConnContext.Id().String()
 	flow := &Flow{
@@ -230,7 +283,10 @@ func ToFlow(msg *messageFlow, f *proxy.Flow, decompress bool) *Flow {
 		ClientAddress: f.ConnContext.ClientConn.Conn.RemoteAddr().String(),
 		ClientTls:     f.ConnContext.ClientConn.Tls,
 		RequestBody:   auxlib.B2S(f.Request.Body),
+		RequestSize:   len(f.Request.Body),
+		Tags:          f.Tags,
 		Time:          time.Now(),
+		Timing:        f.Timing,
 	}
 
 	flow.ParseURL()
@@ -240,5 +296,6 @@ func ToFlow(msg *messageFlow, f *proxy.Flow, decompress bool) *Flow {
 		flow.WithResponse(f, decompress)
 	}
 
+	flow.WithSpool(f)
 	return flow
 }
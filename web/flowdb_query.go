@@ -0,0 +1,651 @@
+package web
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/asdine/storm/v3/q"
+)
+
+/*
+	history 过滤表达式:
+
+	host:~api\. AND status>=400 AND method:POST AND resp.body:"error"
+	(host:a.com OR host:b.com) NOT path:~"\.(js|css)$"
+
+	field:value   包含(忽略大小写), 数值字段为等于
+	field=value   等于          field!=value  不等于
+	field:~regex  正则          field!~regex  正则不匹配
+	field>n >= < <=             数值比较, duration 单位 ms
+	value         不带字段时匹配 url
+
+	相邻条件默认 AND, 支持 AND OR NOT 与括号
+*/
+
+type QueryError struct {
+	Pos int    `json:"pos"`
+	Msg string `json:"error"`
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("query error at %d: %s", e.Pos, e.Msg)
+}
+
+type queryNode interface {
+	match(f *Flow, cache *queryCache) bool
+}
+
+type queryAnd struct{ left, right queryNode }
+type queryOr struct{ left, right queryNode }
+type queryNot struct{ node queryNode }
+
+func (n *queryAnd) match(f *Flow, c *queryCache) bool {
+	return n.left.match(f, c) && n.right.match(f, c)
+}
+
+func (n *queryOr) match(f *Flow, c *queryCache) bool {
+	return n.left.match(f, c) || n.right.match(f, c)
+}
+
+func (n *queryNot) match(f *Flow, c *queryCache) bool {
+	return !n.node.match(f, c)
+}
+
+type queryTerm struct {
+	field string
+	op    string
+	value string
+	lower string
+	re    *regexp.Regexp
+	num   float64
+}
+
+// 一次匹配内缓存解析结果, 避免重复解压 body
+type queryCache struct {
+	url     *url.URL
+	reqBody *string
+	resBody *string
+	blob    func(hash string) ([]byte, error)
+}
+
+var queryNumericFields = map[string]bool{
+	"status":   true,
+	"size":     true,
+	"id":       true,
+	"time":     true,
+	"duration": true,
+}
+
+var queryStringFields = map[string]bool{
+	"host":      true,
+	"path":      true,
+	"url":       true,
+	"query":     true,
+	"method":    true,
+	"scheme":    true,
+	"proto":     true,
+	"client":    true,
+	"server":    true,
+	"conn":      true,
+	"flow":      true,
+	"tag":       true,
+	"type":      true,
+	"req.body":  true,
+	"resp.body": true,
+}
+
+var queryFieldAlias = map[string]string{
+	"request.body":    "req.body",
+	"response.body":   "resp.body",
+	"request.header":  "req.header",
+	"response.header": "resp.header",
+	"code":            "status",
+	"length":          "size",
+}
+
+type FlowQuery struct {
+	raw  string
+	root queryNode
+}
+
+func (fq *FlowQuery) String() string {
+	return fq.raw
+}
+
+func (fq *FlowQuery) MatchFlow(f *Flow) bool {
+	if fq == nil || fq.root == nil {
+		return true
+	}
+	return fq.root.match(f, &queryCache{})
+}
+
+// storm q.Matcher
+func (fq *FlowQuery) Match(i interface{}) (bool, error) {
+	switch f := i.(type) {
+	case *Flow:
+		return fq.MatchFlow(f), nil
+	case Flow:
+		return fq.MatchFlow(&f), nil
+	}
+	return false, nil
+}
+
+// body 存在 blob 中时按需读取
+type flowBlobMatcher struct {
+	fq   *FlowQuery
+	blob func(hash string) ([]byte, error)
+}
+
+func (fq *FlowQuery) withBlob(blob func(hash string) ([]byte, error)) q.Matcher {
+	return &flowBlobMatcher{fq: fq, blob: blob}
+}
+
+func (m *flowBlobMatcher) Match(i interface{}) (bool, error) {
+	if m.fq.root == nil {
+		return true, nil
+	}
+
+	switch f := i.(type) {
+	case *Flow:
+		return m.fq.root.match(f, &queryCache{blob: m.blob}), nil
+	case Flow:
+		return m.fq.root.match(&f, &queryCache{blob: m.blob}), nil
+	}
+	return false, nil
+}
+
+func ParseQuery(raw string) (*FlowQuery, error) {
+	p := &queryParser{src: raw}
+	if err := p.lex(); err != nil {
+		return nil, err
+	}
+
+	fq := &FlowQuery{raw: raw}
+	if len(p.tokens) == 1 {
+		return fq, nil
+	}
+
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, &QueryError{Pos: tok.pos, Msg: fmt.Sprintf("unexpected %q", tok.text)}
+	}
+
+	fq.root = root
+	return fq, nil
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokLParen
+	tokRParen
+	tokAnd
+	tokOr
+	tokNot
+	tokTerm
+)
+
+type queryToken struct {
+	kind tokenKind
+	pos  int
+	text string
+	term *queryTerm
+}
+
+type queryParser struct {
+	src    string
+	tokens []queryToken
+	cur    int
+}
+
+func isQueryFieldChar(c byte) bool {
+	return c == '.' || c == '_' || c == '-' ||
+		(c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+var queryOps = []string{":~", "!~", "!=", ">=", "<=", ":", "=", "~", ">", "<"}
+
+func (p *queryParser) lex() error {
+	src := p.src
+	i := 0
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+			continue
+		case c == '(':
+			p.tokens = append(p.tokens, queryToken{kind: tokLParen, pos: i, text: "("})
+			i++
+			continue
+		case c == ')':
+			p.tokens = append(p.tokens, queryToken{kind: tokRParen, pos: i, text: ")"})
+			i++
+			continue
+		}
+
+		start := i
+		for i < len(src) && isQueryFieldChar(src[i]) {
+			i++
+		}
+		word := src[start:i]
+
+		op := ""
+		for _, item := range queryOps {
+			if strings.HasPrefix(src[i:], item) {
+				op = item
+				break
+			}
+		}
+
+		if op == "" || word == "" {
+			// 关键字或不带字段的值
+			if word != "" && (i == len(src) || strings.IndexByte(" \t\r\n()", src[i]) != -1) {
+				switch strings.ToUpper(word) {
+				case "AND":
+					p.tokens = append(p.tokens, queryToken{kind: tokAnd, pos: start, text: word})
+					continue
+				case "OR":
+					p.tokens = append(p.tokens, queryToken{kind: tokOr, pos: start, text: word})
+					continue
+				case "NOT":
+					p.tokens = append(p.tokens, queryToken{kind: tokNot, pos: start, text: word})
+					continue
+				}
+			}
+
+			i = start
+			value, next, err := p.value(i)
+			if err != nil {
+				return err
+			}
+			term, err := newQueryTerm(start, "url", ":", value)
+			if err != nil {
+				return err
+			}
+			p.tokens = append(p.tokens, queryToken{kind: tokTerm, pos: start, text: src[start:next], term: term})
+			i = next
+			continue
+		}
+
+		i += len(op)
+		value, next, err := p.value(i)
+		if err != nil {
+			return err
+		}
+
+		term, err := newQueryTerm(start, word, op, value)
+		if err != nil {
+			return err
+		}
+		p.tokens = append(p.tokens, queryToken{kind: tokTerm, pos: start, text: src[start:next], term: term})
+		i = next
+	}
+
+	p.tokens = append(p.tokens, queryToken{kind: tokEOF, pos: len(src), text: "EOF"})
+	return nil
+}
+
+// 读取值: 引号字符串或直到空白/未配对右括号
+func (p *queryParser) value(i int) (string, int, error) {
+	src := p.src
+	if i >= len(src) || src[i] == ' ' || src[i] == '\t' {
+		return "", i, &QueryError{Pos: i, Msg: "expected value"}
+	}
+
+	if src[i] == '"' {
+		var buf strings.Builder
+		for j := i + 1; j < len(src); j++ {
+			c := src[j]
+			if c == '\\' && j+1 < len(src) && (src[j+1] == '"' || src[j+1] == '\\') {
+				buf.WriteByte(src[j+1])
+				j++
+				continue
+			}
+			if c == '"' {
+				return buf.String(), j + 1, nil
+			}
+			buf.WriteByte(c)
+		}
+		return "", i, &QueryError{Pos: i, Msg: "unterminated string"}
+	}
+
+	depth := 0
+	j := i
+	for ; j < len(src); j++ {
+		c := src[j]
+		if c == ' ' || c == '\t' || c == '\n' || c == '\r' {
+			break
+		}
+		if c == '(' {
+			depth++
+		}
+		if c == ')' {
+			if depth == 0 {
+				break
+			}
+			depth--
+		}
+	}
+
+	if j == i {
+		return "", i, &QueryError{Pos: i, Msg: "expected value"}
+	}
+	return src[i:j], j, nil
+}
+
+func newQueryTerm(pos int, field, op, value string) (*queryTerm, error) {
+	valuePos := pos + len(field) + len(op)
+
+	field = strings.ToLower(field)
+	for alias, name := range queryFieldAlias {
+		if field == alias || strings.HasPrefix(field, alias+".") {
+			field = name + field[len(alias):]
+			break
+		}
+	}
+
+	isHeader := strings.HasPrefix(field, "req.header.") || strings.HasPrefix(field, "resp.header.")
+	if !isHeader && !queryStringFields[field] && !queryNumericFields[field] {
+		return nil, &QueryError{Pos: pos, Msg: fmt.Sprintf("unknown field %s", field)}
+	}
+
+	term := &queryTerm{field: field, op: op, value: value, lower: strings.ToLower(value)}
+
+	switch op {
+	case ":~", "~", "!~":
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return nil, &QueryError{Pos: valuePos, Msg: fmt.Sprintf("invalid regex %v", err)}
+		}
+		term.re = re
+		return term, nil
+	}
+
+	if !queryNumericFields[field] {
+		switch op {
+		case ">", ">=", "<", "<=":
+			return nil, &QueryError{Pos: pos, Msg: fmt.Sprintf("field %s not numeric", field)}
+		}
+		return term, nil
+	}
+
+	num, err := parseQueryNumber(field, value)
+	if err != nil {
+		return nil, &QueryError{Pos: valuePos, Msg: err.Error()}
+	}
+	term.num = num
+	return term, nil
+}
+
+func parseQueryNumber(field, value string) (float64, error) {
+	if field == "time" {
+		for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02"} {
+			if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+				return float64(t.Unix()), nil
+			}
+		}
+	}
+
+	num, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %s", value)
+	}
+	return num, nil
+}
+
+func (p *queryParser) peek() queryToken {
+	return p.tokens[p.cur]
+}
+
+func (p *queryParser) next() queryToken {
+	tok := p.tokens[p.cur]
+	if tok.kind != tokEOF {
+		p.cur++
+	}
+	return tok
+}
+
+func (p *queryParser) parseOr() (queryNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek().kind == tokOr {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &queryOr{left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *queryParser) parseAnd() (queryNode, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		switch p.peek().kind {
+		case tokAnd:
+			p.next()
+		case tokNot, tokTerm, tokLParen:
+			// 相邻条件默认 AND
+		default:
+			return left, nil
+		}
+
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &queryAnd{left: left, right: right}
+	}
+}
+
+func (p *queryParser) parseNot() (queryNode, error) {
+	if p.peek().kind == tokNot {
+		p.next()
+		node, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &queryNot{node: node}, nil
+	}
+
+	return p.parsePrimary()
+}
+
+func (p *queryParser) parsePrimary() (queryNode, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokTerm:
+		return tok.term, nil
+
+	case tokLParen:
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if end := p.next(); end.kind != tokRParen {
+			return nil, &QueryError{Pos: end.pos, Msg: "expected )"}
+		}
+		return node, nil
+
+	case tokEOF:
+		return nil, &QueryError{Pos: tok.pos, Msg: "unexpected end of query"}
+	}
+
+	return nil, &QueryError{Pos: tok.pos, Msg: fmt.Sprintf("unexpected %q", tok.text)}
+}
+
+func (c *queryCache) parsedURL(f *Flow) *url.URL {
+	if c.url == nil {
+		u, err := url.Parse(f.RawURL)
+		if err != nil {
+			u = &url.URL{}
+		}
+		c.url = u
+	}
+	return c.url
+}
+
+func (c *queryCache) requestBody(f *Flow) string {
+	if c.reqBody == nil {
+		body := UncompressedBody(f.RequestHeader, c.rawBody(f.RequestBody, f.RequestBlob))
+		c.reqBody = &body
+	}
+	return *c.reqBody
+}
+
+func (c *queryCache) responseBody(f *Flow) string {
+	if c.resBody == nil {
+		body := UncompressedBody(f.ResponseHeader, c.rawBody(f.ResponseBody, f.ResponseBlob))
+		c.resBody = &body
+	}
+	return *c.resBody
+}
+
+func (c *queryCache) rawBody(inline, hash string) []byte {
+	if inline != "" || hash == "" || c.blob == nil {
+		return []byte(inline)
+	}
+
+	body, err := c.blob(hash)
+	if err != nil {
+		return nil
+	}
+	return body
+}
+
+// 返回字段的候选值, 任一命中即可
+func (t *queryTerm) values(f *Flow, c *queryCache) []string {
+	switch t.field {
+	case "host":
+		return []string{c.parsedURL(f).Host}
+	case "path":
+		return []string{c.parsedURL(f).Path}
+	case "url":
+		return []string{f.RawURL}
+	case "query":
+		return []string{f.Query}
+	case "method":
+		return []string{f.Method}
+	case "scheme":
+		return []string{f.Scheme}
+	case "proto":
+		return []string{f.Proto}
+	case "client":
+		return []string{f.ClientAddress}
+	case "server":
+		return []string{f.ServerAddress, f.ServerPeer}
+	case "conn":
+		return []string{f.ConnId}
+	case "flow":
+		return []string{f.FlowID}
+	case "tag":
+		return f.Tags
+	case "type":
+		return []string{f.ResponseHeader.Get("Content-Type")}
+	case "req.body":
+		return []string{c.requestBody(f)}
+	case "resp.body":
+		return []string{c.responseBody(f)}
+	}
+
+	if strings.HasPrefix(t.field, "req.header.") {
+		return f.RequestHeader.Values(t.field[len("req.header."):])
+	}
+
+	if strings.HasPrefix(t.field, "resp.header.") {
+		return f.ResponseHeader.Values(t.field[len("resp.header."):])
+	}
+
+	return nil
+}
+
+func (t *queryTerm) number(f *Flow) float64 {
+	switch t.field {
+	case "status":
+		return float64(f.StatusCode)
+	case "size":
+		return float64(f.ResponseSize)
+	case "id":
+		return float64(f.ID)
+	case "time":
+		return float64(f.Time.Unix())
+	case "duration":
+		return float64(f.Duration())
+	}
+	return 0
+}
+
+func (t *queryTerm) match(f *Flow, c *queryCache) bool {
+	if queryNumericFields[t.field] && t.re == nil {
+		n := t.number(f)
+		switch t.op {
+		case ":", "=":
+			return n == t.num
+		case "!=":
+			return n != t.num
+		case ">":
+			return n > t.num
+		case ">=":
+			return n >= t.num
+		case "<":
+			return n < t.num
+		case "<=":
+			return n <= t.num
+		}
+		return false
+	}
+
+	var values []string
+	if queryNumericFields[t.field] {
+		values = []string{strconv.FormatFloat(t.number(f), 'f', -1, 64)}
+	} else {
+		values = t.values(f, c)
+	}
+
+	if t.op == "!=" || t.op == "!~" {
+		for _, v := range values {
+			if (t.op == "!=" && v == t.value) || (t.op == "!~" && t.re.MatchString(v)) {
+				return false
+			}
+		}
+		return true
+	}
+
+	for _, v := range values {
+		switch t.op {
+		case ":":
+			if strings.Contains(strings.ToLower(v), t.lower) {
+				return true
+			}
+		case "=":
+			if v == t.value {
+				return true
+			}
+		case ":~", "~":
+			if t.re.MatchString(v) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,93 @@
+package web
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseQuery(t *testing.T) {
+	flow := &Flow{
+		ID:             7,
+		Method:         "POST",
+		RawURL:         "https://api.example.com/v1/login?user=bob",
+		Query:          "user=bob",
+		RequestHeader:  http.Header{"Content-Type": {"application/json"}},
+		RequestBody:    `{"user":"bob"}`,
+		ResponseHeader: http.Header{"Content-Type": {"application/json"}},
+		ResponseBody:   `{"error":"invalid password"}`,
+		StatusCode:     401,
+		ResponseSize:   28,
+		Tags:           []string{"auth"},
+		Time:           time.Date(2023, 5, 1, 10, 0, 0, 0, time.Local),
+	}
+
+	cases := []struct {
+		expr string
+		want bool
+	}{
+		{``, true},
+		{`host:~api\. AND status>=400 AND method:POST AND resp.body:"error"`, true},
+		{`host:~api\. status>=400`, true},
+		{`host:www.example.com OR path:/v1/login`, true},
+		{`host:www.example.com OR status<400`, false},
+		{`NOT method=GET`, true},
+		{`not (status:401 or status:403)`, false},
+		{`method=post`, false},
+		{`method!=GET AND status!=200`, true},
+		{`path!~"^/v1/(login|logout)$"`, false},
+		{`req.header.content-type:json`, true},
+		{`request.body:"\"user\""`, true},
+		{`tag:auth size<100 id=7`, true},
+		{`time>=2023-05-01 AND time<"2023-05-02"`, true},
+		{`login`, true},
+		{`"/v2/"`, false},
+		{`(host:api.example.com)`, true},
+	}
+
+	for _, c := range cases {
+		fq, err := ParseQuery(c.expr)
+		if err != nil {
+			t.Errorf("%s parse fail %v", c.expr, err)
+			continue
+		}
+
+		if got := fq.MatchFlow(flow); got != c.want {
+			t.Errorf("%s = %v, want %v", c.expr, got, c.want)
+		}
+
+		if ok, _ := fq.Match(*flow); ok != c.want {
+			t.Errorf("%s storm matcher = %v, want %v", c.expr, ok, c.want)
+		}
+	}
+}
+
+func TestParseQueryError(t *testing.T) {
+	cases := []struct {
+		expr string
+		pos  int
+	}{
+		{`status>=abc`, 8},
+		{`host:~"(" AND x`, 6},
+		{`method:GET AND`, 14},
+		{`(method:GET`, 11},
+		{`method:GET )`, 11},
+		{`foo:bar`, 0},
+		{`status>=400 AND host>a`, 16},
+		{`host:"abc`, 5},
+		{`host: a`, 5},
+	}
+
+	for _, c := range cases {
+		_, err := ParseQuery(c.expr)
+		qe, ok := err.(*QueryError)
+		if !ok {
+			t.Errorf("%s should fail, got %v", c.expr, err)
+			continue
+		}
+
+		if qe.Pos != c.pos {
+			t.Errorf("%s error at %d, want %d: %v", c.expr, qe.Pos, c.pos, qe)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package web
+
+import (
+	"time"
+
+	"github.com/asdine/storm/v3"
+	"github.com/asdine/storm/v3/q"
+	"github.com/vela-ssoc/vela-mitm/proxy"
+)
+
+const (
+	repeaterTabBucket   = "repeater-tab"
+	repeaterEntryBucket = "repeater-entry"
+)
+
+// Request 为最近一次编辑或发送的请求, Source 为创建时使用的 history flow_id; Raw 不为空时为原始请求标签
+type RepeaterTab struct {
+	ID      string                `json:"id" storm:"id"`
+	Name    string                `json:"name"`
+	Source  string                `json:"source,omitempty"`
+	Request proxy.RequestEditData `json:"request"`
+	Raw     *RawRequest           `json:"raw,omitempty"`
+	Count   int                   `json:"count"`
+	Created time.Time             `json:"created" storm:"index"`
+	Updated time.Time             `json:"updated"`
+}
+
+// 一次发送, Seq 在标签内从 1 开始递增; Flow 包含实际发送的请求和响应, 响应 body 超过 repeaterBodyLimit 时截断
+// 原始请求标签的发送结果在 Raw 中
+type RepeaterEntry struct {
+	ID    int        `json:"id" storm:"id,increment"`
+	TabID string     `json:"tab_id" storm:"index"`
+	Seq   int        `json:"seq"`
+	Sent  time.Time  `json:"sent"`
+	Time  int64      `json:"time"` // 毫秒
+	Error string     `json:"error,omitempty"`
+	Flow  *Flow      `json:"flow,omitempty"`
+	Raw   *RawResult `json:"raw,omitempty"`
+}
+
+type RepeaterDetail struct {
+	RepeaterTab
+	Entries []RepeaterEntry `json:"entries"`
+}
+
+func (fdb *FlowDB) SaveRepeaterTab(tab *RepeaterTab) error {
+	fdb.mu.Lock()
+	defer fdb.mu.Unlock()
+
+	return fdb.db.From(repeaterTabBucket).Save(tab)
+}
+
+// 按创建时间倒序
+func (fdb *FlowDB) RepeaterTabs() ([]RepeaterTab, error) {
+	fdb.mu.Lock()
+	defer fdb.mu.Unlock()
+
+	tabs := make([]RepeaterTab, 0)
+	err := fdb.db.From(repeaterTabBucket).AllByIndex("Created", &tabs, storm.Reverse())
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	return tabs, nil
+}
+
+func (fdb *FlowDB) RepeaterTab(id string) (*RepeaterTab, error) {
+	fdb.mu.Lock()
+	defer fdb.mu.Unlock()
+
+	tab := &RepeaterTab{}
+	if err := fdb.db.From(repeaterTabBucket).One("ID", id, tab); err != nil {
+		return nil, err
+	}
+	return tab, nil
+}
+
+// 同时删除标签的全部发送记录
+func (fdb *FlowDB) DeleteRepeaterTab(id string) error {
+	fdb.mu.Lock()
+	defer fdb.mu.Unlock()
+
+	tab := &RepeaterTab{}
+	if err := fdb.db.From(repeaterTabBucket).One("ID", id, tab); err != nil {
+		return err
+	}
+
+	err := fdb.db.From(repeaterEntryBucket).Select(q.Eq("TabID", id)).Delete(new(RepeaterEntry))
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+	return fdb.db.From(repeaterTabBucket).DeleteStruct(tab)
+}
+
+// 追加发送记录并更新标签的请求和计数
+func (fdb *FlowDB) AddRepeaterEntry(tab *RepeaterTab, entry *RepeaterEntry) error {
+	fdb.mu.Lock()
+	defer fdb.mu.Unlock()
+
+	stored := &RepeaterTab{}
+	if err := fdb.db.From(repeaterTabBucket).One("ID", tab.ID, stored); err != nil {
+		return err
+	}
+
+	stored.Request, stored.Raw = tab.Request, tab.Raw
+	stored.Count++
+	stored.Updated = time.Now()
+	entry.TabID, entry.Seq = stored.ID, stored.Count
+
+	if err := fdb.db.From(repeaterEntryBucket).Save(entry); err != nil {
+		return err
+	}
+	if err := fdb.db.From(repeaterTabBucket).Save(stored); err != nil {
+		return err
+	}
+	*tab = *stored
+	return nil
+}
+
+// 按 Seq 排序, withFlow 为 false 时不返回请求和响应 (包括原始响应)
+func (fdb *FlowDB) RepeaterEntries(id string, skip, size int, withFlow bool) ([]RepeaterEntry, error) {
+	fdb.mu.Lock()
+	defer fdb.mu.Unlock()
+
+	entries := make([]RepeaterEntry, 0)
+	query := fdb.db.From(repeaterEntryBucket).Select(q.Eq("TabID", id)).OrderBy("Seq").Skip(skip)
+	if size > 0 {
+		query = query.Limit(size)
+	}
+
+	err := query.Find(&entries)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+
+	if !withFlow {
+		for i := range entries {
+			entries[i].Flow, entries[i].Raw = nil, nil
+		}
+	}
+	return entries, nil
+}
+
+func (fdb *FlowDB) RepeaterEntry(id string, seq int) (*RepeaterEntry, error) {
+	fdb.mu.Lock()
+	defer fdb.mu.Unlock()
+
+	entry := &RepeaterEntry{}
+	err := fdb.db.From(repeaterEntryBucket).Select(q.Eq("TabID", id), q.Eq("Seq", seq)).First(entry)
+	if err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
@@ -0,0 +1,470 @@
+package web
+
+import (
+	"encoding/binary"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/asdine/storm/v3/index"
+	log "github.com/sirupsen/logrus"
+	"go.etcd.io/bbolt"
+)
+
+/*
+	history 保留策略, 由后台 janitor 定期清理:
+	max_age   超过时长的 flow 删除
+	max_count 只保留最新的 N 条
+	max_size  flow 记录, blob 和落盘 body 的总大小(字节)
+	exclude   不参与清理的 host, 支持 *.example.com
+	compact   定期压缩数据库文件, 回收已删除记录的空间
+*/
+
+type Retention struct {
+	MaxAge   time.Duration `json:"max_age" yaml:"max_age"`
+	MaxCount int           `json:"max_count" yaml:"max_count"`
+	MaxSize  int64         `json:"max_size" yaml:"max_size"`
+	Exclude  []string      `json:"exclude" yaml:"exclude"`
+	Interval time.Duration `json:"interval" yaml:"interval"`
+	Compact  time.Duration `json:"compact" yaml:"compact"`
+}
+
+const (
+	defaultPruneInterval = time.Minute
+	compactTxMaxSize     = 64 * 1024 * 1024
+
+	// storm 存储 Flow 的子 bucket 及 FlowID 唯一索引
+	stormFlowBucket  = "Flow"
+	stormFlowIDIndex = "__storm_index_FlowID"
+)
+
+type FlowDBStats struct {
+	Flows       int       `json:"flows"`
+	FlowBytes   int64     `json:"flow_bytes"`
+	Blobs       int       `json:"blobs"`
+	BlobBytes   int64     `json:"blob_bytes"`
+	SpoolFiles  int       `json:"spool_files"`
+	SpoolBytes  int64     `json:"spool_bytes"`
+	FileSize    int64     `json:"file_size"`
+	Oldest      int64     `json:"oldest"`
+	Newest      int64     `json:"newest"`
+	Pruned      int64     `json:"pruned"`
+	LastPrune   int64     `json:"last_prune"`
+	Reclaimed   int64     `json:"reclaimed"`
+	LastCompact int64     `json:"last_compact"`
+	FullText    bool      `json:"fulltext"`
+	Retention   Retention `json:"retention"`
+}
+
+type janitorStat struct {
+	pruned      int64
+	lastPrune   int64
+	reclaimed   int64
+	lastCompact int64
+}
+
+// 清理时只解码需要的字段
+type flowMeta struct {
+	FlowID       string    `json:"flow_id"`
+	RawURL       string    `json:"rawURL"`
+	RequestBlob  string    `json:"request_blob"`
+	ResponseBlob string    `json:"response_blob"`
+	RequestFile  string    `json:"request_file"`
+	ResponseFile string    `json:"response_file"`
+	RequestSize  int       `json:"request_size"`
+	ResponseSize int       `json:"response_size"`
+	StatusCode   int       `json:"status_code"`
+	Time         time.Time `json:"time"`
+}
+
+// 记录大小, 包含 blob 和落盘的 body; 共用的 blob 按存储的字节只计一次, 算在最新引用它的 flow 上
+func (m *flowMeta) size(record []byte, blobs *bbolt.Bucket, seen map[string]bool) int64 {
+	n := int64(len(record))
+	for _, hash := range []string{m.RequestBlob, m.ResponseBlob} {
+		if hash == "" || blobs == nil || seen[hash] {
+			continue
+		}
+		seen[hash] = true
+		n += int64(len(blobs.Get([]byte(hash))))
+	}
+	if m.RequestFile != "" {
+		n += int64(m.RequestSize)
+	}
+	if m.ResponseFile != "" {
+		n += int64(m.ResponseSize)
+	}
+	return n
+}
+
+func (r Retention) enable() bool {
+	return r.MaxAge > 0 || r.MaxCount > 0 || r.MaxSize > 0 || r.Compact > 0
+}
+
+func (r Retention) excluded(host string) bool {
+	for _, pattern := range r.Exclude {
+		if hostMatch(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// example.com 精确匹配, *.example.com 匹配 example.com 及其子域名
+func hostMatch(pattern, host string) bool {
+	pattern = strings.ToLower(pattern)
+	host = strings.ToLower(host)
+
+	if !strings.HasPrefix(pattern, "*.") {
+		return pattern == host
+	}
+
+	suffix := pattern[1:]
+	return host == suffix[1:] || strings.HasSuffix(host, suffix)
+}
+
+// 设置保留策略并启动 janitor, 重复调用会替换之前的策略
+func (fdb *FlowDB) SetRetention(r Retention) {
+	if r.Interval <= 0 {
+		r.Interval = defaultPruneInterval
+	}
+
+	fdb.mu.Lock()
+	defer fdb.mu.Unlock()
+
+	fdb.stopJanitor()
+	fdb.retention = r
+	if !r.enable() {
+		return
+	}
+
+	fdb.janitor = make(chan struct{})
+	go fdb.janitorLoop(fdb.janitor, r)
+}
+
+func (fdb *FlowDB) stopJanitor() {
+	if fdb.janitor == nil {
+		return
+	}
+	close(fdb.janitor)
+	fdb.janitor = nil
+}
+
+func (fdb *FlowDB) janitorLoop(done chan struct{}, r Retention) {
+	prune := time.NewTicker(r.Interval)
+	defer prune.Stop()
+
+	var compact <-chan time.Time
+	if r.Compact > 0 {
+		tk := time.NewTicker(r.Compact)
+		defer tk.Stop()
+		compact = tk.C
+	}
+
+	for {
+		select {
+		case <-done:
+			return
+
+		case <-prune.C:
+			if n, err := fdb.Prune(); err != nil {
+				log.Errorf("flow db prune fail %v", err)
+			} else if n > 0 {
+				log.Infof("flow db prune %d flows", n)
+			}
+
+		case <-compact:
+			if n, err := fdb.Compact(); err != nil {
+				log.Errorf("flow db compact fail %v", err)
+			} else {
+				log.Infof("flow db compact reclaimed %d bytes", n)
+			}
+		}
+	}
+}
+
+// 按保留策略删除 flow, 从最新往旧遍历, 返回删除条数
+func (fdb *FlowDB) Prune() (int, error) {
+	fdb.mu.Lock()
+	defer fdb.mu.Unlock()
+
+	if fdb.db == nil {
+		return 0, nil
+	}
+
+	r := fdb.retention
+	if r.MaxAge <= 0 && r.MaxCount <= 0 && r.MaxSize <= 0 {
+		return 0, nil
+	}
+
+	var deleted int
+	var files []string
+	var oldest time.Time // 保留的 flow 中最早的时间
+	now := time.Now()
+	err := fdb.db.Bolt.Update(func(tx *bbolt.Tx) error {
+		records := fdb.records(tx)
+		if records == nil {
+			return nil
+		}
+
+		type victim struct {
+			key  []byte
+			meta flowMeta
+		}
+
+		var count int
+		var size int64
+		victims := make([]victim, 0)
+		blobs := tx.Bucket(blobBucket)
+		seen := make(map[string]bool)
+
+		c := records.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			// 索引等子 bucket
+			if v == nil {
+				continue
+			}
+
+			var meta flowMeta
+			if err := SonicCodec.Unmarshal(v, &meta); err != nil {
+				continue
+			}
+
+			if u, err := url.Parse(meta.RawURL); err == nil && r.excluded(u.Hostname()) {
+				continue
+			}
+
+			count++
+			size += meta.size(v, blobs, seen)
+
+			if (r.MaxAge > 0 && now.Sub(meta.Time) > r.MaxAge) ||
+				(r.MaxCount > 0 && count > r.MaxCount) ||
+				(r.MaxSize > 0 && size > r.MaxSize) {
+				victims = append(victims, victim{key: append([]byte(nil), k...), meta: meta})
+				continue
+			}
+			oldest = meta.Time
+		}
+
+		if len(victims) == 0 {
+			return nil
+		}
+
+		idx, err := index.NewUniqueIndex(records, []byte(stormFlowIDIndex))
+		if err != nil {
+			return err
+		}
+
+		mgr := fdb.db.From(fdb.FlowMgrBkt).WithTransaction(tx)
+		fsm := &FlowStatMgr{}
+		mgr.Get(fdb.FlowMgrBkt, "flow-mgr", fsm)
+
+		for _, item := range victims {
+			if err = records.Delete(item.key); err != nil {
+				return err
+			}
+
+			if item.meta.FlowID != "" {
+				if err = idx.Remove([]byte(item.meta.FlowID)); err != nil {
+					return err
+				}
+			}
+
+			if err = blobRelease(tx, item.meta.RequestBlob); err != nil {
+				return err
+			}
+
+			if err = blobRelease(tx, item.meta.ResponseBlob); err != nil {
+				return err
+			}
+
+			files = append(files, item.meta.RequestFile, item.meta.ResponseFile)
+			fsm.count(item.meta.StatusCode, -1)
+
+			if err = ftsDelete(tx, int(binary.BigEndian.Uint64(item.key))); err != nil {
+				return err
+			}
+		}
+
+		// 统计与剩余的 flow 一致
+		if err = mgr.Set(fdb.FlowMgrBkt, "flow-mgr", fsm); err != nil {
+			return err
+		}
+
+		deleted = len(victims)
+		return nil
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	// 连接在其上的 flow 之后关闭, 早于保留的 flow 关闭的连接上已经没有 flow
+	before := oldest
+	if before.IsZero() {
+		before = now
+	}
+	if r.MaxAge > 0 && now.Add(-r.MaxAge).Before(before) {
+		before = now.Add(-r.MaxAge)
+	}
+	fdb.pruneConns(before)
+
+	fdb.removeSpool(files...)
+	fdb.stat.pruned += int64(deleted)
+	fdb.stat.lastPrune = now.Unix()
+	return deleted, nil
+}
+
+func (fdb *FlowDB) records(tx *bbolt.Tx) *bbolt.Bucket {
+	root := tx.Bucket([]byte(fdb.FlowBucket))
+	if root == nil {
+		return nil
+	}
+	return root.Bucket([]byte(stormFlowBucket))
+}
+
+func fileSize(path string) int64 {
+	s, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return s.Size()
+}
+
+// 压缩数据库文件, 重写到临时文件后替换, 返回回收的字节数
+func (fdb *FlowDB) Compact() (int64, error) {
+	fdb.mu.Lock()
+	defer fdb.mu.Unlock()
+
+	if fdb.db == nil {
+		return 0, nil
+	}
+
+	before := fileSize(fdb.Path)
+	tmp := fdb.Path + ".compact"
+	os.Remove(tmp)
+
+	dst, err := bbolt.Open(tmp, 0600, fdb.options)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = bbolt.Compact(dst, fdb.db.Bolt, compactTxMaxSize); err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return 0, err
+	}
+
+	if err = dst.Sync(); err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return 0, err
+	}
+	dst.Close()
+
+	if err = fdb.db.Close(); err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	// 重新打开失败时不再使用已关闭的句柄
+	fdb.db = nil
+
+	if err = os.Rename(tmp, fdb.Path); err != nil {
+		os.Remove(tmp)
+		if e := fdb.open(); e != nil {
+			return 0, e
+		}
+		return 0, err
+	}
+
+	if err = fdb.open(); err != nil {
+		return 0, err
+	}
+
+	reclaimed := before - fileSize(fdb.Path)
+	fdb.stat.reclaimed += reclaimed
+	fdb.stat.lastCompact = time.Now().Unix()
+	return reclaimed, nil
+}
+
+func (fdb *FlowDB) Stats() (*FlowDBStats, error) {
+	fdb.mu.Lock()
+	defer fdb.mu.Unlock()
+
+	stats := &FlowDBStats{
+		FileSize:    fileSize(fdb.Path),
+		Pruned:      fdb.stat.pruned,
+		LastPrune:   fdb.stat.lastPrune,
+		Reclaimed:   fdb.stat.reclaimed,
+		LastCompact: fdb.stat.lastCompact,
+		FullText:    fdb.index != nil,
+		Retention:   fdb.retention,
+	}
+
+	if entries, err := os.ReadDir(fdb.spoolDir()); err == nil {
+		for _, entry := range entries {
+			if info, err := entry.Info(); err == nil && info.Mode().IsRegular() {
+				stats.SpoolFiles++
+				stats.SpoolBytes += info.Size()
+			}
+		}
+	}
+
+	if fdb.db == nil {
+		return stats, nil
+	}
+
+	// key 为自增 id, 顺序遍历时首尾即最旧和最新
+	err := fdb.db.Bolt.View(func(tx *bbolt.Tx) error {
+		records := fdb.records(tx)
+		if records == nil {
+			return nil
+		}
+
+		var last []byte
+		err := records.ForEach(func(k, v []byte) error {
+			if v == nil {
+				return nil
+			}
+
+			if stats.Flows == 0 {
+				stats.Oldest = flowTime(v)
+			}
+			stats.Flows++
+			stats.FlowBytes += int64(len(v))
+			last = v
+			return nil
+		})
+
+		stats.Newest = flowTime(last)
+		if err != nil {
+			return err
+		}
+
+		if blobs := tx.Bucket(blobBucket); blobs != nil {
+			return blobs.ForEach(func(k, v []byte) error {
+				stats.Blobs++
+				stats.BlobBytes += int64(len(v))
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+func flowTime(v []byte) int64 {
+	if v == nil {
+		return 0
+	}
+
+	var meta flowMeta
+	if err := SonicCodec.Unmarshal(v, &meta); err != nil {
+		return 0
+	}
+	return meta.Time.Unix()
+}
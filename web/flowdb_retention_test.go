@@ -0,0 +1,216 @@
+package web
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/asdine/storm/v3"
+	"github.com/bytedance/sonic"
+)
+
+func addRetentionFlows(t *testing.T, db *FlowDB, urls []string, times []time.Time) []*Flow {
+	t.Helper()
+	flows := make([]*Flow, len(urls))
+	for i, u := range urls {
+		flows[i] = &Flow{Method: "GET", RawURL: u, RequestHeader: http.Header{}, StatusCode: 200, ResponseBody: "body", Time: times[i]}
+		if err := addTestFlow(db, flows[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return flows
+}
+
+// 返回仍然存在的 flow 下标
+func remainFlows(t *testing.T, db *FlowDB, flows []*Flow) []int {
+	t.Helper()
+	remain := make([]int, 0)
+	for i, flow := range flows {
+		_, err := db.FindFlowId(flow.FlowID)
+		switch err {
+		case nil:
+			remain = append(remain, i)
+		case storm.ErrNotFound:
+		default:
+			t.Fatal(err)
+		}
+	}
+	return remain
+}
+
+func TestPrune(t *testing.T) {
+	now := time.Now()
+	urls := []string{"http://keep.example.com/", "http://a.com/1", "http://a.com/2", "http://a.com/3", "http://a.com/4"}
+	times := []time.Time{now.Add(-3 * time.Hour), now.Add(-3 * time.Hour), now.Add(-2 * time.Hour), now, now}
+
+	cases := []struct {
+		name   string
+		policy func(db *FlowDB) Retention
+		remain []int
+	}{
+		{"max_count", func(*FlowDB) Retention { return Retention{MaxCount: 2} }, []int{3, 4}},
+		{"max_age", func(*FlowDB) Retention { return Retention{MaxAge: time.Hour} }, []int{3, 4}},
+		{"max_size", func(db *FlowDB) Retention {
+			stats, err := db.Stats()
+			if err != nil {
+				t.Fatal(err)
+			}
+			// 记录大小相同, 保留最新的 3 条
+			return Retention{MaxSize: stats.FlowBytes * 3 / 5}
+		}, []int{2, 3, 4}},
+		{"exclude", func(*FlowDB) Retention {
+			return Retention{MaxCount: 2, Exclude: []string{"*.example.com"}}
+		}, []int{0, 3, 4}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			db := newTestFlowDB(t)
+			flows := addRetentionFlows(t, db, urls, times)
+
+			db.SetRetention(tc.policy(db))
+			n, err := db.Prune()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			remain := remainFlows(t, db, flows)
+			if n != len(flows)-len(tc.remain) || len(remain) != len(tc.remain) {
+				t.Fatalf("pruned %d remain %v want %v", n, remain, tc.remain)
+			}
+			for i := range remain {
+				if remain[i] != tc.remain[i] {
+					t.Fatalf("remain %v want %v", remain, tc.remain)
+				}
+			}
+
+			if n, _ = db.Prune(); n != 0 {
+				t.Fatalf("prune again %d", n)
+			}
+
+			// history 的统计不包括删除的 flow
+			var history HistoryMgr
+			if err = sonic.Unmarshal(db.History(0, 10), &history); err != nil {
+				t.Fatal(err)
+			}
+			if history.Total != len(tc.remain) || history.Http200 != len(tc.remain) || len(history.Flows) != len(tc.remain) {
+				t.Fatalf("history stat %+v", history.FlowStatMgr)
+			}
+
+			// 删除后唯一索引一致, 被删除的 FlowID 可以重新保存
+			again := &Flow{FlowID: flows[1].FlowID, Method: "GET", RawURL: urls[1], RequestHeader: http.Header{}, Time: now}
+			if err = addTestFlow(db, again); err != nil {
+				t.Fatal(err)
+			}
+			if flow, err := db.FindFlowId(again.FlowID); err != nil || flow.ID != again.ID {
+				t.Fatalf("find after prune %v %+v", err, flow)
+			}
+		})
+	}
+}
+
+func TestCompact(t *testing.T) {
+	db := newTestFlowDB(t)
+	now := time.Now()
+	urls := make([]string, 200)
+	times := make([]time.Time, 200)
+	for i := range urls {
+		urls[i] = "http://a.com/"
+		times[i] = now
+	}
+	flows := addRetentionFlows(t, db, urls, times)
+
+	db.SetRetention(Retention{MaxCount: 10})
+	if n, err := db.Prune(); err != nil || n != 190 {
+		t.Fatalf("prune %d %v", n, err)
+	}
+
+	if _, err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if remain := remainFlows(t, db, flows); len(remain) != 10 || remain[0] != 190 {
+		t.Fatalf("remain after compact %v", remain)
+	}
+
+	flow := &Flow{Method: "GET", RawURL: "http://a.com/new", RequestHeader: http.Header{}, Time: now}
+	if err := addTestFlow(db, flow); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := db.FindFlowId(flow.FlowID); err != nil || got.ID <= flows[199].ID {
+		t.Fatalf("add after compact %v %+v", err, got)
+	}
+	if stats, err := db.Stats(); err != nil || stats.Flows != 11 || stats.LastCompact == 0 {
+		t.Fatalf("stats %v %+v", err, stats)
+	}
+
+	// 替换文件失败后重新打开也失败时不再持有已关闭的句柄
+	dir := filepath.Join(t.TempDir(), "flow.db")
+	if err := os.MkdirAll(filepath.Join(dir, "x"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	db.Path = dir
+	if _, err := db.Compact(); err == nil {
+		t.Fatal("compact into directory should fail")
+	}
+	if db.db != nil {
+		t.Fatal("closed handle kept")
+	}
+	if err := addTestFlow(db, flow); err == nil {
+		t.Fatal("add to closed db should fail")
+	}
+	if n, err := db.Prune(); n != 0 || err != nil {
+		t.Fatalf("prune closed db %d %v", n, err)
+	}
+}
+
+func TestReset(t *testing.T) {
+	db := newTestFlowDB(t)
+	db.EnableFullText()
+	flows := addRetentionFlows(t, db, []string{"http://a.com/1", "http://a.com/2"}, []time.Time{time.Now(), time.Now()})
+	waitFullText(t, db, "a.com", 2)
+	db.UpsertConn(&ConnRecord{ID: "c1", ServerAddress: "a.com:80", Open: time.Now()})
+	if err := db.SaveRepeaterTab(&RepeaterTab{ID: "tab", Name: "tab", Created: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	db.SaveIntruderJob(&IntruderJob{ID: "job", User: "alice"})
+	if _, err := db.AddFinding(&Finding{Type: "xss", Host: "a.com", Path: "/1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Reset(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 流量相关的数据全部清空
+	if remain := remainFlows(t, db, flows); len(remain) != 0 {
+		t.Fatalf("flows after reset %v", remain)
+	}
+	if stats, err := db.Stats(); err != nil || stats.Flows != 0 || stats.Blobs != 0 {
+		t.Fatalf("stats %v %+v", err, stats)
+	}
+	if conns, err := db.Conns(0, 10); err != nil || len(conns) != 0 {
+		t.Fatalf("conns %v %+v", err, conns)
+	}
+	if hits, err := db.FullTextSearch("a.com", 10); err != nil || len(hits) != 0 {
+		t.Fatalf("full text %v %+v", err, hits)
+	}
+
+	// 重放, 爆破和漏洞结果保留
+	if _, err := db.RepeaterTab("tab"); err != nil {
+		t.Fatalf("repeater tab %v", err)
+	}
+	if _, err := db.IntruderJob("job"); err != nil {
+		t.Fatalf("intruder job %v", err)
+	}
+	if fds, err := db.Findings(FindingFilter{}, 0, 10); err != nil || len(fds) != 1 {
+		t.Fatalf("findings %v %+v", err, fds)
+	}
+
+	flows = addRetentionFlows(t, db, []string{"http://b.com/1"}, []time.Time{time.Now()})
+	if remain := remainFlows(t, db, flows); len(remain) != 1 {
+		t.Fatalf("add after reset %v", remain)
+	}
+	waitFullText(t, db, "b.com", 1)
+}
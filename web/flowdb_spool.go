@@ -0,0 +1,99 @@
+package web
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vela-ssoc/vela-mitm/proxy"
+)
+
+// stream 模式落盘的 body 与数据库同目录保存: flow.{name}.spool/{flow_id}.{request|response}
+
+func (fdb *FlowDB) spoolDir() string {
+	return strings.TrimSuffix(fdb.Path, filepath.Ext(fdb.Path)) + ".spool"
+}
+
+func (fdb *FlowDB) spoolPath(name string) string {
+	return filepath.Join(fdb.spoolDir(), filepath.Base(name))
+}
+
+// 优先硬链接, 跨文件系统时复制
+func linkOrCopy(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
+
+func (fdb *FlowDB) keepSpool(s *proxy.Spool, name string) string {
+	if s == nil || s.Path == "" {
+		return ""
+	}
+
+	if err := os.MkdirAll(fdb.spoolDir(), 0700); err != nil {
+		log.Errorf("create spool dir fail %v", err)
+		return ""
+	}
+
+	if err := linkOrCopy(s.Path, fdb.spoolPath(name)); err != nil {
+		log.Errorf("save spool %s fail %v", name, err)
+		return ""
+	}
+	return name
+}
+
+// 调用方持有 fdb.mu, 保存 flow 前把临时文件转存到 spool 目录
+func (fdb *FlowDB) saveSpool(flow *Flow, f *proxy.Flow) {
+	if !f.Stream {
+		return
+	}
+
+	flow.RequestFile = fdb.keepSpool(f.Request.Spool, flow.FlowID+".request")
+	if f.Response != nil {
+		flow.ResponseFile = fdb.keepSpool(f.Response.Spool, flow.FlowID+".response")
+	}
+}
+
+func (fdb *FlowDB) removeSpool(names ...string) {
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		if err := os.Remove(fdb.spoolPath(name)); err != nil && !os.IsNotExist(err) {
+			log.Errorf("remove spool %s fail %v", name, err)
+		}
+	}
+}
+
+// 打开落盘的 body, part 为 request 或 response
+func (fdb *FlowDB) OpenSpool(flow *Flow, part string) (*os.File, error) {
+	name := flow.ResponseFile
+	if part == "request" {
+		name = flow.RequestFile
+	}
+
+	if name == "" {
+		return nil, os.ErrNotExist
+	}
+	return os.Open(fdb.spoolPath(name))
+}
@@ -0,0 +1,131 @@
+package web
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/vela-ssoc/vela-mitm/proxy"
+)
+
+// stream 模式的 flow, 请求和响应 body 已写入临时文件
+func newSpoolFlow(t *testing.T, rawURL, request, response string) (*messageFlow, *proxy.Flow) {
+	t.Helper()
+	dir := t.TempDir()
+	spool := func(name, data string) *proxy.Spool {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return &proxy.Spool{Path: path, Size: int64(len(data)) * 2, Written: int64(len(data)), Truncated: true}
+	}
+
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+
+	u, _ := url.Parse(rawURL)
+	f := &proxy.Flow{
+		Id:          uuid.NewV4(),
+		ConnContext: &proxy.ConnContext{ClientConn: &proxy.ClientConn{Id: uuid.NewV4(), Conn: client}},
+		Stream:      true,
+		Request:     &proxy.Request{Method: "POST", URL: u, Header: http.Header{}, Spool: spool("req", request)},
+		Response:    &proxy.Response{StatusCode: 200, Header: http.Header{}, Spool: spool("res", response)},
+	}
+	return &messageFlow{mType: messageTypeResponseBody, id: f.Id}, f
+}
+
+func spoolFiles(t *testing.T, db *FlowDB) int {
+	t.Helper()
+	entries, err := os.ReadDir(db.spoolDir())
+	if os.IsNotExist(err) {
+		return 0
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(entries)
+}
+
+func TestSpool(t *testing.T) {
+	db := newTestFlowDB(t)
+
+	msg, f := newSpoolFlow(t, "http://a.com/files/video.mp4", "upload", "large video")
+	db.UpsertFlow(msg, f)
+
+	flow, err := db.FindFlowId(f.Id.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !flow.Stream || !flow.Truncated || flow.RequestFile == "" || flow.ResponseFile == "" || spoolFiles(t, db) != 2 {
+		t.Fatalf("flow %+v", flow)
+	}
+
+	// 临时文件在 flow 结束时删除, spool 目录中的副本仍然可以读取
+	os.Remove(f.Request.Spool.Path)
+	os.Remove(f.Response.Spool.Path)
+
+	file, err := db.OpenSpool(flow, "request")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(file)
+	file.Close()
+	if string(data) != "upload" {
+		t.Fatalf("request spool %q", data)
+	}
+
+	w := httptest.NewRecorder()
+	(&WebAddon{}).MitmFlowDownload(w, httptest.NewRequest("GET", "/flow/download?flow="+flow.FlowID, nil), db)
+	if w.Code != http.StatusOK || w.Body.String() != "large video" {
+		t.Fatalf("download %d %q", w.Code, w.Body)
+	}
+	if w.Header().Get("Content-Disposition") != "attachment; filename=response-video.mp4" ||
+		w.Header().Get("X-Mitm-Truncated") != "true" || w.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Fatalf("download header %v", w.Header())
+	}
+
+	// 没有落盘的 flow
+	plain := &Flow{Method: "GET", RawURL: "http://a.com/", RequestHeader: http.Header{}, Time: time.Now()}
+	if err = addTestFlow(db, plain); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.OpenSpool(plain, "response"); !os.IsNotExist(err) {
+		t.Fatalf("open missing spool %v", err)
+	}
+	w = httptest.NewRecorder()
+	(&WebAddon{}).MitmFlowDownload(w, httptest.NewRequest("GET", "/flow/download?flow="+plain.FlowID, nil), db)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("download missing %d", w.Code)
+	}
+
+	// 清理 flow 时删除落盘文件
+	db.SetRetention(Retention{MaxCount: 1, Interval: time.Hour})
+	if n, err := db.Prune(); err != nil || n != 1 {
+		t.Fatalf("prune %d %v", n, err)
+	}
+	if n := spoolFiles(t, db); n != 0 {
+		t.Fatalf("spool files after prune %d", n)
+	}
+
+	msg, f = newSpoolFlow(t, "http://a.com/b.bin", "a", "b")
+	db.UpsertFlow(msg, f)
+	if n := spoolFiles(t, db); n != 2 {
+		t.Fatalf("spool files %d", n)
+	}
+	if err = db.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if n := spoolFiles(t, db); n != 0 {
+		t.Fatalf("spool files after reset %d", n)
+	}
+}
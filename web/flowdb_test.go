@@ -0,0 +1,46 @@
+package web
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// FlowDB 文件放在 t.TempDir() 下, 不修改工作目录, 测试结束时关闭
+func newTestFlowDB(t *testing.T) *FlowDB {
+	t.Helper()
+	db := &FlowDB{
+		FlowBucket: "flow",
+		FlowMgrBkt: "flow-mgr",
+		Path:       filepath.Join(t.TempDir(), "flow.test.db"),
+	}
+	if err := db.open(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.close)
+	return db
+}
+
+// 与 UpsertFlow 一样保存并计数, 不需要构造 proxy.Flow; FlowID 为空时生成
+func addTestFlow(db *FlowDB, flow *Flow) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.db == nil {
+		return fmt.Errorf("flow db not open")
+	}
+
+	if flow.FlowID == "" {
+		flow.FlowID = uuid.NewV4().String()
+	}
+	if u, err := url.Parse(flow.RawURL); err == nil {
+		flow.Scheme = u.Scheme
+		flow.URL = u.Scheme + "://" + u.Host + u.Path
+		flow.Query = u.RawQuery
+	}
+
+	return db.saveFlow(flow)
+}
@@ -0,0 +1,277 @@
+package web
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/bytedance/sonic"
+	"github.com/vela-ssoc/vela-kit/auxlib"
+	"github.com/vela-ssoc/vela-mitm/proxy"
+)
+
+// HAR 1.2 导出 http://www.softwareishard.com/blog/har-12-spec/
+
+type HAR struct {
+	Log HARLog `json:"log"`
+}
+
+type HARLog struct {
+	Version string     `json:"version"`
+	Creator HARCreator `json:"creator"`
+	Entries []HAREntry `json:"entries"`
+}
+
+type HARCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type HAREntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         HARRequest  `json:"request"`
+	Response        HARResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         HARTimings  `json:"timings"`
+	ServerIPAddress string      `json:"serverIPAddress,omitempty"`
+	Connection      string      `json:"connection,omitempty"`
+	Comment         string      `json:"comment,omitempty"`
+}
+
+type HARNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type HARPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type HARRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARNameValue `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	QueryString []HARNameValue `json:"queryString"`
+	PostData    *HARPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type HARContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type HARResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARNameValue `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	Content     HARContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+// 单位 ms, -1 表示不可用
+type HARTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	SSL     float64 `json:"ssl"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+func harHeaders(header http.Header) []HARNameValue {
+	items := make([]HARNameValue, 0, len(header))
+	for name, values := range header {
+		for _, v := range values {
+			items = append(items, HARNameValue{Name: name, Value: v})
+		}
+	}
+	return items
+}
+
+func harRequestCookies(header http.Header) []HARNameValue {
+	cookies := (&http.Request{Header: header}).Cookies()
+	items := make([]HARNameValue, 0, len(cookies))
+	for _, c := range cookies {
+		items = append(items, HARNameValue{Name: c.Name, Value: c.Value})
+	}
+	return items
+}
+
+func harResponseCookies(header http.Header) []HARNameValue {
+	cookies := (&http.Response{Header: header}).Cookies()
+	items := make([]HARNameValue, 0, len(cookies))
+	for _, c := range cookies {
+		items = append(items, HARNameValue{Name: c.Name, Value: c.Value})
+	}
+	return items
+}
+
+func harQuery(rawURL string) []HARNameValue {
+	items := make([]HARNameValue, 0)
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return items
+	}
+
+	for name, values := range u.Query() {
+		for _, v := range values {
+			items = append(items, HARNameValue{Name: name, Value: v})
+		}
+	}
+	return items
+}
+
+func harProto(proto string) string {
+	if proto == "" {
+		return "HTTP/1.1"
+	}
+	return proto
+}
+
+func harMs(start, end time.Time) float64 {
+	if start.IsZero() || end.IsZero() || end.Before(start) {
+		return -1
+	}
+	return float64(end.Sub(start).Microseconds()) / 1000
+}
+
+// connect 按规范包含 ssl, 复用连接时 dns/connect/ssl 为 -1
+func harTimings(t proxy.Timing) HARTimings {
+	h := HARTimings{Blocked: -1, DNS: -1, Connect: -1, SSL: -1}
+
+	if !t.ConnReused {
+		h.DNS = harMs(t.DNSStart, t.DNSDone)
+		h.Connect = harMs(t.ConnectStart, t.ConnectDone)
+		h.SSL = harMs(t.TLSStart, t.TLSDone)
+		if h.Connect >= 0 && h.SSL >= 0 {
+			h.Connect += h.SSL
+		}
+	}
+
+	if blocked := harMs(t.UpstreamStart, t.GotConn); blocked >= 0 {
+		for _, v := range []float64{h.DNS, h.Connect} {
+			if v > 0 {
+				blocked -= v
+			}
+		}
+		if blocked < 0 {
+			blocked = 0
+		}
+		h.Blocked = blocked
+	}
+
+	for _, item := range []struct {
+		dst        *float64
+		start, end time.Time
+	}{
+		{&h.Send, t.GotConn, t.RequestSent},
+		{&h.Wait, t.RequestSent, t.FirstByte},
+		{&h.Receive, t.FirstByte, t.ResponseComplete},
+	} {
+		if v := harMs(item.start, item.end); v > 0 {
+			*item.dst = v
+		}
+	}
+
+	return h
+}
+
+func (h HARTimings) total() float64 {
+	var total float64
+	for _, v := range []float64{h.Blocked, h.DNS, h.Connect, h.Send, h.Wait, h.Receive} {
+		if v > 0 {
+			total += v
+		}
+	}
+	return total
+}
+
+func (f *Flow) HAREntry() HAREntry {
+	timings := harTimings(f.Timing)
+	entry := HAREntry{
+		StartedDateTime: f.Time.Format("2006-01-02T15:04:05.000Z07:00"),
+		Request: HARRequest{
+			Method:      f.Method,
+			URL:         f.RawURL,
+			HTTPVersion: harProto(f.Proto),
+			Cookies:     harRequestCookies(f.RequestHeader),
+			Headers:     harHeaders(f.RequestHeader),
+			QueryString: harQuery(f.RawURL),
+			HeadersSize: -1,
+			BodySize:    len(f.RequestBody),
+		},
+		Response: HARResponse{
+			Status:      f.StatusCode,
+			StatusText:  http.StatusText(f.StatusCode),
+			HTTPVersion: harProto(f.Proto),
+			Cookies:     harResponseCookies(f.ResponseHeader),
+			Headers:     harHeaders(f.ResponseHeader),
+			RedirectURL: f.ResponseHeader.Get("Location"),
+			HeadersSize: -1,
+			BodySize:    f.ResponseSize,
+		},
+		Time:            timings.total(),
+		Timings:         timings,
+		ServerIPAddress: f.ServerPeer,
+		Connection:      f.ConnId,
+		Comment:         strings.Join(f.Tags, ","),
+	}
+
+	if reqBody := UncompressedBody(f.RequestHeader, auxlib.S2B(f.RequestBody)); len(reqBody) > 0 {
+		entry.Request.PostData = &HARPostData{
+			MimeType: f.RequestHeader.Get("Content-Type"),
+			Text:     reqBody,
+		}
+	}
+
+	resBody := UncompressedBody(f.ResponseHeader, auxlib.S2B(f.ResponseBody))
+	entry.Response.Content = HARContent{
+		Size:     len(resBody),
+		MimeType: f.ResponseHeader.Get("Content-Type"),
+	}
+
+	if utf8.ValidString(resBody) {
+		entry.Response.Content.Text = resBody
+	} else {
+		entry.Response.Content.Text = base64.StdEncoding.EncodeToString(auxlib.S2B(resBody))
+		entry.Response.Content.Encoding = "base64"
+	}
+
+	return entry
+}
+
+func NewHAR(flows []Flow) *HAR {
+	har := &HAR{
+		Log: HARLog{
+			Version: "1.2",
+			Creator: HARCreator{Name: "vela-mitm", Version: proxy.Version},
+			Entries: make([]HAREntry, len(flows)),
+		},
+	}
+
+	for i := range flows {
+		har.Log.Entries[i] = flows[i].HAREntry()
+	}
+	return har
+}
+
+func (h *HAR) Bytes() []byte {
+	chunk, _ := sonic.Marshal(h)
+	return chunk
+}
@@ -0,0 +1,43 @@
+package web
+
+import (
+	"testing"
+	"time"
+
+	"github.com/vela-ssoc/vela-mitm/proxy"
+)
+
+func TestHARTimings(t *testing.T) {
+	base := time.Date(2023, 5, 1, 10, 0, 0, 0, time.UTC)
+	at := func(ms int) time.Time {
+		return base.Add(time.Duration(ms) * time.Millisecond)
+	}
+
+	h := harTimings(proxy.Timing{
+		UpstreamStart:    at(0),
+		DNSStart:         at(1),
+		DNSDone:          at(5),
+		ConnectStart:     at(5),
+		ConnectDone:      at(15),
+		TLSStart:         at(15),
+		TLSDone:          at(35),
+		GotConn:          at(40),
+		RequestSent:      at(42),
+		FirstByte:        at(100),
+		ResponseComplete: at(110),
+	})
+
+	want := HARTimings{Blocked: 6, DNS: 4, Connect: 30, SSL: 20, Send: 2, Wait: 58, Receive: 10}
+	if h != want {
+		t.Fatalf("timings %+v, want %+v", h, want)
+	}
+
+	if total := h.total(); total != 110 {
+		t.Fatalf("total %v, want 110", total)
+	}
+
+	reused := harTimings(proxy.Timing{ConnReused: true, UpstreamStart: at(0), GotConn: at(1)})
+	if reused.DNS != -1 || reused.Connect != -1 || reused.SSL != -1 || reused.Blocked != 1 {
+		t.Fatalf("reused timings %+v", reused)
+	}
+}
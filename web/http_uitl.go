@@ -7,12 +7,15 @@ import (
 	"compress/zlib"
 	"fmt"
 	"github.com/andybalholm/brotli"
+	"github.com/bytedance/sonic"
 	"github.com/gorilla/schema"
 	log "github.com/sirupsen/logrus"
 	"github.com/vela-ssoc/vela-kit/auxlib"
 	"io"
+	"net"
 	"net/http"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
@@ -47,6 +50,14 @@ func Bad(w http.ResponseWriter, code int, format string, v ...interface{}) {
 	w.Write(auxlib.S2B(fmt.Sprintf(format, v...)))
 }
 
+// 带状态码的 json 错误, 如表达式解析错误的位置信息
+func BadJSON(w http.ResponseWriter, code int, v interface{}) {
+	chunk, _ := sonic.Marshal(v)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(chunk)
+}
+
 func JSON(w http.ResponseWriter, data []byte) {
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(data)
@@ -171,52 +182,138 @@ READER:
 }
 
 func RegexMatch(a, b string) bool {
-	re := regexp.MustCompile(b)
-	if re == nil {
+	re, err := regexp.Compile(b)
+	if err != nil {
+		log.Errorf("regex %s compile fail %v", b, err)
+		return false
+	}
+
+	return re.MatchString(a)
+}
+
+// 支持 ip, cidr 以及 1.1.1.1-1.1.1.100 范围; a 可以带端口
+func IPMatch(a, b string) bool {
+	if host, _, err := net.SplitHostPort(a); err == nil {
+		a = host
+	}
+
+	ip := net.ParseIP(strings.TrimSpace(a))
+	if ip == nil {
+		return false
+	}
+
+	b = strings.TrimSpace(b)
+	if strings.Contains(b, "/") {
+		_, ipNet, err := net.ParseCIDR(b)
+		if err != nil {
+			return false
+		}
+		return ipNet.Contains(ip)
+	}
+
+	if idx := strings.Index(b, "-"); idx != -1 {
+		start := net.ParseIP(strings.TrimSpace(b[:idx]))
+		end := net.ParseIP(strings.TrimSpace(b[idx+1:]))
+		if start == nil || end == nil {
+			return false
+		}
+		return bytes.Compare(ip.To16(), start.To16()) >= 0 && bytes.Compare(ip.To16(), end.To16()) <= 0
+	}
+
+	target := net.ParseIP(b)
+	if target == nil {
+		return false
+	}
+	return target.Equal(ip)
+}
+
+func numericCompare(cmp func(a, b float64) bool) func(a, b string) bool {
+	return func(a, b string) bool {
+		x, err := strconv.ParseFloat(strings.TrimSpace(a), 64)
+		if err != nil {
+			return false
+		}
+
+		y, err := strconv.ParseFloat(strings.TrimSpace(b), 64)
+		if err != nil {
+			return false
+		}
+		return cmp(x, y)
+	}
+}
+
+// b 格式 200-299, 包含两端
+func NumericRange(a, b string) bool {
+	b = strings.TrimSpace(b)
+	if len(b) < 3 {
 		return false
 	}
 
-	match := re.FindAllString(a, -1)
-	if len(match) > 0 {
-		return true
+	idx := strings.Index(b[1:], "-")
+	if idx == -1 {
+		return false
 	}
+	idx++
+
+	return numericCompare(func(x, y float64) bool { return x >= y })(a, b[:idx]) &&
+		numericCompare(func(x, y float64) bool { return x <= y })(a, b[idx+1:])
+}
 
-	return false
+func lower(fn func(a, b string) bool) func(a, b string) bool {
+	return func(a, b string) bool {
+		return fn(strings.ToLower(a), strings.ToLower(b))
+	}
 }
 
+// 以 ! 开头的方法取反; 以 i 开头的为忽略大小写版本
 func ParseCndMethod(v string) (fn func(a, b string) bool, isNot bool) {
+	if strings.HasPrefix(v, "!") {
+		isNot = true
+		v = v[1:]
+	}
+
 	switch v {
 	case "equal":
-		return func(a, b string) bool { return a == b }, false
-	case "!equal":
-		return func(a, b string) bool { return a == b }, true
+		return func(a, b string) bool { return a == b }, isNot
+	case "iequal":
+		return strings.EqualFold, isNot
 
 	case "regex":
-		return func(a, b string) bool { return a == b }, true
-
-	case "!regex":
-		return func(a, b string) bool { return a == b }, true
+		return RegexMatch, isNot
+	case "iregex":
+		return func(a, b string) bool { return RegexMatch(a, "(?i)"+b) }, isNot
 
 	case "prefix":
-		return strings.HasPrefix, false
-
-	case "!prefix":
-		return strings.HasPrefix, true
+		return strings.HasPrefix, isNot
+	case "iprefix":
+		return lower(strings.HasPrefix), isNot
 
 	case "suffix":
-		return strings.HasSuffix, false
-
-	case "!suffix":
-		return strings.HasSuffix, true
+		return strings.HasSuffix, isNot
+	case "isuffix":
+		return lower(strings.HasSuffix), isNot
 
 	case "contain":
-		return strings.Contains, false
-	case "!contain":
-		return strings.Contains, true
+		return strings.Contains, isNot
+	case "icontain":
+		return lower(strings.Contains), isNot
 
 	case "ip":
-
-	case "!ip":
+		return IPMatch, isNot
+
+	case ">":
+		return numericCompare(func(x, y float64) bool { return x > y }), isNot
+	case ">=":
+		return numericCompare(func(x, y float64) bool { return x >= y }), isNot
+	case "<":
+		return numericCompare(func(x, y float64) bool { return x < y }), isNot
+	case "<=":
+		return numericCompare(func(x, y float64) bool { return x <= y }), isNot
+	case "range":
+		return NumericRange, isNot
+
+	case "exists":
+		return func(a, b string) bool { return a != "" }, isNot
 	}
 
 	return func(a, b string) bool {
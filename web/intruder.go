@@ -0,0 +1,401 @@
+package web
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/vela-ssoc/vela-mitm/proxy"
+)
+
+// 攻击方式
+const (
+	IntruderSniper       = "sniper"        // 单个 payload 集合, 依次替换每个位置, 其他位置保持原值
+	IntruderBatteringRam = "battering_ram" // 单个 payload 集合, 所有位置同时替换为同一个值
+	IntruderPitchfork    = "pitchfork"     // 每个位置一个集合, 按下标同时取值, 次数为最短集合的长度
+	IntruderClusterBomb  = "cluster_bomb"  // 每个位置一个集合, 所有组合
+)
+
+const (
+	intruderDefaultMarker = "§"
+	intruderMaxRequests   = 1000000
+	intruderMaxFileSize   = 64 << 20
+)
+
+// payload 来源, Type 为 list numbers file
+// numbers 生成 From 到 To (包含) 步长为 Step 的数字, Format 为 fmt 格式, 默认 %d
+// file 为 Config.PayloadDir 下的文件名, 每行一个 payload
+// 取值时先加 Prefix Suffix, 再按顺序执行 Transforms
+type PayloadSet struct {
+	Type       string   `json:"type"`
+	List       []string `json:"list,omitempty"`
+	From       int64    `json:"from,omitempty"`
+	To         int64    `json:"to,omitempty"`
+	Step       int64    `json:"step,omitempty"`
+	Format     string   `json:"format,omitempty"`
+	File       string   `json:"file,omitempty"`
+	Prefix     string   `json:"prefix,omitempty"`
+	Suffix     string   `json:"suffix,omitempty"`
+	Transforms []string `json:"transforms,omitempty"`
+}
+
+var payloadTransforms = map[string]func(string) string{
+	"lower":    strings.ToLower,
+	"upper":    strings.ToUpper,
+	"url":      url.QueryEscape,
+	"url_path": url.PathEscape,
+	"html":     html.EscapeString,
+	"hex":      func(s string) string { return hex.EncodeToString([]byte(s)) },
+	"base64":   func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) },
+	"base64url": func(s string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(s))
+	},
+	"md5": func(s string) string {
+		sum := md5.Sum([]byte(s))
+		return hex.EncodeToString(sum[:])
+	},
+	"sha1": func(s string) string {
+		sum := sha1.Sum([]byte(s))
+		return hex.EncodeToString(sum[:])
+	},
+	"sha256": func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:])
+	},
+	"capitalize": func(s string) string {
+		if s == "" {
+			return s
+		}
+		return strings.ToUpper(s[:1]) + s[1:]
+	},
+	"reverse": func(s string) string {
+		r := []rune(s)
+		for i, j := 0, len(r)-1; i < j; i, j = i+1, j-1 {
+			r[i], r[j] = r[j], r[i]
+		}
+		return string(r)
+	},
+}
+
+// 按下标取值, 数字范围和变换不需要提前生成全部 payload
+type payloadSource struct {
+	list       []string
+	from, step int64
+	count      int
+	format     string
+	prefix     string
+	suffix     string
+	transforms []func(string) string
+}
+
+func (ps *payloadSource) len() int {
+	return ps.count
+}
+
+func (ps *payloadSource) at(i int) string {
+	var v string
+	if ps.list != nil {
+		v = ps.list[i]
+	} else {
+		v = fmt.Sprintf(ps.format, ps.from+int64(i)*ps.step)
+	}
+
+	v = ps.prefix + v + ps.suffix
+	for _, fn := range ps.transforms {
+		v = fn(v)
+	}
+	return v
+}
+
+func (set *PayloadSet) source(dir string) (*payloadSource, error) {
+	ps := &payloadSource{prefix: set.Prefix, suffix: set.Suffix}
+	for _, name := range set.Transforms {
+		fn, ok := payloadTransforms[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown transform %s", name)
+		}
+		ps.transforms = append(ps.transforms, fn)
+	}
+
+	switch set.Type {
+	case "list", "":
+		ps.list = set.List
+		if ps.list == nil {
+			ps.list = []string{}
+		}
+		ps.count = len(set.List)
+
+	case "numbers":
+		step := set.Step
+		if step == 0 {
+			step = 1
+		}
+		if (step > 0 && set.To < set.From) || (step < 0 && set.To > set.From) {
+			return nil, fmt.Errorf("numbers %d to %d step %d is empty", set.From, set.To, step)
+		}
+		n := (set.To-set.From)/step + 1
+		if n > intruderMaxRequests {
+			return nil, fmt.Errorf("numbers %d to %d step %d too many", set.From, set.To, step)
+		}
+		ps.from, ps.step, ps.count = set.From, step, int(n)
+		ps.format = set.Format
+		if ps.format == "" {
+			ps.format = "%d"
+		}
+
+	case "file":
+		list, err := readPayloadFile(dir, set.File)
+		if err != nil {
+			return nil, err
+		}
+		ps.list, ps.count = list, len(list)
+
+	default:
+		return nil, fmt.Errorf("unknown payload type %s", set.Type)
+	}
+
+	return ps, nil
+}
+
+// 只能读取 payload 目录下的文件, 防止通过 payload 读取服务器上的任意文件
+func readPayloadFile(dir, name string) ([]string, error) {
+	if name == "" || name != filepath.Base(name) || name == "." || name == ".." {
+		return nil, fmt.Errorf("invalid payload file %q", name)
+	}
+
+	path := filepath.Join(dir, name)
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if stat.Size() > intruderMaxFileSize {
+		return nil, fmt.Errorf("payload file %s too large", name)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var list []string
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		list = append(list, line)
+	}
+	return list, scanner.Err()
+}
+
+// 按标记切分的字符串, parts 依次为 原文, 位置, 原文 ... 原文; first 为第一个位置的全局序号
+type segments struct {
+	parts []string
+	first int
+}
+
+func parseSegments(s, marker string, defaults *[]string) (*segments, error) {
+	parts := strings.Split(s, marker)
+	if len(parts)%2 == 0 {
+		return nil, fmt.Errorf("unpaired marker %s in %q", marker, s)
+	}
+
+	seg := &segments{parts: parts, first: len(*defaults)}
+	for i := 1; i < len(parts); i += 2 {
+		*defaults = append(*defaults, parts[i])
+	}
+	return seg, nil
+}
+
+func (seg *segments) render(values []string) string {
+	if len(seg.parts) == 1 {
+		return seg.parts[0]
+	}
+
+	var b strings.Builder
+	for i, part := range seg.parts {
+		if i%2 == 0 {
+			b.WriteString(part)
+			continue
+		}
+		b.WriteString(values[seg.first+i/2])
+	}
+	return b.String()
+}
+
+// 请求模板, 位置按 method url header body 的顺序编号, header 按名称排序后以 "Name: value" 行处理
+type intruderTemplate struct {
+	method   *segments
+	url      *segments
+	header   []*segments
+	body     *segments
+	defaults []string // 每个位置标记内的原值
+}
+
+func parseTemplate(fr *proxy.RequestEditData, marker string) (*intruderTemplate, error) {
+	tpl := &intruderTemplate{}
+
+	var err error
+	if tpl.method, err = parseSegments(fr.Method, marker, &tpl.defaults); err != nil {
+		return nil, err
+	}
+	if tpl.url, err = parseSegments(fr.RawURL, marker, &tpl.defaults); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(fr.Header))
+	for name := range fr.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, value := range fr.Header[name] {
+			seg, err := parseSegments(name+": "+value, marker, &tpl.defaults)
+			if err != nil {
+				return nil, err
+			}
+			tpl.header = append(tpl.header, seg)
+		}
+	}
+
+	if tpl.body, err = parseSegments(fr.Body, marker, &tpl.defaults); err != nil {
+		return nil, err
+	}
+	return tpl, nil
+}
+
+func (tpl *intruderTemplate) positions() int {
+	return len(tpl.defaults)
+}
+
+func (tpl *intruderTemplate) render(values []string) *proxy.RequestEditData {
+	fr := &proxy.RequestEditData{
+		Method: tpl.method.render(values),
+		RawURL: tpl.url.render(values),
+		Header: make(http.Header),
+		Body:   tpl.body.render(values),
+	}
+
+	for _, seg := range tpl.header {
+		line := seg.render(values)
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			continue
+		}
+		fr.Header.Add(strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:]))
+	}
+	return fr
+}
+
+type intruderAttack struct {
+	mode     string
+	tpl      *intruderTemplate
+	sets     []*payloadSource
+	total    int
+	defaults []string
+	matcher  *intruderMatcher
+}
+
+func newIntruderAttack(mode string, tpl *intruderTemplate, sets []*payloadSource) (*intruderAttack, error) {
+	n := tpl.positions()
+	if n == 0 {
+		return nil, fmt.Errorf("no payload position marked")
+	}
+
+	a := &intruderAttack{mode: mode, tpl: tpl, sets: sets, defaults: tpl.defaults, matcher: &intruderMatcher{}}
+
+	var total int64
+	switch mode {
+	case IntruderSniper, IntruderBatteringRam:
+		if len(sets) == 0 {
+			return nil, fmt.Errorf("%s need one payload set", mode)
+		}
+		a.sets = sets[:1]
+		total = int64(sets[0].len())
+		if mode == IntruderSniper {
+			total *= int64(n)
+		}
+
+	case IntruderPitchfork, IntruderClusterBomb:
+		if len(sets) != n {
+			return nil, fmt.Errorf("%s need %d payload sets, got %d", mode, n, len(sets))
+		}
+
+		total = int64(sets[0].len())
+		for _, set := range sets[1:] {
+			if mode == IntruderPitchfork {
+				if int64(set.len()) < total {
+					total = int64(set.len())
+				}
+				continue
+			}
+
+			total *= int64(set.len())
+			if total > intruderMaxRequests {
+				break
+			}
+		}
+
+	default:
+		return nil, fmt.Errorf("unknown attack mode %s", mode)
+	}
+
+	if total > intruderMaxRequests {
+		return nil, fmt.Errorf("too many requests %d, max %d", total, intruderMaxRequests)
+	}
+	a.total = int(total)
+	return a, nil
+}
+
+// 第 i 个请求各位置的值, payloads 为用于展示的 payload, sniper 时 position 为替换的位置, 否则为 -1
+func (a *intruderAttack) values(i int) (values, payloads []string, position int) {
+	values = append([]string(nil), a.defaults...)
+	position = -1
+
+	switch a.mode {
+	case IntruderSniper:
+		n := a.sets[0].len()
+		position = i / n
+		v := a.sets[0].at(i % n)
+		values[position] = v
+		payloads = []string{v}
+
+	case IntruderBatteringRam:
+		v := a.sets[0].at(i)
+		for p := range values {
+			values[p] = v
+		}
+		payloads = []string{v}
+
+	case IntruderPitchfork:
+		for p, set := range a.sets {
+			values[p] = set.at(i)
+		}
+		payloads = values
+
+	case IntruderClusterBomb:
+		// 最后一个位置变化最快
+		for p := len(a.sets) - 1; p >= 0; p-- {
+			n := a.sets[p].len()
+			values[p] = a.sets[p].at(i % n)
+			i /= n
+		}
+		payloads = values
+	}
+	return values, payloads, position
+}
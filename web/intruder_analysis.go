@@ -0,0 +1,282 @@
+package web
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+)
+
+const (
+	intruderOutlierRatio    = 0.05 // 结果数不超过总数该比例的聚类视为异常
+	intruderLengthTolerance = 16   // 长度相差不超过该值或 5% 时归为同一聚类
+	intruderTimeSigma       = 3    // 耗时超过均值加几倍标准差视为异常
+)
+
+// 异常原因
+const (
+	AnomalyStatus = "status"
+	AnomalyLength = "length"
+	AnomalyTime   = "time"
+	AnomalyError  = "error"
+)
+
+// 从响应 header 和 body 中提取, Regex 有分组时取第一个分组, 否则取整个匹配
+type IntruderExtract struct {
+	Name  string `json:"name"`
+	Regex string `json:"regex"`
+}
+
+type intruderMatcher struct {
+	grep    [][]byte
+	extract []*regexp.Regexp
+}
+
+func newIntruderMatcher(grep []string, extract []IntruderExtract) (*intruderMatcher, error) {
+	m := &intruderMatcher{}
+	for _, s := range grep {
+		if s == "" {
+			return nil, fmt.Errorf("empty grep pattern")
+		}
+		m.grep = append(m.grep, bytes.ToLower([]byte(s)))
+	}
+
+	for _, ex := range extract {
+		re, err := regexp.Compile(ex.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("extract %s: %v", ex.Name, err)
+		}
+		m.extract = append(m.extract, re)
+	}
+	return m, nil
+}
+
+// 在截断 body 之前执行, grep 不区分大小写
+func (m *intruderMatcher) apply(res *IntruderResult, flow *Flow) {
+	if len(m.grep) == 0 && len(m.extract) == 0 {
+		return
+	}
+
+	var b bytes.Buffer
+	flow.ResponseHeader.Write(&b)
+	b.WriteString("\r\n")
+	b.WriteString(flow.ResponseBody)
+	raw := b.Bytes()
+
+	if len(m.grep) > 0 {
+		lower := bytes.ToLower(raw)
+		res.Matches = make([]bool, len(m.grep))
+		for i, g := range m.grep {
+			res.Matches[i] = bytes.Contains(lower, g)
+		}
+	}
+
+	if len(m.extract) > 0 {
+		res.Extracts = make([]string, len(m.extract))
+		for i, re := range m.extract {
+			sub := re.FindSubmatch(raw)
+			switch {
+			case sub == nil:
+			case len(sub) > 1:
+				res.Extracts[i] = string(sub[1])
+			default:
+				res.Extracts[i] = string(sub[0])
+			}
+		}
+	}
+}
+
+// 状态码聚类时 Min Max 相同
+type IntruderCluster struct {
+	Min     int  `json:"min"`
+	Max     int  `json:"max"`
+	Count   int  `json:"count"`
+	Outlier bool `json:"outlier"`
+}
+
+// 毫秒
+type IntruderTimeStats struct {
+	Mean   float64 `json:"mean"`
+	Stddev float64 `json:"stddev"`
+	P50    int64   `json:"p50"`
+	P95    int64   `json:"p95"`
+	Max    int64   `json:"max"`
+}
+
+type IntruderOutlier struct {
+	Index   int      `json:"index"`
+	Reasons []string `json:"reasons"`
+}
+
+// Matches 为每个 grep 匹配到的结果数, 不包含基准请求
+type IntruderAnalysis struct {
+	Baseline *IntruderResult   `json:"baseline,omitempty"`
+	Status   []IntruderCluster `json:"status"`
+	Length   []IntruderCluster `json:"length"`
+	Time     IntruderTimeStats `json:"time"`
+	Matches  []int             `json:"matches"`
+	Outliers []IntruderOutlier `json:"outliers"`
+}
+
+// 按状态码 响应长度 耗时聚类, 结果数很少的聚类和耗时明显偏高的结果标记为异常
+func analyzeIntruder(results []IntruderResult, grep int) *IntruderAnalysis {
+	an := &IntruderAnalysis{
+		Status:   []IntruderCluster{},
+		Length:   []IntruderCluster{},
+		Matches:  make([]int, grep),
+		Outliers: []IntruderOutlier{},
+	}
+
+	var ok []IntruderResult
+	for _, res := range results {
+		for i, m := range res.Matches {
+			if m && i < grep {
+				an.Matches[i]++
+			}
+		}
+		if res.Error == "" {
+			ok = append(ok, res)
+		}
+	}
+
+	limit := int(math.Max(1, math.Floor(float64(len(ok))*intruderOutlierRatio)))
+
+	an.Status = clusterStatus(ok, limit)
+	an.Length = clusterLength(ok, limit)
+	an.Time = timeStats(ok)
+
+	timeLimit := an.Time.Mean + intruderTimeSigma*an.Time.Stddev
+	for _, res := range results {
+		var reasons []string
+		if res.Error != "" {
+			reasons = append(reasons, AnomalyError)
+		} else {
+			if findCluster(an.Status, res.Status).Outlier {
+				reasons = append(reasons, AnomalyStatus)
+			}
+			if findCluster(an.Length, res.Length).Outlier {
+				reasons = append(reasons, AnomalyLength)
+			}
+			if an.Time.Stddev > 0 && float64(res.Time) > timeLimit && res.Time > 2*an.Time.P50 {
+				reasons = append(reasons, AnomalyTime)
+			}
+		}
+
+		if len(reasons) > 0 {
+			an.Outliers = append(an.Outliers, IntruderOutlier{Index: res.Index, Reasons: reasons})
+		}
+	}
+	return an
+}
+
+// 至少两个聚类时, 不是最大的且结果数不超过 limit 的聚类为异常
+func markOutliers(clusters []IntruderCluster, limit int) {
+	if len(clusters) < 2 {
+		return
+	}
+
+	largest := 0
+	for i, c := range clusters {
+		if c.Count > clusters[largest].Count {
+			largest = i
+		}
+	}
+
+	for i := range clusters {
+		clusters[i].Outlier = i != largest && clusters[i].Count <= limit
+	}
+}
+
+func clusterStatus(results []IntruderResult, limit int) []IntruderCluster {
+	counts := make(map[int]int)
+	for _, res := range results {
+		counts[res.Status]++
+	}
+
+	clusters := make([]IntruderCluster, 0, len(counts))
+	for status, n := range counts {
+		clusters = append(clusters, IntruderCluster{Min: status, Max: status, Count: n})
+	}
+	sort.Slice(clusters, func(i, j int) bool { return clusters[i].Min < clusters[j].Min })
+
+	markOutliers(clusters, limit)
+	return clusters
+}
+
+// 排序后相邻长度的差距超过容差时分为新的聚类
+func clusterLength(results []IntruderResult, limit int) []IntruderCluster {
+	lengths := make([]int, 0, len(results))
+	for _, res := range results {
+		lengths = append(lengths, res.Length)
+	}
+	sort.Ints(lengths)
+
+	clusters := make([]IntruderCluster, 0)
+	for _, n := range lengths {
+		last := len(clusters) - 1
+		if last >= 0 {
+			tolerance := clusters[last].Max / 20
+			if tolerance < intruderLengthTolerance {
+				tolerance = intruderLengthTolerance
+			}
+			if n-clusters[last].Max <= tolerance {
+				clusters[last].Max = n
+				clusters[last].Count++
+				continue
+			}
+		}
+		clusters = append(clusters, IntruderCluster{Min: n, Max: n, Count: 1})
+	}
+
+	markOutliers(clusters, limit)
+	return clusters
+}
+
+func findCluster(clusters []IntruderCluster, v int) IntruderCluster {
+	for _, c := range clusters {
+		if v >= c.Min && v <= c.Max {
+			return c
+		}
+	}
+	return IntruderCluster{}
+}
+
+func timeStats(results []IntruderResult) IntruderTimeStats {
+	var stats IntruderTimeStats
+	if len(results) == 0 {
+		return stats
+	}
+
+	times := make([]int64, 0, len(results))
+	var sum float64
+	for _, res := range results {
+		times = append(times, res.Time)
+		sum += float64(res.Time)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+
+	stats.Mean = sum / float64(len(times))
+	var variance float64
+	for _, t := range times {
+		d := float64(t) - stats.Mean
+		variance += d * d
+	}
+	stats.Stddev = math.Sqrt(variance / float64(len(times)))
+	stats.P50 = times[(len(times)-1)*50/100]
+	stats.P95 = times[(len(times)-1)*95/100]
+	stats.Max = times[len(times)-1]
+	return stats
+}
+
+// 把异常原因写入当前页的结果
+func (an *IntruderAnalysis) mark(results []IntruderResult) {
+	reasons := make(map[int][]string, len(an.Outliers))
+	for _, o := range an.Outliers {
+		reasons[o.Index] = o.Reasons
+	}
+
+	for i := range results {
+		results[i].Anomalies = reasons[results[i].Index]
+	}
+}
@@ -0,0 +1,277 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/bytedance/sonic"
+	uuid "github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/vela-ssoc/vela-mitm/proxy"
+)
+
+const (
+	intruderDefaultConcurrency = 4
+	intruderMaxConcurrency     = 64
+	intruderMaxRate            = 1000
+	intruderDefaultTimeout     = 30 * time.Second
+	intruderBodyLimit          = 256 << 10
+	intruderSaveEvery          = 50 // 每完成多少个请求保存一次进度
+)
+
+// Request 中用 Marker (默认 §) 包围的部分为 payload 位置, 如 /user?id=§1§
+type IntruderAttack struct {
+	Request     proxy.RequestEditData `json:"request"`
+	Marker      string                `json:"marker,omitempty"`
+	Mode        string                `json:"mode"`
+	Payloads    []PayloadSet          `json:"payloads"`
+	Concurrency int                   `json:"concurrency,omitempty"` // 默认 4, 最大 64
+	Rate        float64               `json:"rate,omitempty"`        // 每秒最多发送的请求数, 0 不限制, 最大 1000
+	Timeout     int                   `json:"timeout,omitempty"`     // 单个请求超时, 毫秒, 默认 30000
+	Grep        []string              `json:"grep,omitempty"`        // 响应中包含该字符串时标记, 不区分大小写
+	Extract     []IntruderExtract     `json:"extract,omitempty"`     // 用正则从响应中提取, 如 csrf token 错误信息
+	Chain       bool                  `json:"chain,omitempty"`       // 经过代理自身发送, 请求经过 rewrite script 等 addon
+}
+
+func (web *WebAddon) payloadDir() string {
+	if web.config.PayloadDir == "" {
+		return "payloads"
+	}
+	return web.config.PayloadDir
+}
+
+func (atk *IntruderAttack) prepare(dir string) (*intruderAttack, error) {
+	marker := atk.Marker
+	if marker == "" {
+		marker = intruderDefaultMarker
+	}
+
+	if atk.Rate < 0 || math.IsNaN(atk.Rate) {
+		return nil, fmt.Errorf("invalid rate %v", atk.Rate)
+	}
+	if atk.Rate > intruderMaxRate {
+		atk.Rate = intruderMaxRate
+	}
+
+	tpl, err := parseTemplate(&atk.Request, marker)
+	if err != nil {
+		return nil, err
+	}
+
+	sets := make([]*payloadSource, 0, len(atk.Payloads))
+	for i := range atk.Payloads {
+		ps, err := atk.Payloads[i].source(dir)
+		if err != nil {
+			return nil, fmt.Errorf("payload set %d: %v", i, err)
+		}
+		sets = append(sets, ps)
+	}
+
+	matcher, err := newIntruderMatcher(atk.Grep, atk.Extract)
+	if err != nil {
+		return nil, err
+	}
+
+	a, err := newIntruderAttack(atk.Mode, tpl, sets)
+	if err != nil {
+		return nil, err
+	}
+	a.matcher = matcher
+	return a, nil
+}
+
+// NewTicker 的间隔必须大于 0
+func rateInterval(rate float64) time.Duration {
+	if d := time.Duration(float64(time.Second) / rate); d > 0 {
+		return d
+	}
+	return time.Nanosecond
+}
+
+// 校验并作为后台任务执行, 结果写入用户的 FlowDB 并推送到该用户的 websocket 会话, 可以暂停和恢复
+func (web *WebAddon) startIntruder(c *concurrentConn, atk *IntruderAttack) (*IntruderJob, error) {
+	a, err := atk.prepare(web.payloadDir())
+	if err != nil {
+		return nil, err
+	}
+	if err = web.config.Scope.Check(a.tpl.render(a.defaults).RawURL); err != nil {
+		return nil, err
+	}
+
+	job := &IntruderJob{
+		ID:        uuid.NewV4().String(),
+		User:      c.userData.Name,
+		Mode:      atk.Mode,
+		Positions: a.tpl.positions(),
+		Total:     a.total,
+		State:     IntruderRunning,
+		Created:   time.Now(),
+		Attack:    *atk,
+	}
+
+	c.db.SaveIntruderJob(job)
+	created := *job
+
+	web.submitJob(c, jobSpec{
+		ID:       job.ID,
+		Kind:     JobIntruder,
+		Total:    job.Total,
+		Pausable: true,
+		Run: func(ctx context.Context, j *backgroundJob, db *FlowDB) error {
+			web.runIntruder(ctx, j, db, job, a)
+			return nil
+		},
+	})
+
+	return &created, nil
+}
+
+func (web *WebAddon) runIntruder(ctx context.Context, j *backgroundJob, db *FlowDB, job *IntruderJob, a *intruderAttack) {
+	atk := &job.Attack
+	us := j.us
+	workers := atk.Concurrency
+	if workers <= 0 {
+		workers = intruderDefaultConcurrency
+	}
+	if workers > intruderMaxConcurrency {
+		workers = intruderMaxConcurrency
+	}
+
+	opt := sendOptions{Timeout: intruderDefaultTimeout, Chain: atk.Chain}
+	if atk.Timeout > 0 {
+		opt.Timeout = time.Duration(atk.Timeout) * time.Millisecond
+	}
+
+	// 先发送基准请求, 用于对比和差异
+	base := &IntruderResult{JobID: job.ID, Index: intruderBaselineIndex, Baseline: true, Position: -1}
+	web.intruderSend(ctx, a, base, a.defaults, opt)
+	db.SaveIntruderResult(base)
+	streamIntruderResult(us, base)
+
+	indexes := make(chan int)
+	go func() {
+		defer close(indexes)
+
+		var tick <-chan time.Time
+		if atk.Rate > 0 {
+			ticker := time.NewTicker(rateInterval(atk.Rate))
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+
+		for i := 0; i < a.total; i++ {
+			// 暂停时阻塞
+			if j.wait(ctx) != nil {
+				return
+			}
+
+			if tick != nil && i > 0 {
+				select {
+				case <-tick:
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			select {
+			case indexes <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	results := make(chan *IntruderResult)
+	var wg sync.WaitGroup
+	for n := 0; n < workers; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				values, payloads, position := a.values(i)
+				res := &IntruderResult{JobID: job.ID, Index: i, Position: position, Payloads: payloads}
+				web.intruderSend(ctx, a, res, values, opt)
+				results <- res
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	for res := range results {
+		// 停止时未完成的请求不计入结果
+		if res.Error != "" && ctx.Err() != nil {
+			continue
+		}
+		db.SaveIntruderResult(res)
+
+		job.Done++
+		if res.Error != "" {
+			job.Errors++
+		}
+		if job.Done%intruderSaveEvery == 0 {
+			db.SaveIntruderJob(job)
+		}
+		j.progress(job.Done, job.Total)
+
+		streamIntruderResult(us, res)
+	}
+
+	job.State = IntruderDone
+	if ctx.Err() != nil && job.Done < job.Total {
+		job.State = IntruderStopped
+	}
+	job.Finished = time.Now()
+	db.SaveIntruderJob(job)
+
+	chunk, _ := sonic.Marshal(job)
+	sendToUser(us, messageTypeIntruderDone, job.ID, chunk)
+	log.Infof("intruder job %s %s %d/%d errors %d", job.ID, job.State, job.Done, job.Total, job.Errors)
+}
+
+// 推送时不包含请求和响应
+func streamIntruderResult(us *userState, res *IntruderResult) {
+	row := *res
+	row.Flow = nil
+	chunk, _ := sonic.Marshal(row)
+	sendToUser(us, messageTypeIntruder, res.JobID, chunk)
+}
+
+func (web *WebAddon) intruderSend(ctx context.Context, a *intruderAttack, res *IntruderResult, values []string, opt sendOptions) {
+	fr := a.tpl.render(values)
+	start := time.Now()
+	flow, err := web.doRequest(ctx, fr, opt)
+	res.Time = time.Since(start).Milliseconds()
+	if err != nil {
+		res.Error = err.Error()
+		return
+	}
+
+	res.Status = flow.StatusCode
+	res.Length = flow.ResponseSize
+	a.matcher.apply(res, flow)
+	if len(flow.ResponseBody) > intruderBodyLimit {
+		flow.ResponseBody = flow.ResponseBody[:intruderBodyLimit]
+		flow.Truncated = true
+	}
+	res.Flow = flow
+}
+
+// 推送到用户当前的所有 websocket 会话, 没有会话时丢弃
+func sendToUser(us *userState, mType messageType, id string, chunk []byte) {
+	msg := NewBinMessage(mType, id, 0, chunk)
+	for _, c := range us.snapshot() {
+		c.mu.Lock()
+		err := c.write(msg)
+		c.mu.Unlock()
+		if err != nil {
+			log.Error(err)
+		}
+	}
+}
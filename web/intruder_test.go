@@ -0,0 +1,328 @@
+package web
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"testing"
+
+	"github.com/vela-ssoc/vela-mitm/proxy"
+)
+
+func TestIntruderTemplate(t *testing.T) {
+	fr := &proxy.RequestEditData{
+		Method: "GET",
+		RawURL: "http://a.com/user?id=§1§&name=§bob§",
+		Header: http.Header{"X-Token": {"§t§"}},
+		Body:   "q=§x§",
+	}
+
+	tpl, err := parseTemplate(fr, intruderDefaultMarker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tpl.defaults, []string{"1", "bob", "t", "x"}) {
+		t.Fatalf("defaults %v", tpl.defaults)
+	}
+
+	out := tpl.render([]string{"2", "alice", "abc", "y"})
+	if out.RawURL != "http://a.com/user?id=2&name=alice" || out.Header.Get("X-Token") != "abc" || out.Body != "q=y" {
+		t.Fatalf("render %+v", out)
+	}
+
+	fr.Body = "§x"
+	if _, err = parseTemplate(fr, intruderDefaultMarker); err == nil {
+		t.Fatal("unpaired marker should fail")
+	}
+}
+
+func TestIntruderModes(t *testing.T) {
+	tpl, _ := parseTemplate(&proxy.RequestEditData{Method: "GET", RawURL: "http://a.com/§a§/§b§"}, intruderDefaultMarker)
+	list := func(v ...string) *payloadSource {
+		ps, _ := (&PayloadSet{Type: "list", List: v}).source("")
+		return ps
+	}
+
+	cases := []struct {
+		mode string
+		sets []*payloadSource
+		want [][]string
+	}{
+		{IntruderSniper, []*payloadSource{list("1", "2")}, [][]string{{"1", "b"}, {"2", "b"}, {"a", "1"}, {"a", "2"}}},
+		{IntruderBatteringRam, []*payloadSource{list("1", "2")}, [][]string{{"1", "1"}, {"2", "2"}}},
+		{IntruderPitchfork, []*payloadSource{list("1", "2", "3"), list("x", "y")}, [][]string{{"1", "x"}, {"2", "y"}}},
+		{IntruderClusterBomb, []*payloadSource{list("1", "2"), list("x", "y")}, [][]string{{"1", "x"}, {"1", "y"}, {"2", "x"}, {"2", "y"}}},
+	}
+
+	for _, c := range cases {
+		a, err := newIntruderAttack(c.mode, tpl, c.sets)
+		if err != nil {
+			t.Fatal(c.mode, err)
+		}
+
+		var got [][]string
+		for i := 0; i < a.total; i++ {
+			values, _, _ := a.values(i)
+			got = append(got, values)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %v", c.mode, got)
+		}
+	}
+
+	if _, err := newIntruderAttack(IntruderPitchfork, tpl, []*payloadSource{list("1")}); err == nil {
+		t.Error("pitchfork need a set per position")
+	}
+}
+
+func TestPayloadSource(t *testing.T) {
+	ps, err := (&PayloadSet{Type: "numbers", From: 8, To: 12, Step: 2, Format: "%03d", Prefix: "id", Transforms: []string{"upper"}}).source("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ps.len() != 3 || ps.at(0) != "ID008" || ps.at(2) != "ID012" {
+		t.Fatalf("numbers %d %s %s", ps.len(), ps.at(0), ps.at(2))
+	}
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "words.txt"), []byte("admin\r\n\nroot\n"), 0600)
+	ps, err = (&PayloadSet{Type: "file", File: "words.txt", Transforms: []string{"base64"}}).source(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ps.len() != 2 || ps.at(1) != "cm9vdA==" {
+		t.Fatalf("file %d %s", ps.len(), ps.at(1))
+	}
+
+	if _, err = (&PayloadSet{Type: "file", File: "../words.txt"}).source(dir); err == nil {
+		t.Fatal("file outside payload dir should fail")
+	}
+}
+
+func TestIntruderAnalysis(t *testing.T) {
+	m, err := newIntruderMatcher([]string{"ERROR"}, []IntruderExtract{{Name: "csrf", Regex: `csrf=(\w+)`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := &IntruderResult{}
+	m.apply(res, &Flow{ResponseHeader: http.Header{"Set-Cookie": {"csrf=abc123"}}, ResponseBody: "sql error"})
+	if !reflect.DeepEqual(res.Matches, []bool{true}) || !reflect.DeepEqual(res.Extracts, []string{"abc123"}) {
+		t.Fatalf("matches %v extracts %v", res.Matches, res.Extracts)
+	}
+
+	var results []IntruderResult
+	for i := 0; i < 40; i++ {
+		results = append(results, IntruderResult{Index: i, Status: 200, Length: 1000 + i%5, Time: 10})
+	}
+	results[7].Status, results[7].Length = 500, 3000
+	results[9].Time = 5000
+	results[11].Error = "timeout"
+
+	an := analyzeIntruder(results, 0)
+	want := []IntruderOutlier{
+		{Index: 7, Reasons: []string{AnomalyStatus, AnomalyLength}},
+		{Index: 9, Reasons: []string{AnomalyTime}},
+		{Index: 11, Reasons: []string{AnomalyError}},
+	}
+	if !reflect.DeepEqual(an.Outliers, want) {
+		t.Fatalf("outliers %+v", an.Outliers)
+	}
+	if len(an.Length) != 2 || an.Length[0].Count != 38 {
+		t.Fatalf("length clusters %+v", an.Length)
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	lines := diffLines([]string{"a", "b", "c"}, []string{"a", "x", "c", "d"})
+	var ops string
+	for _, line := range lines {
+		ops += line.Op
+	}
+	if ops != "=-+=+" && ops != "=+-=+" {
+		t.Fatalf("ops %s %+v", ops, lines)
+	}
+
+	old := &Flow{StatusCode: 200, ResponseHeader: http.Header{"X-A": {"1"}}, ResponseBody: "1\n2\n3\n4\n5\n6\n7\n8\n9\n"}
+	cur := &Flow{StatusCode: 200, ResponseHeader: http.Header{"X-A": {"2"}}, ResponseBody: "1\n2\n3\n4\n5\n6\n7\n8\nnine\n"}
+	diff := DiffFlows(old, cur)
+	if len(diff.Header) != 1 || diff.Header[0].Name != "X-A" {
+		t.Fatalf("header diff %+v", diff.Header)
+	}
+	if diff.Body[0].Op != "..." || diff.Body[0].Text != "5" || len(diff.Body) != 6 {
+		t.Fatalf("body diff %+v", diff.Body)
+	}
+}
+
+func TestDiffLinesLarge(t *testing.T) {
+	// 按 diff 还原出两侧内容
+	check := func(a, b []string, lines []DiffLine) {
+		var ra, rb []string
+		for _, line := range lines {
+			if line.Op != "+" {
+				ra = append(ra, line.Text)
+			}
+			if line.Op != "-" {
+				rb = append(rb, line.Text)
+			}
+		}
+		if !reflect.DeepEqual(ra, a) || !reflect.DeepEqual(rb, b) {
+			t.Fatalf("diff does not rebuild input")
+		}
+	}
+	gen := func(n int, prefix string) []string {
+		lines := make([]string, n)
+		for i := range lines {
+			lines[i] = prefix + strconv.Itoa(i)
+		}
+		return lines
+	}
+
+	every := func(lines []string, n int) []string {
+		for i := 0; i < len(lines); i += n {
+			lines[i] = "x"
+		}
+		return lines
+	}
+
+	cases := []struct {
+		name string
+		a, b []string
+		eqs  int
+	}{
+		{"replace", gen(20000, "a"), gen(20000, "b"), 0},
+		{"max_edits", gen(5000, "a"), gen(5000, "b"), 0},
+		{"sparse", gen(20000, "a"), append(gen(20000, "a")[:10000:10000], append([]string{"x"}, gen(20000, "a")[10001:]...)...), 19999},
+		{"interleaved", gen(3000, "a"), every(gen(3000, "a"), 10), 2700},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			lines := diffLines(c.a, c.b)
+			runtime.ReadMemStats(&after)
+
+			if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 64<<20 {
+				t.Fatalf("alloc %d bytes", alloc)
+			}
+			check(c.a, c.b, lines)
+			eqs := 0
+			for _, line := range lines {
+				if line.Op == "=" {
+					eqs++
+				}
+			}
+			if eqs != c.eqs {
+				t.Fatalf("equal lines %d", eqs)
+			}
+		})
+	}
+}
+
+func TestIntruderRate(t *testing.T) {
+	if d := rateInterval(1e12); d <= 0 {
+		t.Fatalf("interval %v", d)
+	}
+
+	for _, rate := range []float64{-1, math.NaN()} {
+		atk := &IntruderAttack{Request: proxy.RequestEditData{Method: "GET", RawURL: "http://a.com/?id=§1§"}, Mode: IntruderSniper,
+			Payloads: []PayloadSet{{Type: "list", List: []string{"2"}}}, Rate: rate}
+		if _, err := atk.prepare(""); err == nil {
+			t.Fatalf("rate %v should fail", rate)
+		}
+	}
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.RawQuery))
+	}))
+	defer target.Close()
+
+	// 过大的 rate 限制为最大值, 不会使 NewTicker 的间隔为 0
+	web := &WebAddon{dbs: map[string]*sharedDB{"alice": {db: newTestFlowDB(t), refs: 1}}}
+	c := &concurrentConn{userData: &UserData{Name: "alice", DB: "alice", Role: RoleTester}, user: &userState{}, db: web.dbs["alice"].db}
+	job, err := web.startIntruder(c, &IntruderAttack{
+		Request:  proxy.RequestEditData{Method: "GET", RawURL: target.URL + "/?id=§1§", Header: http.Header{}},
+		Mode:     IntruderSniper,
+		Payloads: []PayloadSet{{Type: "list", List: []string{"2", "3", "4"}}},
+		Rate:     1e12,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Attack.Rate != intruderMaxRate {
+		t.Fatalf("rate %v", job.Attack.Rate)
+	}
+	waitJob(t, web, c, job.ID, JobDone)
+}
+
+func TestIntruderResultStore(t *testing.T) {
+	db := newTestFlowDB(t)
+	for _, id := range []string{"job-a", "job-b"} {
+		// 乱序写入, 读取时按序号排序
+		for _, i := range []int{3, 1, 0, 2} {
+			db.SaveIntruderResult(&IntruderResult{JobID: id, Index: i, Status: 200, Flow: &Flow{FlowID: id + strconv.Itoa(i)}})
+		}
+	}
+
+	var rows []IntruderResult
+	if err := db.db.From(intruderResultBucket).All(&rows); err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range rows {
+		if row.Flow != nil {
+			t.Fatalf("summary %s/%d stores flow", row.JobID, row.Index)
+		}
+	}
+
+	results, err := db.IntruderResults("job-b", 1, 2, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0].Index != 1 || results[1].Index != 2 {
+		t.Fatalf("results %+v", results)
+	}
+	if results[0].Flow == nil || results[0].Flow.FlowID != "job-b1" {
+		t.Fatalf("flow %+v", results[0].Flow)
+	}
+
+	results, err = db.IntruderResults("job-a", 0, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 4 || results[0].Flow != nil {
+		t.Fatalf("results %+v", results)
+	}
+
+	if results, err = db.IntruderResults("job-c", 0, 0, false); err != nil || len(results) != 0 {
+		t.Fatalf("results %v %v", results, err)
+	}
+}
+
+func TestIntruderResultLookup(t *testing.T) {
+	db := newTestFlowDB(t)
+	db.SaveIntruderResult(&IntruderResult{JobID: "job", Index: intruderBaselineIndex, Baseline: true, Status: 200, Flow: &Flow{FlowID: "base"}})
+	for i := 0; i < 3; i++ {
+		db.SaveIntruderResult(&IntruderResult{JobID: "job", Index: i, Status: 200, Length: 10, Flow: &Flow{FlowID: strconv.Itoa(i)}})
+	}
+
+	res, err := db.IntruderResult("job", 2)
+	if err != nil || res.Flow == nil || res.Flow.FlowID != "2" {
+		t.Fatalf("result %+v %v", res, err)
+	}
+	if _, err = db.IntruderResult("job", 3); err == nil {
+		t.Fatal("missing result found")
+	}
+
+	an, err := db.IntruderAnalysis(&IntruderJob{ID: "job", Attack: IntruderAttack{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if an.Baseline == nil || !an.Baseline.Baseline || an.Baseline.Flow != nil {
+		t.Fatalf("baseline %+v", an.Baseline)
+	}
+}
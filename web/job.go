@@ -0,0 +1,362 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bytedance/sonic"
+	uuid "github.com/satori/go.uuid"
+	"github.com/vela-ssoc/vela-mitm/proxy"
+)
+
+const (
+	JobRepeat   = "repeat"
+	JobIntruder = "intruder"
+	JobSmuggle  = "smuggle"
+	JobScan     = "scan"
+)
+
+const (
+	JobRunning = "running"
+	JobPaused  = "paused"
+	JobDone    = "done"
+	JobStopped = "stopped"
+	JobFailed  = "failed"
+)
+
+const (
+	jobRetention      = time.Hour   // 结束的任务在内存中保留的时间
+	jobReportInterval = time.Second // 进度推送的最小间隔, 状态变化时立即推送
+)
+
+var (
+	JobNotFoundE    = fmt.Errorf("job not found")
+	JobNotPausableE = fmt.Errorf("job can not be paused")
+	JobFinishedE    = fmt.Errorf("job already finished")
+)
+
+// 后台任务与发起的请求和 websocket 会话无关, 会话全部断开后继续执行
+// 状态和进度通过 websocket 推送给该用户当前的所有会话
+type JobInfo struct {
+	ID       string    `json:"id"`
+	Kind     string    `json:"kind"`
+	User     string    `json:"user"`
+	State    string    `json:"state"`
+	Pausable bool      `json:"pausable"`
+	Done     int       `json:"done"`
+	Total    int       `json:"total"`
+	Error    string    `json:"error,omitempty"`
+	Created  time.Time `json:"created"`
+	Finished time.Time `json:"finished"`
+}
+
+func (info *JobInfo) finished() bool {
+	return info.State == JobDone || info.State == JobStopped || info.State == JobFailed
+}
+
+// Result 为 repeat 任务的响应, Raw 为原始请求的响应, intruder 的结果保存在 FlowDB 中
+// Report 为扫描任务的报告, 执行过程中随发现更新
+type JobDetail struct {
+	JobInfo
+	Result *Flow       `json:"result,omitempty"`
+	Raw    *RawResult  `json:"raw,omitempty"`
+	Report interface{} `json:"report,omitempty"`
+}
+
+// 暂停时 resume 不为 nil, 恢复时关闭
+type pauseGate struct {
+	mu     sync.Mutex
+	resume chan struct{}
+}
+
+func (g *pauseGate) pause() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.resume == nil {
+		g.resume = make(chan struct{})
+	}
+}
+
+func (g *pauseGate) unpause() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.resume != nil {
+		close(g.resume)
+		g.resume = nil
+	}
+}
+
+// 暂停时阻塞直到恢复或取消
+func (g *pauseGate) wait(ctx context.Context) error {
+	g.mu.Lock()
+	ch := g.resume
+	g.mu.Unlock()
+
+	if ch == nil {
+		return ctx.Err()
+	}
+
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type backgroundJob struct {
+	mu       sync.Mutex
+	info     JobInfo
+	result   *Flow
+	raw      *RawResult
+	output   interface{}
+	reported time.Time
+	cancel   context.CancelFunc
+	gate     pauseGate
+	us       *userState
+}
+
+func (j *backgroundJob) snapshot() JobDetail {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return JobDetail{JobInfo: j.info, Result: j.result, Raw: j.raw, Report: j.output}
+}
+
+// 推送当前状态, force 为 false 时按 jobReportInterval 限流
+func (j *backgroundJob) report(force bool) {
+	j.mu.Lock()
+	if !force && time.Since(j.reported) < jobReportInterval {
+		j.mu.Unlock()
+		return
+	}
+	j.reported = time.Now()
+	chunk, _ := sonic.Marshal(j.info)
+	j.mu.Unlock()
+
+	sendToUser(j.us, messageTypeJob, j.info.ID, chunk)
+}
+
+func (j *backgroundJob) progress(done, total int) {
+	j.mu.Lock()
+	j.info.Done, j.info.Total = done, total
+	j.mu.Unlock()
+	j.report(false)
+}
+
+// v 在设置之后不能再修改
+func (j *backgroundJob) setOutput(v interface{}) {
+	j.mu.Lock()
+	j.output = v
+	j.mu.Unlock()
+}
+
+// 任务在每个请求之前调用, 暂停时阻塞
+func (j *backgroundJob) wait(ctx context.Context) error {
+	return j.gate.wait(ctx)
+}
+
+// 暂停或恢复, 状态已经一致时不做处理
+func (j *backgroundJob) pause(paused bool) error {
+	j.mu.Lock()
+	if j.info.finished() {
+		j.mu.Unlock()
+		return JobFinishedE
+	}
+	if !j.info.Pausable {
+		j.mu.Unlock()
+		return JobNotPausableE
+	}
+
+	from, to := JobRunning, JobPaused
+	if !paused {
+		from, to = JobPaused, JobRunning
+	}
+	changed := j.info.State == from
+	if changed {
+		j.info.State = to
+		if paused {
+			j.gate.pause()
+		} else {
+			j.gate.unpause()
+		}
+	}
+	j.mu.Unlock()
+
+	if changed {
+		j.report(true)
+	}
+	return nil
+}
+
+type jobSpec struct {
+	ID       string // 为空时生成
+	Kind     string
+	Total    int
+	Pausable bool
+	Run      func(ctx context.Context, j *backgroundJob, db *FlowDB) error
+}
+
+type jobManager struct {
+	mu   sync.Mutex
+	jobs map[string]*backgroundJob
+}
+
+// 在后台执行, 任务持有 FlowDB 的引用直到结束
+func (web *WebAddon) submitJob(c *concurrentConn, spec jobSpec) JobInfo {
+	if spec.ID == "" {
+		spec.ID = uuid.NewV4().String()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &backgroundJob{
+		info: JobInfo{
+			ID:       spec.ID,
+			Kind:     spec.Kind,
+			User:     c.userData.Name,
+			State:    JobRunning,
+			Pausable: spec.Pausable,
+			Total:    spec.Total,
+			Created:  time.Now(),
+		},
+		cancel: cancel,
+		us:     c.user,
+	}
+
+	jm := &web.jobs
+	jm.mu.Lock()
+	jm.gc()
+	if jm.jobs == nil {
+		jm.jobs = make(map[string]*backgroundJob)
+	}
+	jm.jobs[j.info.ID] = j
+	jm.mu.Unlock()
+
+	name := c.userData.DB
+	db := web.acquireDB(name)
+	go func() {
+		defer web.releaseDB(name)
+		defer cancel()
+
+		err := spec.Run(ctx, j, db)
+
+		j.mu.Lock()
+		switch {
+		case err != nil && ctx.Err() == nil:
+			j.info.State = JobFailed
+			j.info.Error = err.Error()
+		case ctx.Err() != nil && j.info.Done < j.info.Total:
+			j.info.State = JobStopped
+		default:
+			j.info.State = JobDone
+		}
+		j.info.Finished = time.Now()
+		j.mu.Unlock()
+		j.report(true)
+	}()
+
+	return j.snapshot().JobInfo
+}
+
+// 删除超过保留时间的已结束任务, 调用方持有锁
+func (jm *jobManager) gc() {
+	for id, j := range jm.jobs {
+		j.mu.Lock()
+		expired := j.info.finished() && time.Since(j.info.Finished) > jobRetention
+		j.mu.Unlock()
+		if expired {
+			delete(jm.jobs, id)
+		}
+	}
+}
+
+// 只能查看和操作自己的任务, admin 可以操作所有任务
+func (web *WebAddon) job(c *concurrentConn, id string) (*backgroundJob, error) {
+	jm := &web.jobs
+	jm.mu.Lock()
+	j, ok := jm.jobs[id]
+	jm.mu.Unlock()
+
+	if !ok || (j.info.User != c.userData.Name && !c.userData.Role.Allow(RoleAdmin)) {
+		return nil, JobNotFoundE
+	}
+	return j, nil
+}
+
+// 按创建时间倒序, 不包含结果; admin 列出所有用户的任务
+func (web *WebAddon) listJobs(c *concurrentConn) []JobInfo {
+	jm := &web.jobs
+	jm.mu.Lock()
+	jm.gc()
+	jobs := make([]*backgroundJob, 0, len(jm.jobs))
+	for _, j := range jm.jobs {
+		jobs = append(jobs, j)
+	}
+	jm.mu.Unlock()
+
+	infos := make([]JobInfo, 0, len(jobs))
+	for _, j := range jobs {
+		info := j.snapshot().JobInfo
+		if info.User == c.userData.Name || c.userData.Role.Allow(RoleAdmin) {
+			infos = append(infos, info)
+		}
+	}
+
+	sort.Slice(infos, func(i, k int) bool { return infos[i].Created.After(infos[k].Created) })
+	return infos
+}
+
+func (web *WebAddon) stopJob(c *concurrentConn, id string) error {
+	j, err := web.job(c, id)
+	if err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	finished := j.info.finished()
+	j.mu.Unlock()
+	if finished {
+		return JobFinishedE
+	}
+
+	j.cancel()
+	return nil
+}
+
+// action 为 stop pause resume
+func (web *WebAddon) controlJob(c *concurrentConn, id, action string) error {
+	if action == "stop" {
+		return web.stopJob(c, id)
+	}
+	if action != "pause" && action != "resume" {
+		return fmt.Errorf("unknown action %s", action)
+	}
+
+	j, err := web.job(c, id)
+	if err != nil {
+		return err
+	}
+	return j.pause(action == "pause")
+}
+
+// 后台重放, 结束后结果通过 JobDetail 读取
+func (web *WebAddon) submitRepeat(c *concurrentConn, fr *proxy.RequestEditData, opt sendOptions) JobInfo {
+	return web.submitJob(c, jobSpec{
+		Kind:  JobRepeat,
+		Total: 1,
+		Run: func(ctx context.Context, j *backgroundJob, _ *FlowDB) error {
+			flow, err := web.doRequest(ctx, fr, opt)
+			if err != nil {
+				return err
+			}
+
+			j.mu.Lock()
+			j.result = flow
+			j.info.Done = 1
+			j.mu.Unlock()
+			return nil
+		},
+	})
+}
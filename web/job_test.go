@@ -0,0 +1,103 @@
+package web
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vela-ssoc/vela-mitm/proxy"
+)
+
+func waitJob(t *testing.T, web *WebAddon, c *concurrentConn, id string, state string) JobDetail {
+	t.Helper()
+	for i := 0; i < 200; i++ {
+		j, err := web.job(c, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d := j.snapshot(); d.State == state {
+			return d
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("job %s not %s", id, state)
+	return JobDetail{}
+}
+
+func TestJobManager(t *testing.T) {
+	// 预先放入 dbs, 任务结束释放引用时不会关闭
+	web := &WebAddon{dbs: map[string]*sharedDB{
+		"alice": {db: newTestFlowDB(t), refs: 1},
+		"bob":   {db: newTestFlowDB(t), refs: 1},
+	}}
+	alice := &concurrentConn{userData: &UserData{Name: "alice", DB: "alice", Role: RoleTester}, user: &userState{}}
+	bob := &concurrentConn{userData: &UserData{Name: "bob", DB: "bob", Role: RoleTester}, user: &userState{}}
+
+	var n int64
+	info := web.submitJob(alice, jobSpec{Kind: JobIntruder, Total: 1000, Pausable: true,
+		Run: func(ctx context.Context, j *backgroundJob, _ *FlowDB) error {
+			for i := 1; i <= 1000; i++ {
+				if err := j.wait(ctx); err != nil {
+					return err
+				}
+				atomic.AddInt64(&n, 1)
+				j.progress(i, 1000)
+				time.Sleep(time.Millisecond)
+			}
+			return nil
+		}})
+
+	if _, err := web.job(bob, info.ID); err != JobNotFoundE {
+		t.Fatalf("other user got job %v", err)
+	}
+
+	if err := web.controlJob(alice, info.ID, "pause"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	paused := atomic.LoadInt64(&n)
+	time.Sleep(50 * time.Millisecond)
+	if atomic.LoadInt64(&n) != paused {
+		t.Fatal("job still running after pause")
+	}
+
+	if err := web.controlJob(alice, info.ID, "resume"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if atomic.LoadInt64(&n) == paused {
+		t.Fatal("job not resumed")
+	}
+
+	if err := web.controlJob(alice, info.ID, "stop"); err != nil {
+		t.Fatal(err)
+	}
+	waitJob(t, web, alice, info.ID, JobStopped)
+	if err := web.controlJob(alice, info.ID, "stop"); err != JobFinishedE {
+		t.Fatalf("stop finished job %v", err)
+	}
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("pong"))
+	}))
+	defer target.Close()
+
+	info = web.submitRepeat(alice, &proxy.RequestEditData{Method: "GET", RawURL: target.URL, Header: http.Header{}}, sendOptions{Timeout: time.Second})
+	if err := web.controlJob(alice, info.ID, "pause"); err != JobNotPausableE && err != JobFinishedE {
+		t.Fatalf("pause repeat %v", err)
+	}
+	detail := waitJob(t, web, alice, info.ID, JobDone)
+	if detail.Result == nil || detail.Result.ResponseBody != "pong" {
+		t.Fatalf("repeat result %+v", detail.Result)
+	}
+
+	if jobs := web.listJobs(alice); len(jobs) != 2 || jobs[0].ID != info.ID {
+		t.Fatalf("list %+v", jobs)
+	}
+	if jobs := web.listJobs(bob); len(jobs) != 0 {
+		t.Fatalf("bob list %+v", jobs)
+	}
+}
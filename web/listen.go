@@ -0,0 +1,91 @@
+package web
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vela-ssoc/vela-mitm/cert"
+)
+
+// web 后台的监听方式, 默认为 Config.Addr 上的 http
+type Listen struct {
+	Unix     string `yaml:"unix"`     // unix socket 路径, 设置后忽略 Addr 和 Loopback
+	Loopback bool   `yaml:"loopback"` // 只监听 127.0.0.1, 使用 Addr 中的端口
+
+	TLS   bool     `yaml:"tls"`
+	Cert  string   `yaml:"cert"` // 证书和私钥文件, 为空时由代理的 ca 签发
+	Key   string   `yaml:"key"`
+	Hosts []string `yaml:"hosts"` // ca 签发证书的域名和 ip, 默认 localhost 127.0.0.1 ::1
+}
+
+var defaultConsoleHosts = []string{"localhost", "127.0.0.1", "::1"}
+
+func (web *WebAddon) listen(addr string) (net.Listener, error) {
+	opt := web.config.Listen
+	if opt.Unix != "" {
+		// 上次异常退出遗留的 socket 文件
+		if err := os.Remove(opt.Unix); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		ln, err := net.Listen("unix", opt.Unix)
+		if err != nil {
+			return nil, err
+		}
+
+		// 只有同一用户可以连接
+		if err = os.Chmod(opt.Unix, 0600); err != nil {
+			ln.Close()
+			return nil, err
+		}
+		return ln, nil
+	}
+
+	if opt.Loopback {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		if ip := net.ParseIP(host); host != "" && host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			log.Warnf("web listen %s is not loopback, use 127.0.0.1", host)
+		}
+		addr = net.JoinHostPort("127.0.0.1", port)
+	}
+
+	return net.Listen("tcp", addr)
+}
+
+// 用户证书优先, 否则用代理的 ca 签发, 浏览器信任 ca 后可以直接访问
+func (web *WebAddon) tlsConfig() (*tls.Config, error) {
+	opt := web.config.Listen
+	if opt.Cert != "" || opt.Key != "" {
+		pair, err := tls.LoadX509KeyPair(opt.Cert, opt.Key)
+		if err != nil {
+			return nil, fmt.Errorf("load web cert fail %v", err)
+		}
+		return &tls.Config{Certificates: []tls.Certificate{pair}, MinVersion: tls.VersionTLS12}, nil
+	}
+
+	ca, err := cert.NewCA(web.certDir())
+	if err != nil {
+		return nil, fmt.Errorf("load ca fail %v", err)
+	}
+
+	hosts := opt.Hosts
+	if len(hosts) == 0 {
+		hosts = defaultConsoleHosts
+	}
+
+	leaf, err := ca.IssueCert(hosts...)
+	if err != nil {
+		return nil, fmt.Errorf("issue web cert fail %v", err)
+	}
+	log.Infof("web cert issued by ca for %s", strings.Join(hosts, ", "))
+
+	return &tls.Config{Certificates: []tls.Certificate{*leaf}, MinVersion: tls.VersionTLS12}, nil
+}
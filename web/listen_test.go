@@ -0,0 +1,182 @@
+package web
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/vela-ssoc/vela-mitm/cert"
+)
+
+func serveListen(t *testing.T, ln net.Listener, cfg *tls.Config) {
+	t.Helper()
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("pong"))
+	}), TLSConfig: cfg}
+	go func() {
+		if cfg != nil {
+			server.ServeTLS(ln, "", "")
+		} else {
+			server.Serve(ln)
+		}
+	}()
+	t.Cleanup(func() { server.Close() })
+}
+
+func getPong(t *testing.T, client *http.Client, url string) {
+	t.Helper()
+	r, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Body.Close()
+
+	body, _ := io.ReadAll(r.Body)
+	if string(body) != "pong" {
+		t.Fatalf("body %q", body)
+	}
+}
+
+func TestListenTLS(t *testing.T) {
+	dir := t.TempDir()
+	web := &WebAddon{config: Config{CertDir: dir, Listen: Listen{TLS: true, Loopback: true}}}
+	cfg, err := web.tlsConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := web.listen("0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveListen(t, ln, cfg)
+
+	// 信任代理的 ca 后可以校验 ca 签发的证书
+	ca, err := cert.NewCA(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(&ca.RootCert)
+	client := &http.Client{Timeout: 5 * time.Second, Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, ServerName: "localhost"}}}
+	getPong(t, client, "https://"+ln.Addr().String()+"/")
+
+	// 不信任 ca 时握手失败
+	if _, err = (&http.Client{Timeout: 5 * time.Second}).Get("https://" + ln.Addr().String() + "/"); err == nil {
+		t.Fatal("untrusted cert accepted")
+	}
+
+	// 用户证书优先
+	leaf, err := ca.IssueCert("localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "web.crt"), filepath.Join(dir, "web.key")
+	if err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf.Certificate[0]}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	key, err := x509.MarshalPKCS8PrivateKey(leaf.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	web.config.Listen.Cert, web.config.Listen.Key = certFile, keyFile
+	if cfg, err = web.tlsConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Certificates) != 1 || string(cfg.Certificates[0].Certificate[0]) != string(leaf.Certificate[0]) {
+		t.Fatal("user cert not used")
+	}
+
+	web.config.Listen.Key = filepath.Join(dir, "missing.key")
+	if _, err = web.tlsConfig(); err == nil {
+		t.Fatal("missing key accepted")
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	// t.TempDir 的路径可能超过 unix socket 的长度限制
+	dir, err := os.MkdirTemp("", "mitm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// 上次异常退出遗留的文件
+	sock := filepath.Join(dir, "web.sock")
+	if err = os.WriteFile(sock, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	web := &WebAddon{config: Config{Listen: Listen{Unix: sock, Loopback: true}}}
+	ln, err := web.listen("0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveListen(t, ln, nil)
+
+	info, err := os.Stat(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0600 {
+		t.Fatalf("socket mode %v", info.Mode())
+	}
+
+	client := &http.Client{Timeout: 5 * time.Second, Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", sock)
+		},
+	}}
+	getPong(t, client, "http://unix/")
+}
+
+func TestListenLoopback(t *testing.T) {
+	web := &WebAddon{config: Config{Listen: Listen{Loopback: true}}}
+	ln, err := web.listen("0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveListen(t, ln, nil)
+
+	// 非 loopback 的地址改为监听 127.0.0.1
+	addr := ln.Addr().(*net.TCPAddr)
+	if !addr.IP.IsLoopback() {
+		t.Fatalf("listen %v", addr)
+	}
+	getPong(t, &http.Client{Timeout: 5 * time.Second}, "http://"+addr.String()+"/")
+
+	// 从本机非 loopback 的地址连接会被拒绝
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range addrs {
+		ip, ok := a.(*net.IPNet)
+		if !ok || ip.IP.IsLoopback() || ip.IP.To4() == nil {
+			continue
+		}
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip.IP.String(), strconv.Itoa(addr.Port)), time.Second)
+		if err == nil {
+			conn.Close()
+			t.Fatalf("%s accepted", ip.IP)
+		}
+	}
+
+	if _, err = web.listen("bad-addr"); err == nil {
+		t.Fatal("invalid addr accepted")
+	}
+}
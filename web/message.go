@@ -20,6 +20,8 @@ import (
 // messageFlow
 // version 1 byte + type 1 byte + id 36 byte + waitIntercept 1 byte + content left bytes
 
+// type: 0/5 由服务端推送连接建立(含更新)/关闭, id 为连接 id, content 为 ConnRecord json
+
 // type: 11/12/13/14
 // messageEdit
 // version 1 byte + type 1 byte + id 36 byte + header len 4 byte + header content bytes + body len 4 byte + [body content bytes]
@@ -28,6 +30,10 @@ import (
 // messageMeta
 // version 1 byte + type 1 byte + content left bytes
 
+// type: 107
+// messageFeed
+// version 1 byte + type 1 byte + query expression left bytes, 空表达式表示关闭实时推送
+
 var (
 	TooShortE     = fmt.Errorf("too short message")
 	VersionE      = fmt.Errorf("invalid message version")
@@ -63,8 +69,15 @@ const (
 
 	messageTypePull  messageType = 105
 	messageTypeFlows messageType = 106
+	messageTypeFeed  messageType = 107
 
-	messageTypeLogin messageType = 110
+	messageTypeLogin  messageType = 110
+	messageTypeDenied messageType = 111 // 角色权限不足, 内容为被拒绝的消息类型和需要的角色
+
+	messageTypeIntruder     messageType = 112 // intruder 单个请求的结果, id 为任务 id
+	messageTypeIntruderDone messageType = 113 // intruder 任务结束
+	messageTypeJob          messageType = 114 // 后台任务的状态和进度, id 为任务 id
+	messageTypeFinding      messageType = 115 // 扫描的新发现, id 为发现的 id
 )
 
 var allMessageTypes = []messageType{
@@ -86,6 +99,7 @@ var allMessageTypes = []messageType{
 	MessageTypeChangeHistoryRules,
 	messageTypePull,
 	messageTypeFlows,
+	messageTypeFeed,
 }
 
 func validMessageType(t byte) bool {
@@ -147,13 +161,6 @@ func newMessageFlow(mType messageType, f *proxy.Flow) *messageFlow {
 	}
 }
 
-func newMessageConnClose(connCtx *proxy.ConnContext) *messageFlow {
-	return &messageFlow{
-		mType: messageTypeConnClose,
-		id:    connCtx.Id(),
-	}
-}
-
 func (m *messageFlow) bytes() []byte {
 	buf := bytes.NewBuffer(make([]byte, 0))
 	buf.WriteByte(byte(messageVersion))
@@ -332,6 +339,18 @@ func NewMessage(data []byte) *messageEdit {
 	}
 }
 
+type messageFeed struct {
+	query string
+}
+
+func (m *messageFeed) bytes() []byte {
+	buf := bytes.NewBuffer(make([]byte, 0))
+	buf.WriteByte(byte(messageVersion))
+	buf.WriteByte(byte(messageTypeFeed))
+	buf.WriteString(m.query)
+	return buf.Bytes()
+}
+
 type Pull struct {
 	Page     int `json:"page"`
 	PageSize int `json:"page_size"`
@@ -436,6 +455,9 @@ func parseMessage(data []byte) (message, error) {
 	case messageTypePull:
 		return ParseHistoryPullInfo(data), nil
 
+	case messageTypeFeed:
+		return &messageFeed{query: string(data[2:])}, nil
+
 	default:
 		log.Warnf("invalid message type %v", mType)
 		return nil, MessageE
@@ -0,0 +1,527 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vela-ssoc/vela-mitm/proxy"
+)
+
+/*
+	被动扫描, 只分析经过代理的 flow, 不发送任何请求
+	扫描在后台 worker 中执行, 不阻塞代理; 队列满时丢弃, scope 外的 flow 不扫描
+	结果保存到记录该 flow 的用户的 FlowDB, 新的发现通过 websocket 推送
+*/
+
+const (
+	PassiveSecurityHeaders = "security-headers"
+	PassiveCookie          = "insecure-cookie"
+	PassiveReflection      = "reflected-parameter"
+	PassiveSecret          = "secret"
+	PassiveStackTrace      = "stack-trace"
+	PassiveMixedContent    = "mixed-content"
+	PassiveCORS            = "cors"
+	PassiveURLSensitive    = "sensitive-url"
+)
+
+var passiveChecks = []string{
+	PassiveSecurityHeaders,
+	PassiveCookie,
+	PassiveReflection,
+	PassiveSecret,
+	PassiveStackTrace,
+	PassiveMixedContent,
+	PassiveCORS,
+	PassiveURLSensitive,
+}
+
+const (
+	passiveDefaultMaxBody = 1 << 20
+	passiveWorkers        = 4
+	passiveQueueSize      = 1024
+)
+
+// Checks 为空时执行全部检查; MaxBody 为分析的响应 body 上限, 超过部分忽略, 默认 1MB
+type PassiveConfig struct {
+	Enable  bool     `json:"enable" yaml:"enable"`
+	Checks  []string `json:"checks" yaml:"checks"`
+	MaxBody int      `json:"max_body" yaml:"max_body"`
+}
+
+type PassiveAddon struct {
+	proxy.BaseAddon
+
+	mu     sync.RWMutex
+	config PassiveConfig
+	checks map[string]bool
+	sink   func(f *proxy.Flow, findings []*Finding)
+	scope  *ProjectScope
+	queue  chan passiveJob
+}
+
+type passiveJob struct {
+	flow     *proxy.Flow
+	withBody bool
+}
+
+func NewPassiveAddon(cfg PassiveConfig) (*PassiveAddon, error) {
+	pa := &PassiveAddon{queue: make(chan passiveJob, passiveQueueSize)}
+	if err := pa.SetConfig(cfg); err != nil {
+		return nil, err
+	}
+	for i := 0; i < passiveWorkers; i++ {
+		go pa.worker()
+	}
+	return pa, nil
+}
+
+func (pa *PassiveAddon) SetConfig(cfg PassiveConfig) error {
+	checks := make(map[string]bool)
+	for _, name := range cfg.Checks {
+		found := false
+		for _, v := range passiveChecks {
+			found = found || v == name
+		}
+		if !found {
+			return fmt.Errorf("invalid passive check %s", name)
+		}
+		checks[name] = true
+	}
+	if len(checks) == 0 {
+		for _, v := range passiveChecks {
+			checks[v] = true
+		}
+	}
+	if cfg.MaxBody <= 0 {
+		cfg.MaxBody = passiveDefaultMaxBody
+	}
+
+	pa.mu.Lock()
+	pa.config, pa.checks = cfg, checks
+	pa.mu.Unlock()
+	return nil
+}
+
+func (pa *PassiveAddon) Config() PassiveConfig {
+	pa.mu.RLock()
+	defer pa.mu.RUnlock()
+	return pa.config
+}
+
+func (pa *PassiveAddon) setSink(sink func(f *proxy.Flow, findings []*Finding)) {
+	pa.mu.Lock()
+	pa.sink = sink
+	pa.mu.Unlock()
+}
+
+func (pa *PassiveAddon) setScope(scope *ProjectScope) {
+	pa.mu.Lock()
+	pa.scope = scope
+	pa.mu.Unlock()
+}
+
+func (pa *PassiveAddon) Response(f *proxy.Flow) {
+	pa.handle(f, true)
+}
+
+// stream 模式没有缓存 body, 只检查 header 和 url
+func (pa *PassiveAddon) StreamComplete(f *proxy.Flow) {
+	pa.handle(f, false)
+}
+
+func (pa *PassiveAddon) handle(f *proxy.Flow, withBody bool) {
+	if f.Response == nil || f.Request.Method == "CONNECT" {
+		return
+	}
+
+	pa.mu.RLock()
+	enable, sink, scope := pa.config.Enable, pa.sink, pa.scope
+	pa.mu.RUnlock()
+	if !enable || sink == nil || !scope.InScope(f.Request.URL) {
+		return
+	}
+
+	select {
+	case pa.queue <- passiveJob{flow: passiveSnapshot(f), withBody: withBody}:
+	default:
+		log.Warnf("passive scan queue full, skip flow %s", f.Id)
+	}
+}
+
+func (pa *PassiveAddon) worker() {
+	for job := range pa.queue {
+		findings := pa.scan(job.flow, job.withBody)
+		if len(findings) == 0 {
+			continue
+		}
+
+		pa.mu.RLock()
+		sink := pa.sink
+		pa.mu.RUnlock()
+		if sink != nil {
+			sink(job.flow, findings)
+		}
+	}
+}
+
+// hook 返回后后续 addon 还会修改 flow, 复制 header 和解码缓存, body 只读共用
+func passiveSnapshot(f *proxy.Flow) *proxy.Flow {
+	cp := *f
+	req, resp := *f.Request, *f.Response
+	req.Header, resp.Header = f.Request.Header.Clone(), f.Response.Header.Clone()
+	cp.Request, cp.Response = &req, &resp
+	cp.Tags = append([]string(nil), f.Tags...)
+	return &cp
+}
+
+type passiveFlow struct {
+	flow   *proxy.Flow
+	https  bool
+	host   string
+	path   string
+	params url.Values // query 和 urlencoded 表单参数
+	html   bool
+	body   string
+}
+
+func (pa *PassiveAddon) scan(f *proxy.Flow, withBody bool) []*Finding {
+	pa.mu.RLock()
+	checks, maxBody := pa.checks, pa.config.MaxBody
+	pa.mu.RUnlock()
+
+	u := f.Request.URL
+	pf := &passiveFlow{
+		flow:   f,
+		https:  u.Scheme == "https",
+		host:   u.Host,
+		path:   u.Path,
+		params: u.Query(),
+		html:   strings.Contains(f.Response.Header.Get("Content-Type"), "html"),
+	}
+	if pf.path == "" {
+		pf.path = "/"
+	}
+
+	if strings.HasPrefix(f.Request.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		if form, err := url.ParseQuery(string(f.Request.Body)); err == nil {
+			for k, v := range form {
+				pf.params[k] = append(pf.params[k], v...)
+			}
+		}
+	}
+
+	if withBody && f.Response.IsTextContentType() {
+		if body, err := f.Response.DecodedBody(); err == nil {
+			if len(body) > maxBody {
+				body = body[:maxBody]
+			}
+			pf.body = string(body)
+		}
+	}
+
+	var findings []*Finding
+	for _, name := range passiveChecks {
+		if !checks[name] {
+			continue
+		}
+		for _, fd := range passiveCheckFuncs[name](pf) {
+			fd.Type, fd.Host, fd.Path = name, pf.host, pf.path
+			fd.ID = findingID(fd.Type, fd.Name, fd.Host, fd.Path)
+			fd.FlowIDs = []string{f.Id.String()}
+			fd.Last = time.Now()
+			findings = append(findings, fd)
+		}
+	}
+	return findings
+}
+
+var passiveCheckFuncs = map[string]func(pf *passiveFlow) []*Finding{
+	PassiveSecurityHeaders: checkSecurityHeaders,
+	PassiveCookie:          checkCookies,
+	PassiveReflection:      checkReflection,
+	PassiveSecret:          checkSecrets,
+	PassiveStackTrace:      checkStackTrace,
+	PassiveMixedContent:    checkMixedContent,
+	PassiveCORS:            checkCORS,
+	PassiveURLSensitive:    checkSensitiveURL,
+}
+
+// 只检查成功的响应, csp 和 x-frame-options 只对 html 检查
+func checkSecurityHeaders(pf *passiveFlow) []*Finding {
+	status := pf.flow.Response.StatusCode
+	if status < 200 || status >= 300 {
+		return nil
+	}
+
+	h := pf.flow.Response.Header
+	var findings []*Finding
+	missing := func(name, severity string) {
+		findings = append(findings, &Finding{Name: name, Severity: severity, Detail: "missing " + name + " header"})
+	}
+
+	csp := h.Get("Content-Security-Policy")
+	if pf.html && csp == "" {
+		missing("content-security-policy", SeverityLow)
+	}
+	if pf.html && h.Get("X-Frame-Options") == "" && !strings.Contains(csp, "frame-ancestors") {
+		missing("x-frame-options", SeverityLow)
+	}
+	if h.Get("Content-Type") != "" && !strings.EqualFold(h.Get("X-Content-Type-Options"), "nosniff") {
+		missing("x-content-type-options", SeverityInfo)
+	}
+	if pf.https && h.Get("Strict-Transport-Security") == "" {
+		missing("strict-transport-security", SeverityLow)
+	}
+	return findings
+}
+
+var sessionCookieRe = regexp.MustCompile(`(?i)sess|token|auth|sid|jwt|login`)
+
+// 删除 cookie 的响应不检查
+func checkCookies(pf *passiveFlow) []*Finding {
+	resp := &http.Response{Header: pf.flow.Response.Header}
+
+	var findings []*Finding
+	for _, cookie := range resp.Cookies() {
+		if cookie.MaxAge < 0 || (!cookie.Expires.IsZero() && cookie.Expires.Before(time.Now())) {
+			continue
+		}
+
+		var flags []string
+		if pf.https && !cookie.Secure {
+			flags = append(flags, "Secure")
+		}
+		if !cookie.HttpOnly {
+			flags = append(flags, "HttpOnly")
+		}
+		if cookie.SameSite == http.SameSiteDefaultMode {
+			flags = append(flags, "SameSite")
+		}
+		if cookie.SameSite == http.SameSiteNoneMode && !cookie.Secure {
+			flags = append(flags, "Secure (SameSite=None)")
+		}
+		if len(flags) == 0 {
+			continue
+		}
+
+		severity := SeverityLow
+		if sessionCookieRe.MatchString(cookie.Name) && (!cookie.HttpOnly || (pf.https && !cookie.Secure)) {
+			severity = SeverityMedium
+		}
+		findings = append(findings, &Finding{
+			Name:     cookie.Name,
+			Severity: severity,
+			Detail:   "cookie without " + strings.Join(flags, ", "),
+			Evidence: "Set-Cookie: " + cookie.String(),
+		})
+	}
+	return findings
+}
+
+// 参数值至少 4 个字符且包含字母, 减少数字和短值的误报; 包含 html 特殊字符且未编码时为 medium
+func checkReflection(pf *passiveFlow) []*Finding {
+	if pf.body == "" {
+		return nil
+	}
+
+	var findings []*Finding
+	for name, values := range pf.params {
+		for _, v := range values {
+			if len(v) < 4 || !strings.ContainsAny(strings.ToLower(v), "abcdefghijklmnopqrstuvwxyz") {
+				continue
+			}
+			i := strings.Index(pf.body, v)
+			if i < 0 {
+				continue
+			}
+
+			fd := &Finding{Name: name, Severity: SeverityInfo, Detail: "parameter value reflected in response", Evidence: snippet(pf.body, i, len(v))}
+			if strings.ContainsAny(v, `<>"'`) {
+				fd.Severity, fd.Detail = SeverityMedium, "parameter value reflected without html encoding"
+			}
+			findings = append(findings, fd)
+			break
+		}
+	}
+	return findings
+}
+
+type secretPattern struct {
+	name     string
+	severity string
+	re       *regexp.Regexp
+}
+
+var secretPatterns = []secretPattern{
+	{"private-key", SeverityHigh, regexp.MustCompile(`-----BEGIN (?:RSA |EC |DSA |OPENSSH |ENCRYPTED )?PRIVATE KEY-----`)},
+	{"aws-access-key", SeverityHigh, regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{"google-api-key", SeverityMedium, regexp.MustCompile(`\bAIza[0-9A-Za-z_\-]{35}\b`)},
+	{"github-token", SeverityHigh, regexp.MustCompile(`\bgh[pousr]_[0-9A-Za-z]{36}\b`)},
+	{"slack-token", SeverityHigh, regexp.MustCompile(`\bxox[abposr]-[0-9A-Za-z\-]{10,}`)},
+	{"stripe-key", SeverityHigh, regexp.MustCompile(`\b[sr]k_live_[0-9A-Za-z]{24,}\b`)},
+	{"jwt", SeverityMedium, regexp.MustCompile(`\beyJ[A-Za-z0-9_\-]{5,}\.eyJ[A-Za-z0-9_\-]{5,}\.[A-Za-z0-9_\-]*`)},
+}
+
+// 每种类型只报告第一个匹配, 证据只保留首尾
+func checkSecrets(pf *passiveFlow) []*Finding {
+	if pf.body == "" {
+		return nil
+	}
+
+	var findings []*Finding
+	for _, p := range secretPatterns {
+		if m := p.re.FindString(pf.body); m != "" {
+			findings = append(findings, &Finding{Name: p.name, Severity: p.severity, Detail: p.name + " in response body", Evidence: maskSecret(m)})
+		}
+	}
+	return findings
+}
+
+var stackTracePatterns = []struct {
+	name string
+	re   *regexp.Regexp
+}{
+	{"java", regexp.MustCompile(`(?m)^\s*at [\w$.<>]+\([\w$]+\.java:\d+\)`)},
+	{"python", regexp.MustCompile(`Traceback \(most recent call last\):`)},
+	{"php", regexp.MustCompile(`(?:Fatal error|Warning|Parse error)</b>?:.+ on line <b>?\d+|PHP (?:Fatal error|Warning):.+ on line \d+`)},
+	{"dotnet", regexp.MustCompile(`at [\w.]+\(.*\) in .+\.cs:line \d+|\[\w+Exception: .+\]\s+System\.`)},
+	{"go", regexp.MustCompile(`goroutine \d+ \[running\]:`)},
+	{"node", regexp.MustCompile(`(?m)^\s*at .+ \(.+\.js:\d+:\d+\)`)},
+	{"ruby", regexp.MustCompile(`\.rb:\d+:in ` + "`")},
+}
+
+func checkStackTrace(pf *passiveFlow) []*Finding {
+	if pf.body == "" {
+		return nil
+	}
+
+	for _, p := range stackTracePatterns {
+		if loc := p.re.FindStringIndex(pf.body); loc != nil {
+			return []*Finding{{Name: p.name, Severity: SeverityMedium, Detail: p.name + " stack trace in response", Evidence: snippet(pf.body, loc[0], loc[1]-loc[0])}}
+		}
+	}
+	return nil
+}
+
+var mixedContentRe = regexp.MustCompile(`(?i)<(script|iframe|link|object|embed|img|audio|video|source|form)\b[^>]*?\b(?:src|href|action|data)\s*=\s*["']?(http://[^"'\s>]+)`)
+
+// 脚本 iframe 样式等主动内容为 medium, 图片等被动内容为 low
+func checkMixedContent(pf *passiveFlow) []*Finding {
+	if !pf.https || !pf.html || pf.body == "" {
+		return nil
+	}
+
+	matches := mixedContentRe.FindAllStringSubmatch(pf.body, -1)
+	if len(matches) == 0 {
+		return nil
+	}
+
+	fd := &Finding{Severity: SeverityLow, Detail: "https page loads http resources", Evidence: matches[0][2]}
+	for _, m := range matches {
+		switch strings.ToLower(m[1]) {
+		case "script", "iframe", "link", "object", "embed", "form":
+			fd.Severity, fd.Evidence = SeverityMedium, m[2]
+			return []*Finding{fd}
+		}
+	}
+	return []*Finding{fd}
+}
+
+func checkCORS(pf *passiveFlow) []*Finding {
+	h := pf.flow.Response.Header
+	acao := h.Get("Access-Control-Allow-Origin")
+	if acao == "" {
+		return nil
+	}
+	creds := strings.EqualFold(h.Get("Access-Control-Allow-Credentials"), "true")
+	origin := pf.flow.Request.Header.Get("Origin")
+	evidence := "Access-Control-Allow-Origin: " + acao
+	if creds {
+		evidence += ", Access-Control-Allow-Credentials: true"
+	}
+
+	fd := &Finding{Name: "access-control-allow-origin", Evidence: evidence}
+	switch {
+	case acao == "null":
+		fd.Severity, fd.Detail = SeverityMedium, "null origin allowed"
+	case acao == "*" && creds:
+		fd.Severity, fd.Detail = SeverityMedium, "wildcard origin with credentials"
+	case origin != "" && acao == origin && !sameOriginHost(origin, pf.host):
+		fd.Severity, fd.Detail = SeverityMedium, "request origin reflected"
+	default:
+		return nil
+	}
+	if creds {
+		fd.Severity = SeverityHigh
+		fd.Detail += ", credentials allowed"
+	}
+	return []*Finding{fd}
+}
+
+func sameOriginHost(origin, host string) bool {
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Hostname(), strings.Split(host, ":")[0])
+}
+
+var sensitiveParamRe = regexp.MustCompile(`(?i)^(pass(word|wd)?|pwd|secret|client_secret|token|access_token|refresh_token|id_token|api_?key|auth|authorization|session(_?id)?|sid|jsessionid|phpsessid|credit_?card|card_?number|cvv|ssn)$`)
+
+// 只检查 url 中的 query 和 path 参数, 不包括请求 body
+func checkSensitiveURL(pf *passiveFlow) []*Finding {
+	u := pf.flow.Request.URL
+
+	var findings []*Finding
+	for name, values := range u.Query() {
+		for _, v := range values {
+			if v == "" {
+				continue
+			}
+
+			detail := ""
+			if sensitiveParamRe.MatchString(name) {
+				detail = "sensitive parameter " + name + " in url"
+			}
+			for _, p := range secretPatterns {
+				if detail == "" && p.re.MatchString(v) {
+					detail = p.name + " in url"
+				}
+			}
+			if detail != "" {
+				findings = append(findings, &Finding{Name: name, Severity: SeverityMedium, Detail: detail, Evidence: name + "=" + maskSecret(v)})
+				break
+			}
+		}
+	}
+
+	if i := strings.Index(strings.ToLower(u.Path), ";jsessionid="); i >= 0 {
+		findings = append(findings, &Finding{Name: "jsessionid", Severity: SeverityMedium, Detail: "session id in url path", Evidence: maskSecret(u.Path[i+1:])})
+	}
+	return findings
+}
+
+func maskSecret(s string) string {
+	if len(s) <= 12 {
+		return strings.Repeat("*", len(s))
+	}
+	return s[:6] + "..." + s[len(s)-4:]
+}
+
+// 匹配位置前后各取 40 个字符
+func snippet(s string, i, n int) string {
+	start, end := i-40, i+n+40
+	if start < 0 {
+		start = 0
+	}
+	if end > len(s) {
+		end = len(s)
+	}
+	return strings.ToValidUTF8(s[start:end], "")
+}
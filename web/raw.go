@@ -0,0 +1,320 @@
+package web
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/vela-ssoc/vela-mitm/proxy"
+)
+
+const (
+	rawDefaultIdle = 2 * time.Second
+	rawMaxRequests = 100
+)
+
+// 原样发送, 不做任何规范化: Requests 为完整的请求 (包括 \r\n), 按顺序在同一个连接上发送
+// Pipeline 为 true 时一次全部写入, 否则每个请求收到响应 (或空闲超时) 之后再发送下一个
+type RawRequest struct {
+	Addr     string   `json:"addr"` // host:port
+	TLS      bool     `json:"tls,omitempty"`
+	SNI      string   `json:"sni,omitempty"` // 为空时使用 addr 的主机名
+	Requests []string `json:"requests"`
+	Pipeline bool     `json:"pipeline,omitempty"`
+	Base64   bool     `json:"base64,omitempty"` // requests 和 response 使用 base64, 用于非 utf-8 的内容
+	Idle     int      `json:"idle,omitempty"`   // 收到数据后多久没有新数据时结束, 毫秒, 默认 2000
+}
+
+// 按 http 响应解析的结果, Offset 为在原始响应中的位置
+type RawResponse struct {
+	Offset int         `json:"offset"`
+	Size   int         `json:"size"`
+	Proto  string      `json:"proto"`
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Length int         `json:"length"` // body 长度
+}
+
+// Response 为收到的原始字节, 超过 repeaterBodyLimit 时截断; 解析失败的部分不包含在 Responses 中
+type RawResult struct {
+	Sent      int           `json:"sent"` // 写入的字节数
+	Response  string        `json:"response"`
+	Responses []RawResponse `json:"responses"`
+	Closed    bool          `json:"closed"` // 服务器关闭了连接
+	Truncated bool          `json:"truncated,omitempty"`
+	Time      int64         `json:"time"` // 毫秒
+	Error     string        `json:"error,omitempty"`
+}
+
+func (rr *RawRequest) payloads() ([][]byte, error) {
+	if _, _, err := net.SplitHostPort(rr.Addr); err != nil {
+		return nil, fmt.Errorf("invalid addr %q, want host:port", rr.Addr)
+	}
+	if len(rr.Requests) == 0 {
+		return nil, fmt.Errorf("requests required")
+	}
+	if len(rr.Requests) > rawMaxRequests {
+		return nil, fmt.Errorf("too many requests %d > %d", len(rr.Requests), rawMaxRequests)
+	}
+
+	payloads := make([][]byte, 0, len(rr.Requests))
+	for i, req := range rr.Requests {
+		if !rr.Base64 {
+			payloads = append(payloads, []byte(req))
+			continue
+		}
+
+		chunk, err := base64.StdEncoding.DecodeString(req)
+		if err != nil {
+			return nil, fmt.Errorf("request %d: %v", i, err)
+		}
+		payloads = append(payloads, chunk)
+	}
+	return payloads, nil
+}
+
+// 把请求转换为原始格式, header 按名称排序, Host 在最前面
+func rawFromRequest(fr *proxy.RequestEditData) (*RawRequest, error) {
+	u, err := url.Parse(fr.RawURL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid url %s", fr.RawURL)
+	}
+
+	rr := &RawRequest{Addr: u.Host, TLS: u.Scheme == "https"}
+	if u.Port() == "" {
+		port := "80"
+		if rr.TLS {
+			port = "443"
+		}
+		rr.Addr = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s HTTP/1.1\r\n", fr.Method, u.RequestURI())
+
+	header := fr.Header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	proxy.StripControlHeaders(header)
+	if header.Get("Host") == "" {
+		fmt.Fprintf(&b, "Host: %s\r\n", u.Host)
+	}
+	if len(fr.Body) > 0 && header.Get("Content-Length") == "" && header.Get("Transfer-Encoding") == "" {
+		header.Set("Content-Length", fmt.Sprint(len(fr.Body)))
+	}
+
+	keys := make([]string, 0, len(header))
+	for key := range header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, v := range header[key] {
+			fmt.Fprintf(&b, "%s: %s\r\n", key, v)
+		}
+	}
+	b.WriteString("\r\n")
+	b.WriteString(fr.Body)
+
+	rr.Requests = []string{b.String()}
+	return rr, nil
+}
+
+// 没有配置 Config.Proxy 时直接连接, 不校验证书
+func (web *WebAddon) rawDialer() *proxy.Proxy {
+	if web.config.Proxy != nil {
+		return web.config.Proxy
+	}
+	return &proxy.Proxy{Opts: &proxy.Options{SslInsecure: true}}
+}
+
+// 参数错误时返回 error, 连接和读写失败记录在 RawResult.Error 中, 已收到的数据同样返回
+func (web *WebAddon) sendRaw(ctx context.Context, rr *RawRequest, timeout time.Duration) (*RawResult, error) {
+	payloads, err := rr.payloads()
+	if err != nil {
+		return nil, err
+	}
+	if err = web.config.Scope.CheckRaw(rr.Addr, rr.TLS, payloads[0]); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	res := &RawResult{Responses: make([]RawResponse, 0)}
+	start := time.Now()
+
+	rc := &rawConn{idle: rawDefaultIdle}
+	if rr.Idle > 0 {
+		rc.idle = time.Duration(rr.Idle) * time.Millisecond
+	}
+	for _, p := range payloads {
+		rc.methods = append(rc.methods, string(bytes.SplitN(p, []byte(" "), 2)[0]))
+	}
+
+	rc.conn, err = web.rawDialer().DialRaw(ctx, rr.Addr, rr.TLS, rr.SNI)
+	if err == nil {
+		err = rc.exchange(ctx, payloads, rr.Pipeline)
+		rc.conn.Close()
+	}
+
+	if err != nil {
+		res.Error = err.Error()
+	}
+	res.Sent, res.Closed, res.Truncated = rc.sent, rc.closed, rc.truncated
+	res.Responses = append(res.Responses, rc.responses...)
+	res.Response = string(rc.buf)
+	if rr.Base64 {
+		res.Response = base64.StdEncoding.EncodeToString(rc.buf)
+	}
+	res.Time = time.Since(start).Milliseconds()
+	return res, nil
+}
+
+type rawConn struct {
+	conn      net.Conn
+	idle      time.Duration
+	methods   []string
+	buf       []byte
+	sent      int
+	closed    bool
+	truncated bool
+	responses []RawResponse
+}
+
+func (rc *rawConn) exchange(ctx context.Context, payloads [][]byte, pipeline bool) error {
+	// 取消时关闭连接, 结束阻塞的读写
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			rc.conn.Close()
+		case <-done:
+		}
+	}()
+
+	if pipeline {
+		for _, p := range payloads {
+			if err := rc.write(ctx, p); err != nil {
+				return err
+			}
+		}
+		return rc.readUntil(ctx, len(payloads))
+	}
+
+	for i, p := range payloads {
+		if err := rc.write(ctx, p); err != nil {
+			return err
+		}
+		if err := rc.readUntil(ctx, i+1); err != nil || rc.closed || rc.truncated {
+			return err
+		}
+	}
+	return nil
+}
+
+func (rc *rawConn) write(ctx context.Context, p []byte) error {
+	n, err := rc.conn.Write(p)
+	rc.sent += n
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// 读取直到解析出 n 个响应, 连接关闭, 超过 repeaterBodyLimit 或收到数据后空闲超时
+func (rc *rawConn) readUntil(ctx context.Context, n int) error {
+	deadline, _ := ctx.Deadline()
+	chunk := make([]byte, 32<<10)
+	received := false
+
+	for len(rc.responses) < n && !rc.closed && !rc.truncated {
+		if received {
+			rc.conn.SetReadDeadline(time.Now().Add(rc.idle))
+		} else {
+			rc.conn.SetReadDeadline(deadline)
+		}
+
+		m, err := rc.conn.Read(chunk)
+		if m > 0 {
+			received = true
+			if room := repeaterBodyLimit - len(rc.buf); m > room {
+				m, rc.truncated = room, true
+			}
+			rc.buf = append(rc.buf, chunk[:m]...)
+		}
+
+		switch {
+		case err == nil:
+		case ctx.Err() != nil:
+			rc.parse()
+			return ctx.Err()
+		case err == io.EOF:
+			rc.closed = true
+		default:
+			rc.parse()
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && received {
+				return nil
+			}
+			return err
+		}
+		rc.parse()
+	}
+	return nil
+}
+
+func (rc *rawConn) parse() {
+	rc.responses = parseRawResponses(rc.buf, rc.methods, rc.closed)
+}
+
+// 依次解析完整的响应, 不完整或格式错误时停止; 没有长度的响应以连接关闭结束
+func parseRawResponses(data []byte, methods []string, closed bool) []RawResponse {
+	responses := make([]RawResponse, 0)
+	r := bytes.NewReader(data)
+	br := bufio.NewReader(r)
+
+	for {
+		offset := len(data) - r.Len() - br.Buffered()
+		if offset >= len(data) {
+			return responses
+		}
+
+		method := http.MethodGet
+		if i := len(responses); i < len(methods) {
+			method = methods[i]
+		}
+
+		resp, err := http.ReadResponse(br, &http.Request{Method: method})
+		if err != nil {
+			return responses
+		}
+		length, err := io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return responses
+		}
+		if resp.ContentLength < 0 && len(resp.TransferEncoding) == 0 && method != http.MethodHead && !closed {
+			return responses
+		}
+
+		responses = append(responses, RawResponse{
+			Offset: offset,
+			Size:   len(data) - r.Len() - br.Buffered() - offset,
+			Proto:  resp.Proto,
+			Status: resp.StatusCode,
+			Header: resp.Header,
+			Length: int(length),
+		})
+	}
+}
@@ -0,0 +1,282 @@
+package web
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// 最小的 http/2 客户端, 只用于发送不合规的请求 (带 transfer-encoding 或与 body 不一致的 content-length) 并读取响应状态码
+// header 使用不索引的字面量编码, 只在 stream 1 上发送一个请求
+
+const h2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+const (
+	h2FrameData      = 0x0
+	h2FrameHeaders   = 0x1
+	h2FrameRSTStream = 0x3
+	h2FrameSettings  = 0x4
+	h2FramePing      = 0x6
+	h2FrameGoAway    = 0x7
+
+	h2FlagEndStream  = 0x1
+	h2FlagAck        = 0x1
+	h2FlagEndHeaders = 0x4
+	h2FlagPadded     = 0x8
+	h2FlagPriority   = 0x20
+
+	h2MaxFrame = 16384
+)
+
+// 静态表中 :status 的索引
+var h2StaticStatus = map[byte]int{8: 200, 9: 204, 10: 206, 11: 304, 12: 400, 13: 404, 14: 500}
+
+type h2Header struct {
+	Name  string
+	Value string
+}
+
+type h2Response struct {
+	Status int    // 0 表示没有解析出状态码
+	Reset  bool   // 收到 RST_STREAM 或 GOAWAY
+	Code   uint32 // reset 的错误码
+}
+
+func hpackInt(b []byte, prefix byte, bits uint, v int) []byte {
+	max := 1<<bits - 1
+	if v < max {
+		return append(b, prefix|byte(v))
+	}
+
+	b = append(b, prefix|byte(max))
+	for v -= max; v >= 128; v /= 128 {
+		b = append(b, byte(v%128+128))
+	}
+	return append(b, byte(v))
+}
+
+// 不索引的字面量, 名称和值都不压缩, 名称需要是小写
+func hpackEncode(headers []h2Header) []byte {
+	var b []byte
+	for _, h := range headers {
+		b = append(b, 0x00)
+		b = hpackInt(b, 0, 7, len(h.Name))
+		b = append(b, h.Name...)
+		b = hpackInt(b, 0, 7, len(h.Value))
+		b = append(b, h.Value...)
+	}
+	return b
+}
+
+func h2WriteFrame(w io.Writer, typ, flags byte, stream uint32, payload []byte) error {
+	frame := make([]byte, 9, 9+len(payload))
+	frame[0], frame[1], frame[2] = byte(len(payload)>>16), byte(len(payload)>>8), byte(len(payload))
+	frame[3], frame[4] = typ, flags
+	binary.BigEndian.PutUint32(frame[5:], stream&0x7fffffff)
+	_, err := w.Write(append(frame, payload...))
+	return err
+}
+
+func h2ReadFrame(r io.Reader) (typ, flags byte, stream uint32, payload []byte, err error) {
+	var hdr [9]byte
+	if _, err = io.ReadFull(r, hdr[:]); err != nil {
+		return
+	}
+
+	size := int(hdr[0])<<16 | int(hdr[1])<<8 | int(hdr[2])
+	typ, flags = hdr[3], hdr[4]
+	stream = binary.BigEndian.Uint32(hdr[5:]) & 0x7fffffff
+	payload = make([]byte, size)
+	_, err = io.ReadFull(r, payload)
+	return
+}
+
+// 发送一个请求, 读取直到收到 stream 1 的响应头或被重置; 超时由 ctx 控制
+func h2Exchange(ctx context.Context, conn net.Conn, headers []h2Header, data []byte) (*h2Response, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// 取消时关闭连接, 结束阻塞的读写
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	if _, err := conn.Write([]byte(h2Preface)); err != nil {
+		return nil, err
+	}
+	if err := h2WriteFrame(conn, h2FrameSettings, 0, 0, nil); err != nil {
+		return nil, err
+	}
+
+	flags := byte(h2FlagEndHeaders)
+	if len(data) == 0 {
+		flags |= h2FlagEndStream
+	}
+	if err := h2WriteFrame(conn, h2FrameHeaders, flags, 1, hpackEncode(headers)); err != nil {
+		return nil, err
+	}
+
+	for len(data) > 0 {
+		n := len(data)
+		if n > h2MaxFrame {
+			n = h2MaxFrame
+		}
+		flags = 0
+		if n == len(data) {
+			flags = h2FlagEndStream
+		}
+		if err := h2WriteFrame(conn, h2FrameData, flags, 1, data[:n]); err != nil {
+			return nil, err
+		}
+		data = data[n:]
+	}
+
+	for {
+		typ, flags, stream, payload, err := h2ReadFrame(conn)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+
+		switch {
+		case typ == h2FrameSettings && flags&h2FlagAck == 0:
+			if err = h2WriteFrame(conn, h2FrameSettings, h2FlagAck, 0, nil); err != nil {
+				return nil, err
+			}
+
+		case typ == h2FramePing && flags&h2FlagAck == 0:
+			if err = h2WriteFrame(conn, h2FramePing, h2FlagAck, 0, payload); err != nil {
+				return nil, err
+			}
+
+		case typ == h2FrameHeaders && stream == 1:
+			return &h2Response{Status: h2Status(h2HeaderBlock(flags, payload))}, nil
+
+		case typ == h2FrameRSTStream && stream == 1 && len(payload) >= 4:
+			return &h2Response{Reset: true, Code: binary.BigEndian.Uint32(payload)}, nil
+
+		case typ == h2FrameGoAway && len(payload) >= 8:
+			return &h2Response{Reset: true, Code: binary.BigEndian.Uint32(payload[4:])}, nil
+		}
+	}
+}
+
+// 去掉 padding 和 priority 字段
+func h2HeaderBlock(flags byte, payload []byte) []byte {
+	pad := 0
+	if flags&h2FlagPadded != 0 && len(payload) > 0 {
+		pad = int(payload[0])
+		payload = payload[1:]
+	}
+	if flags&h2FlagPriority != 0 && len(payload) >= 5 {
+		payload = payload[5:]
+	}
+	if pad > len(payload) {
+		return nil
+	}
+	return payload[:len(payload)-pad]
+}
+
+// 只解析响应头的第一个字段 :status, 服务器总是把它放在最前面
+func h2Status(block []byte) int {
+	// 动态表大小更新
+	for len(block) > 0 && block[0]&0xe0 == 0x20 {
+		multi := block[0]&0x1f == 0x1f
+		block = block[1:]
+		for multi && len(block) > 0 {
+			last := block[0]&0x80 == 0
+			block = block[1:]
+			if last {
+				break
+			}
+		}
+	}
+	if len(block) == 0 {
+		return 0
+	}
+
+	b := block[0]
+	if b&0x80 != 0 {
+		return h2StaticStatus[b&0x7f]
+	}
+
+	// 名称引用静态表 8-14 (都是 :status) 的字面量
+	var index byte
+	switch {
+	case b&0xc0 == 0x40:
+		index = b & 0x3f
+	case b&0xf0 == 0x00, b&0xf0 == 0x10:
+		index = b & 0x0f
+	}
+	if index < 8 || index > 14 || len(block) < 2 {
+		return 0
+	}
+
+	size := int(block[1] & 0x7f)
+	if len(block) < 2+size {
+		return 0
+	}
+	value := block[2 : 2+size]
+	if block[1]&0x80 != 0 {
+		value = huffmanDigits(value)
+	}
+
+	status, _ := strconv.Atoi(string(value))
+	return status
+}
+
+// 只解码由数字组成的 huffman 字符串: 0-2 为 5 位 00000-00010, 3-9 为 6 位 011001-011111
+func huffmanDigits(data []byte) []byte {
+	bits := len(data) * 8
+	bit := func(i int) int {
+		return int(data[i/8]>>(7-uint(i%8))) & 1
+	}
+	read := func(i, n int) int {
+		v := 0
+		for k := 0; k < n; k++ {
+			v = v<<1 | bit(i+k)
+		}
+		return v
+	}
+
+	var out []byte
+	for i := 0; i < bits; {
+		// 剩余不足 8 位且全为 1 时是 padding
+		if rest := bits - i; rest < 8 && read(i, rest) == 1<<uint(rest)-1 {
+			break
+		}
+		if i+5 <= bits && read(i, 5) <= 2 {
+			out = append(out, byte('0'+read(i, 5)))
+			i += 5
+			continue
+		}
+		if i+6 <= bits {
+			if v := read(i, 6); v >= 0x19 && v <= 0x1f {
+				out = append(out, byte('3'+v-0x19))
+				i += 6
+				continue
+			}
+		}
+		return nil
+	}
+	return out
+}
+
+func (r *h2Response) String() string {
+	if r.Reset {
+		return fmt.Sprintf("reset %d", r.Code)
+	}
+	return strconv.Itoa(r.Status)
+}
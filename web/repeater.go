@@ -0,0 +1,331 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bytedance/sonic"
+	uuid "github.com/satori/go.uuid"
+	"github.com/vela-ssoc/vela-mitm/proxy"
+)
+
+const repeaterBodyLimit = 1 << 20
+
+// 创建标签时 FlowID 不为空则从 history 复制请求, 否则使用 Request
+// Raw 不为空时创建原始请求标签, Raw.Requests 为空时由 history 或 Request 转换
+// 修改标签时只更新不为空的字段
+type RepeaterTabForm struct {
+	Name    string                 `json:"name"`
+	FlowID  string                 `json:"flow_id,omitempty"`
+	Request *proxy.RequestEditData `json:"request,omitempty"`
+	Raw     *RawRequest            `json:"raw,omitempty"`
+}
+
+// history 中的请求, body 已解压时去掉 Content-Encoding
+func flowRequest(flow *Flow) *proxy.RequestEditData {
+	raw := flow.RequestBody
+	flow.Uncompress()
+
+	header := flow.RequestHeader.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	if raw != flow.RequestBody {
+		header.Del("Content-Encoding")
+	}
+	header.Del("Content-Length")
+
+	// URL 不包括 query
+	rawURL := flow.URL
+	if rawURL == "" {
+		rawURL = flow.RawURL
+	} else if flow.Query != "" {
+		rawURL += "?" + flow.Query
+	}
+
+	return &proxy.RequestEditData{
+		Method: flow.Method,
+		RawURL: rawURL,
+		Header: header,
+		Body:   flow.RequestBody,
+	}
+}
+
+// 默认名称为 METHOD host/path
+func repeaterTabName(fr *proxy.RequestEditData) string {
+	u, err := url.Parse(fr.RawURL)
+	if err != nil || u.Host == "" {
+		return fr.Method + " " + fr.RawURL
+	}
+	return fr.Method + " " + u.Host + u.Path
+}
+
+func createRepeaterTab(db *FlowDB, form *RepeaterTabForm) (*RepeaterTab, error) {
+	tab := &RepeaterTab{
+		ID:      uuid.NewV4().String(),
+		Name:    form.Name,
+		Created: time.Now(),
+		Updated: time.Now(),
+	}
+
+	switch {
+	case form.FlowID != "":
+		flow, err := db.FindFlowId(form.FlowID)
+		if err != nil {
+			return nil, fmt.Errorf("flow %s not found", form.FlowID)
+		}
+		if err = db.LoadBody(flow); err != nil {
+			return nil, err
+		}
+		tab.Source = form.FlowID
+		tab.Request = *flowRequest(flow)
+
+	case form.Request != nil:
+		tab.Request = *form.Request
+
+	case form.Raw != nil:
+
+	default:
+		return nil, fmt.Errorf("flow_id, request or raw required")
+	}
+
+	if form.Raw != nil {
+		raw, err := repeaterRaw(&tab.Request, form.Raw)
+		if err != nil {
+			return nil, err
+		}
+		tab.Raw = raw
+	}
+
+	switch {
+	case tab.Name != "":
+	case tab.Raw != nil && tab.Request.RawURL == "":
+		tab.Name = "RAW " + tab.Raw.Addr
+	default:
+		tab.Name = repeaterTabName(&tab.Request)
+	}
+	if err := db.SaveRepeaterTab(tab); err != nil {
+		return nil, err
+	}
+	return tab, nil
+}
+
+func updateRepeaterTab(db *FlowDB, id string, form *RepeaterTabForm) (*RepeaterTab, error) {
+	tab, err := db.RepeaterTab(id)
+	if err != nil {
+		return nil, fmt.Errorf("tab %s not found", id)
+	}
+
+	if form.Name != "" {
+		tab.Name = form.Name
+	}
+	if form.Request != nil {
+		tab.Request = *form.Request
+	}
+	if form.Raw != nil {
+		if _, err = form.Raw.payloads(); err != nil {
+			return nil, err
+		}
+		tab.Raw = form.Raw
+	}
+	tab.Updated = time.Now()
+
+	if err = db.SaveRepeaterTab(tab); err != nil {
+		return nil, err
+	}
+	return tab, nil
+}
+
+// requests 为空时转换 fr, 未指定的 addr tls 同时使用 fr 的
+func repeaterRaw(fr *proxy.RequestEditData, form *RawRequest) (*RawRequest, error) {
+	raw := *form
+	if len(raw.Requests) == 0 {
+		converted, err := rawFromRequest(fr)
+		if err != nil {
+			return nil, err
+		}
+		raw.Requests = converted.Requests
+		if raw.Addr == "" {
+			raw.Addr, raw.TLS = converted.Addr, converted.TLS
+		}
+	}
+
+	if _, err := raw.payloads(); err != nil {
+		return nil, err
+	}
+	return &raw, nil
+}
+
+// body 为空时使用标签保存的请求, 否则普通标签为 proxy.RequestEditData, 原始请求标签为 RawRequest
+func (web *WebAddon) sendRepeaterBody(ctx context.Context, db *FlowDB, id string, chunk []byte, opt sendOptions) (*RepeaterEntry, error) {
+	tab, err := db.RepeaterTab(id)
+	if err != nil {
+		return nil, fmt.Errorf("tab %s not found", id)
+	}
+
+	if tab.Raw != nil {
+		var rr *RawRequest
+		if len(chunk) > 0 {
+			rr = &RawRequest{}
+			if err = sonic.Unmarshal(chunk, rr); err != nil {
+				return nil, fmt.Errorf("decode fail %v", err)
+			}
+		}
+		return web.sendRawRepeater(ctx, db, id, rr, opt)
+	}
+
+	var fr *proxy.RequestEditData
+	if len(chunk) > 0 {
+		fr = &proxy.RequestEditData{}
+		if err = sonic.Unmarshal(chunk, fr); err != nil {
+			return nil, fmt.Errorf("decode fail %v", err)
+		}
+	}
+	return web.sendRepeater(ctx, db, id, fr, opt)
+}
+
+// 发送标签的请求并记录, fr 不为空时先替换标签的请求; 请求失败也会记录
+func (web *WebAddon) sendRepeater(ctx context.Context, db *FlowDB, id string, fr *proxy.RequestEditData, opt sendOptions) (*RepeaterEntry, error) {
+	tab, err := db.RepeaterTab(id)
+	if err != nil {
+		return nil, fmt.Errorf("tab %s not found", id)
+	}
+	if fr != nil {
+		tab.Request = *fr
+	}
+
+	entry := &RepeaterEntry{Sent: time.Now()}
+	flow, err := web.doRequest(ctx, &tab.Request, opt)
+	entry.Time = time.Since(entry.Sent).Milliseconds()
+	if err != nil {
+		entry.Error = err.Error()
+	} else {
+		if len(flow.ResponseBody) > repeaterBodyLimit {
+			flow.ResponseBody = flow.ResponseBody[:repeaterBodyLimit]
+			flow.Truncated = true
+		}
+		entry.Flow = flow
+	}
+
+	if err = db.AddRepeaterEntry(tab, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// 原始请求标签的发送, 不支持 chain; rr 不为空时先替换标签的请求
+func (web *WebAddon) sendRawRepeater(ctx context.Context, db *FlowDB, id string, rr *RawRequest, opt sendOptions) (*RepeaterEntry, error) {
+	if opt.Chain {
+		return nil, fmt.Errorf("chain not supported for raw request")
+	}
+
+	tab, err := db.RepeaterTab(id)
+	if err != nil {
+		return nil, fmt.Errorf("tab %s not found", id)
+	}
+	if rr != nil {
+		tab.Raw = rr
+	}
+
+	entry := &RepeaterEntry{Sent: time.Now()}
+	raw, err := web.sendRaw(ctx, tab.Raw, opt.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	entry.Time = time.Since(entry.Sent).Milliseconds()
+	entry.Error = raw.Error
+	entry.Raw = raw
+
+	if err = db.AddRepeaterEntry(tab, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// 作为后台任务发送, 结束后任务结果为本次发送的 flow 或原始响应
+func (web *WebAddon) submitRepeaterSend(c *concurrentConn, id string, chunk []byte, opt sendOptions) JobInfo {
+	return web.submitJob(c, jobSpec{
+		Kind:  JobRepeat,
+		Total: 1,
+		Run: func(ctx context.Context, j *backgroundJob, db *FlowDB) error {
+			entry, err := web.sendRepeaterBody(ctx, db, id, chunk, opt)
+			if err != nil {
+				return err
+			}
+			if entry.Error != "" {
+				return fmt.Errorf("%s", entry.Error)
+			}
+
+			j.mu.Lock()
+			j.result, j.raw = entry.Flow, entry.Raw
+			j.info.Done = 1
+			j.mu.Unlock()
+			return nil
+		},
+	})
+}
+
+// 响应引用: flow:{flow_id} history 中的响应, tab:{id}:{seq} repeater 的发送, intruder:{job}:{index} intruder 的结果
+func loadResponse(db *FlowDB, ref string) (*Flow, error) {
+	parts := strings.Split(ref, ":")
+
+	switch {
+	case len(parts) == 2 && parts[0] == "flow":
+		flow, err := db.FindFlowId(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("flow %s not found", parts[1])
+		}
+		if err = db.LoadBody(flow); err != nil {
+			return nil, err
+		}
+		return flow.Uncompress(), nil
+
+	case len(parts) == 3 && (parts[0] == "tab" || parts[0] == "intruder"):
+		n, err := strconv.Atoi(parts[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid ref %s", ref)
+		}
+
+		var flow *Flow
+		if parts[0] == "tab" {
+			entry, err := db.RepeaterEntry(parts[1], n)
+			if err != nil {
+				return nil, fmt.Errorf("%s not found", ref)
+			}
+			flow = entry.Flow
+		} else {
+			res, err := db.IntruderResult(parts[1], n)
+			if err != nil {
+				return nil, fmt.Errorf("%s not found", ref)
+			}
+			flow = res.Flow
+		}
+
+		if flow == nil {
+			return nil, fmt.Errorf("%s has no response", ref)
+		}
+		return flow, nil
+
+	default:
+		return nil, fmt.Errorf("invalid ref %s", ref)
+	}
+}
+
+// 比较任意两个响应
+func diffResponses(db *FlowDB, a, b string) (*FlowDiff, error) {
+	old, err := loadResponse(db, a)
+	if err != nil {
+		return nil, err
+	}
+
+	cur, err := loadResponse(db, b)
+	if err != nil {
+		return nil, err
+	}
+	return DiffFlows(old, cur), nil
+}
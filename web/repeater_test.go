@@ -0,0 +1,221 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/vela-ssoc/vela-mitm/proxy"
+)
+
+func TestDiffJSON(t *testing.T) {
+	old := &Flow{ResponseBody: `{"user":{"name":"a","roles":["x"]},"n":1}`}
+	cur := &Flow{ResponseBody: `{"n":2, "user":{"name":"a","roles":["x","y"]},"ok":true}`}
+
+	diff := DiffFlows(old, cur)
+	want := []JSONDiff{
+		{Path: "$.n", Op: "change", Old: float64(1), New: float64(2)},
+		{Path: "$.ok", Op: "add", New: true},
+		{Path: "$.user.roles[1]", Op: "add", New: "y"},
+	}
+	if fmt.Sprint(diff.JSON) != fmt.Sprint(want) {
+		t.Fatalf("json diff %+v", diff.JSON)
+	}
+
+	if diff = DiffFlows(&Flow{ResponseBody: "a"}, &Flow{ResponseBody: "b"}); diff.JSON != nil {
+		t.Fatalf("text body json diff %+v", diff.JSON)
+	}
+}
+
+func TestRepeaterTabs(t *testing.T) {
+	db := newTestFlowDB(t)
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"q":%q}`, r.URL.Query().Get("q"))
+	}))
+	defer target.Close()
+
+	tab, err := createRepeaterTab(db, &RepeaterTabForm{Request: &proxy.RequestEditData{Method: "GET", RawURL: target.URL + "/s?q=1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tab.Name != "GET "+target.Listener.Addr().String()+"/s" {
+		t.Fatalf("name %s", tab.Name)
+	}
+	if _, err = createRepeaterTab(db, &RepeaterTabForm{FlowID: "missing"}); err == nil {
+		t.Fatal("missing flow should fail")
+	}
+
+	for _, q := range []string{"1", "2"} {
+		fr := &proxy.RequestEditData{Method: "GET", RawURL: target.URL + "/s?q=" + q, Header: http.Header{}}
+		if _, err = (&WebAddon{}).sendRepeater(context.Background(), db, tab.ID, fr, sendOptions{Timeout: time.Second}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := db.RepeaterEntries(tab.ID, 0, 0, false)
+	if err != nil || len(entries) != 2 || entries[1].Seq != 2 || entries[1].Flow != nil {
+		t.Fatalf("entries %+v %v", entries, err)
+	}
+
+	stored, _ := db.RepeaterTab(tab.ID)
+	if stored.Count != 2 || stored.Request.RawURL != target.URL+"/s?q=2" {
+		t.Fatalf("tab %+v", stored)
+	}
+
+	diff, err := diffResponses(db, "tab:"+tab.ID+":1", "tab:"+tab.ID+":2")
+	if err != nil || len(diff.JSON) != 1 || diff.JSON[0].Path != "$.q" {
+		t.Fatalf("diff %+v %v", diff, err)
+	}
+
+	if err = db.DeleteRepeaterTab(tab.ID); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ = db.RepeaterEntries(tab.ID, 0, 0, false); len(entries) != 0 {
+		t.Fatalf("entries after delete %+v", entries)
+	}
+}
+
+type headerAddon struct {
+	proxy.BaseAddon
+	seen chan string
+}
+
+func (a *headerAddon) Request(f *proxy.Flow) {
+	a.seen <- f.Request.Header.Get("X-Mitmproxy-Test")
+}
+
+func TestRepeatOutbound(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s|%s", r.Host, r.Header.Get("X-Mitmproxy-Test"))
+	}))
+	defer target.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	_, port, _ := net.SplitHostPort(target.Listener.Addr().String())
+	p, err := proxy.NewProxy(&proxy.Options{
+		Addr:       addr,
+		CaRootPath: t.TempDir(),
+		Hosts:      map[string]string{"target.test": "127.0.0.1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := &headerAddon{seen: make(chan string, 1)}
+	p.AddAddon(seen)
+	go p.Start()
+	defer p.Close()
+
+	web := &WebAddon{config: Config{Proxy: p}}
+	fr := &proxy.RequestEditData{
+		Method: "GET",
+		RawURL: "http://target.test:" + port + "/",
+		Header: http.Header{"X-Mitmproxy-Test": {"1"}},
+	}
+
+	flow, err := web.doRequest(context.Background(), fr, sendOptions{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flow.ResponseBody != "target.test:"+port+"|" || flow.RequestHeader.Get("X-Mitmproxy-Test") != "" {
+		t.Fatalf("outbound %s %v", flow.ResponseBody, flow.RequestHeader)
+	}
+	if fr.Header.Get("X-Mitmproxy-Test") != "1" {
+		t.Fatal("request header modified")
+	}
+
+	var chained *Flow
+	for i := 0; i < 50; i++ {
+		if chained, err = web.doRequest(context.Background(), fr, sendOptions{Timeout: time.Second, Chain: true}); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chained.ResponseBody != "target.test:"+port+"|" {
+		t.Fatalf("chain %s", chained.ResponseBody)
+	}
+	if h := <-seen.seen; h != "1" {
+		t.Fatalf("addon header %q", h)
+	}
+}
+
+func TestRawRequest(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// 收到两个请求后返回两个响应, 第二个没有长度, 之后关闭连接
+	req := "GET /a HTTP/1.1\r\nHost: x\r\nContent-Length: 0\r\nContent-Length: 5\r\n\r\n"
+	received := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		buf := make([]byte, 0, 2*len(req))
+		chunk := make([]byte, 1024)
+		for len(buf) < 2*len(req) {
+			n, err := conn.Read(chunk)
+			if err != nil {
+				break
+			}
+			buf = append(buf, chunk[:n]...)
+		}
+		received <- string(buf)
+		conn.Write([]byte("HTTP/1.1 400 Bad Request\r\nContent-Length: 3\r\n\r\nbadHTTP/1.1 200 OK\r\n\r\nrest"))
+	}()
+
+	web := &WebAddon{}
+	res, err := web.sendRaw(context.Background(), &RawRequest{
+		Addr:     ln.Addr().String(),
+		Requests: []string{req, req},
+		Pipeline: true,
+	}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := <-received; got != req+req || res.Sent != 2*len(req) {
+		t.Fatalf("sent %q %d", got, res.Sent)
+	}
+	if !res.Closed || len(res.Responses) != 2 || res.Responses[0].Status != 400 || res.Responses[1].Length != 4 {
+		t.Fatalf("result %+v", res)
+	}
+	if res.Response[res.Responses[1].Offset:] != "HTTP/1.1 200 OK\r\n\r\nrest" {
+		t.Fatalf("response %q", res.Response)
+	}
+
+	if _, err = web.sendRaw(context.Background(), &RawRequest{Addr: "x", Requests: []string{req}}, time.Second); err == nil {
+		t.Fatal("invalid addr should fail")
+	}
+
+	raw, err := rawFromRequest(&proxy.RequestEditData{
+		Method: "POST",
+		RawURL: "https://a.com/p?q=1",
+		Header: http.Header{"X-Mitmproxy-Peer": {"p"}, "B": {"2"}, "A": {"1"}},
+		Body:   "xy",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "POST /p?q=1 HTTP/1.1\r\nHost: a.com\r\nA: 1\r\nB: 2\r\nContent-Length: 2\r\n\r\nxy"
+	if raw.Addr != "a.com:443" || !raw.TLS || raw.Requests[0] != want {
+		t.Fatalf("raw %+v", raw)
+	}
+}
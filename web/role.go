@@ -0,0 +1,76 @@
+package web
+
+import (
+	"net/http"
+	"strings"
+)
+
+// 角色按权限从低到高排列, 高级角色拥有低级角色的全部权限
+// viewer 只能查看 history, tester 可以重放和拦截, admin 可以修改证书 配置和清理数据
+type Role int
+
+const (
+	RoleViewer Role = iota + 1
+	RoleTester
+	RoleAdmin
+)
+
+var roleNames = map[Role]string{
+	RoleViewer: "viewer",
+	RoleTester: "tester",
+	RoleAdmin:  "admin",
+}
+
+// 未知或为空时为 viewer
+func ParseRole(s string) Role {
+	for role, name := range roleNames {
+		if strings.EqualFold(s, name) {
+			return role
+		}
+	}
+	return RoleViewer
+}
+
+func (r Role) String() string {
+	if name, ok := roleNames[r]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+func (r Role) Allow(need Role) bool {
+	return r >= need
+}
+
+// 接口权限, GET HEAD 请求需要 Read, 其他方法需要 Write
+type perm struct {
+	Read  Role
+	Write Role
+}
+
+var (
+	permView  = perm{Read: RoleViewer, Write: RoleViewer}
+	permTest  = perm{Read: RoleTester, Write: RoleTester}
+	permAdmin = perm{Read: RoleAdmin, Write: RoleAdmin}
+	// 所有人可以查看, 只有 admin 可以修改
+	permConfig = perm{Read: RoleViewer, Write: RoleAdmin}
+	// 所有人可以查看结果, tester 可以执行
+	permRun = perm{Read: RoleViewer, Write: RoleTester}
+)
+
+func (p perm) need(method string) Role {
+	if method == http.MethodGet || method == http.MethodHead {
+		return p.Read
+	}
+	return p.Write
+}
+
+// websocket 消息需要的角色, feed 只影响自己的推送
+func messageRole(msg message) Role {
+	switch msg.(type) {
+	case *messageEdit, *messageMeta:
+		return RoleTester
+	default:
+		return RoleViewer
+	}
+}
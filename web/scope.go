@@ -0,0 +1,229 @@
+package web
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+	项目 scope, history 记录 断点 intruder repeater 和扫描共用
+	include 为空时所有目标都在 scope 内, 命中 exclude 的不在 scope 内
+
+	scope:
+	  include:
+	    - host: "*.example.com"
+	    - host: example.com
+	      scheme: https
+	      port: 443
+	      path: /api/
+	  exclude:
+	    - path: /logout
+	  record_only: true
+*/
+
+// 为空的字段匹配任意值; Host 支持 * ? 通配, 忽略大小写, "*.a.com" 不包括 a.com; Path 为前缀
+type ScopeRule struct {
+	Scheme string `json:"scheme,omitempty" yaml:"scheme,omitempty"`
+	Host   string `json:"host,omitempty" yaml:"host,omitempty"`
+	Port   int    `json:"port,omitempty" yaml:"port,omitempty"`
+	Path   string `json:"path,omitempty" yaml:"path,omitempty"`
+}
+
+// RecordOnly 为 true 时 history 只记录 scope 内的 flow
+type Scope struct {
+	Include    []ScopeRule `json:"include" yaml:"include"`
+	Exclude    []ScopeRule `json:"exclude" yaml:"exclude"`
+	RecordOnly bool        `json:"record_only" yaml:"record_only"`
+}
+
+func (rule *ScopeRule) validate() error {
+	switch strings.ToLower(rule.Scheme) {
+	case "", "http", "https", "ws", "wss":
+	default:
+		return fmt.Errorf("invalid scope scheme %s", rule.Scheme)
+	}
+	if _, err := path.Match(rule.Host, ""); err != nil {
+		return fmt.Errorf("invalid scope host %s", rule.Host)
+	}
+	if rule.Port < 0 || rule.Port > 65535 {
+		return fmt.Errorf("invalid scope port %d", rule.Port)
+	}
+	return nil
+}
+
+func (rule *ScopeRule) match(u *url.URL) bool {
+	if rule.Scheme != "" && !strings.EqualFold(rule.Scheme, u.Scheme) {
+		return false
+	}
+	if rule.Host != "" {
+		if ok, _ := path.Match(strings.ToLower(rule.Host), strings.ToLower(u.Hostname())); !ok {
+			return false
+		}
+	}
+	if rule.Port != 0 && rule.Port != urlPort(u) {
+		return false
+	}
+	if rule.Path != "" {
+		p := u.Path
+		if p == "" {
+			p = "/"
+		}
+		if !strings.HasPrefix(p, rule.Path) {
+			return false
+		}
+	}
+	return true
+}
+
+// 没有端口时按 scheme 取默认端口
+func urlPort(u *url.URL) int {
+	if port, err := strconv.Atoi(u.Port()); err == nil {
+		return port
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "https", "wss":
+		return 443
+	default:
+		return 80
+	}
+}
+
+func (s *Scope) contains(u *url.URL) bool {
+	for i := range s.Exclude {
+		if s.Exclude[i].match(u) {
+			return false
+		}
+	}
+	if len(s.Include) == 0 {
+		return true
+	}
+	for i := range s.Include {
+		if s.Include[i].match(u) {
+			return true
+		}
+	}
+	return false
+}
+
+// 运行时可以通过 web 后台修改, nil 表示没有配置, 所有目标都在 scope 内
+type ProjectScope struct {
+	mu    sync.RWMutex
+	scope Scope
+	// 串行写回配置文件和替换 scope
+	save sync.Mutex
+}
+
+func NewProjectScope(s Scope) (*ProjectScope, error) {
+	ps := new(ProjectScope)
+	if err := ps.Set(s); err != nil {
+		return nil, err
+	}
+	return ps, nil
+}
+
+func (s *Scope) validate() error {
+	for _, rules := range [][]ScopeRule{s.Include, s.Exclude} {
+		for i := range rules {
+			if err := rules[i].validate(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (ps *ProjectScope) Set(s Scope) error {
+	if err := s.validate(); err != nil {
+		return err
+	}
+	if s.Include == nil {
+		s.Include = []ScopeRule{}
+	}
+	if s.Exclude == nil {
+		s.Exclude = []ScopeRule{}
+	}
+
+	ps.mu.Lock()
+	ps.scope = s
+	ps.mu.Unlock()
+	return nil
+}
+
+func (ps *ProjectScope) Get() Scope {
+	if ps == nil {
+		return Scope{Include: []ScopeRule{}, Exclude: []ScopeRule{}}
+	}
+
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	s := ps.scope
+	s.Include = append([]ScopeRule{}, s.Include...)
+	s.Exclude = append([]ScopeRule{}, s.Exclude...)
+	return s
+}
+
+func (ps *ProjectScope) InScope(u *url.URL) bool {
+	if ps == nil || u == nil {
+		return true
+	}
+
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	return ps.scope.contains(u)
+}
+
+// 开启 record_only 时只记录 scope 内的 flow
+func (ps *ProjectScope) Record(u *url.URL) bool {
+	if ps == nil {
+		return true
+	}
+
+	ps.mu.RLock()
+	recordOnly := ps.scope.RecordOnly
+	ps.mu.RUnlock()
+	return !recordOnly || ps.InScope(u)
+}
+
+// 主动发送请求 (repeater intruder 扫描) 前检查, 不在 scope 内时返回错误
+func (ps *ProjectScope) Check(rawURL string) error {
+	if ps == nil {
+		return nil
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid url %s", rawURL)
+	}
+	if !ps.InScope(u) {
+		return fmt.Errorf("%s out of scope", u.Host+u.Path)
+	}
+	return nil
+}
+
+// 原始请求按连接地址和第一个请求的路径检查
+func (ps *ProjectScope) CheckRaw(addr string, tls bool, request []byte) error {
+	if ps == nil {
+		return nil
+	}
+
+	scheme := "http"
+	if tls {
+		scheme = "https"
+	}
+
+	target := "/"
+	if fields := strings.Fields(strings.SplitN(string(request), "\n", 2)[0]); len(fields) >= 2 && strings.HasPrefix(fields[1], "/") {
+		target = fields[1]
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid addr %q, want host:port", addr)
+	}
+	return ps.Check(scheme + "://" + net.JoinHostPort(host, port) + target)
+}
@@ -0,0 +1,120 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vela-ssoc/vela-mitm/proxy"
+)
+
+func TestScope(t *testing.T) {
+	ps, err := NewProjectScope(Scope{
+		Include: []ScopeRule{
+			{Host: "*.example.com"},
+			{Scheme: "https", Host: "example.com", Port: 443, Path: "/api/"},
+		},
+		Exclude: []ScopeRule{{Path: "/logout"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]bool{
+		"http://a.example.com/":            true,
+		"https://A.Example.com:8443/x":     true,
+		"http://a.example.com/logout":      false,
+		"https://example.com/api/users":    true,
+		"https://example.com:443/api/":     true,
+		"https://example.com/":             false,
+		"http://example.com/api/users":     false,
+		"https://example.com:8443/api/":    false,
+		"https://other.com/api/":           false,
+		"https://example.com.evil.com/api": false,
+	}
+	for raw, want := range cases {
+		u, _ := url.Parse(raw)
+		if ps.InScope(u) != want {
+			t.Fatalf("%s want %v", raw, want)
+		}
+		// 没有开启 record_only 时全部记录
+		if !ps.Record(u) {
+			t.Fatalf("%s record", raw)
+		}
+	}
+
+	if err = ps.Set(Scope{Include: []ScopeRule{{Host: "example.com"}}, RecordOnly: true}); err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := url.Parse("http://other.com/"); ps.Record(u) {
+		t.Fatal("record out of scope")
+	}
+	if err = ps.CheckRaw("example.com:443", true, []byte("GET /x HTTP/1.1\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err = ps.CheckRaw("other.com:80", false, []byte("GET / HTTP/1.1\r\n\r\n")); err == nil {
+		t.Fatal("raw out of scope")
+	}
+
+	if err = ps.Set(Scope{Include: []ScopeRule{{Scheme: "ftp"}}}); err == nil {
+		t.Fatal("invalid scheme")
+	}
+	if err = ps.Set(Scope{Include: []ScopeRule{{Host: "["}}}); err == nil {
+		t.Fatal("invalid host pattern")
+	}
+
+	// 没有配置时所有目标都在 scope 内
+	var empty *ProjectScope
+	if !empty.InScope(&url.URL{Host: "a.com"}) || empty.Check("http://a.com/") != nil {
+		t.Fatal("nil scope")
+	}
+
+	web := &WebAddon{config: Config{Scope: ps}}
+	fr := &proxy.RequestEditData{Method: "GET", RawURL: "http://127.0.0.1:1/", Header: http.Header{}}
+	if _, err = web.doRequest(context.Background(), fr, sendOptions{Timeout: time.Second}); err == nil || !strings.Contains(err.Error(), "out of scope") {
+		t.Fatalf("repeat out of scope %v", err)
+	}
+	if _, err = web.sendRaw(context.Background(), &RawRequest{Addr: "127.0.0.1:1", Requests: []string{"GET / HTTP/1.1\r\n\r\n"}}, time.Second); err == nil {
+		t.Fatal("raw repeat out of scope")
+	}
+}
+
+func TestScopeSave(t *testing.T) {
+	ps, _ := NewProjectScope(Scope{Include: []ScopeRule{{Host: "a.com"}}})
+	var saved []Scope
+	fail := false
+	web := &WebAddon{config: Config{Scope: ps, SaveScope: func(s Scope) error {
+		if fail {
+			return errors.New("read-only")
+		}
+		saved = append(saved, s)
+		return nil
+	}}}
+
+	put := func(body string) int {
+		w := httptest.NewRecorder()
+		web.MitmScope(w, httptest.NewRequest(http.MethodPost, "/scope", strings.NewReader(body)), nil)
+		return w.Code
+	}
+
+	if code := put(`{"include":[{"host":"b.com"}],"record_only":true}`); code != http.StatusOK {
+		t.Fatalf("code %d", code)
+	}
+	if len(saved) != 1 || saved[0].Include[0].Host != "b.com" || ps.Get().Include[0].Host != "b.com" {
+		t.Fatalf("saved %+v scope %+v", saved, ps.Get())
+	}
+
+	// 校验失败不写配置, 写配置失败不生效
+	if code := put(`{"include":[{"scheme":"ftp"}]}`); code != http.StatusBadRequest || len(saved) != 1 {
+		t.Fatalf("code %d saved %d", code, len(saved))
+	}
+	fail = true
+	if code := put(`{"include":[{"host":"c.com"}]}`); code != http.StatusInternalServerError || ps.Get().Include[0].Host != "b.com" {
+		t.Fatalf("code %d scope %+v", code, ps.Get())
+	}
+}
@@ -0,0 +1,191 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vela-ssoc/vela-kit/lua"
+	"github.com/vela-ssoc/vela-kit/lua/parse"
+	"github.com/vela-ssoc/vela-mitm/proxy"
+)
+
+/*
+	可修改 flow 的 lua 脚本, 按阶段注册:
+	request   完整请求读取后
+	response  完整响应读取后
+	websocket websocket 握手请求
+
+	if flow.host.eq("api.example.com") then
+		flow.set_header("X-Debug", "1")
+		flow.tag("api")
+	end
+*/
+
+const (
+	ScriptPhaseRequest   = "request"
+	ScriptPhaseResponse  = "response"
+	ScriptPhaseWebsocket = "websocket"
+)
+
+type ScriptRule struct {
+	Name   string `json:"name" yaml:"name"`
+	Phase  string `json:"phase" yaml:"phase"`
+	Enable bool   `json:"enable" yaml:"enable"`
+	Script string `json:"script" yaml:"script"`
+
+	proto *lua.FunctionProto
+}
+
+type ScriptAddon struct {
+	proxy.BaseAddon
+
+	mu      sync.RWMutex
+	scripts []*ScriptRule
+}
+
+func NewScriptAddon(rules []ScriptRule) (*ScriptAddon, error) {
+	sa := new(ScriptAddon)
+	if err := sa.SetScripts(rules); err != nil {
+		return nil, err
+	}
+	return sa, nil
+}
+
+func (rule *ScriptRule) compile() error {
+	switch rule.Phase {
+	case ScriptPhaseRequest, ScriptPhaseResponse, ScriptPhaseWebsocket:
+	default:
+		return fmt.Errorf("invalid script phase %s", rule.Phase)
+	}
+
+	// 只编译, 每次调用时在各自的 LState 上创建函数
+	chunk, err := parse.Parse(strings.NewReader(rule.Script), rule.Name)
+	if err != nil {
+		return err
+	}
+
+	proto, err := lua.Compile(chunk, rule.Name)
+	if err != nil {
+		return err
+	}
+
+	rule.proto = proto
+	return nil
+}
+
+// 整体替换脚本, 同阶段按顺序执行
+func (sa *ScriptAddon) SetScripts(rules []ScriptRule) error {
+	scripts := make([]*ScriptRule, len(rules))
+	for i := range rules {
+		rule := rules[i]
+		if err := rule.compile(); err != nil {
+			return fmt.Errorf("script %d %s compile fail %v", i, rule.Name, err)
+		}
+		scripts[i] = &rule
+	}
+
+	sa.mu.Lock()
+	sa.scripts = scripts
+	sa.mu.Unlock()
+	return nil
+}
+
+func (sa *ScriptAddon) Scripts() []ScriptRule {
+	sa.mu.RLock()
+	defer sa.mu.RUnlock()
+
+	rules := make([]ScriptRule, len(sa.scripts))
+	for i, rule := range sa.scripts {
+		rules[i] = *rule
+	}
+	return rules
+}
+
+func (sa *ScriptAddon) run(phase string, f *proxy.Flow) {
+	sa.mu.RLock()
+	scripts := sa.scripts
+	sa.mu.RUnlock()
+
+	for _, rule := range scripts {
+		if !rule.Enable || rule.Phase != phase {
+			continue
+		}
+
+		if rule.call(phase, f) {
+			return
+		}
+	}
+}
+
+// 返回 true 表示 flow 已被丢弃或替换响应, 后续脚本不再执行
+func (rule *ScriptRule) call(phase string, f *proxy.Flow) bool {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fl := &flowL{ctx: ctx, stop: cancel, flow: f, phase: phase, mutable: true, script: rule.Name}
+
+	co := ruleLuaCoroutinePool.Get().(*lua.LState)
+	co.SetContext(ctx)
+	co.Exdata = fl
+	defer func() {
+		co.Exdata = nil
+		co.SetContext(nil)
+		ruleLuaCoroutinePool.Put(co)
+	}()
+
+	// 全局变量写入本次调用的环境, 读取时回退到 LState 的全局表, 并发的 flow 之间互不影响
+	fn := co.NewFunctionFromProto(rule.proto)
+	env, meta := co.NewTable(), co.NewTable()
+	meta.RawSetString("__index", co.G.Global)
+	co.SetMetatable(env, meta)
+	fn.Env = env
+
+	err := co.CallByParam(lua.P{
+		Fn:      fn,
+		Protect: true,
+		NRet:    0,
+	})
+
+	if err != nil && !strings.Contains(err.Error(), context.Canceled.Error()) {
+		log.Errorf("script %s call fail: %v", rule.Name, err)
+	}
+
+	return fl.done
+}
+
+// Connection 可能带多个 token, 如 firefox 的 keep-alive, Upgrade
+func isWebsocketUpgrade(req *proxy.Request) bool {
+	return headerHasToken(req.Header, "Connection", "upgrade") && headerHasToken(req.Header, "Upgrade", "websocket")
+}
+
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (sa *ScriptAddon) Requestheaders(f *proxy.Flow) {
+	if isWebsocketUpgrade(f.Request) {
+		sa.run(ScriptPhaseWebsocket, f)
+	}
+}
+
+func (sa *ScriptAddon) Request(f *proxy.Flow) {
+	sa.run(ScriptPhaseRequest, f)
+}
+
+func (sa *ScriptAddon) Response(f *proxy.Flow) {
+	if f.Response == nil || f.Request.Method == "CONNECT" {
+		return
+	}
+	sa.run(ScriptPhaseResponse, f)
+}
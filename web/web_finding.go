@@ -0,0 +1,121 @@
+package web
+
+import (
+	"net/http"
+
+	"github.com/bytedance/sonic"
+	"github.com/bytedance/sonic/decoder"
+	log "github.com/sirupsen/logrus"
+	"github.com/vela-ssoc/vela-kit/auxlib"
+	"github.com/vela-ssoc/vela-mitm/proxy"
+)
+
+// 扫描结果保存到记录该 flow 的用户的 FlowDB, 新的发现推送给该用户的全部会话
+// 共用 FlowDB 的用户只保存一次
+func (web *WebAddon) addFindings(f *proxy.Flow, findings []*Finding) {
+	saved := make(map[*FlowDB][]*Finding)
+	web.forEachConn(func(c *concurrentConn) {
+		if !c.recording(f) {
+			return
+		}
+
+		created, ok := saved[c.db]
+		if !ok {
+			created = saveFindings(c.db, findings)
+			saved[c.db] = created
+		}
+
+		for _, fd := range created {
+			chunk, _ := sonic.Marshal(fd)
+			sendToUser(c.user, messageTypeFinding, fd.ID, chunk)
+		}
+	})
+}
+
+func saveFindings(db *FlowDB, findings []*Finding) []*Finding {
+	var created []*Finding
+	for _, v := range findings {
+		fd := *v
+		isNew, err := db.AddFinding(&fd)
+		if err != nil {
+			log.Errorf("save finding fail %v", err)
+			continue
+		}
+		if isNew {
+			created = append(created, &fd)
+		}
+	}
+	return created
+}
+
+// GET ?id= 读取发现, 否则按最后出现时间倒序列出, 可按 type severity host 过滤
+// DELETE ?id= 删除发现, id 为空时删除全部
+func (web *WebAddon) MitmProxyFindings(w http.ResponseWriter, r *http.Request, db *FlowDB) {
+	query := r.URL.Query()
+	id := query.Get("id")
+
+	if r.Method == http.MethodDelete {
+		if err := db.DeleteFindings(id); err != nil {
+			Bad(w, http.StatusInternalServerError, "%v", err)
+			return
+		}
+		w.Write([]byte("ok"))
+		return
+	}
+
+	if id != "" {
+		fd, err := db.Finding(id)
+		if err != nil {
+			Bad(w, http.StatusNotFound, "%s: %v", id, err)
+			return
+		}
+		chunk, _ := sonic.Marshal(fd)
+		JSON(w, chunk)
+		return
+	}
+
+	page := auxlib.ToInt(query.Get("page"))
+	pageSize := auxlib.ToInt(query.Get("pagesize"))
+	if page < 1 || pageSize <= 0 {
+		page, pageSize = 1, 100
+	}
+
+	filter := FindingFilter{Type: query.Get("type"), Severity: query.Get("severity"), Host: query.Get("host")}
+	findings, err := db.Findings(filter, (page-1)*pageSize, pageSize)
+	if err != nil {
+		Bad(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+
+	chunk, _ := sonic.Marshal(findings)
+	JSON(w, chunk)
+}
+
+// GET 读取被动扫描配置, POST 整体替换
+func (web *WebAddon) MitmPassiveConfig(w http.ResponseWriter, r *http.Request, db *FlowDB) {
+	if web.config.Passive == nil {
+		Bad(w, http.StatusNotFound, "passive addon not enable")
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		var cfg PassiveConfig
+		if err := decoder.NewStreamDecoder(r.Body).Decode(&cfg); err != nil {
+			Bad(w, http.StatusBadRequest, "decode fail %v", err)
+			return
+		}
+
+		if err := web.config.Passive.SetConfig(cfg); err != nil {
+			Bad(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+	}
+
+	chunk, err := sonic.Marshal(web.config.Passive.Config())
+	if err != nil {
+		Bad(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+
+	JSON(w, chunk)
+}
@@ -1,7 +1,14 @@
 package web
 
-import "net/http"
+import (
+	"mime"
+	"net/http"
+	"path"
 
+	"github.com/vela-ssoc/vela-kit/auxlib"
+)
+
+// ?flow=id&body=false 时只返回 flow 记录, body 通过 /flow/body 单独读取
 func (web *WebAddon) MitmFlowPull(w http.ResponseWriter, r *http.Request, db *FlowDB) {
 	flowId := r.URL.Query().Get("flow")
 	flow, err := db.FindFlowId(flowId)
@@ -10,5 +17,86 @@ func (web *WebAddon) MitmFlowPull(w http.ResponseWriter, r *http.Request, db *Fl
 		return
 	}
 
+	if r.URL.Query().Get("body") != "false" {
+		if err = db.LoadBody(flow); err != nil {
+			Bad(w, http.StatusInternalServerError, "load body fail %v", err)
+			return
+		}
+	}
+
 	JSON(w, flow.Uncompress().Bytes())
 }
+
+// 捕获的内容来自目标站点, 不能在后台的 origin 下渲染或执行
+func attachmentHeader(w http.ResponseWriter, flow *Flow, part string) {
+	name := path.Base(flow.URL)
+	if name == "" || name == "/" || name == "." {
+		name = flow.FlowID
+	}
+
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": part + "-" + name}))
+}
+
+// ?flow=id&part=request|response 返回解压后的 body
+func (web *WebAddon) MitmFlowBody(w http.ResponseWriter, r *http.Request, db *FlowDB) {
+	flow, err := db.FindFlowId(r.URL.Query().Get("flow"))
+	if err != nil {
+		Bad(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	if err = db.LoadBody(flow); err != nil {
+		Bad(w, http.StatusInternalServerError, "load body fail %v", err)
+		return
+	}
+
+	part, header, body := "response", flow.ResponseHeader, flow.ResponseBody
+	if r.URL.Query().Get("part") == "request" {
+		part, header, body = "request", flow.RequestHeader, flow.RequestBody
+	}
+
+	if ct := header.Get("Content-Type"); ct != "" {
+		w.Header().Set("Content-Type", ct)
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	attachmentHeader(w, flow, part)
+	w.WriteHeader(http.StatusOK)
+	w.Write(auxlib.S2B(UncompressedBody(header, auxlib.S2B(body))))
+}
+
+// ?flow=id&part=request|response 下载 stream 模式落盘的原始 body
+func (web *WebAddon) MitmFlowDownload(w http.ResponseWriter, r *http.Request, db *FlowDB) {
+	flow, err := db.FindFlowId(r.URL.Query().Get("flow"))
+	if err != nil {
+		Bad(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	part := r.URL.Query().Get("part")
+	if part != "request" {
+		part = "response"
+	}
+
+	file, err := db.OpenSpool(flow, part)
+	if err != nil {
+		Bad(w, http.StatusNotFound, "%s body not found", part)
+		return
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		Bad(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	attachmentHeader(w, flow, part)
+	if flow.Truncated {
+		w.Header().Set("X-Mitm-Truncated", "true")
+	}
+	http.ServeContent(w, r, "", stat.ModTime(), file)
+}
@@ -0,0 +1,34 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMitmFlowBody(t *testing.T) {
+	db := newTestFlowDB(t)
+	flow := &Flow{Method: "GET", RawURL: "http://a.com/page.html", RequestHeader: http.Header{},
+		ResponseHeader: http.Header{"Content-Type": {"text/html"}}, ResponseBody: "<script>alert(1)</script>"}
+	if err := addTestFlow(db, flow); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	(&WebAddon{}).MitmFlowBody(w, httptest.NewRequest("GET", "/flow/body?flow="+flow.FlowID, nil), db)
+	if w.Code != http.StatusOK || w.Body.String() != flow.ResponseBody {
+		t.Fatalf("body %d %s", w.Code, w.Body)
+	}
+
+	want := map[string]string{
+		"Content-Type":            "text/html",
+		"X-Content-Type-Options":  "nosniff",
+		"Content-Security-Policy": "sandbox",
+		"Content-Disposition":     `attachment; filename=response-page.html`,
+	}
+	for k, v := range want {
+		if got := w.Header().Get(k); got != v {
+			t.Fatalf("%s: %q want %q", k, got, v)
+		}
+	}
+}
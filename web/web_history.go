@@ -1,30 +1,11 @@
 package web
 
 import (
+	"github.com/bytedance/sonic"
 	"github.com/vela-ssoc/vela-kit/auxlib"
 	"net/http"
 )
 
-func (web *WebAddon) auth(r *http.Request) (bool, *FlowDB) {
-	token := r.Header.Get("Authorization")
-	if token == "" {
-		return false, nil
-	}
-
-	size := len(web.conns)
-	if size == 0 {
-		return false, nil
-	}
-
-	for i := 0; i < size; i++ {
-		conn := web.conns[i]
-		if conn.userData.Token == token {
-			return true, conn.db
-		}
-	}
-	return false, nil
-}
-
 func (web *WebAddon) MitmHistoryPull(w http.ResponseWriter, r *http.Request, db *FlowDB) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(200)
@@ -52,3 +33,154 @@ func (web *WebAddon) MitmHistoryClear(w http.ResponseWriter, r *http.Request, db
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("ok"))
 }
+
+func parseQueryParam(w http.ResponseWriter, r *http.Request) (*FlowQuery, bool) {
+	fq, err := ParseQuery(r.URL.Query().Get("q"))
+	if err != nil {
+		if qe, ok := err.(*QueryError); ok {
+			BadJSON(w, http.StatusBadRequest, qe)
+			return nil, false
+		}
+		BadJSON(w, http.StatusBadRequest, &QueryError{Msg: err.Error()})
+		return nil, false
+	}
+
+	return fq, true
+}
+
+// ?q=host:~api\. AND status>=400&page=1&pagesize=20
+func (web *WebAddon) MitmHistorySearch(w http.ResponseWriter, r *http.Request, db *FlowDB) {
+	page := auxlib.ToInt(r.URL.Query().Get("page"))
+	pageSize := auxlib.ToInt(r.URL.Query().Get("pagesize"))
+	if page < 1 || pageSize <= 0 {
+		Bad(w, http.StatusBadRequest, "page number fail page:%v page_size:%d", page, pageSize)
+		return
+	}
+
+	fq, ok := parseQueryParam(w, r)
+	if !ok {
+		return
+	}
+
+	JSON(w, db.Search(fq, (page-1)*pageSize, pageSize))
+}
+
+// ?q=...&format=har|json&limit=1000
+func (web *WebAddon) MitmHistoryExport(w http.ResponseWriter, r *http.Request, db *FlowDB) {
+	fq, ok := parseQueryParam(w, r)
+	if !ok {
+		return
+	}
+
+	flows, err := db.Export(fq, auxlib.ToInt(r.URL.Query().Get("limit")))
+	if err != nil {
+		Bad(w, http.StatusInternalServerError, "export fail %v", err)
+		return
+	}
+
+	if r.URL.Query().Get("format") == "json" {
+		for i := range flows {
+			flows[i].Uncompress()
+		}
+		chunk, _ := sonic.Marshal(flows)
+		w.Header().Set("Content-Disposition", "attachment; filename=flows.json")
+		JSON(w, chunk)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", "attachment; filename=flows.har")
+	JSON(w, NewHAR(flows).Bytes())
+}
+
+// ?q=token user_12345&limit=50
+func (web *WebAddon) MitmHistoryFullText(w http.ResponseWriter, r *http.Request, db *FlowDB) {
+	if !db.FullTextEnabled() {
+		Bad(w, http.StatusNotFound, "full text index not enable")
+		return
+	}
+
+	limit := auxlib.ToInt(r.URL.Query().Get("limit"))
+	if limit <= 0 {
+		limit = 50
+	}
+
+	hits, err := db.FullTextSearch(r.URL.Query().Get("q"), limit)
+	if err != nil {
+		Bad(w, http.StatusInternalServerError, "full text search fail %v", err)
+		return
+	}
+
+	chunk, _ := sonic.Marshal(hits)
+	JSON(w, chunk)
+}
+
+func (web *WebAddon) MitmHistoryStats(w http.ResponseWriter, r *http.Request, db *FlowDB) {
+	stats, err := db.Stats()
+	if err != nil {
+		Bad(w, http.StatusInternalServerError, "stats fail %v", err)
+		return
+	}
+
+	chunk, _ := sonic.Marshal(stats)
+	JSON(w, chunk)
+}
+
+// POST 立即按保留策略清理, ?compact=true 同时压缩数据库文件
+func (web *WebAddon) MitmHistoryPrune(w http.ResponseWriter, r *http.Request, db *FlowDB) {
+	if r.Method != http.MethodPost {
+		Bad(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	pruned, err := db.Prune()
+	if err != nil {
+		Bad(w, http.StatusInternalServerError, "prune fail %v", err)
+		return
+	}
+
+	var reclaimed int64
+	if r.URL.Query().Get("compact") == "true" {
+		reclaimed, err = db.Compact()
+		if err != nil {
+			Bad(w, http.StatusInternalServerError, "compact fail %v", err)
+			return
+		}
+	}
+
+	chunk, _ := sonic.Marshal(map[string]int64{
+		"pruned":    int64(pruned),
+		"reclaimed": reclaimed,
+	})
+	JSON(w, chunk)
+}
+
+// ?page=1&pagesize=20 按建立时间倒序列出连接
+func (web *WebAddon) MitmHistoryConns(w http.ResponseWriter, r *http.Request, db *FlowDB) {
+	page := auxlib.ToInt(r.URL.Query().Get("page"))
+	pageSize := auxlib.ToInt(r.URL.Query().Get("pagesize"))
+	if page < 1 || pageSize <= 0 {
+		Bad(w, http.StatusNotFound, "page number fail page:%v page_size:%d", page, pageSize)
+		return
+	}
+
+	conns, err := db.Conns((page-1)*pageSize, pageSize)
+	if err != nil {
+		Bad(w, http.StatusInternalServerError, "conns fail %v", err)
+		return
+	}
+
+	chunk, _ := sonic.Marshal(conns)
+	JSON(w, chunk)
+}
+
+// ?id=conn_id 返回连接记录及该连接上的 flow
+func (web *WebAddon) MitmHistoryConn(w http.ResponseWriter, r *http.Request, db *FlowDB) {
+	detail, err := db.Conn(r.URL.Query().Get("id"))
+	if err != nil {
+		Bad(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	chunk, _ := sonic.Marshal(detail)
+	JSON(w, chunk)
+}
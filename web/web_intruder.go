@@ -1,52 +1,103 @@
 package web
 
 import (
-	"fmt"
-	"github.com/bytedance/sonic/decoder"
-	"github.com/vela-ssoc/vela-mitm/proxy"
 	"net/http"
-	"strings"
+
+	"github.com/bytedance/sonic"
+	"github.com/bytedance/sonic/decoder"
+	"github.com/vela-ssoc/vela-kit/auxlib"
 )
 
+// POST 启动任务, 返回任务信息, 结果通过 websocket 推送
+// GET ?job=&page=&pagesize=&flow=true&analysis=true 读取任务及结果, 不带 job 时按时间倒序列出任务
+// GET ?job=&diff= 第 diff 个结果与基准请求的响应差异
+// DELETE ?job= 停止任务
 func (web *WebAddon) MitmProxyIntruder(w http.ResponseWriter, r *http.Request, db *FlowDB) {
-	var fr proxy.RequestEditData
-	err := decoder.NewStreamDecoder(r.Body).Decode(&fr)
-	fmt.Println(fr.Body)
-	if err != nil {
-		Bad(w, http.StatusServiceUnavailable, "decode fail %v", err)
-		return
-	}
+	query := r.URL.Query()
 
-	request, err := http.NewRequest(fr.Method, fr.RawURL, strings.NewReader(fr.Body))
-	if err != nil {
-		Bad(w, http.StatusServiceUnavailable, "decode fail %v", err)
+	c := web.session(r)
+	if c == nil {
+		Unauthorized(w, r)
 		return
 	}
 
-	request.Header = fr.Header
+	switch r.Method {
+	case http.MethodPost:
+		var atk IntruderAttack
+		if err := decoder.NewStreamDecoder(r.Body).Decode(&atk); err != nil {
+			Bad(w, http.StatusBadRequest, "decode fail %v", err)
+			return
+		}
 
-	peer := request.Header.Get("X-Mitmproxy-Peer")
+		job, err := web.startIntruder(c, &atk)
+		if err != nil {
+			Bad(w, http.StatusBadRequest, "%v", err)
+			return
+		}
 
-	client := &http.Client{}
-	if tp := NewTransport(peer); tp != nil {
-		client.Transport = tp
-	}
+		chunk, _ := sonic.Marshal(job)
+		JSON(w, chunk)
 
-	resp, err := client.Do(request)
-	if err != nil {
-		Bad(w, http.StatusServiceUnavailable, "http request fail %v", err)
-		return
+	case http.MethodDelete:
+		if err := web.stopJob(c, query.Get("job")); err != nil {
+			Bad(w, http.StatusNotFound, "%s: %v", query.Get("job"), err)
+			return
+		}
+		w.Write([]byte("ok"))
 
-	}
+	default:
+		page := auxlib.ToInt(query.Get("page"))
+		pageSize := auxlib.ToInt(query.Get("pagesize"))
+		if page < 1 || pageSize <= 0 {
+			page, pageSize = 1, 100
+		}
+		skip := (page - 1) * pageSize
 
-	flow := &Flow{
-		Proto:          resp.Proto,
-		StatusCode:     resp.StatusCode,
-		ResponseHeader: resp.Header,
-	}
+		id := query.Get("job")
+		if id == "" {
+			jobs, err := db.IntruderJobs(skip, pageSize)
+			if err != nil {
+				Bad(w, http.StatusInternalServerError, "query fail %v", err)
+				return
+			}
+			chunk, _ := sonic.Marshal(jobs)
+			JSON(w, chunk)
+			return
+		}
+
+		if query.Has("diff") {
+			diff, err := db.IntruderDiff(id, auxlib.ToInt(query.Get("diff")))
+			if err != nil {
+				Bad(w, http.StatusNotFound, "%v", err)
+				return
+			}
+			chunk, _ := sonic.Marshal(diff)
+			JSON(w, chunk)
+			return
+		}
 
-	flow.ResponseBody = UncompressResponse(resp)
-	flow.ResponseSize = len(flow.ResponseBody)
+		job, err := db.IntruderJob(id)
+		if err != nil {
+			Bad(w, http.StatusNotFound, "job %s not found", id)
+			return
+		}
 
-	JSON(w, flow.Bytes())
+		results, err := db.IntruderResults(id, skip, pageSize, query.Get("flow") == "true")
+		if err != nil {
+			Bad(w, http.StatusInternalServerError, "query fail %v", err)
+			return
+		}
+
+		detail := IntruderDetail{IntruderJob: *job, Results: results}
+		if query.Get("analysis") == "true" {
+			if detail.Analysis, err = db.IntruderAnalysis(job); err != nil {
+				Bad(w, http.StatusInternalServerError, "analysis fail %v", err)
+				return
+			}
+			detail.Analysis.mark(results)
+		}
+
+		chunk, _ := sonic.Marshal(detail)
+		JSON(w, chunk)
+	}
 }
@@ -0,0 +1,44 @@
+package web
+
+import (
+	"net/http"
+
+	"github.com/bytedance/sonic"
+)
+
+// GET 按创建时间倒序列出后台任务, GET ?id= 任务状态, repeat 任务包含结果
+// POST ?id=&action=stop|pause|resume 控制任务
+func (web *WebAddon) MitmProxyJobs(w http.ResponseWriter, r *http.Request, db *FlowDB) {
+	query := r.URL.Query()
+
+	c := web.session(r)
+	if c == nil {
+		Unauthorized(w, r)
+		return
+	}
+
+	id := query.Get("id")
+	if r.Method == http.MethodPost {
+		if err := web.controlJob(c, id, query.Get("action")); err != nil {
+			Bad(w, http.StatusBadRequest, "%s: %v", id, err)
+			return
+		}
+		w.Write([]byte("ok"))
+		return
+	}
+
+	if id == "" {
+		chunk, _ := sonic.Marshal(web.listJobs(c))
+		JSON(w, chunk)
+		return
+	}
+
+	j, err := web.job(c, id)
+	if err != nil {
+		Bad(w, http.StatusNotFound, "%s: %v", id, err)
+		return
+	}
+
+	chunk, _ := sonic.Marshal(j.snapshot())
+	JSON(w, chunk)
+}
@@ -2,7 +2,6 @@ package web
 
 import (
 	"github.com/gorilla/websocket"
-	uuid "github.com/satori/go.uuid"
 	log "github.com/sirupsen/logrus"
 	"net/http"
 	"os"
@@ -12,23 +11,70 @@ import (
 
 type UserData struct {
 	Name  string
+	DB    string
+	Role  Role
+	SID   string // 登录标识, 同一次登录 refresh 后的 token 共用; api 会话为空
 	Token string
 	Time  time.Time
 }
 
-func (web *WebAddon) Login(r *http.Request) (bool, *UserData) {
-	query := r.URL.Query()
-	pass := query.Get("id")
-
-	if pass == web.config.Pass {
-		return true, &UserData{
-			Name:  web.config.Name,
-			Token: uuid.NewV4().String(),
-			Time:  time.Now(),
+func newUserData(u *User) *UserData {
+	return &UserData{
+		Name: u.Name,
+		DB:   u.dbName(),
+		Role: ParseRole(u.Role),
+		Time: time.Now(),
+	}
+}
+
+// 配置的账户, Config.Name/Pass 作为兼容的单用户
+func (web *WebAddon) accounts() []User {
+	users := web.config.Users
+	if web.config.Name == "" || web.config.Pass == "" {
+		return users
+	}
+
+	for _, u := range users {
+		if u.Name == web.config.Name {
+			return users
+		}
+	}
+
+	// 兼容旧配置, Name/Pass 为管理员
+	return append(users[:len(users):len(users)], User{Name: web.config.Name, Pass: web.config.Pass, Role: "admin"})
+}
+
+// name 为空时使用 Config.Name
+func (web *WebAddon) authenticate(name, pass string) (*User, bool) {
+	if name == "" {
+		name = web.config.Name
+	}
+
+	for _, u := range web.accounts() {
+		if u.Name == name && u.Verify(pass) {
+			return &u, true
 		}
 	}
+	return nil, false
+}
+
+// ?token=, token 由 POST /mitm/{name}/login 获取, 浏览器的 websocket 不能设置 Authorization
+func (web *WebAddon) Login(r *http.Request) (bool, *UserData) {
+	token := r.URL.Query().Get("token")
+	claims, err := web.tokens.verify(token)
+	if err != nil {
+		return false, nil
+	}
 
-	return false, nil
+	u, ok := web.account(claims.User)
+	if !ok {
+		return false, nil
+	}
+
+	ud := newUserData(u)
+	ud.SID = claims.SID
+	ud.Token = token
+	return true, ud
 }
 
 func (web *WebAddon) MitmConnect(w http.ResponseWriter, r *http.Request) {
@@ -36,7 +82,7 @@ func (web *WebAddon) MitmConnect(w http.ResponseWriter, r *http.Request) {
 	if !ok {
 		w.WriteHeader(http.StatusUnauthorized)
 		w.Write([]byte("check you login info"))
-		log.Errorf("web %s connect fail", web.config.Name)
+		log.Errorf("web %s connect fail from %s", web.config.Name, r.RemoteAddr)
 		return
 	}
 
@@ -63,8 +109,15 @@ func (web *WebAddon) MitmConnect(w http.ResponseWriter, r *http.Request) {
 
 }
 
+func (web *WebAddon) certDir() string {
+	if web.config.CertDir == "" {
+		return "cert.d"
+	}
+	return web.config.CertDir
+}
+
 func (web *WebAddon) MitmDummyCert(w http.ResponseWriter, r *http.Request, db *FlowDB) {
-	cer, err := os.ReadFile(filepath.Join("cert.d/mitmproxy-ca-cert.cer"))
+	cer, err := os.ReadFile(filepath.Join(web.certDir(), "mitmproxy-ca-cert.cer"))
 	if err != nil {
 		w.WriteHeader(http.StatusNotFound)
 		w.Write([]byte("not found"))
@@ -2,7 +2,10 @@ package web
 
 import (
 	"context"
+	"fmt"
+	"github.com/bytedance/sonic"
 	"github.com/bytedance/sonic/decoder"
+	"github.com/vela-ssoc/vela-kit/auxlib"
 	"github.com/vela-ssoc/vela-mitm/proxy"
 	"net"
 	"net/http"
@@ -36,6 +39,28 @@ func NewTransport(peer string) http.RoundTripper {
 	return Transport
 }
 
+const repeatDefaultTimeout = 60 * time.Second
+
+// Chain 为 true 时经过代理自身发送, 请求和响应经过全部 addon (重写 脚本 history 记录)
+// 否则使用与代理相同的上游配置直接连接; 使用代理的配置时总是不跟随重定向, NoRedirect 用于没有配置代理时
+type sendOptions struct {
+	Timeout    time.Duration
+	Chain      bool
+	NoRedirect bool
+}
+
+// ?timeout= 毫秒, 默认 60 秒; ?chain=true
+func repeatOptions(r *http.Request) sendOptions {
+	query := r.URL.Query()
+	opt := sendOptions{Timeout: repeatDefaultTimeout, Chain: query.Get("chain") == "true"}
+	if ms := auxlib.ToInt(query.Get("timeout")); ms > 0 {
+		opt.Timeout = time.Duration(ms) * time.Millisecond
+	}
+	return opt
+}
+
+// ?async=true 时作为后台任务执行, 立即返回任务, 结果通过 proxy/jobs?id= 读取
+// 否则等待响应, 浏览器断开请求时取消
 func (web *WebAddon) MitmProxyRequest(w http.ResponseWriter, r *http.Request, db *FlowDB) {
 	var fr proxy.RequestEditData
 	err := decoder.NewStreamDecoder(r.Body).Decode(&fr)
@@ -44,36 +69,105 @@ func (web *WebAddon) MitmProxyRequest(w http.ResponseWriter, r *http.Request, db
 		return
 	}
 
-	request, err := http.NewRequest(fr.Method, fr.RawURL, strings.NewReader(fr.Body))
+	if r.URL.Query().Get("async") == "true" {
+		c := web.session(r)
+		if c == nil {
+			Unauthorized(w, r)
+			return
+		}
+
+		chunk, _ := sonic.Marshal(web.submitRepeat(c, &fr, repeatOptions(r)))
+		JSON(w, chunk)
+		return
+	}
+
+	flow, err := web.doRequest(r.Context(), &fr, repeatOptions(r))
 	if err != nil {
-		Bad(w, http.StatusServiceUnavailable, "decode fail %v", err)
+		Bad(w, http.StatusServiceUnavailable, "%v", err)
 		return
 	}
 
-	request.Header = fr.Header
+	JSON(w, flow.Bytes())
+}
 
-	peer := request.Header.Get("X-Mitmproxy-Peer")
+// 重放请求, 使用与代理相同的上游配置, X-Mitmproxy-Peer 等控制 header 不发往目标服务器
+func (web *WebAddon) Repeat(fr *proxy.RequestEditData) (*Flow, error) {
+	return web.doRequest(context.Background(), fr, sendOptions{Timeout: repeatDefaultTimeout})
+}
 
-	client := &http.Client{}
-	if tp := NewTransport(peer); tp != nil {
-		client.Transport = tp
+// 没有配置 Config.Proxy 时直接连接, X-Mitmproxy-Peer 指定实际连接的地址, 不支持 chain
+func (web *WebAddon) outbound(request *http.Request, opt sendOptions) (*http.Client, error) {
+	p := web.config.Proxy
+	switch {
+	case p == nil && opt.Chain:
+		return nil, fmt.Errorf("proxy not configured, chain unavailable")
+	case p == nil:
+		client := &http.Client{Timeout: opt.Timeout}
+		if tp := NewTransport(request.Header.Get("X-Mitmproxy-Peer")); tp != nil {
+			client.Transport = tp
+		}
+		if opt.NoRedirect {
+			client.CheckRedirect = func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			}
+		}
+		return client, nil
+	case opt.Chain:
+		return p.ChainClient(request, opt.Timeout)
+	default:
+		return p.OutboundClient(request, opt.Timeout), nil
 	}
+}
 
-	resp, err := client.Do(request)
+// 返回的 flow 包含实际发送的请求
+func (web *WebAddon) doRequest(ctx context.Context, fr *proxy.RequestEditData, opt sendOptions) (*Flow, error) {
+	if err := web.config.Scope.Check(fr.RawURL); err != nil {
+		return nil, err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, fr.Method, fr.RawURL, strings.NewReader(fr.Body))
 	if err != nil {
-		Bad(w, http.StatusServiceUnavailable, "http request fail %v", err)
-		return
+		return nil, fmt.Errorf("decode fail %v", err)
+	}
 
+	request.Header = fr.Header.Clone()
+	if request.Header == nil {
+		request.Header = make(http.Header)
 	}
 
+	client, err := web.outbound(request, opt)
+	if err != nil {
+		return nil, err
+	}
+
+	// chain 时由代理选择上游后删除
+	if !opt.Chain {
+		proxy.StripControlHeaders(request.Header)
+	}
+
+	start := time.Now()
+	resp, err := client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("http request fail %v", err)
+	}
+	defer resp.Body.Close()
+
 	flow := &Flow{
+		Method:         request.Method,
+		Scheme:         request.URL.Scheme,
 		Proto:          resp.Proto,
+		RequestHeader:  request.Header,
+		RawURL:         fr.RawURL,
+		URL:            request.URL.String(),
+		Query:          request.URL.RawQuery,
+		RequestBody:    fr.Body,
+		RequestSize:    len(fr.Body),
 		StatusCode:     resp.StatusCode,
 		ResponseHeader: resp.Header,
+		Time:           start,
 	}
 
 	flow.ResponseBody = UncompressResponse(resp)
 	flow.ResponseSize = len(flow.ResponseBody)
-
-	JSON(w, flow.Bytes())
+	return flow, nil
 }
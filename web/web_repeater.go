@@ -0,0 +1,148 @@
+package web
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/bytedance/sonic"
+	"github.com/bytedance/sonic/decoder"
+	"github.com/vela-ssoc/vela-kit/auxlib"
+)
+
+// GET 按创建时间倒序列出标签, GET ?tab=&page=&pagesize=&flow=true 标签及发送记录
+// GET ?a=&b= 比较两个响应, 引用格式见 loadResponse
+// POST 创建标签, POST ?tab=&async=true&timeout= 发送, body 为空时使用标签的请求
+// POST ?raw=true 不创建标签直接发送 RawRequest
+// PUT ?tab= 修改名称或请求, DELETE ?tab= 删除
+func (web *WebAddon) MitmProxyRepeater(w http.ResponseWriter, r *http.Request, db *FlowDB) {
+	query := r.URL.Query()
+	id := query.Get("tab")
+
+	switch r.Method {
+	case http.MethodPost:
+		if id == "" && query.Get("raw") == "true" {
+			var rr RawRequest
+			if err := decoder.NewStreamDecoder(r.Body).Decode(&rr); err != nil {
+				Bad(w, http.StatusBadRequest, "decode fail %v", err)
+				return
+			}
+
+			res, err := web.sendRaw(r.Context(), &rr, repeatOptions(r).Timeout)
+			if err != nil {
+				Bad(w, http.StatusBadRequest, "%v", err)
+				return
+			}
+			chunk, _ := sonic.Marshal(res)
+			JSON(w, chunk)
+			return
+		}
+
+		if id == "" {
+			var form RepeaterTabForm
+			if err := decoder.NewStreamDecoder(r.Body).Decode(&form); err != nil {
+				Bad(w, http.StatusBadRequest, "decode fail %v", err)
+				return
+			}
+
+			tab, err := createRepeaterTab(db, &form)
+			if err != nil {
+				Bad(w, http.StatusBadRequest, "%v", err)
+				return
+			}
+			chunk, _ := sonic.Marshal(tab)
+			JSON(w, chunk)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			Bad(w, http.StatusBadRequest, "read body fail %v", err)
+			return
+		}
+
+		if query.Get("async") == "true" {
+			c := web.session(r)
+			if c == nil {
+				Unauthorized(w, r)
+				return
+			}
+			chunk, _ := sonic.Marshal(web.submitRepeaterSend(c, id, body, repeatOptions(r)))
+			JSON(w, chunk)
+			return
+		}
+
+		entry, err := web.sendRepeaterBody(r.Context(), db, id, body, repeatOptions(r))
+		if err != nil {
+			Bad(w, http.StatusNotFound, "%v", err)
+			return
+		}
+		chunk, _ := sonic.Marshal(entry)
+		JSON(w, chunk)
+
+	case http.MethodPut:
+		var form RepeaterTabForm
+		if err := decoder.NewStreamDecoder(r.Body).Decode(&form); err != nil {
+			Bad(w, http.StatusBadRequest, "decode fail %v", err)
+			return
+		}
+
+		tab, err := updateRepeaterTab(db, id, &form)
+		if err != nil {
+			Bad(w, http.StatusNotFound, "%v", err)
+			return
+		}
+		chunk, _ := sonic.Marshal(tab)
+		JSON(w, chunk)
+
+	case http.MethodDelete:
+		if err := db.DeleteRepeaterTab(id); err != nil {
+			Bad(w, http.StatusNotFound, "tab %s not found", id)
+			return
+		}
+		w.Write([]byte("ok"))
+
+	default:
+		if query.Get("a") != "" {
+			diff, err := diffResponses(db, query.Get("a"), query.Get("b"))
+			if err != nil {
+				Bad(w, http.StatusNotFound, "%v", err)
+				return
+			}
+			chunk, _ := sonic.Marshal(diff)
+			JSON(w, chunk)
+			return
+		}
+
+		if id == "" {
+			tabs, err := db.RepeaterTabs()
+			if err != nil {
+				Bad(w, http.StatusInternalServerError, "query fail %v", err)
+				return
+			}
+			chunk, _ := sonic.Marshal(tabs)
+			JSON(w, chunk)
+			return
+		}
+
+		tab, err := db.RepeaterTab(id)
+		if err != nil {
+			Bad(w, http.StatusNotFound, "tab %s not found", id)
+			return
+		}
+
+		page := auxlib.ToInt(query.Get("page"))
+		pageSize := auxlib.ToInt(query.Get("pagesize"))
+		if page < 1 || pageSize <= 0 {
+			page, pageSize = 1, 100
+		}
+
+		entries, err := db.RepeaterEntries(id, (page-1)*pageSize, pageSize, query.Get("flow") == "true")
+		if err != nil {
+			Bad(w, http.StatusInternalServerError, "query fail %v", err)
+			return
+		}
+
+		chunk, _ := sonic.Marshal(RepeaterDetail{RepeaterTab: *tab, Entries: entries})
+		JSON(w, chunk)
+	}
+}
@@ -0,0 +1,37 @@
+package web
+
+import (
+	"github.com/bytedance/sonic"
+	"github.com/bytedance/sonic/decoder"
+	"github.com/vela-ssoc/vela-mitm/addon"
+	"net/http"
+)
+
+// GET 读取改写规则及命中次数, POST 整体替换规则(顺序即执行顺序)
+func (web *WebAddon) MitmRewriteRules(w http.ResponseWriter, r *http.Request, db *FlowDB) {
+	if web.config.Rewrite == nil {
+		Bad(w, http.StatusNotFound, "rewrite addon not enable")
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		var rules []addon.RewriteRule
+		if err := decoder.NewStreamDecoder(r.Body).Decode(&rules); err != nil {
+			Bad(w, http.StatusBadRequest, "decode fail %v", err)
+			return
+		}
+
+		if err := web.config.Rewrite.SetRules(rules); err != nil {
+			Bad(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+	}
+
+	chunk, err := sonic.Marshal(web.config.Rewrite.Rules())
+	if err != nil {
+		Bad(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+
+	JSON(w, chunk)
+}
@@ -0,0 +1,59 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/bytedance/sonic"
+	"github.com/bytedance/sonic/decoder"
+)
+
+// GET 读取项目 scope, POST 整体替换
+func (web *WebAddon) MitmScope(w http.ResponseWriter, r *http.Request, db *FlowDB) {
+	if web.config.Scope == nil {
+		Bad(w, http.StatusNotFound, "scope not enable")
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		var scope Scope
+		if err := decoder.NewStreamDecoder(r.Body).Decode(&scope); err != nil {
+			Bad(w, http.StatusBadRequest, "decode fail %v", err)
+			return
+		}
+
+		if code, err := web.updateScope(scope); err != nil {
+			Bad(w, code, "%v", err)
+			return
+		}
+	}
+
+	chunk, err := sonic.Marshal(web.config.Scope.Get())
+	if err != nil {
+		Bad(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+
+	JSON(w, chunk)
+}
+
+// 先写回配置文件再生效, 写入失败时保持原来的 scope, 重启后与 web 后台看到的一致
+func (web *WebAddon) updateScope(scope Scope) (int, error) {
+	if err := scope.validate(); err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	web.config.Scope.save.Lock()
+	defer web.config.Scope.save.Unlock()
+
+	if save := web.config.SaveScope; save != nil {
+		if err := save(scope); err != nil {
+			return http.StatusInternalServerError, fmt.Errorf("save scope fail %v", err)
+		}
+	}
+
+	if err := web.config.Scope.Set(scope); err != nil {
+		return http.StatusBadRequest, err
+	}
+	return http.StatusOK, nil
+}
@@ -0,0 +1,36 @@
+package web
+
+import (
+	"github.com/bytedance/sonic"
+	"github.com/bytedance/sonic/decoder"
+	"net/http"
+)
+
+// GET 读取 lua 脚本, POST 整体替换脚本
+func (web *WebAddon) MitmScriptRules(w http.ResponseWriter, r *http.Request, db *FlowDB) {
+	if web.config.Script == nil {
+		Bad(w, http.StatusNotFound, "script addon not enable")
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		var rules []ScriptRule
+		if err := decoder.NewStreamDecoder(r.Body).Decode(&rules); err != nil {
+			Bad(w, http.StatusBadRequest, "decode fail %v", err)
+			return
+		}
+
+		if err := web.config.Script.SetScripts(rules); err != nil {
+			Bad(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+	}
+
+	chunk, err := sonic.Marshal(web.config.Script.Scripts())
+	if err != nil {
+		Bad(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+
+	JSON(w, chunk)
+}
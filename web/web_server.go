@@ -6,6 +6,7 @@ import (
 	log "github.com/sirupsen/logrus"
 	"io/fs"
 	"net/http"
+	"strings"
 )
 
 //go:embed client/build
@@ -26,39 +27,80 @@ func (web *WebAddon) HaveOrigin(origin string) bool {
 
 }
 
-func (web *WebAddon) HandleFunc(next func(w http.ResponseWriter, r *http.Request, fdb *FlowDB)) http.HandlerFunc {
+// 设置跨域头, OPTIONS 请求直接返回 true
+func (web *WebAddon) preflight(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if web.HaveOrigin(origin) {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Methods", "GET, PUT, POST, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Origin, Accept")
+	}
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusNoContent)
+		return true
+	}
+	return false
+}
+
+// p 为接口需要的角色, 特权操作和越权请求写入审计日志
+func (web *WebAddon) HandleFunc(p perm, next func(w http.ResponseWriter, r *http.Request, fdb *FlowDB)) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		origin := r.Header.Get("Origin")
-		if web.HaveOrigin(origin) {
-			w.Header().Set("Access-Control-Allow-Origin", origin)
-			w.Header().Set("Access-Control-Allow-Methods", "GET, PUT, POST, DELETE, OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Origin, Accept")
+		if web.preflight(w, r) {
+			return
 		}
 
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusNoContent)
+		c := web.session(r)
+		if c == nil {
+			Unauthorized(w, r)
 			return
 		}
 
-		ok, db := web.auth(r)
-		if !ok {
-			Unauthorized(w, r)
+		need := p.need(r.Method)
+		allowed := c.userData.Role.Allow(need)
+		action := r.Method + " " + strings.TrimPrefix(r.URL.Path, "/mitm/"+web.config.Name+"/")
+		web.audit(c, action, r.URL.RawQuery, r.RemoteAddr, need, allowed)
+		if !allowed {
+			Bad(w, http.StatusForbidden, "role %s not allow, need %s", c.userData.Role, need)
 			return
 		}
 
-		next(w, r, db)
+		next(w, r, c.db)
 	}
 }
 
 func (web *WebAddon) Router() *http.ServeMux {
 	serverMux := new(http.ServeMux)
+	serverMux.HandleFunc("/mitm/"+web.config.Name+"/login", web.MitmLogin)
+	serverMux.HandleFunc("/mitm/"+web.config.Name+"/refresh", web.MitmRefresh)
+	serverMux.HandleFunc("/mitm/"+web.config.Name+"/logout", web.MitmLogout)
 	serverMux.HandleFunc("/mitm/"+web.config.Name+"/connect", web.MitmConnect)
-	serverMux.HandleFunc("/mitm/"+web.config.Name+"/history/pull", web.HandleFunc(web.MitmHistoryPull))
-	serverMux.HandleFunc("/mitm/"+web.config.Name+"/flow/pull", web.HandleFunc(web.MitmFlowPull))
-	serverMux.HandleFunc("/mitm/"+web.config.Name+"/history/clear", web.HandleFunc(web.MitmHistoryClear))
-	serverMux.HandleFunc("/mitm/"+web.config.Name+"/proxy/repeat", web.HandleFunc(web.MitmProxyRequest))
-	serverMux.HandleFunc("/mitm/"+web.config.Name+"/proxy/intruder", web.HandleFunc(web.MitmProxyIntruder))
-	serverMux.HandleFunc("/mitm/"+web.config.Name+"/dummy/cert", web.HandleFunc(web.MitmDummyCert))
+	serverMux.HandleFunc("/mitm/"+web.config.Name+"/history/pull", web.HandleFunc(permView, web.MitmHistoryPull))
+	serverMux.HandleFunc("/mitm/"+web.config.Name+"/flow/pull", web.HandleFunc(permView, web.MitmFlowPull))
+	serverMux.HandleFunc("/mitm/"+web.config.Name+"/flow/body", web.HandleFunc(permView, web.MitmFlowBody))
+	serverMux.HandleFunc("/mitm/"+web.config.Name+"/flow/download", web.HandleFunc(permView, web.MitmFlowDownload))
+	serverMux.HandleFunc("/mitm/"+web.config.Name+"/history/clear", web.HandleFunc(permAdmin, web.MitmHistoryClear))
+	serverMux.HandleFunc("/mitm/"+web.config.Name+"/history/search", web.HandleFunc(permView, web.MitmHistorySearch))
+	serverMux.HandleFunc("/mitm/"+web.config.Name+"/history/export", web.HandleFunc(permView, web.MitmHistoryExport))
+	serverMux.HandleFunc("/mitm/"+web.config.Name+"/history/fulltext", web.HandleFunc(permView, web.MitmHistoryFullText))
+	serverMux.HandleFunc("/mitm/"+web.config.Name+"/history/stats", web.HandleFunc(permView, web.MitmHistoryStats))
+	serverMux.HandleFunc("/mitm/"+web.config.Name+"/history/prune", web.HandleFunc(permAdmin, web.MitmHistoryPrune))
+	serverMux.HandleFunc("/mitm/"+web.config.Name+"/history/conns", web.HandleFunc(permView, web.MitmHistoryConns))
+	serverMux.HandleFunc("/mitm/"+web.config.Name+"/history/conn", web.HandleFunc(permView, web.MitmHistoryConn))
+	serverMux.HandleFunc("/mitm/"+web.config.Name+"/proxy/repeat", web.HandleFunc(permTest, web.MitmProxyRequest))
+	serverMux.HandleFunc("/mitm/"+web.config.Name+"/proxy/intruder", web.HandleFunc(permRun, web.MitmProxyIntruder))
+	serverMux.HandleFunc("/mitm/"+web.config.Name+"/proxy/jobs", web.HandleFunc(permRun, web.MitmProxyJobs))
+	serverMux.HandleFunc("/mitm/"+web.config.Name+"/proxy/repeater", web.HandleFunc(permRun, web.MitmProxyRepeater))
+	serverMux.HandleFunc("/mitm/"+web.config.Name+"/proxy/smuggle", web.HandleFunc(permRun, web.MitmProxySmuggle))
+	serverMux.HandleFunc("/mitm/"+web.config.Name+"/proxy/scan", web.HandleFunc(permRun, web.MitmProxyScan))
+	serverMux.HandleFunc("/mitm/"+web.config.Name+"/proxy/findings", web.HandleFunc(permRun, web.MitmProxyFindings))
+	serverMux.HandleFunc("/mitm/"+web.config.Name+"/dummy/cert", web.HandleFunc(permView, web.MitmDummyCert))
+	serverMux.HandleFunc("/mitm/"+web.config.Name+"/rewrite/rules", web.HandleFunc(permConfig, web.MitmRewriteRules))
+	serverMux.HandleFunc("/mitm/"+web.config.Name+"/script/rules", web.HandleFunc(permConfig, web.MitmScriptRules))
+	serverMux.HandleFunc("/mitm/"+web.config.Name+"/scope", web.HandleFunc(permConfig, web.MitmScope))
+	serverMux.HandleFunc("/mitm/"+web.config.Name+"/passive/config", web.HandleFunc(permConfig, web.MitmPassiveConfig))
+	serverMux.HandleFunc("/mitm/"+web.config.Name+"/audit", web.HandleFunc(permAdmin, web.MitmAudit))
+	serverMux.Handle(apiPrefix+"/", web.API())
 
 	fsys, err := fs.Sub(assets, "client/build")
 	if err != nil {
@@ -71,15 +113,32 @@ func (web *WebAddon) Router() *http.ServeMux {
 
 func (web *WebAddon) ListenServer(addr string) {
 	web.upgrader = &websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool {
-			return true
-		},
+		CheckOrigin: web.checkOrigin,
 	}
 	server := &http.Server{Addr: addr, Handler: web.Router()}
 
+	if web.config.Listen.TLS {
+		cfg, err := web.tlsConfig()
+		if err != nil {
+			log.Errorf("web interface tls fail %v", err)
+			return
+		}
+		server.TLSConfig = cfg
+	}
+
+	ln, err := web.listen(addr)
+	if err != nil {
+		log.Errorf("web interface listen fail %v", err)
+		return
+	}
+
 	go func() {
-		log.Infof("web interface start listen at %v\n", addr)
-		err := server.ListenAndServe()
+		log.Infof("web interface start listen at %v tls:%v\n", ln.Addr(), server.TLSConfig != nil)
+		if server.TLSConfig != nil {
+			err = server.ServeTLS(ln, "", "")
+		} else {
+			err = server.Serve(ln)
+		}
 		log.Error(err)
 	}()
 
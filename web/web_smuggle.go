@@ -0,0 +1,37 @@
+package web
+
+import (
+	"net/http"
+
+	"github.com/bytedance/sonic"
+	"github.com/bytedance/sonic/decoder"
+)
+
+// POST 启动请求走私扫描, 立即返回任务, 报告通过 proxy/jobs?id= 读取
+func (web *WebAddon) MitmProxySmuggle(w http.ResponseWriter, r *http.Request, db *FlowDB) {
+	if r.Method != http.MethodPost {
+		Bad(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	c := web.session(r)
+	if c == nil {
+		Unauthorized(w, r)
+		return
+	}
+
+	var scan SmuggleScan
+	if err := decoder.NewStreamDecoder(r.Body).Decode(&scan); err != nil {
+		Bad(w, http.StatusBadRequest, "decode fail %v", err)
+		return
+	}
+
+	info, err := web.startSmuggle(c, &scan)
+	if err != nil {
+		Bad(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+
+	chunk, _ := sonic.Marshal(info)
+	JSON(w, chunk)
+}